@@ -0,0 +1,550 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi3"
+	gyaml "github.com/ghodss/yaml"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Regenerating an OpenAPI app used to overwrite it, and workflows broke
+// silently on renamed or removed parameters. The regenerate flow compares
+// the deployed app with the app generated from the new spec, lists the
+// workflow actions which would break, and publishes the result as a new
+// app version so the old version keeps working until workflows are moved.
+type AppParameterChange struct {
+	Name        string `json:"name"`
+	Change      string `json:"change"`
+	Breaking    bool   `json:"breaking"`
+	NowRequired bool   `json:"now_required,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type AppActionChange struct {
+	Name       string               `json:"name"`
+	Label      string               `json:"label"`
+	Change     string               `json:"change"`
+	Breaking   bool                 `json:"breaking"`
+	Parameters []AppParameterChange `json:"parameters,omitempty"`
+}
+
+type AffectedWorkflowAction struct {
+	ActionId   string   `json:"action_id"`
+	ActionName string   `json:"action_name"`
+	Label      string   `json:"label"`
+	Reasons    []string `json:"reasons"`
+}
+
+type AffectedWorkflow struct {
+	Id      string                   `json:"id"`
+	Name    string                   `json:"name"`
+	Actions []AffectedWorkflowAction `json:"actions"`
+}
+
+type AppRegenerationDiff struct {
+	Success           bool               `json:"success"`
+	AppId             string             `json:"app_id"`
+	AppName           string             `json:"app_name"`
+	OldVersion        string             `json:"old_version"`
+	NewVersion        string             `json:"new_version"`
+	Breaking          bool               `json:"breaking"`
+	Added             []AppActionChange  `json:"added"`
+	Removed           []AppActionChange  `json:"removed"`
+	Changed           []AppActionChange  `json:"changed"`
+	AffectedWorkflows []AffectedWorkflow `json:"affected_workflows"`
+}
+
+// Loads an OpenAPI 3.0, OpenAPI 3.1 or AsyncAPI spec. 3.1 specs are
+// converted, so the returned body is the one the app is built from.
+func loadSwaggerSpec(body []byte) ([]byte, *openapi3.Swagger, bool, error) {
+	var err error
+	if isAsyncApiSpec(body) {
+		swagger, err := getAsyncApiSwagger(body)
+		return body, swagger, true, err
+	}
+
+	if isOpenApi31(getOpenApiVersion(body)) {
+		body, err = convertOpenApi31(body)
+		if err != nil {
+			return body, nil, false, err
+		}
+	}
+
+	swaggerLoader := openapi3.NewSwaggerLoader()
+	swaggerLoader.IsExternalRefsAllowed = true
+	swagger, err := swaggerLoader.LoadSwaggerFromData(body)
+	return body, swagger, false, err
+}
+
+// Generates the app definition for a spec without building anything
+func generateSwaggerAppDefinition(body []byte) (shuffle.WorkflowApp, error) {
+	body, swagger, asyncApi, err := loadSwaggerSpec(body)
+	if err != nil {
+		return shuffle.WorkflowApp{}, err
+	}
+
+	if swagger.Info == nil {
+		return shuffle.WorkflowApp{}, errors.New("Info not parsed")
+	}
+
+	hasher := md5.New()
+	hasher.Write(body)
+	newmd5 := hex.EncodeToString(hasher.Sum(nil))
+
+	var api shuffle.WorkflowApp
+	if asyncApi {
+		api, _, _, err = generateAsyncApiApp(body, swagger, newmd5)
+	} else {
+		_, api, _, err = shuffle.GenerateYaml(swagger, newmd5)
+	}
+
+	return api, err
+}
+
+func diffAppParameters(oldAction, newAction shuffle.WorkflowAppAction) []AppParameterChange {
+	changes := []AppParameterChange{}
+	newParams := map[string]shuffle.WorkflowAppActionParameter{}
+	for _, param := range newAction.Parameters {
+		newParams[param.Name] = param
+	}
+
+	oldParams := map[string]shuffle.WorkflowAppActionParameter{}
+	for _, oldParam := range oldAction.Parameters {
+		oldParams[oldParam.Name] = oldParam
+
+		newParam, ok := newParams[oldParam.Name]
+		if !ok {
+			changes = append(changes, AppParameterChange{
+				Name:     oldParam.Name,
+				Change:   "removed",
+				Breaking: true,
+				Reason:   "Parameter was removed",
+			})
+			continue
+		}
+
+		reasons := []string{}
+		breaking := false
+		nowRequired := newParam.Required && !oldParam.Required
+		if nowRequired {
+			breaking = true
+			reasons = append(reasons, "Parameter is now required")
+		}
+
+		if len(oldParam.Schema.Type) > 0 && len(newParam.Schema.Type) > 0 && oldParam.Schema.Type != newParam.Schema.Type {
+			breaking = true
+			reasons = append(reasons, fmt.Sprintf("Type changed from %s to %s", oldParam.Schema.Type, newParam.Schema.Type))
+		}
+
+		removedOptions := []string{}
+		if len(newParam.Options) > 0 {
+			for _, option := range oldParam.Options {
+				if !shuffle.ArrayContains(newParam.Options, option) {
+					removedOptions = append(removedOptions, option)
+				}
+			}
+
+			if len(oldParam.Options) == 0 {
+				removedOptions = append(removedOptions, "any value")
+			}
+		}
+
+		if len(removedOptions) > 0 {
+			breaking = true
+			reasons = append(reasons, fmt.Sprintf("Options no longer allowed: %s", strings.Join(removedOptions, ", ")))
+		}
+
+		if oldParam.Description != newParam.Description || oldParam.Example != newParam.Example || oldParam.Multiline != newParam.Multiline {
+			reasons = append(reasons, "Description or example changed")
+		}
+
+		if len(reasons) > 0 {
+			changes = append(changes, AppParameterChange{
+				Name:        oldParam.Name,
+				Change:      "changed",
+				Breaking:    breaking,
+				NowRequired: nowRequired,
+				Reason:      strings.Join(reasons, ". "),
+			})
+		}
+	}
+
+	for _, newParam := range newAction.Parameters {
+		if _, ok := oldParams[newParam.Name]; ok {
+			continue
+		}
+
+		change := AppParameterChange{
+			Name:   newParam.Name,
+			Change: "added",
+		}
+
+		if newParam.Required && !newParam.Configuration {
+			change.Breaking = true
+			change.Reason = "New required parameter"
+		}
+
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// Actions are matched by name, as that's what workflows reference. A
+// renamed action therefore shows up as removed and added.
+func diffAppActions(oldApp, newApp shuffle.WorkflowApp) AppRegenerationDiff {
+	diff := AppRegenerationDiff{
+		Success:           true,
+		AppId:             oldApp.ID,
+		AppName:           oldApp.Name,
+		OldVersion:        oldApp.AppVersion,
+		Added:             []AppActionChange{},
+		Removed:           []AppActionChange{},
+		Changed:           []AppActionChange{},
+		AffectedWorkflows: []AffectedWorkflow{},
+	}
+
+	newActions := map[string]shuffle.WorkflowAppAction{}
+	for _, action := range newApp.Actions {
+		newActions[action.Name] = action
+	}
+
+	oldActions := map[string]bool{}
+	for _, oldAction := range oldApp.Actions {
+		oldActions[oldAction.Name] = true
+
+		newAction, ok := newActions[oldAction.Name]
+		if !ok {
+			diff.Breaking = true
+			diff.Removed = append(diff.Removed, AppActionChange{
+				Name:     oldAction.Name,
+				Label:    oldAction.Label,
+				Change:   "removed",
+				Breaking: true,
+			})
+			continue
+		}
+
+		parameters := diffAppParameters(oldAction, newAction)
+		if len(parameters) == 0 {
+			continue
+		}
+
+		change := AppActionChange{
+			Name:       oldAction.Name,
+			Label:      newAction.Label,
+			Change:     "changed",
+			Parameters: parameters,
+		}
+
+		for _, param := range parameters {
+			if param.Breaking {
+				change.Breaking = true
+				diff.Breaking = true
+			}
+		}
+
+		diff.Changed = append(diff.Changed, change)
+	}
+
+	for _, action := range newApp.Actions {
+		if oldActions[action.Name] {
+			continue
+		}
+
+		diff.Added = append(diff.Added, AppActionChange{
+			Name:   action.Name,
+			Label:  action.Label,
+			Change: "added",
+		})
+	}
+
+	return diff
+}
+
+// Finds the workflow actions using the old app which the changes break.
+// Parameter changes only break an action when it actually relies on them,
+// e.g. a removed parameter which was never filled in is fine.
+func findAffectedWorkflows(workflows []shuffle.Workflow, app shuffle.WorkflowApp, diff AppRegenerationDiff) []AffectedWorkflow {
+	removed := map[string]bool{}
+	for _, action := range diff.Removed {
+		removed[action.Name] = true
+	}
+
+	changed := map[string]AppActionChange{}
+	for _, action := range diff.Changed {
+		if action.Breaking {
+			changed[action.Name] = action
+		}
+	}
+
+	affected := []AffectedWorkflow{}
+	for _, workflow := range workflows {
+		affectedWorkflow := AffectedWorkflow{
+			Id:      workflow.ID,
+			Name:    workflow.Name,
+			Actions: []AffectedWorkflowAction{},
+		}
+
+		for _, action := range workflow.Actions {
+			if action.AppID != app.ID && !(action.AppName == app.Name && action.AppVersion == app.AppVersion) {
+				continue
+			}
+
+			reasons := []string{}
+			if removed[action.Name] {
+				reasons = append(reasons, "Action was removed")
+			} else if actionChange, ok := changed[action.Name]; ok {
+				values := map[string]string{}
+				for _, param := range action.Parameters {
+					values[param.Name] = param.Value
+				}
+
+				for _, param := range actionChange.Parameters {
+					if !param.Breaking {
+						continue
+					}
+
+					value, isSet := values[param.Name]
+					isSet = isSet && len(value) > 0
+					if (param.Change == "added" && !isSet) || (param.Change == "removed" && isSet) || (param.Change == "changed" && (isSet || param.NowRequired)) {
+						reasons = append(reasons, fmt.Sprintf("%s: %s", param.Name, param.Reason))
+					}
+				}
+			}
+
+			if len(reasons) > 0 {
+				affectedWorkflow.Actions = append(affectedWorkflow.Actions, AffectedWorkflowAction{
+					ActionId:   action.ID,
+					ActionName: action.Name,
+					Label:      action.Label,
+					Reasons:    reasons,
+				})
+			}
+		}
+
+		if len(affectedWorkflow.Actions) > 0 {
+			affected = append(affected, affectedWorkflow)
+		}
+	}
+
+	return affected
+}
+
+// Breaking changes bump the major version, everything else the minor one.
+// Versions already taken by the app are skipped.
+func getNextAppVersion(current string, breaking bool, existing []string) string {
+	parts := strings.Split(current, ".")
+	for len(parts) < 3 {
+		parts = append(parts, "0")
+	}
+
+	major, _ := strconv.Atoi(parts[0])
+	minor, _ := strconv.Atoi(parts[1])
+	for _, version := range existing {
+		versionParts := strings.Split(version, ".")
+		if len(versionParts) < 2 {
+			continue
+		}
+
+		existingMajor, err := strconv.Atoi(versionParts[0])
+		if err != nil {
+			continue
+		}
+
+		existingMinor, _ := strconv.Atoi(versionParts[1])
+		if existingMajor > major || (existingMajor == major && existingMinor > minor) {
+			major = existingMajor
+			minor = existingMinor
+		}
+	}
+
+	if breaking {
+		return fmt.Sprintf("%d.0.0", major+1)
+	}
+
+	return fmt.Sprintf("%d.%d.0", major, minor+1)
+}
+
+func getAppRegenerationDiff(ctx context.Context, user shuffle.User, app shuffle.WorkflowApp, body []byte) (AppRegenerationDiff, error) {
+	newApp, err := generateSwaggerAppDefinition(body)
+	if err != nil {
+		return AppRegenerationDiff{}, err
+	}
+
+	diff := diffAppActions(app, newApp)
+
+	existingVersions := []string{}
+	apps, err := shuffle.FindWorkflowAppByName(ctx, app.Name)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding versions of app %s: %s", app.Name, err)
+	}
+
+	for _, existingApp := range apps {
+		if existingApp.Name == app.Name {
+			existingVersions = append(existingVersions, existingApp.AppVersion)
+		}
+	}
+
+	diff.NewVersion = getNextAppVersion(app.AppVersion, diff.Breaking, existingVersions)
+
+	workflows, err := shuffle.GetAllWorkflowsByQuery(ctx, user, 1000, "")
+	if err != nil {
+		log.Printf("[WARNING] Failed getting workflows for app %s regeneration: %s", app.ID, err)
+	} else {
+		diff.AffectedWorkflows = findAffectedWorkflows(workflows, app, diff)
+	}
+
+	sort.Slice(diff.AffectedWorkflows, func(i, j int) bool {
+		return diff.AffectedWorkflows[i].Name < diff.AffectedWorkflows[j].Name
+	})
+
+	return diff, nil
+}
+
+// Returns the spec with the fields buildSwaggerApp uses to publish it as a
+// new version of the app, rather than a separate app
+func getAppRegenerationBody(body []byte, app shuffle.WorkflowApp, version string) ([]byte, error) {
+	jsonBody, err := gyaml.YAMLToJSON(body)
+	if err != nil {
+		return body, err
+	}
+
+	spec := map[string]interface{}{}
+	err = json.Unmarshal(jsonBody, &spec)
+	if err != nil {
+		return body, err
+	}
+
+	info, ok := spec["info"].(map[string]interface{})
+	if !ok {
+		return body, errors.New("Info not parsed")
+	}
+
+	info["title"] = app.Name
+	spec["app_version"] = version
+	spec["editing"] = false
+	delete(spec, "id")
+	if len(app.LargeImage) > 0 {
+		spec["image"] = app.LargeImage
+	}
+
+	return json.Marshal(spec)
+}
+
+// Compares an OpenAPI app with the app generated from a new spec:
+// POST /api/v1/apps/{appId}/regenerate with the spec as the body.
+// ?publish=true builds it as a new app version. Requires admin, and can
+// be forced past breaking changes with &force=true.
+func handleRegenerateApp(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app regeneration: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role == "org-reader" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Read only user"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Missing app id"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	appId := location[4]
+	app, err := shuffle.GetApp(ctx, appId, user, false)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting app %s for regeneration: %s", appId, err)
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "App not found"}`))
+		return
+	}
+
+	if !(user.Id == app.Owner || (user.Role == "admin" && user.ActiveOrg.Id == app.ReferenceOrg) || shuffle.ArrayContains(app.Contributors, user.Id)) {
+		log.Printf("[WARNING] Wrong user (%s) for app %s when regenerating", user.Username, app.Name)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "You don't have permissions to regenerate this app"}`))
+		return
+	}
+
+	if !app.Generated {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Only apps generated from an OpenAPI spec can be regenerated"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil || len(body) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Missing OpenAPI spec in body"}`))
+		return
+	}
+
+	diff, err := getAppRegenerationDiff(ctx, user, *app, body)
+	if err != nil {
+		log.Printf("[WARNING] Failed generating app %s from the new spec: %s", app.ID, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed parsing the new spec: %s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	if request.URL.Query().Get("publish") != "true" {
+		newjson, err := json.Marshal(diff)
+		if err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed marshalling diff"}`))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write(newjson)
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to publish a new app version"}`))
+		return
+	}
+
+	if len(diff.AffectedWorkflows) > 0 && request.URL.Query().Get("force") != "true" {
+		resp.WriteHeader(409)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "The new version breaks %d workflow(s). Review the diff and publish with force=true to continue"}`, len(diff.AffectedWorkflows))))
+		return
+	}
+
+	newBody, err := getAppRegenerationBody(body, *app, diff.NewVersion)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed preparing the new spec: %s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) is publishing app %s version %s (from %s). Breaking: %t, affected workflows: %d", user.Username, user.Id, app.Name, diff.NewVersion, app.AppVersion, diff.Breaking, len(diff.AffectedWorkflows))
+	buildSwaggerApp(resp, newBody, user, true)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Archive sources are tar.gz or zip files with apps or workflows, served
+// over HTTPS or from an S3 compatible bucket (s3://bucket/key). They are
+// unpacked in memory and read with the same iterators as git sources.
+type ArchiveSource struct {
+	URL   string
+	OrgId string
+
+	// sha256 of the archive, optionally prefixed with "sha256:". Required
+	// unless SHUFFLE_ARCHIVE_CHECKSUM_FROM_SOURCE=true, which falls back to
+	// a "<url>.sha256" file next to the archive.
+	Checksum     string
+	CredentialId string
+}
+
+func isArchiveSourceUrl(sourceUrl string) bool {
+	parsedUrl, err := url.Parse(sourceUrl)
+	if err != nil || len(parsedUrl.Host) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(parsedUrl.Scheme) {
+	case "s3":
+		return true
+	case "http", "https":
+		lowerPath := strings.ToLower(parsedUrl.Path)
+		return strings.HasSuffix(lowerPath, ".tar.gz") || strings.HasSuffix(lowerPath, ".tgz") || strings.HasSuffix(lowerPath, ".zip")
+	}
+
+	return false
+}
+
+func getArchiveLimits() (int64, int64) {
+	maxSize := int64(200 * 1024 * 1024)
+	if len(os.Getenv("SHUFFLE_ARCHIVE_MAX_SIZE")) > 0 {
+		parsedSize, err := strconv.ParseInt(os.Getenv("SHUFFLE_ARCHIVE_MAX_SIZE"), 10, 64)
+		if err == nil && parsedSize > 0 {
+			maxSize = parsedSize
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ARCHIVE_MAX_SIZE must be a size in bytes, not '%s'. Using default.", os.Getenv("SHUFFLE_ARCHIVE_MAX_SIZE"))
+		}
+	}
+
+	return maxSize, maxSize * 10
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Signs an S3 GET request with AWS signature version 4
+func signS3Request(request *http.Request, accessKey, secretKey, region string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+	payloadHash := sha256Hex([]byte{})
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", request.URL.Host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, region)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSha256([]byte("AWS4"+secretKey), shortDate)
+	signingKey = hmacSha256(signingKey, region)
+	signingKey = hmacSha256(signingKey, "s3")
+	signingKey = hmacSha256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+// Builds the request for an archive. s3:// URLs use path style addressing
+// towards SHUFFLE_ARCHIVE_S3_ENDPOINT, e.g. an internal MinIO, or AWS.
+func getArchiveRequest(ctx context.Context, source ArchiveSource, sourceUrl string) (*http.Request, error) {
+	parsedUrl, err := url.Parse(sourceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	var credential *GitCredential
+	if len(source.CredentialId) > 0 {
+		credential, err = getGitCredential(ctx, source.OrgId, source.CredentialId)
+		if err != nil {
+			return nil, fmt.Errorf("Credential %s not found", source.CredentialId)
+		}
+	}
+
+	if strings.ToLower(parsedUrl.Scheme) != "s3" {
+		request, err := http.NewRequestWithContext(ctx, "GET", sourceUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if credential != nil && credential.Type == "basic" {
+			request.SetBasicAuth(credential.Username, credential.Password)
+		} else if credential != nil && credential.Type == "token" {
+			request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", credential.Token))
+		}
+
+		return request, nil
+	}
+
+	region := os.Getenv("SHUFFLE_ARCHIVE_S3_REGION")
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+
+	endpoint := strings.TrimRight(os.Getenv("SHUFFLE_ARCHIVE_S3_ENDPOINT"), "/")
+	if len(endpoint) == 0 {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	objectUrl := fmt.Sprintf("%s/%s/%s", endpoint, parsedUrl.Host, strings.TrimLeft(parsedUrl.Path, "/"))
+	request, err := http.NewRequestWithContext(ctx, "GET", objectUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	accessKey := os.Getenv("SHUFFLE_ARCHIVE_S3_ACCESS_KEY")
+	secretKey := os.Getenv("SHUFFLE_ARCHIVE_S3_SECRET_KEY")
+	if credential != nil {
+		if credential.Type != "s3" {
+			return nil, errors.New("s3:// sources need an s3 credential")
+		}
+
+		accessKey = credential.Username
+		secretKey = credential.Password
+	}
+
+	// Public buckets are read without signing
+	if len(accessKey) > 0 && len(secretKey) > 0 {
+		signS3Request(request, accessKey, secretKey, region)
+	}
+
+	return request, nil
+}
+
+func downloadArchiveFile(ctx context.Context, source ArchiveSource, sourceUrl string, maxSize int64) ([]byte, error) {
+	request, err := getArchiveRequest(ctx, source, sourceUrl)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	client := shuffle.GetExternalClient(request.URL.String())
+	client.Timeout = 5 * time.Minute
+	resp, err := client.Do(request)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return []byte{}, fmt.Errorf("Got status %d when downloading %s", resp.StatusCode, sourceUrl)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if int64(len(body)) > maxSize {
+		return []byte{}, fmt.Errorf("%s is larger than the max size of %d bytes", sourceUrl, maxSize)
+	}
+
+	return body, nil
+}
+
+// Archives need an explicit sha256 checksum. A <url>.sha256 file next to
+// the archive comes from the same source, so it is only used if
+// SHUFFLE_ARCHIVE_CHECKSUM_FROM_SOURCE is enabled. Unverified archives are
+// only allowed if SHUFFLE_ARCHIVE_ALLOW_UNVERIFIED is enabled.
+func verifyArchiveChecksum(ctx context.Context, source ArchiveSource, data []byte) error {
+	checksum := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(source.Checksum)), "sha256:")
+	if len(checksum) == 0 && os.Getenv("SHUFFLE_ARCHIVE_CHECKSUM_FROM_SOURCE") == "true" {
+		log.Printf("[WARNING] No checksum given for %s. Using %s.sha256 from the same source, as SHUFFLE_ARCHIVE_CHECKSUM_FROM_SOURCE is enabled", source.URL, source.URL)
+		checksumData, err := downloadArchiveFile(ctx, source, source.URL+".sha256", 1024)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting %s.sha256: %s", source.URL, err)
+		} else {
+			// The format of sha256sum: "<hash>  <filename>"
+			fields := strings.Fields(string(checksumData))
+			if len(fields) > 0 {
+				checksum = strings.ToLower(fields[0])
+			}
+		}
+	}
+
+	if len(checksum) == 0 {
+		if os.Getenv("SHUFFLE_ARCHIVE_ALLOW_UNVERIFIED") == "true" {
+			log.Printf("[WARNING] Loading %s without checksum verification", source.URL)
+			return nil
+		}
+
+		return fmt.Errorf("No checksum given for %s. Add the sha256 checksum of the archive", source.URL)
+	}
+
+	if !hmac.Equal([]byte(checksum), []byte(sha256Hex(data))) {
+		return fmt.Errorf("Checksum mismatch for %s", source.URL)
+	}
+
+	return nil
+}
+
+func getArchivePath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	cleanName := path.Clean(name)
+	if path.IsAbs(cleanName) || cleanName == ".." || strings.HasPrefix(cleanName, "../") {
+		return "", fmt.Errorf("Invalid path %s in archive", name)
+	}
+
+	return cleanName, nil
+}
+
+type archiveWriter struct {
+	fs              billy.Filesystem
+	totalSize       int64
+	maxUncompressed int64
+	fileCount       int
+}
+
+func (writer *archiveWriter) writeFile(name string, reader io.Reader) error {
+	filePath, err := getArchivePath(name)
+	if err != nil {
+		return err
+	}
+
+	writer.fileCount += 1
+	if writer.fileCount > 10000 {
+		return errors.New("Too many files in the archive")
+	}
+
+	// The header sizes can't be trusted, so the copy itself is capped
+	data, err := ioutil.ReadAll(io.LimitReader(reader, writer.maxUncompressed-writer.totalSize+1))
+	if err != nil {
+		return err
+	}
+
+	writer.totalSize += int64(len(data))
+	if writer.totalSize > writer.maxUncompressed {
+		return errors.New("The archive is too large when uncompressed")
+	}
+
+	err = writer.fs.MkdirAll(path.Dir(filePath), 0755)
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFile(writer.fs, filePath, data, 0644)
+}
+
+// Unpacks a tar.gz or zip into memory. Only regular files are kept.
+func unpackArchive(data []byte, maxUncompressed int64) (billy.Filesystem, error) {
+	writer := &archiveWriter{
+		fs:              memfs.New(),
+		maxUncompressed: maxUncompressed,
+	}
+
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		zipReader, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range zipReader.File {
+			if !item.Mode().IsRegular() {
+				continue
+			}
+
+			reader, err := item.Open()
+			if err != nil {
+				return nil, err
+			}
+
+			err = writer.writeFile(item.Name, reader)
+			reader.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return writer.fs, nil
+	}
+
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return nil, errors.New("Archive must be a tar.gz or zip")
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		err = writer.writeFile(header.Name, tarReader)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return writer.fs, nil
+}
+
+// Downloads, verifies and unpacks an archive source
+func loadArchiveSource(ctx context.Context, source ArchiveSource) (billy.Filesystem, error) {
+	maxSize, maxUncompressed := getArchiveLimits()
+	data, err := downloadArchiveFile(ctx, source, source.URL, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyArchiveChecksum(ctx, source, data)
+	if err != nil {
+		return nil, err
+	}
+
+	fs, err := unpackArchive(data, maxUncompressed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed unpacking %s: %s", source.URL, err)
+	}
+
+	log.Printf("[INFO] Loaded archive %s (%d bytes, sha256 %s)", source.URL, len(data), sha256Hex(data))
+	return fs, nil
+}
@@ -0,0 +1,886 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// App bundles are used to move apps across an air gap. A bundle is a
+// tar.gz containing a signed manifest, the app definitions and the
+// Docker image of each app as produced by "docker save".
+const appBundleManifestName = "manifest.json"
+const appBundleSignatureName = "manifest.sig"
+const appBundleVersion = 1
+
+type AppBundleApp struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	AppVersion  string `json:"app_version"`
+	Image       string `json:"image"`
+	Definition  string `json:"definition"`
+	OpenApi     string `json:"openapi,omitempty"`
+	ImageFile   string `json:"image_file"`
+	ImageDigest string `json:"image_digest"`
+}
+
+type AppBundleManifest struct {
+	Version int               `json:"version"`
+	Created int64             `json:"created"`
+	Apps    []AppBundleApp    `json:"apps"`
+	Files   map[string]string `json:"files"`
+}
+
+type appBundle struct {
+	Dir       string
+	Manifest  []byte
+	Signature string
+}
+
+// Signs with ed25519 if a private key is configured, as the importing
+// side then only needs the public key. Falls back to a shared HMAC key.
+func signAppBundle(manifest []byte) (string, error) {
+	privateKey := os.Getenv("SHUFFLE_APP_BUNDLE_PRIVATE_KEY")
+	if len(privateKey) > 0 {
+		keyBytes, err := hex.DecodeString(strings.TrimSpace(privateKey))
+		if err != nil {
+			return "", fmt.Errorf("SHUFFLE_APP_BUNDLE_PRIVATE_KEY must be hex encoded: %s", err)
+		}
+
+		var key ed25519.PrivateKey
+		if len(keyBytes) == ed25519.SeedSize {
+			key = ed25519.NewKeyFromSeed(keyBytes)
+		} else if len(keyBytes) == ed25519.PrivateKeySize {
+			key = ed25519.PrivateKey(keyBytes)
+		} else {
+			return "", errors.New("SHUFFLE_APP_BUNDLE_PRIVATE_KEY must be a 32 byte seed or a 64 byte ed25519 key")
+		}
+
+		return fmt.Sprintf("ed25519:%s", hex.EncodeToString(ed25519.Sign(key, manifest))), nil
+	}
+
+	sharedKey := os.Getenv("SHUFFLE_APP_BUNDLE_KEY")
+	if len(sharedKey) > 0 {
+		mac := hmac.New(sha256.New, []byte(sharedKey))
+		mac.Write(manifest)
+		return fmt.Sprintf("hmac-sha256:%s", hex.EncodeToString(mac.Sum(nil))), nil
+	}
+
+	return "", errors.New("SHUFFLE_APP_BUNDLE_KEY or SHUFFLE_APP_BUNDLE_PRIVATE_KEY must be set to sign app bundles")
+}
+
+func verifyAppBundle(manifest []byte, signature string) error {
+	signatureSplit := strings.SplitN(strings.TrimSpace(signature), ":", 2)
+	if len(signatureSplit) != 2 {
+		return errors.New("Bundle signature is malformed")
+	}
+
+	signatureBytes, err := hex.DecodeString(signatureSplit[1])
+	if err != nil {
+		return errors.New("Bundle signature is malformed")
+	}
+
+	switch signatureSplit[0] {
+	case "ed25519":
+		publicKey := os.Getenv("SHUFFLE_APP_BUNDLE_PUBLIC_KEY")
+		if len(publicKey) == 0 {
+			return errors.New("Bundle is signed with ed25519, but SHUFFLE_APP_BUNDLE_PUBLIC_KEY is not set")
+		}
+
+		keyBytes, err := hex.DecodeString(strings.TrimSpace(publicKey))
+		if err != nil || len(keyBytes) != ed25519.PublicKeySize {
+			return errors.New("SHUFFLE_APP_BUNDLE_PUBLIC_KEY must be a hex encoded 32 byte ed25519 key")
+		}
+
+		if !ed25519.Verify(ed25519.PublicKey(keyBytes), manifest, signatureBytes) {
+			return errors.New("Bundle signature is invalid")
+		}
+	case "hmac-sha256":
+		sharedKey := os.Getenv("SHUFFLE_APP_BUNDLE_KEY")
+		if len(sharedKey) == 0 {
+			return errors.New("Bundle is signed with a shared key, but SHUFFLE_APP_BUNDLE_KEY is not set")
+		}
+
+		mac := hmac.New(sha256.New, []byte(sharedKey))
+		mac.Write(manifest)
+		if !hmac.Equal(mac.Sum(nil), signatureBytes) {
+			return errors.New("Bundle signature is invalid")
+		}
+	default:
+		return fmt.Errorf("Unsupported bundle signature type %s", signatureSplit[0])
+	}
+
+	return nil
+}
+
+// Writes the reader to a file in the bundle dir and returns its sha256
+func writeAppBundleFile(dir, name string, reader io.Reader) (string, error) {
+	fullPath := filepath.Join(dir, filepath.FromSlash(name))
+	err := os.MkdirAll(filepath.Dir(fullPath), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.Create(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hasher), reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func saveAppBundleImage(ctx context.Context, dockercli *client.Client, imageName string) (io.ReadCloser, error) {
+	_, _, err := dockercli.ImageInspectWithRaw(ctx, imageName)
+	if err != nil {
+		log.Printf("[INFO] Image %s not found locally for bundle export. Pulling.", imageName)
+		reader, err := dockercli.ImagePull(ctx, imageName, image.PullOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Failed pulling image %s: %s", imageName, err)
+		}
+
+		io.Copy(ioutil.Discard, reader)
+		reader.Close()
+	}
+
+	return dockercli.ImageSave(ctx, []string{imageName})
+}
+
+// Collects the definitions and images of the apps in a temporary folder
+// and signs the manifest. The caller is responsible for removing the dir.
+func prepareAppBundle(ctx context.Context, apps []shuffle.WorkflowApp) (*appBundle, error) {
+	dockercli, err := client.NewEnvClient()
+	if err != nil {
+		return nil, fmt.Errorf("Failed creating docker client: %s", err)
+	}
+	defer dockercli.Close()
+
+	dir, err := ioutil.TempDir("", "shuffle-bundle-")
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &appBundle{
+		Dir: dir,
+	}
+
+	manifest := AppBundleManifest{
+		Version: appBundleVersion,
+		Created: time.Now().Unix(),
+		Apps:    []AppBundleApp{},
+		Files:   map[string]string{},
+	}
+
+	for _, app := range apps {
+		bundleApp := AppBundleApp{
+			ID:         app.ID,
+			Name:       app.Name,
+			AppVersion: app.AppVersion,
+			Image:      getAppImageName(app.Name, app.AppVersion),
+			Definition: fmt.Sprintf("apps/%s/app.json", app.ID),
+			ImageFile:  fmt.Sprintf("images/%s.tar", app.ID),
+		}
+
+		appData, err := json.MarshalIndent(app, "", "  ")
+		if err != nil {
+			return bundle, fmt.Errorf("Failed marshalling app %s: %s", app.Name, err)
+		}
+
+		digest, err := writeAppBundleFile(dir, bundleApp.Definition, strings.NewReader(string(appData)))
+		if err != nil {
+			return bundle, err
+		}
+
+		manifest.Files[bundleApp.Definition] = digest
+
+		if app.Generated {
+			openapi, err := shuffle.GetOpenApiDatastore(ctx, app.ID)
+			if err != nil || len(openapi.Body) == 0 {
+				log.Printf("[WARNING] No OpenAPI found for generated app %s (%s) during bundle export: %s", app.Name, app.ID, err)
+			} else {
+				bundleApp.OpenApi = fmt.Sprintf("apps/%s/openapi.json", app.ID)
+				digest, err = writeAppBundleFile(dir, bundleApp.OpenApi, strings.NewReader(openapi.Body))
+				if err != nil {
+					return bundle, err
+				}
+
+				manifest.Files[bundleApp.OpenApi] = digest
+			}
+		}
+
+		reader, err := saveAppBundleImage(ctx, dockercli, bundleApp.Image)
+		if err != nil {
+			return bundle, fmt.Errorf("Failed saving image %s: %s", bundleApp.Image, err)
+		}
+
+		digest, err = writeAppBundleFile(dir, bundleApp.ImageFile, reader)
+		reader.Close()
+		if err != nil {
+			return bundle, err
+		}
+
+		manifest.Files[bundleApp.ImageFile] = digest
+		bundleApp.ImageDigest = digest
+		manifest.Apps = append(manifest.Apps, bundleApp)
+
+		log.Printf("[INFO] Added app %s:%s with image %s to bundle", app.Name, app.AppVersion, bundleApp.Image)
+	}
+
+	bundle.Manifest, err = json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return bundle, err
+	}
+
+	bundle.Signature, err = signAppBundle(bundle.Manifest)
+	if err != nil {
+		return bundle, err
+	}
+
+	return bundle, nil
+}
+
+func writeAppBundleTarEntry(tarWriter *tar.Writer, name string, size int64, reader io.Reader) error {
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tarWriter, reader)
+	return err
+}
+
+// The manifest and signature go first so an import can stop early
+func writeAppBundle(bundle *appBundle, output io.Writer) error {
+	gzipWriter := gzip.NewWriter(output)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err := writeAppBundleTarEntry(tarWriter, appBundleManifestName, int64(len(bundle.Manifest)), strings.NewReader(string(bundle.Manifest)))
+	if err != nil {
+		return err
+	}
+
+	err = writeAppBundleTarEntry(tarWriter, appBundleSignatureName, int64(len(bundle.Signature)), strings.NewReader(bundle.Signature))
+	if err != nil {
+		return err
+	}
+
+	err = filepath.Walk(bundle.Dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		relativePath, err := filepath.Rel(bundle.Dir, fullPath)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(fullPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		return writeAppBundleTarEntry(tarWriter, filepath.ToSlash(relativePath), info.Size(), file)
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return err
+	}
+
+	return gzipWriter.Close()
+}
+
+// Loads an image into the local Docker engine. If REGISTRY_URL is set,
+// the image is also pushed there so Kubernetes and swarm nodes can use it.
+func loadAppBundleImage(ctx context.Context, dockercli *client.Client, imageFile, imageName string) error {
+	file, err := os.Open(imageFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loadResp, err := dockercli.ImageLoad(ctx, file, client.ImageLoadWithQuiet(true))
+	if err != nil {
+		return fmt.Errorf("Failed loading image %s: %s", imageName, err)
+	}
+
+	io.Copy(ioutil.Discard, loadResp.Body)
+	loadResp.Body.Close()
+
+	registryName := os.Getenv("REGISTRY_URL")
+	if len(registryName) == 0 {
+		return nil
+	}
+
+	registryImage := fmt.Sprintf("%s/%s", strings.TrimSuffix(registryName, "/"), imageName)
+	err = dockercli.ImageTag(ctx, imageName, registryImage)
+	if err != nil {
+		return fmt.Errorf("Failed tagging image %s for registry: %s", registryImage, err)
+	}
+
+	pushResp, err := dockercli.ImagePush(ctx, registryImage, image.PushOptions{
+		RegistryAuth: base64.URLEncoding.EncodeToString([]byte("{}")),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed pushing image %s: %s", registryImage, err)
+	}
+
+	pushOutput, _ := ioutil.ReadAll(pushResp)
+	pushResp.Close()
+	if strings.Contains(string(pushOutput), `"error"`) {
+		return fmt.Errorf("Failed pushing image %s: %s", registryImage, string(pushOutput))
+	}
+
+	log.Printf("[INFO] Pushed bundled image %s", registryImage)
+	return nil
+}
+
+func getAppBundleSizeLimit(envName string, defaultSize int64) int64 {
+	if len(os.Getenv(envName)) == 0 {
+		return defaultSize
+	}
+
+	tmpInt, err := strconv.ParseInt(os.Getenv(envName), 10, 64)
+	if err != nil || tmpInt <= 0 {
+		log.Printf("[WARNING] Env %s must be a size in bytes, not '%s'. Using default.", envName, os.Getenv(envName))
+		return defaultSize
+	}
+
+	return tmpInt
+}
+
+// Verifies and imports a bundle. Apps are registered like the hotloader
+// does: existing apps with the same name and version are replaced,
+// unless they were already imported from the same content. With a user
+// the apps are private to the user's org, like an uploaded app zip, and
+// only the user's own apps there are replaced.
+func importAppBundle(ctx context.Context, input io.Reader, forceUpdate bool, user *shuffle.User) ([]string, error) {
+	imported := []string{}
+
+	gzipReader, err := gzip.NewReader(input)
+	if err != nil {
+		return imported, fmt.Errorf("Bundle is not a valid gzip file: %s", err)
+	}
+	defer gzipReader.Close()
+
+	dir, err := ioutil.TempDir("", "shuffle-bundle-")
+	if err != nil {
+		return imported, err
+	}
+	defer os.RemoveAll(dir)
+
+	// The manifest and signature are the first two entries, and are
+	// verified before anything else in the bundle is extracted
+	tarReader := tar.NewReader(gzipReader)
+	manifestData := []byte{}
+	signature := ""
+	for len(manifestData) == 0 || len(signature) == 0 {
+		header, err := tarReader.Next()
+		if err != nil {
+			return imported, errors.New("Bundle must start with its manifest and signature")
+		}
+
+		if header.Typeflag != tar.TypeReg || header.Size > 10*1024*1024 {
+			return imported, errors.New("Bundle must start with its manifest and signature")
+		}
+
+		data, err := ioutil.ReadAll(tarReader)
+		if err != nil {
+			return imported, err
+		}
+
+		if path.Clean(header.Name) == appBundleManifestName && len(manifestData) == 0 {
+			manifestData = data
+		} else if path.Clean(header.Name) == appBundleSignatureName && len(signature) == 0 {
+			signature = string(data)
+		} else {
+			return imported, errors.New("Bundle must start with its manifest and signature")
+		}
+	}
+
+	err = verifyAppBundle(manifestData, signature)
+	if err != nil {
+		return imported, err
+	}
+
+	manifest := AppBundleManifest{}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return imported, fmt.Errorf("Failed unmarshalling bundle manifest: %s", err)
+	}
+
+	if manifest.Version > appBundleVersion {
+		return imported, fmt.Errorf("Bundle version %d is not supported by this version of Shuffle", manifest.Version)
+	}
+
+	maxFileSize := getAppBundleSizeLimit("SHUFFLE_APP_BUNDLE_MAX_FILE_SIZE", 5*1024*1024*1024)
+	maxTotalSize := getAppBundleSizeLimit("SHUFFLE_APP_BUNDLE_MAX_SIZE", 20*1024*1024*1024)
+	totalSize := int64(0)
+	extracted := []string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return imported, fmt.Errorf("Failed reading bundle: %s", err)
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || path.IsAbs(name) || strings.HasPrefix(name, "..") {
+			return imported, fmt.Errorf("Bundle contains invalid entry %s", header.Name)
+		}
+
+		expectedDigest, ok := manifest.Files[name]
+		if !ok || shuffle.ArrayContains(extracted, name) {
+			return imported, fmt.Errorf("Bundle file %s is not listed in the manifest", name)
+		}
+
+		totalSize += header.Size
+		if header.Size > maxFileSize || totalSize > maxTotalSize {
+			return imported, fmt.Errorf("Bundle file %s is larger than the allowed size", name)
+		}
+
+		// The tar reader never reads past the size in the header
+		digest, err := writeAppBundleFile(dir, name, tarReader)
+		if err != nil {
+			return imported, fmt.Errorf("Failed extracting %s from bundle: %s", name, err)
+		}
+
+		if digest != expectedDigest {
+			return imported, fmt.Errorf("Bundle file %s does not match the manifest", name)
+		}
+
+		extracted = append(extracted, name)
+	}
+
+	for name := range manifest.Files {
+		if !shuffle.ArrayContains(extracted, name) {
+			return imported, fmt.Errorf("Bundle file %s is missing", name)
+		}
+	}
+
+	dockercli, err := client.NewEnvClient()
+	if err != nil {
+		return imported, fmt.Errorf("Failed creating docker client: %s", err)
+	}
+	defer dockercli.Close()
+
+	allapps, err := shuffle.GetAllWorkflowApps(ctx, 0, 0)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting apps to verify bundle import: %s", err)
+	}
+
+	for _, bundleApp := range manifest.Apps {
+		if len(manifest.Files[bundleApp.Definition]) == 0 || len(manifest.Files[bundleApp.ImageFile]) == 0 {
+			return imported, fmt.Errorf("Bundle app %s is not covered by the manifest", bundleApp.Name)
+		}
+
+		if bundleApp.ImageDigest != manifest.Files[bundleApp.ImageFile] {
+			return imported, fmt.Errorf("Image digest of bundle app %s does not match the manifest", bundleApp.Name)
+		}
+
+		if len(bundleApp.OpenApi) > 0 && len(manifest.Files[bundleApp.OpenApi]) == 0 {
+			return imported, fmt.Errorf("OpenAPI of bundle app %s is not covered by the manifest", bundleApp.Name)
+		}
+
+		appData, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(bundleApp.Definition)))
+		if err != nil {
+			return imported, err
+		}
+
+		workflowapp := shuffle.WorkflowApp{}
+		err = json.Unmarshal(appData, &workflowapp)
+		if err != nil {
+			return imported, fmt.Errorf("Failed unmarshalling app %s from bundle: %s", bundleApp.Name, err)
+		}
+
+		contentHash := sha256.Sum256([]byte(manifest.Files[bundleApp.Definition] + bundleApp.ImageDigest))
+		hash := hex.EncodeToString(contentHash[:])
+
+		if user != nil {
+			workflowapp.ID = uuid.NewV4().String()
+		}
+
+		removeApps := []string{}
+		skip := false
+		for _, app := range allapps {
+			if user != nil && (app.ReferenceOrg != user.ActiveOrg.Id || app.Owner != user.Id) {
+				continue
+			}
+
+			if app.Name == workflowapp.Name && app.AppVersion == workflowapp.AppVersion {
+				if app.Hash == hash && !forceUpdate {
+					skip = true
+					break
+				}
+
+				if app.ID != workflowapp.ID {
+					removeApps = append(removeApps, app.ID)
+				}
+			}
+		}
+
+		if skip {
+			log.Printf("[DEBUG] Skipping bundled app %s:%s as it is already imported", workflowapp.Name, workflowapp.AppVersion)
+			continue
+		}
+
+		err = checkWorkflowApp(workflowapp)
+		if err != nil {
+			return imported, fmt.Errorf("%s for app %s:%s", err, workflowapp.Name, workflowapp.AppVersion)
+		}
+
+		err = loadAppBundleImage(ctx, dockercli, filepath.Join(dir, filepath.FromSlash(bundleApp.ImageFile)), bundleApp.Image)
+		if err != nil {
+			return imported, err
+		}
+
+		for _, item := range removeApps {
+			log.Printf("[WARNING] Removing duplicate app during bundle import: %s", item)
+			err = shuffle.DeleteKey(ctx, "workflowapp", item)
+			if err != nil {
+				log.Printf("[ERROR] Failed deleting duplicate %s: %s", item, err)
+			}
+		}
+
+		if len(bundleApp.OpenApi) > 0 {
+			openapi, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(bundleApp.OpenApi)))
+			if err != nil {
+				return imported, err
+			}
+
+			err = shuffle.SetOpenApiDatastore(ctx, workflowapp.ID, shuffle.ParsedOpenApi{
+				Body:    string(openapi),
+				ID:      workflowapp.ID,
+				Success: true,
+			})
+			if err != nil {
+				log.Printf("[WARNING] Failed setting OpenAPI for bundled app %s: %s", workflowapp.Name, err)
+			}
+		}
+
+		workflowapp.IsValid = true
+		workflowapp.Downloaded = true
+		workflowapp.Hash = hash
+		if user != nil {
+			workflowapp.Sharing = false
+			workflowapp.Public = false
+			workflowapp.Owner = user.Id
+			workflowapp.ReferenceOrg = user.ActiveOrg.Id
+			workflowapp.Contributors = []string{user.Id}
+		}
+
+		err = shuffle.SetWorkflowAppDatastore(ctx, workflowapp, workflowapp.ID)
+		if err != nil {
+			return imported, fmt.Errorf("Failed setting app %s: %s", workflowapp.Name, err)
+		}
+
+		log.Printf("[INFO] Imported app %s:%s (%s) with image %s from bundle", workflowapp.Name, workflowapp.AppVersion, workflowapp.ID, bundleApp.Image)
+		imported = append(imported, fmt.Sprintf("%s:%s", workflowapp.Name, workflowapp.AppVersion))
+	}
+
+	cacheKey := fmt.Sprintf("workflowapps-sorted")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-100")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-500")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-1000")
+	shuffle.DeleteCache(ctx, cacheKey)
+
+	return imported, nil
+}
+
+// Imports every bundle in a folder. Used for SHUFFLE_APP_BUNDLE_FOLDER.
+func handleAppBundleFolder(ctx context.Context, location string, forceUpdate bool) error {
+	files, err := ioutil.ReadDir(location)
+	if err != nil {
+		return fmt.Errorf("Failed reading bundle folder %s: %s", location, err)
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !(strings.HasSuffix(file.Name(), ".bundle") || strings.HasSuffix(file.Name(), ".tar.gz")) {
+			continue
+		}
+
+		bundleFile, err := os.Open(filepath.Join(location, file.Name()))
+		if err != nil {
+			log.Printf("[WARNING] Failed opening bundle %s: %s", file.Name(), err)
+			continue
+		}
+
+		imported, err := importAppBundle(ctx, bundleFile, forceUpdate, nil)
+		bundleFile.Close()
+		if err != nil {
+			log.Printf("[WARNING] Failed importing bundle %s: %s", file.Name(), err)
+			continue
+		}
+
+		log.Printf("[INFO] Imported %d app(s) from bundle %s", len(imported), file.Name())
+	}
+
+	return nil
+}
+
+func handleExportAppBundle(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app bundle export: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to export apps"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	type exportRequest struct {
+		Apps []string `json:"apps"`
+	}
+
+	var exportData exportRequest
+	err = json.Unmarshal(body, &exportData)
+	if err != nil || len(exportData.Apps) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Provide the app IDs to export in the 'apps' field"}`))
+		return
+	}
+
+	ctx := context.Background()
+	apps := []shuffle.WorkflowApp{}
+	for _, appId := range exportData.Apps {
+		app, err := shuffle.GetApp(ctx, appId, user, false)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting app %s for bundle export: %s", appId, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed finding app %s"}`, appId)))
+			return
+		}
+
+		if !app.Sharing && !app.Public && app.Owner != user.Id {
+			resp.WriteHeader(403)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "No access to app %s"}`, appId)))
+			return
+		}
+
+		apps = append(apps, *app)
+	}
+
+	bundle, err := prepareAppBundle(ctx, apps)
+	if bundle != nil {
+		defer os.RemoveAll(bundle.Dir)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed preparing app bundle: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) exported a bundle with %d app(s)", user.Username, user.Id, len(apps))
+
+	resp.Header().Set("Content-Type", "application/gzip")
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="shuffle-apps-%d.bundle"`, time.Now().Unix()))
+	resp.WriteHeader(200)
+	err = writeAppBundle(bundle, resp)
+	if err != nil {
+		log.Printf("[ERROR] Failed writing app bundle: %s", err)
+	}
+}
+
+func handleImportAppBundle(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app bundle import: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to import apps"}`))
+		return
+	}
+
+	// Supports both a multipart upload and the raw bundle as body
+	request.Body = http.MaxBytesReader(resp, request.Body, getAppBundleSizeLimit("SHUFFLE_APP_BUNDLE_MAX_SIZE", 20*1024*1024*1024))
+	var input io.Reader = request.Body
+	if strings.HasPrefix(request.Header.Get("Content-Type"), "multipart/form-data") {
+		request.ParseMultipartForm(32 << 20)
+		file, _, err := request.FormFile("shuffle_file")
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Upload the bundle in the 'shuffle_file' field"}`))
+			return
+		}
+		defer file.Close()
+
+		input = file
+	}
+
+	ctx := context.Background()
+	imported, err := importAppBundle(ctx, input, true, &user)
+	if err != nil {
+		log.Printf("[WARNING] Failed importing app bundle: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) imported a bundle with apps %s", user.Username, user.Id, strings.Join(imported, ", "))
+
+	newjson, err := json.Marshal(imported)
+	if err != nil {
+		newjson = []byte("[]")
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "apps": %s}`, string(newjson))))
+}
+
+// Usage:
+//
+//	backend bundle export <output file> <app id>...
+//	backend bundle import <bundle file>...
+func runAppBundleCli(args []string) int {
+	if len(args) < 2 || (args[0] != "export" && args[0] != "import") || (args[0] == "export" && len(args) < 3) {
+		log.Printf("Usage: %s bundle export <output file> <app id>... | %s bundle import <bundle file>...", os.Args[0], os.Args[0])
+		return 1
+	}
+
+	elasticConfig := "elasticsearch"
+	if strings.ToLower(os.Getenv("SHUFFLE_ELASTIC")) == "false" {
+		elasticConfig = ""
+	}
+
+	_, err := shuffle.RunInit(*shuffle.GetDatastore(), *shuffle.GetStorage(), gceProject, "onprem", true, elasticConfig, false, 0)
+	if err != nil {
+		log.Printf("[ERROR] Failed database connection: %s", err)
+		return 1
+	}
+
+	ctx := context.Background()
+	if args[0] == "import" {
+		for _, filename := range args[1:] {
+			bundleFile, err := os.Open(filename)
+			if err != nil {
+				log.Printf("[ERROR] Failed opening bundle %s: %s", filename, err)
+				return 1
+			}
+
+			imported, err := importAppBundle(ctx, bundleFile, true, nil)
+			bundleFile.Close()
+			if err != nil {
+				log.Printf("[ERROR] Failed importing bundle %s: %s", filename, err)
+				return 1
+			}
+
+			log.Printf("[INFO] Imported apps from %s: %s", filename, strings.Join(imported, ", "))
+		}
+
+		return 0
+	}
+
+	apps := []shuffle.WorkflowApp{}
+	for _, appId := range args[2:] {
+		app, err := shuffle.GetApp(ctx, appId, shuffle.User{}, true)
+		if err != nil {
+			log.Printf("[ERROR] Failed getting app %s: %s", appId, err)
+			return 1
+		}
+
+		apps = append(apps, *app)
+	}
+
+	bundle, err := prepareAppBundle(ctx, apps)
+	if bundle != nil {
+		defer os.RemoveAll(bundle.Dir)
+	}
+
+	if err != nil {
+		log.Printf("[ERROR] Failed preparing bundle: %s", err)
+		return 1
+	}
+
+	output, err := os.Create(args[1])
+	if err != nil {
+		log.Printf("[ERROR] Failed creating %s: %s", args[1], err)
+		return 1
+	}
+	defer output.Close()
+
+	err = writeAppBundle(bundle, output)
+	if err != nil {
+		log.Printf("[ERROR] Failed writing bundle: %s", err)
+		return 1
+	}
+
+	log.Printf("[INFO] Wrote bundle with %d app(s) to %s", len(apps), args[1])
+	return 0
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	http2 "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+	"golang.org/x/crypto/ssh"
+)
+
+// Git credentials are stored encrypted per org, and referenced by id when
+// loading apps and workflows from a git host
+var gitCredentialCategory = "git_credentials"
+
+// Matches scp-like git URLs, e.g. git@gitea.internal:team/apps.git
+var scpGitUrlPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/].*$`)
+
+type GitCredential struct {
+	Id    string `json:"id"`
+	OrgId string `json:"org_id"`
+	Name  string `json:"name"`
+
+	// basic, token, ssh or s3. s3 uses the username and password as
+	// access key and secret key, for archive sources.
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`
+
+	PrivateKey    string `json:"private_key,omitempty"`
+	KeyPassphrase string `json:"key_passphrase,omitempty"`
+	KnownHosts    string `json:"known_hosts"`
+
+	// PEM encoded CA certificates for hosts with an internal CA
+	CABundle string `json:"ca_bundle"`
+	Created  int64  `json:"created"`
+	Edited   int64  `json:"edited"`
+}
+
+// Any git host is allowed, but only over the network. Local paths and
+// file:// URLs would let a user read the backend's filesystem.
+func isGitRepositoryUrl(repoUrl string) bool {
+	if scpGitUrlPattern.MatchString(repoUrl) {
+		return true
+	}
+
+	parsedUrl, err := url.Parse(repoUrl)
+	if err != nil || len(parsedUrl.Host) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(parsedUrl.Scheme) {
+	case "http", "https", "ssh", "git":
+		return true
+	}
+
+	return false
+}
+
+func getGitCredentialPassphrase(credential GitCredential) string {
+	return fmt.Sprintf("%s_%d_%s", credential.OrgId, credential.Created, credential.Id)
+}
+
+func getGitCredential(ctx context.Context, orgId, credentialId string) (*GitCredential, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, gitCredentialCategory, credentialId), gitCredentialCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	credential := GitCredential{}
+	err = json.Unmarshal([]byte(cacheData.Value), &credential)
+	if err != nil {
+		return nil, err
+	}
+
+	// Secrets are decrypted on load, and only ever stored encrypted
+	passphrase := getGitCredentialPassphrase(credential)
+	for _, secret := range []*string{&credential.Password, &credential.Token, &credential.PrivateKey, &credential.KeyPassphrase} {
+		if len(*secret) == 0 {
+			continue
+		}
+
+		decrypted, err := shuffle.HandleKeyDecryption([]byte(*secret), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("Failed decrypting git credential %s", credentialId)
+		}
+
+		*secret = string(decrypted)
+	}
+
+	return &credential, nil
+}
+
+func setGitCredential(ctx context.Context, credential GitCredential) error {
+	passphrase := getGitCredentialPassphrase(credential)
+	for _, secret := range []*string{&credential.Password, &credential.Token, &credential.PrivateKey, &credential.KeyPassphrase} {
+		if len(*secret) == 0 {
+			continue
+		}
+
+		encrypted, err := shuffle.HandleKeyEncryption([]byte(*secret), passphrase)
+		if err != nil {
+			return err
+		}
+
+		*secret = string(encrypted)
+	}
+
+	credential.Edited = time.Now().Unix()
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    credential.OrgId,
+		Key:      fmt.Sprintf("%s_%s", gitCredentialCategory, credential.Id),
+		Value:    string(data),
+		Category: gitCredentialCategory,
+	})
+}
+
+// Sets the auth method and CA bundle of a stored credential on the clone
+func applyGitCredential(ctx context.Context, orgId, credentialId string, cloneOptions *git.CloneOptions) error {
+	if len(credentialId) == 0 {
+		return nil
+	}
+
+	credential, err := getGitCredential(ctx, orgId, credentialId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting git credential %s for org %s: %s", credentialId, orgId, err)
+		return fmt.Errorf("Git credential %s not found", credentialId)
+	}
+
+	if len(credential.CABundle) > 0 {
+		cloneOptions.CABundle = []byte(credential.CABundle)
+	}
+
+	switch credential.Type {
+	case "basic":
+		cloneOptions.Auth = &http2.BasicAuth{
+			Username: credential.Username,
+			Password: credential.Password,
+		}
+	case "token":
+		cloneOptions.Auth = &http2.TokenAuth{
+			Token: credential.Token,
+		}
+	case "ssh":
+		username := credential.Username
+		if len(username) == 0 {
+			username = "git"
+		}
+
+		auth, err := gitssh.NewPublicKeys(username, []byte(credential.PrivateKey), credential.KeyPassphrase)
+		if err != nil {
+			return fmt.Errorf("Failed parsing SSH key of git credential %s: %s", credential.Name, err)
+		}
+
+		auth.HostKeyCallback, err = getGitKnownHostsCallback(credential.KnownHosts)
+		if err != nil {
+			return fmt.Errorf("Failed parsing known_hosts of git credential %s: %s", credential.Name, err)
+		}
+
+		cloneOptions.Auth = auth
+	default:
+		return fmt.Errorf("Unsupported git credential type '%s'", credential.Type)
+	}
+
+	return nil
+}
+
+// The known hosts are read into memory, so the file is only needed while
+// the callback is created
+func getGitKnownHostsCallback(knownHosts string) (ssh.HostKeyCallback, error) {
+	if len(strings.TrimSpace(knownHosts)) == 0 {
+		return nil, errors.New("known_hosts is required for SSH credentials")
+	}
+
+	tmpFile, err := ioutil.TempFile("", "shuffle-known-hosts-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write([]byte(knownHosts))
+	tmpFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return gitssh.NewKnownHostsCallback(tmpFile.Name())
+}
+
+func handleGetGitCredentials(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get git credentials: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage git credentials"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	cacheKeys, _, err := shuffle.GetAllCacheKeys(ctx, user.ActiveOrg.Id, gitCredentialCategory, 100, "")
+	if err != nil {
+		log.Printf("[WARNING] Failed getting git credentials: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting git credentials"}`))
+		return
+	}
+
+	// Secrets are never returned
+	credentials := []GitCredential{}
+	for _, cacheKey := range cacheKeys {
+		credential := GitCredential{}
+		err = json.Unmarshal([]byte(cacheKey.Value), &credential)
+		if err != nil || len(credential.Id) == 0 {
+			continue
+		}
+
+		credential.Password = ""
+		credential.Token = ""
+		credential.PrivateKey = ""
+		credential.KeyPassphrase = ""
+		credentials = append(credentials, credential)
+	}
+
+	newjson, err := json.Marshal(credentials)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling git credentials"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func handleSetGitCredential(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set git credential: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage git credentials"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var credential GitCredential
+	err = json.Unmarshal(body, &credential)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling git credential"}`))
+		return
+	}
+
+	switch credential.Type {
+	case "basic":
+		if len(credential.Username) == 0 || len(credential.Password) == 0 {
+			err = errors.New("Basic credentials need a username and password")
+		}
+	case "token":
+		if len(credential.Token) == 0 {
+			err = errors.New("Token credentials need a token")
+		}
+	case "s3":
+		if len(credential.Username) == 0 || len(credential.Password) == 0 {
+			err = errors.New("S3 credentials need an access key (username) and secret key (password)")
+		}
+	case "ssh":
+		if len(credential.PrivateKey) == 0 || len(strings.TrimSpace(credential.KnownHosts)) == 0 {
+			err = errors.New("SSH credentials need a private key and known_hosts")
+		} else if _, keyErr := gitssh.NewPublicKeys("git", []byte(credential.PrivateKey), credential.KeyPassphrase); keyErr != nil {
+			err = fmt.Errorf("Invalid private key: %s", keyErr)
+		} else if _, hostsErr := getGitKnownHostsCallback(credential.KnownHosts); hostsErr != nil {
+			err = fmt.Errorf("Invalid known_hosts: %s", hostsErr)
+		}
+	default:
+		err = errors.New("Type must be basic, token, ssh or s3")
+	}
+
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	credential.Id = uuid.NewV4().String()
+	credential.OrgId = user.ActiveOrg.Id
+	credential.Created = time.Now().Unix()
+	if len(credential.Name) == 0 {
+		credential.Name = fmt.Sprintf("%s credential", credential.Type)
+	}
+
+	ctx := shuffle.GetContext(request)
+	err = setGitCredential(ctx, credential)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving git credential: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving git credential"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) added %s git credential %s (%s)", user.Username, user.Id, credential.Type, credential.Name, credential.Id)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, credential.Id)))
+}
+
+func handleDeleteGitCredential(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete git credential: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage git credentials"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	credentialId := location[5]
+	cacheId := fmt.Sprintf("%s_%s_%s_%s", user.ActiveOrg.Id, gitCredentialCategory, credentialId, gitCredentialCategory)
+	err = shuffle.DeleteKey(ctx, "org_cache", url.QueryEscape(cacheId))
+	if err != nil {
+		log.Printf("[WARNING] Failed deleting git credential %s: %s", credentialId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed deleting git credential"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) deleted git credential %s", user.Username, user.Id, credentialId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/docker/docker/client"
 	newdockerclient "github.com/fsouza/go-dockerclient"
 	"github.com/go-git/go-billy/v5"
+	uuid "github.com/satori/go.uuid"
 
 	//network "github.com/docker/docker/api/types/network"
 	//natting "github.com/docker/go-connections/nat"
@@ -34,6 +35,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
 
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -63,7 +65,7 @@ func getParsedTar(tw *tar.Writer, baseDir, extra string) error {
 			filenamesplit := strings.Split(file, "/")
 			filename := fmt.Sprintf("%s%s/", extra, filenamesplit[len(filenamesplit)-1])
 
-			tmpExtra := fmt.Sprintf(filename)
+			tmpExtra := filename
 			//log.Printf("TmpExtra: %s", tmpExtra)
 			err = getParsedTar(tw, file, tmpExtra)
 			if err != nil {
@@ -350,7 +352,164 @@ func deleteJob(client *kubernetes.Clientset, jobName, namespace string) error {
 	})
 }
 
-func buildImage(tags []string, dockerfileLocation string) error {
+// Tracks an app image build so the UI can show its progress
+type AppBuild struct {
+	Id         string   `json:"id"`
+	AppId      string   `json:"app_id"`
+	OrgId      string   `json:"org_id"`
+	AppName    string   `json:"app_name"`
+	AppVersion string   `json:"app_version"`
+	Tags       []string `json:"tags"`
+	Hash       string   `json:"hash,omitempty"`
+	Builder    string   `json:"builder"`
+	JobName    string   `json:"job_name,omitempty"`
+	Status     string   `json:"status"`
+	Reason     string   `json:"reason,omitempty"`
+	Logs       string   `json:"logs,omitempty"`
+	Created    int64    `json:"created"`
+	Edited     int64    `json:"edited"`
+}
+
+var appBuildCategory = "app_builds"
+
+// Only the end of the builder output is kept, as that's where errors are
+var appBuildLogLimit = 64000
+
+func getAppBuild(ctx context.Context, orgId, appId string) (*AppBuild, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, appBuildCategory, appId), appBuildCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	build := AppBuild{}
+	err = json.Unmarshal([]byte(cacheData.Value), &build)
+	if err != nil {
+		return nil, err
+	}
+
+	return &build, nil
+}
+
+func setAppBuild(ctx context.Context, build *AppBuild) {
+	if build == nil || len(build.AppId) == 0 {
+		return
+	}
+
+	if len(build.Logs) > appBuildLogLimit {
+		build.Logs = build.Logs[len(build.Logs)-appBuildLogLimit:]
+	}
+
+	build.Edited = time.Now().Unix()
+	data, err := json.Marshal(build)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling build %s: %s", build.Id, err)
+		return
+	}
+
+	err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    build.OrgId,
+		Key:      fmt.Sprintf("%s_%s", appBuildCategory, build.AppId),
+		Value:    string(data),
+		Category: appBuildCategory,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed setting build %s for app %s: %s", build.Id, build.AppId, err)
+	}
+}
+
+func finishAppBuild(ctx context.Context, build *AppBuild, logs string, err error) {
+	if build == nil {
+		return
+	}
+
+	if len(logs) > 0 {
+		build.Logs = logs
+	}
+
+	if err != nil {
+		build.Status = "failed"
+		build.Reason = err.Error()
+	} else {
+		build.Status = "ready"
+		build.Reason = ""
+	}
+
+	setAppBuild(ctx, build)
+}
+
+// Pinned, as a floating tag can change the builder between two builds
+func getAppBuilderImage() string {
+	builderImage := os.Getenv("SHUFFLE_APP_BUILDER_IMAGE")
+	if len(builderImage) == 0 {
+		builderImage = "gcr.io/kaniko-project/executor:v1.23.2"
+	}
+
+	return builderImage
+}
+
+func getAppBuildTimeout() time.Duration {
+	timeout := 5 * time.Minute
+	if len(os.Getenv("SHUFFLE_APP_BUILD_TIMEOUT")) > 0 {
+		parsedTimeout, err := time.ParseDuration(os.Getenv("SHUFFLE_APP_BUILD_TIMEOUT"))
+		if err == nil && parsedTimeout > 0 {
+			timeout = parsedTimeout
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_APP_BUILD_TIMEOUT must be a duration like '10m', not '%s'. Using default.", os.Getenv("SHUFFLE_APP_BUILD_TIMEOUT"))
+		}
+	}
+
+	return timeout
+}
+
+// Job names must be valid DNS labels, and unique so builds don't collide
+func getAppBuildJobName(tags []string) string {
+	name := ""
+	if len(tags) > 0 {
+		tagSplit := strings.Split(tags[len(tags)-1], ":")
+		for _, character := range strings.ToLower(tagSplit[len(tagSplit)-1]) {
+			if (character >= 'a' && character <= 'z') || (character >= '0' && character <= '9') {
+				name += string(character)
+			} else if len(name) > 0 && !strings.HasSuffix(name, "-") {
+				name += "-"
+			}
+		}
+	}
+
+	if len(name) > 30 {
+		name = name[:30]
+	}
+
+	name = strings.Trim(name, "-")
+	if len(name) == 0 {
+		name = "app"
+	}
+
+	return fmt.Sprintf("shuffle-app-builder-%s-%s", name, strings.Split(uuid.NewV4().String(), "-")[0])
+}
+
+func getAppBuildJobLogs(client *kubernetes.Clientset, jobName, namespace string) string {
+	pods, err := client.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("job-name=%s", jobName),
+	})
+	if err != nil || len(pods.Items) == 0 {
+		log.Printf("[WARNING] Failed finding pod for build job %s: %s", jobName, err)
+		return ""
+	}
+
+	logs, err := client.CoreV1().Pods(namespace).GetLogs(pods.Items[len(pods.Items)-1].Name, &corev1.PodLogOptions{
+		Container: "kaniko",
+	}).DoRaw(context.TODO())
+	if err != nil {
+		log.Printf("[WARNING] Failed getting logs for build job %s: %s", jobName, err)
+		return ""
+	}
+
+	return string(logs)
+}
+
+// The build is optional, and is updated with the status and builder
+// logs as the build progresses
+func buildImage(tags []string, dockerfileLocation string, build *AppBuild) error {
 
 	isKubernetes := false
 	if os.Getenv("IS_KUBERNETES") == "true" {
@@ -376,6 +535,7 @@ func buildImage(tags []string, dockerfileLocation string) error {
 		client, err := getK8sClient()
 		if err != nil {
 			fmt.Printf("Unable to authencticate : %v\n", err)
+			finishAppBuild(context.Background(), build, "", err)
 			return err
 		}
 
@@ -387,30 +547,56 @@ func buildImage(tags []string, dockerfileLocation string) error {
 
 		if podListErr != nil || len(backendPodList.Items) == 0 {
 			fmt.Println("Error getting backend pod or no pod found:", podListErr)
+			if podListErr == nil {
+				podListErr = errors.New("No backend pod found to build on")
+			}
+
+			finishAppBuild(context.Background(), build, "", podListErr)
 			return podListErr
 		}
 
 		backendNodeName := backendPodList.Items[0].Spec.NodeName
 		log.Printf("[INFO] Backend running on: %s", backendNodeName)
 
+		builderArgs := []string{
+			"--verbosity=debug",
+			"--dockerfile=Dockerfile",
+			"--context=dir://" + contextDir,
+			"--destination=" + registryName + "/" + tags[1],
+		}
+
+		// TLS verification towards the registry is only skipped on request
+		if os.Getenv("SHUFFLE_APP_BUILDER_SKIP_TLS_VERIFY") == "true" {
+			builderArgs = append(builderArgs, "--skip-tls-verify")
+		}
+
+		jobName := getAppBuildJobName(tags)
+		backoffLimit := int32(0)
+		jobLabels := map[string]string{
+			"app.shuffler.io/component": "app-builder",
+		}
+
+		if build != nil {
+			jobLabels["app.shuffler.io/build-id"] = build.Id
+		}
+
 		job := &batchv1.Job{
 			ObjectMeta: metav1.ObjectMeta{
-				Name: "shuffle-app-builder",
+				Name:   jobName,
+				Labels: jobLabels,
 			},
 			Spec: batchv1.JobSpec{
+				BackoffLimit: &backoffLimit,
 				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: jobLabels,
+					},
 					Spec: corev1.PodSpec{
 						Containers: []corev1.Container{
 							{
 								Name:  "kaniko",
-								Image: "gcr.io/kaniko-project/executor:latest",
-								Args: []string{
-									"--verbosity=debug",
-									"--dockerfile=Dockerfile",
-									"--context=dir://" + contextDir,
-									"--skip-tls-verify",
-									"--destination=" + registryName + "/" + tags[1],
-								},
+								Image: getAppBuilderImage(),
+								Args:  builderArgs,
 								VolumeMounts: []corev1.VolumeMount{
 									{
 										Name:      "kaniko-workspace",
@@ -439,24 +625,43 @@ func buildImage(tags []string, dockerfileLocation string) error {
 		createdJob, err := client.BatchV1().Jobs("shuffle").Create(context.TODO(), job, metav1.CreateOptions{})
 		if err != nil {
 			log.Printf("Failed to start image builder job: %s", err)
+			finishAppBuild(context.Background(), build, "", err)
 			return err
 		}
 
-		timeout := time.After(5 * time.Minute)
+		if build != nil {
+			build.JobName = createdJob.Name
+			build.Builder = "kaniko"
+			setAppBuild(context.Background(), build)
+		}
+
+		timeout := time.After(getAppBuildTimeout())
 		tick := time.Tick(5 * time.Second)
 
 		for {
 			select {
 			case <-timeout:
-				return fmt.Errorf("job didn't complete within the expected time")
+				logs := getAppBuildJobLogs(client, createdJob.Name, "shuffle")
+				err = deleteJob(client, createdJob.Name, "shuffle")
+				if err != nil {
+					log.Printf("[ERROR] Failed deleting job %s after timeout: %s", createdJob.Name, err)
+				}
+
+				err = fmt.Errorf("job %s didn't complete within the expected time", createdJob.Name)
+				finishAppBuild(context.Background(), build, logs, err)
+				return err
 			case <-tick:
 				currentJob, err := client.BatchV1().Jobs("shuffle").Get(context.TODO(), createdJob.Name, metav1.GetOptions{})
 				if err != nil {
-					return fmt.Errorf("[ERROR] failed to fetch %s status: %v", createdJob.Name, err)
+					err = fmt.Errorf("[ERROR] failed to fetch %s status: %v", createdJob.Name, err)
+					finishAppBuild(context.Background(), build, "", err)
+					return err
 				}
 
 				if currentJob.Status.Succeeded > 0 {
 					log.Printf("[INFO] Job %s completed successfully!", createdJob.Name)
+					finishAppBuild(context.Background(), build, getAppBuildJobLogs(client, createdJob.Name, "shuffle"), nil)
+
 					log.Printf("[INFO] Cleaning up the job %s", createdJob.Name)
 					err := deleteJob(client, createdJob.Name, "shuffle")
 					if err != nil {
@@ -465,16 +670,26 @@ func buildImage(tags []string, dockerfileLocation string) error {
 					log.Println("Job deleted successfully!")
 					return nil
 				} else if currentJob.Status.Failed > 0 {
-					log.Printf("[ERROR] %s job failed with error: %s", createdJob.Name, err)
+					logs := getAppBuildJobLogs(client, createdJob.Name, "shuffle")
+					log.Printf("[ERROR] %s job failed. Builder logs:\n%s", createdJob.Name, logs)
+
+					buildErr := fmt.Errorf("image build job %s failed", createdJob.Name)
+					finishAppBuild(context.Background(), build, logs, buildErr)
+
 					err := deleteJob(client, createdJob.Name, "shuffle")
 					if err != nil {
-						return fmt.Errorf("[ERROR] failed deleting job %s with error: %s", createdJob.Name, err)
+						log.Printf("[ERROR] Failed deleting job %s: %s", createdJob.Name, err)
 					}
+
+					return buildErr
 				}
 			}
 		}
+	}
 
-		return nil
+	if build != nil {
+		build.Builder = "docker"
+		setAppBuild(context.Background(), build)
 	}
 
 	ctx := context.Background()
@@ -482,6 +697,7 @@ func buildImage(tags []string, dockerfileLocation string) error {
 	defer client.Close()
 	if err != nil {
 		log.Printf("Unable to create docker client: %s", err)
+		finishAppBuild(ctx, build, "", err)
 		return err
 	}
 
@@ -535,6 +751,7 @@ func buildImage(tags []string, dockerfileLocation string) error {
 	)
 
 	if err != nil {
+		finishAppBuild(ctx, build, "", err)
 		return err
 	}
 
@@ -543,58 +760,385 @@ func buildImage(tags []string, dockerfileLocation string) error {
 	buildBuf := new(strings.Builder)
 	_, err = io.Copy(buildBuf, imageBuildResponse.Body)
 	if err != nil {
+		finishAppBuild(ctx, build, buildBuf.String(), err)
 		return err
 	} else {
 		if strings.Contains(buildBuf.String(), "errorDetail") {
 			log.Printf("[ERROR] Docker build:\n%s\nERROR ABOVE: Trying to pull tags from: %s", buildBuf.String(), strings.Join(tags, "\n"))
-			return errors.New(fmt.Sprintf("Failed building %s. Check backend logs for details. Most likely means you have an old version of Docker.", strings.Join(tags, ",")))
+			err = errors.New(fmt.Sprintf("Failed building %s. Check backend logs for details. Most likely means you have an old version of Docker.", strings.Join(tags, ",")))
+			finishAppBuild(ctx, build, buildBuf.String(), err)
+			return err
 		}
 	}
 
+	finishAppBuild(ctx, build, buildBuf.String(), nil)
 	return nil
 }
 
-// Checks if an image exists
-func imageCheckBuilder(images []string) error {
-	//log.Printf("[FIXME] ImageNames to check: %#v", images)
-	return nil
+// Returns the latest build of an app. Logs are only included on /logs
+func handleGetAppBuild(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
 
-	ctx := context.Background()
-	client, err := client.NewEnvClient()
+	user, err := shuffle.HandleApiAuthentication(resp, request)
 	if err != nil {
-		log.Printf("Unable to create docker client: %s", err)
-		return err
+		log.Printf("[WARNING] Api authentication failed in get app build: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
 	}
 
-	allImages, err := client.ImageList(ctx, image.ListOptions{
-		All: true,
-	})
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	build, err := getAppBuild(ctx, user.ActiveOrg.Id, location[4])
+	if err != nil {
+		// Hotloaded apps have no org, so their builds are stored without one
+		build, err = getAppBuild(ctx, "", location[4])
+	}
+
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "No build found for this app"}`))
+		return
+	}
+
+	if len(location) < 7 || location[6] != "logs" {
+		build.Logs = ""
+	}
 
+	newjson, err := json.Marshal(build)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling build"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Checks the registry set in REGISTRY_URL for an image, as used with Kaniko builds
+func registryImageExists(ctx context.Context, imageName string) (bool, error) {
+	registryName := strings.TrimSuffix(os.Getenv("REGISTRY_URL"), "/")
+	if len(registryName) == 0 {
+		return false, errors.New("No registry configured")
+	}
+
+	if !strings.HasPrefix(registryName, "http://") && !strings.HasPrefix(registryName, "https://") {
+		registryName = fmt.Sprintf("https://%s", registryName)
+	}
+
+	imageSplit := strings.Split(imageName, ":")
+	tag := "latest"
+	if len(imageSplit) > 1 {
+		tag = imageSplit[len(imageSplit)-1]
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", fmt.Sprintf("%s/v2/%s/manifests/%s", registryName, imageSplit[0], tag), nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json")
+	httpClient := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
+
+	if resp.StatusCode != 200 {
+		return false, fmt.Errorf("Registry returned status %d for %s", resp.StatusCode, imageName)
+	}
+
+	return true, nil
+}
+
+func appImageExists(ctx context.Context, dockercli *client.Client, imageName string) bool {
+	if dockercli != nil {
+		_, _, err := dockercli.ImageInspectWithRaw(ctx, imageName)
+		if err == nil {
+			return true
+		}
+	}
+
+	if len(os.Getenv("REGISTRY_URL")) > 0 {
+		found, err := registryImageExists(ctx, imageName)
+		if err != nil {
+			log.Printf("[WARNING] Failed checking registry for image %s: %s", imageName, err)
+		}
+
+		return found
+	}
+
+	return false
+}
+
+// Generates the code of a generated app from its stored OpenAPI definition
+// and builds the image. Unlike buildSwaggerApp, the stored app is used as
+// it is, and nothing in the database is changed apart from the build.
+func rebuildGeneratedAppImage(ctx context.Context, app shuffle.WorkflowApp, openapi []byte, imageName string) error {
+	body, swagger, asyncApi, err := loadSwaggerSpec(openapi)
 	if err != nil {
-		log.Printf("[ERROR] Failed creating imagelist: %s", err)
 		return err
 	}
 
-	filteredImages := []image.Summary{}
-	for _, image := range allImages {
-		found := false
-		for _, repoTag := range image.RepoTags {
-			if strings.Contains(repoTag, baseDockerName) {
-				found = true
+	if swagger.Info == nil {
+		return errors.New("Info not parsed")
+	}
+
+	swagger.Info.Title = shuffle.FixFunctionName(swagger.Info.Title, swagger.Info.Title, false)
+	if strings.Contains(swagger.Info.Title, " ") {
+		swagger.Info.Title = strings.Replace(swagger.Info.Title, " ", "_", -1)
+	}
+
+	basePath, err := shuffle.BuildStructure(swagger, app.ID)
+	if err != nil {
+		return fmt.Errorf("Failed building baseline structure: %s", err)
+	}
+
+	var pythonfunctions []string
+	if asyncApi {
+		requirements := shuffle.GetAppRequirements()
+		extraRequirements := ""
+		_, pythonfunctions, extraRequirements, err = generateAsyncApiApp(body, swagger, app.ID)
+		if err == nil {
+			err = ioutil.WriteFile(fmt.Sprintf("%s/requirements.txt", basePath), []byte(requirements+extraRequirements), 0644)
+		}
+	} else {
+		swagger, _, pythonfunctions, err = shuffle.GenerateYaml(swagger, app.ID)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed generating app code: %s", err)
+	}
+
+	err = shuffle.DumpApi(basePath, app)
+	if err != nil {
+		return fmt.Errorf("Failed dumping yaml: %s", err)
+	}
+
+	classname := strings.Replace(fmt.Sprintf("%s-%s", swagger.Info.Title, app.ID), " ", "", -1)
+	classname = strings.Replace(classname, "-", "", -1)
+	_, err = shuffle.DumpPython(basePath, classname, swagger.Info.Version, pythonfunctions)
+	if err != nil {
+		return fmt.Errorf("Failed dumping appcode: %s", err)
+	}
+
+	build := &AppBuild{
+		Id:         uuid.NewV4().String(),
+		AppId:      app.ID,
+		OrgId:      app.ReferenceOrg,
+		AppName:    app.Name,
+		AppVersion: app.AppVersion,
+		Tags:       []string{imageName},
+		Status:     "building",
+		Created:    time.Now().Unix(),
+	}
+	setAppBuild(ctx, build)
+
+	return buildImage(build.Tags, fmt.Sprintf("%s/Dockerfile", basePath), build)
+}
+
+// Makes an image available by pulling it, or by rebuilding it from the
+// stored OpenAPI definition for generated apps.
+func buildMissingAppImage(ctx context.Context, dockercli *client.Client, imageName string, action shuffle.Action) error {
+	if dockercli != nil {
+		reader, err := dockercli.ImagePull(ctx, imageName, image.PullOptions{})
+		if err == nil {
+			io.Copy(ioutil.Discard, reader)
+			reader.Close()
+
+			if appImageExists(ctx, dockercli, imageName) {
+				log.Printf("[INFO] Pulled missing image %s", imageName)
+				return nil
+			}
+		}
+	}
+
+	if len(action.AppID) == 0 {
+		return fmt.Errorf("No app found for image %s", imageName)
+	}
+
+	app, err := shuffle.GetApp(ctx, action.AppID, shuffle.User{}, false)
+	if err != nil {
+		return fmt.Errorf("Failed finding app %s: %s", action.AppID, err)
+	}
+
+	if !app.Generated {
+		return fmt.Errorf("App %s:%s isn't generated and can't be rebuilt", app.Name, app.AppVersion)
+	}
+
+	openApiApp, err := shuffle.GetOpenApiDatastore(ctx, app.ID)
+	if err != nil || len(openApiApp.Body) == 0 {
+		return fmt.Errorf("No stored OpenAPI definition for app %s:%s", app.Name, app.AppVersion)
+	}
+
+	log.Printf("[INFO] Rebuilding missing image %s from the OpenAPI definition of app %s", imageName, app.ID)
+	err = rebuildGeneratedAppImage(ctx, *app, []byte(openApiApp.Body), imageName)
+	if err != nil {
+		return fmt.Errorf("Rebuild of app %s:%s failed: %s", app.Name, app.AppVersion, err)
+	}
+
+	if !appImageExists(ctx, dockercli, imageName) {
+		return fmt.Errorf("Image %s still missing after rebuild", imageName)
+	}
+
+	return nil
+}
+
+// Images currently being pulled or rebuilt by imageCheckBuilder
+var imageBuildsLock sync.Mutex
+var imageBuildsRunning = map[string]bool{}
+
+// Pulls or rebuilds a missing image in the background. Failures are cached
+// for a while so the same missing image doesn't get rebuilt for every
+// execution.
+func startMissingAppImageBuild(imageName string, action shuffle.Action) {
+	imageBuildsLock.Lock()
+	defer imageBuildsLock.Unlock()
+
+	if imageBuildsRunning[imageName] {
+		return
+	}
+
+	imageBuildsRunning[imageName] = true
+	go func() {
+		defer func() {
+			imageBuildsLock.Lock()
+			delete(imageBuildsRunning, imageName)
+			imageBuildsLock.Unlock()
+		}()
+
+		ctx := context.Background()
+		dockercli, err := client.NewEnvClient()
+		if err != nil {
+			dockercli = nil
+		} else {
+			defer dockercli.Close()
+		}
+
+		err = buildMissingAppImage(ctx, dockercli, imageName, action)
+		if err != nil {
+			log.Printf("[WARNING] Image %s is missing: %s", imageName, err)
+			shuffle.SetCache(ctx, fmt.Sprintf("image_missing_%s", imageName), []byte(err.Error()), 10)
+			return
+		}
+
+		shuffle.SetCache(ctx, fmt.Sprintf("image_available_%s", imageName), []byte("true"), 30)
+	}()
+}
+
+// Checks that the images an execution needs exist in the local daemon
+// or registry. The check itself is short. Missing images are pulled or
+// rebuilt in the background, and the execution is rejected with the names
+// of the missing apps instead of failing later in the worker. Disable
+// with SHUFFLE_IMAGE_CHECK_ENABLED=false.
+func imageCheckBuilder(ctx context.Context, images []string, actions []shuffle.Action) error {
+	if strings.ToLower(os.Getenv("SHUFFLE_IMAGE_CHECK_ENABLED")) == "false" || len(images) == 0 {
+		return nil
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	dockercli, err := client.NewEnvClient()
+	if err == nil {
+		_, err = dockercli.Ping(checkCtx)
+		if err != nil {
+			dockercli.Close()
+			dockercli = nil
+		} else {
+			defer dockercli.Close()
+		}
+	} else {
+		dockercli = nil
+	}
+
+	if dockercli == nil && len(os.Getenv("REGISTRY_URL")) == 0 {
+		log.Printf("[DEBUG] No Docker daemon or registry available to verify images %s. Skipping image check.", strings.Join(images, ", "))
+		return nil
+	}
+
+	missingApps := []string{}
+	buildingApps := []string{}
+	handled := map[string]bool{}
+	for _, imageName := range images {
+		imageName = strings.ToLower(imageName)
+		if handled[imageName] {
+			continue
+		}
+
+		handled[imageName] = true
+
+		cacheKey := fmt.Sprintf("image_available_%s", imageName)
+		_, err := shuffle.GetCache(ctx, cacheKey)
+		if err == nil {
+			continue
+		}
+
+		action := shuffle.Action{}
+		for _, curaction := range actions {
+			if getAppImageName(curaction.AppName, curaction.AppVersion) == imageName {
+				action = curaction
 				break
 			}
 		}
 
-		if found {
-			filteredImages = append(filteredImages, image)
+		appName := imageName
+		if len(action.AppName) > 0 {
+			appName = fmt.Sprintf("%s:%s", action.AppName, action.AppVersion)
 		}
+
+		missingKey := fmt.Sprintf("image_missing_%s", imageName)
+		_, err = shuffle.GetCache(ctx, missingKey)
+		if err == nil {
+			missingApps = append(missingApps, appName)
+			continue
+		}
+
+		// Integrations and cloud actions don't run from local images
+		if action.AppID == "integration" || strings.ToLower(action.Environment) == "cloud" {
+			continue
+		}
+
+		if !appImageExists(checkCtx, dockercli, imageName) {
+			// A slow daemon or registry shouldn't stop the execution
+			if checkCtx.Err() != nil {
+				log.Printf("[WARNING] Timed out checking image %s. Skipping image check.", imageName)
+				return nil
+			}
+
+			startMissingAppImageBuild(imageName, action)
+			buildingApps = append(buildingApps, appName)
+			continue
+		}
+
+		shuffle.SetCache(ctx, cacheKey, []byte("true"), 30)
 	}
 
-	// FIXME: Continue fixing apps here
-	// https://github.com/frikky/Shuffle/issues/135
-	// 1. Find if app exists
-	// 2. Create app if it doesn't
-	//log.Printf("Apps: %#v", filteredImages)
+	if len(missingApps) > 0 {
+		return fmt.Errorf("Missing Docker image for app(s) %s. Activate or rebuild the app(s) before running the workflow", strings.Join(missingApps, ", "))
+	}
+
+	if len(buildingApps) > 0 {
+		return fmt.Errorf("Missing Docker image for app(s) %s. The image is being pulled or rebuilt. Try again in a few minutes", strings.Join(buildingApps, ", "))
+	}
 
 	return nil
 }
@@ -919,7 +1463,7 @@ func handleRemoteDownloadApp(resp http.ResponseWriter, ctx context.Context, user
 		newapp := shuffle.ParsedOpenApi{}
 		err = json.Unmarshal(key, &newapp)
 		if err != nil {
-			log.Printf("[ERROR] Failed openapi unmarshal during auto-download: %s", app.Success, len(app.OpenAPI), err)
+			log.Printf("[ERROR] Failed openapi unmarshal during auto-download (success: %t, length: %d): %s", app.Success, len(app.OpenAPI), err)
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false, "reason": "App doesn't exist"}`))
 			return
@@ -927,7 +1471,7 @@ func handleRemoteDownloadApp(resp http.ResponseWriter, ctx context.Context, user
 
 		err = json.Unmarshal(key, &newapp)
 		if err != nil {
-			log.Printf("[ERROR] Failed openapi unmarshal during auto-download: %s", app.Success, len(app.OpenAPI), err)
+			log.Printf("[ERROR] Failed openapi unmarshal during auto-download (success: %t, length: %d): %s", app.Success, len(app.OpenAPI), err)
 			resp.WriteHeader(401)
 			resp.Write([]byte(`{"success": false, "reason": "App doesn't exist"}`))
 			return
@@ -1031,4 +1575,9 @@ func activateWorkflowAppDocker(resp http.ResponseWriter, request *http.Request)
 
 	log.Printf("[INFO] User %s (%s) is activating %s. Public: %t, Shared: %t", user.Username, user.Id, app.Name, app.Public, app.Sharing)
 	buildSwaggerApp(resp, []byte(openApiApp.Body), user, true)
+
+	// Pulling it ahead of the first run
+	if len(location) > 5 && strings.HasPrefix(location[5], "activate") {
+		go warmupAppImage(context.Background(), user.ActiveOrg.Id, *app)
+	}
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Egress policies per org, set by org admins. The workers fetch them with
+// the authorization of the execution they run, and apply them on top of
+// SHUFFLE_APP_EGRESS_POLICY / SHUFFLE_APP_EGRESS_POLICIES in Orborus.
+var appEgressPolicyCategory = "app_egress_policies"
+
+// Modes: "allow_all", "internet_only" and "allowlist". BlockShuffle also
+// blocks the backend, for apps which don't use files, cache or datastore.
+type AppEgressPolicy struct {
+	Mode         string   `json:"mode"`
+	Allow        []string `json:"allow"`
+	BlockShuffle bool     `json:"block_shuffle"`
+}
+
+type OrgEgressPolicies struct {
+	// Used for every app without its own policy
+	Default *AppEgressPolicy           `json:"default,omitempty"`
+	Apps    map[string]AppEgressPolicy `json:"apps"`
+	Edited  int64                      `json:"edited"`
+}
+
+func getOrgEgressPolicies(ctx context.Context, orgId string) OrgEgressPolicies {
+	policies := OrgEgressPolicies{
+		Apps: map[string]AppEgressPolicy{},
+	}
+
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s", orgId, appEgressPolicyCategory), appEgressPolicyCategory)
+	if err != nil {
+		return policies
+	}
+
+	err = json.Unmarshal([]byte(cacheData.Value), &policies)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling egress policies for org %s: %s", orgId, err)
+	}
+
+	if policies.Apps == nil {
+		policies.Apps = map[string]AppEgressPolicy{}
+	}
+
+	return policies
+}
+
+func validateAppEgressPolicy(policy AppEgressPolicy) error {
+	if policy.Mode != "allow_all" && policy.Mode != "internet_only" && policy.Mode != "allowlist" {
+		return fmt.Errorf("Unknown egress mode '%s'. Use allow_all, internet_only or allowlist", policy.Mode)
+	}
+
+	for _, allowed := range policy.Allow {
+		if len(strings.TrimSpace(allowed)) == 0 || strings.ContainsAny(strings.TrimSpace(allowed), " \t\\") {
+			return fmt.Errorf("Invalid allowlist entry '%s'", allowed)
+		}
+	}
+
+	return nil
+}
+
+// GET returns the org's policies. Workers use ?execution_id=&authorization=
+// instead of a user API key. POST replaces them, and is admin only.
+func handleAppEgressPolicies(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	orgId := ""
+
+	executionId := request.URL.Query().Get("execution_id")
+	if request.Method == "GET" && len(executionId) > 0 {
+		exec, err := shuffle.GetWorkflowExecution(ctx, executionId)
+		if err != nil || len(exec.Authorization) == 0 || exec.Authorization != request.URL.Query().Get("authorization") {
+			log.Printf("[AUDIT] Bad execution authorization for egress policies of execution %s", executionId)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		orgId = exec.ExecutionOrg
+		if len(orgId) == 0 {
+			orgId = exec.Workflow.OrgId
+		}
+	} else {
+		user, err := shuffle.HandleApiAuthentication(resp, request)
+		if err != nil {
+			log.Printf("[WARNING] Api authentication failed in egress policies: %s", err)
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false}`))
+			return
+		}
+
+		if request.Method == "POST" && user.Role != "admin" {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"success": false, "reason": "Must be admin to change egress policies"}`))
+			return
+		}
+
+		orgId = user.ActiveOrg.Id
+		if request.Method == "POST" {
+			body, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				resp.WriteHeader(400)
+				resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+				return
+			}
+
+			policies := OrgEgressPolicies{}
+			err = json.Unmarshal(body, &policies)
+			if err != nil {
+				resp.WriteHeader(400)
+				resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling egress policies"}`))
+				return
+			}
+
+			if policies.Apps == nil {
+				policies.Apps = map[string]AppEgressPolicy{}
+			}
+
+			if policies.Default != nil {
+				policies.Default.Mode = strings.ToLower(policies.Default.Mode)
+				err = validateAppEgressPolicy(*policies.Default)
+			}
+
+			for appName, policy := range policies.Apps {
+				if err != nil {
+					break
+				}
+
+				policy.Mode = strings.ToLower(policy.Mode)
+				policies.Apps[appName] = policy
+				err = validateAppEgressPolicy(policy)
+			}
+
+			if err != nil {
+				resp.WriteHeader(400)
+				resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+				return
+			}
+
+			policies.Edited = time.Now().Unix()
+			data, err := json.Marshal(policies)
+			if err != nil {
+				resp.WriteHeader(500)
+				resp.Write([]byte(`{"success": false, "reason": "Failed marshalling egress policies"}`))
+				return
+			}
+
+			err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+				OrgId:    orgId,
+				Key:      appEgressPolicyCategory,
+				Value:    string(data),
+				Category: appEgressPolicyCategory,
+			})
+
+			if err != nil {
+				log.Printf("[ERROR] Failed storing egress policies for org %s: %s", orgId, err)
+				resp.WriteHeader(500)
+				resp.Write([]byte(`{"success": false, "reason": "Failed storing egress policies"}`))
+				return
+			}
+
+			log.Printf("[AUDIT] User %s (%s) updated the egress policies of org %s (%d app policies)", user.Username, user.Id, orgId, len(policies.Apps))
+		}
+	}
+
+	newjson, err := json.Marshal(getOrgEgressPolicies(ctx, orgId))
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling egress policies"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
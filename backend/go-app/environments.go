@@ -0,0 +1,1304 @@
+package main
+
+// Environment APIs used by Orborus, and the admin views of what
+// Orborus has been doing in each environment.
+import (
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The result of a non-execution job handled by Orborus
+type OrborusJobResult struct {
+	ExecutionId       string `json:"execution_id"`
+	Type              string `json:"type"`
+	ExecutionArgument string `json:"execution_argument"`
+	ExecutionSource   string `json:"execution_source"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+	Duration          int64  `json:"duration"`
+	Timestamp         int64  `json:"timestamp"`
+	OrborusUuid       string `json:"orborus_uuid"`
+}
+
+// All attempts of a single job, including retries
+type OrborusJob struct {
+	Id          string             `json:"id"`
+	Environment string             `json:"environment"`
+	Type        string             `json:"type"`
+	Status      string             `json:"status"`
+	Attempts    int                `json:"attempts"`
+	MaxAttempts int                `json:"max_attempts"`
+	Results     []OrborusJobResult `json:"results"`
+	Edited      int64              `json:"edited"`
+
+	// The job as the backend handed it to Orborus. Retries re-queue
+	// this, never what Orborus reports back.
+	Request   shuffle.ExecutionRequest `json:"request"`
+	Queue     string                   `json:"queue"`
+	NextRetry int64                    `json:"next_retry,omitempty"`
+}
+
+var orborusJobCategory = "orborus_jobs"
+
+// One index per org lists its jobs, so retries and cleanup don't page
+// through every job record
+var orborusJobIndexCategory = "orborus_job_index"
+var orborusJobIndexLock sync.Mutex
+
+type OrborusJobIndexEntry struct {
+	Environment string `json:"environment"`
+	Status      string `json:"status"`
+	Edited      int64  `json:"edited"`
+	NextRetry   int64  `json:"next_retry,omitempty"`
+}
+
+type OrborusJobIndex struct {
+	Jobs map[string]OrborusJobIndexEntry `json:"jobs"`
+}
+
+// Jobs Orborus runs on behalf of the backend. Results for any other
+// type are rejected.
+var orborusJobTypes = []string{
+	"PIPELINE_CREATE",
+	"PIPELINE_START",
+	"PIPELINE_STOP",
+	"PIPELINE_DELETE",
+	"DOCKER_IMAGE_DOWNLOAD",
+	"DOCKER_IMAGE_PREPULL",
+	"CATEGORY_UPDATE",
+	"DISABLE_SIGMA_FOLDER",
+	"DISABLE_SIGMA_FILE",
+	"ENABLE_SIGMA_FILE",
+	"START_TENZIR",
+}
+
+func isOrborusJobType(jobType string) bool {
+	for _, knownType := range orborusJobTypes {
+		if knownType == jobType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Finds the environment Orborus is polling for, based on its headers, and
+// verifies the Authorization header against the environment's auth key.
+// Orborus sends it from its AUTH environment variable.
+func getOrborusEnvironment(ctx context.Context, request *http.Request) (*shuffle.Environment, error) {
+	// This is really the environment's name - NOT org-id
+	environment := request.Header.Get("Org-Id")
+	if len(environment) == 0 {
+		return nil, errors.New("Specify the org-id header.")
+	}
+
+	orgId := request.Header.Get("org")
+	if len(orgId) == 0 {
+		return nil, errors.New("Specify the org header. Set the ORG environment variable for Orborus to your Org ID in Shuffle.")
+	}
+
+	authKey := strings.TrimSpace(strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "))
+	if len(authKey) == 0 {
+		return nil, errors.New("Specify the Authorization header. Set the AUTH environment variable for Orborus to the environment's auth key.")
+	}
+
+	envs, err := shuffle.GetEnvironments(ctx, orgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting environments for org '%s': %s", orgId, err)
+	}
+
+	for _, env := range envs {
+		if env.Name != environment || env.OrgId != orgId || len(env.Auth) == 0 {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(env.Auth), []byte(authKey)) != 1 {
+			log.Printf("[AUDIT] Invalid Orborus auth for environment %s in org %s", environment, orgId)
+			return nil, errors.New("Invalid authorization for the environment")
+		}
+
+		return &env, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("No environment found matching %s in org %s.", environment, orgId))
+}
+
+// Finds an environment in the users' org by name or ID
+func getUserEnvironment(ctx context.Context, user shuffle.User, key string) (*shuffle.Environment, error) {
+	envs, err := shuffle.GetEnvironments(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, env := range envs {
+		if env.Id == key || env.Name == key {
+			return &env, nil
+		}
+	}
+
+	return nil, errors.New(fmt.Sprintf("Failed getting environment for ID %s", key))
+}
+
+// Used by Orborus to re-create pipelines after the Tenzir node recovers
+func handleGetQueuePipelines(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getOrborusEnvironment(ctx, request)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding environment for queue pipelines: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	allPipelines, err := shuffle.GetPipelines(ctx, env.OrgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting pipelines for org %s: %s", env.OrgId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting pipelines"}`))
+		return
+	}
+
+	// Only the ones that should be running in this environment
+	envPipelines := []shuffle.Pipeline{}
+	for _, pipeline := range allPipelines {
+		if pipeline.Environment != env.Name || pipeline.Status != "running" {
+			continue
+		}
+
+		envPipelines = append(envPipelines, pipeline)
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success   bool               `json:"success"`
+		Pipelines []shuffle.Pipeline `json:"pipelines"`
+	}{
+		Success:   true,
+		Pipelines: envPipelines,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling pipelines"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func getMaxJobAttempts() int {
+	maxAttempts := 3
+	if len(os.Getenv("SHUFFLE_ORBORUS_JOB_RETRIES")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_JOB_RETRIES"))
+		if err == nil && tmpInt >= 0 {
+			maxAttempts = tmpInt + 1
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_JOB_RETRIES must be a number, not '%s'. Using default.", os.Getenv("SHUFFLE_ORBORUS_JOB_RETRIES"))
+		}
+	}
+
+	return maxAttempts
+}
+
+// Retried jobs get a new execution ID based on the first one,
+// so results from every attempt end up on the same job.
+func getRootJobId(executionId string) string {
+	return strings.Split(executionId, "_retry_")[0]
+}
+
+func getOrborusJob(ctx context.Context, orgId, jobId string) (*OrborusJob, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, orborusJobCategory, jobId), orborusJobCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	job := OrborusJob{}
+	err = json.Unmarshal([]byte(cacheData.Value), &job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+func setOrborusJob(ctx context.Context, orgId string, job OrborusJob) error {
+	job.Edited = time.Now().Unix()
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    orgId,
+		Key:      fmt.Sprintf("%s_%s", orborusJobCategory, job.Id),
+		Value:    string(data),
+		Category: orborusJobCategory,
+	})
+	if err != nil {
+		return err
+	}
+
+	orborusJobIndexLock.Lock()
+	defer orborusJobIndexLock.Unlock()
+
+	index := getOrborusJobIndex(ctx, orgId)
+	index.Jobs[job.Id] = OrborusJobIndexEntry{
+		Environment: job.Environment,
+		Status:      job.Status,
+		Edited:      job.Edited,
+		NextRetry:   job.NextRetry,
+	}
+
+	return setOrborusJobIndex(ctx, orgId, index)
+}
+
+func deleteOrborusJob(ctx context.Context, orgId, jobId string) error {
+	cacheId := fmt.Sprintf("%s_%s_%s_%s", orgId, orborusJobCategory, jobId, orborusJobCategory)
+	return shuffle.DeleteKey(ctx, "org_cache", url.QueryEscape(cacheId))
+}
+
+// An org without an index yet gets an empty one
+func getOrborusJobIndex(ctx context.Context, orgId string) OrborusJobIndex {
+	index := OrborusJobIndex{}
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, orborusJobIndexCategory, orgId), orborusJobIndexCategory)
+	if err == nil {
+		json.Unmarshal([]byte(cacheData.Value), &index)
+	}
+
+	if index.Jobs == nil {
+		index.Jobs = map[string]OrborusJobIndexEntry{}
+	}
+
+	return index
+}
+
+func setOrborusJobIndex(ctx context.Context, orgId string, index OrborusJobIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    orgId,
+		Key:      fmt.Sprintf("%s_%s", orborusJobIndexCategory, orgId),
+		Value:    string(data),
+		Category: orborusJobIndexCategory,
+	})
+}
+
+// Jobs are kept for SHUFFLE_ORBORUS_JOB_RETENTION_DAYS (default 7) after
+// their last update. Jobs waiting for a retry are always kept.
+func getOrborusJobRetention() int64 {
+	retentionDays := 7
+	if len(os.Getenv("SHUFFLE_ORBORUS_JOB_RETENTION_DAYS")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_JOB_RETENTION_DAYS"))
+		if err == nil && tmpInt > 0 {
+			retentionDays = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_JOB_RETENTION_DAYS must be a positive number, not '%s'. Using default.", os.Getenv("SHUFFLE_ORBORUS_JOB_RETENTION_DAYS"))
+		}
+	}
+
+	return int64(retentionDays) * 24 * 60 * 60
+}
+
+// Deletes jobs past the retention, and returns the IDs of jobs due for a retry
+func pruneOrborusJobs(ctx context.Context, orgId string, timeNow int64) []string {
+	orborusJobIndexLock.Lock()
+	defer orborusJobIndexLock.Unlock()
+
+	index := getOrborusJobIndex(ctx, orgId)
+	retention := getOrborusJobRetention()
+	dueJobs := []string{}
+	changed := false
+	for jobId, entry := range index.Jobs {
+		if entry.Status == "RETRYING" {
+			if entry.NextRetry <= timeNow {
+				dueJobs = append(dueJobs, jobId)
+			}
+
+			continue
+		}
+
+		if entry.Edited > timeNow-retention {
+			continue
+		}
+
+		err := deleteOrborusJob(ctx, orgId, jobId)
+		if err != nil {
+			log.Printf("[WARNING] Failed deleting old Orborus job %s: %s", jobId, err)
+			continue
+		}
+
+		delete(index.Jobs, jobId)
+		changed = true
+	}
+
+	if changed {
+		err := setOrborusJobIndex(ctx, orgId, index)
+		if err != nil {
+			log.Printf("[WARNING] Failed saving Orborus job index for org %s: %s", orgId, err)
+		}
+	}
+
+	return dueJobs
+}
+
+// Stores the jobs handed to Orborus in a queue poll, so their results
+// can be matched and retried from what the backend itself queued.
+func recordOrborusJobs(ctx context.Context, orgId, environment, queueName string, requests []shuffle.ExecutionRequest) {
+	for _, execRequest := range requests {
+		if !isOrborusJobType(execRequest.Type) || len(execRequest.ExecutionId) == 0 {
+			continue
+		}
+
+		// Orborus may see the job more than once before removing it
+		jobId := getRootJobId(execRequest.ExecutionId)
+		_, err := getOrborusJob(ctx, orgId, jobId)
+		if err == nil {
+			continue
+		}
+
+		execRequest.ExecutionId = jobId
+		err = setOrborusJob(ctx, orgId, OrborusJob{
+			Id:          jobId,
+			Environment: environment,
+			Type:        execRequest.Type,
+			Status:      "QUEUED",
+			MaxAttempts: getMaxJobAttempts(),
+			Request:     execRequest,
+			Queue:       queueName,
+		})
+
+		if err != nil {
+			log.Printf("[WARNING] Failed recording Orborus job %s (%s): %s", jobId, execRequest.Type, err)
+		}
+	}
+}
+
+// Puts the stored job back in its environment queue
+func queueOrborusJobRetry(ctx context.Context, orgId string, job OrborusJob) error {
+	if len(job.Request.Type) == 0 || len(job.Queue) == 0 {
+		return errors.New(fmt.Sprintf("Job %s has no stored request to retry", job.Id))
+	}
+
+	execRequest := job.Request
+	execRequest.ExecutionId = fmt.Sprintf("%s_retry_%d", job.Id, job.Attempts)
+	execRequest.Priority = 11
+
+	log.Printf("[INFO] Retrying Orborus job %s (%s) in environment %s (attempt %d of %d)", job.Id, job.Type, job.Environment, job.Attempts+1, job.MaxAttempts)
+	err := shuffle.SetWorkflowQueue(ctx, execRequest, job.Queue)
+	if err != nil {
+		return err
+	}
+
+	job.Status = "QUEUED"
+	job.NextRetry = 0
+	return setOrborusJob(ctx, orgId, job)
+}
+
+// Re-queues stored jobs whose retry delay has passed, and removes old
+// jobs. Retries are kept in the datastore, so they survive a backend
+// restart.
+func runOrborusJobRetries() {
+	ctx := context.Background()
+	for {
+		time.Sleep(30 * time.Second)
+
+		orgs, err := shuffle.GetAllOrgs(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting orgs for Orborus job retries: %s", err)
+			continue
+		}
+
+		timeNow := time.Now().Unix()
+		for _, org := range orgs {
+			for _, jobId := range pruneOrborusJobs(ctx, org.Id, timeNow) {
+				job, err := getOrborusJob(ctx, org.Id, jobId)
+				if err != nil || job.Status != "RETRYING" {
+					continue
+				}
+
+				err = queueOrborusJobRetry(ctx, org.Id, *job)
+				if err != nil {
+					log.Printf("[ERROR] Failed re-queueing Orborus job %s: %s", job.Id, err)
+				}
+			}
+		}
+	}
+}
+
+// Used by Orborus to report the result of non-execution jobs
+func handleOrborusJobResults(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getOrborusEnvironment(ctx, request)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding environment for job results: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading body for job results: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	results := []OrborusJobResult{}
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling job results: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling job results"}`))
+		return
+	}
+
+	for _, result := range results {
+		if len(result.ExecutionId) == 0 || !isOrborusJobType(result.Type) {
+			log.Printf("[WARNING] Skipping Orborus job result with unknown type '%s' in environment %s", result.Type, env.Name)
+			continue
+		}
+
+		// Only jobs the backend handed out in this environment
+		jobId := getRootJobId(result.ExecutionId)
+		job, err := getOrborusJob(ctx, env.OrgId, jobId)
+		if err != nil || job.Environment != env.Name || job.Type != result.Type {
+			log.Printf("[WARNING] Skipping result for unknown Orborus job %s (%s) in environment %s", jobId, result.Type, env.Name)
+			continue
+		}
+
+		if result.Timestamp == 0 {
+			result.Timestamp = time.Now().Unix()
+		}
+
+		// Async jobs report twice: once when started, once when done
+		if result.Status != "EXECUTING" {
+			job.Attempts += 1
+		}
+
+		job.Status = result.Status
+		job.Results = append(job.Results, result)
+		if len(job.Results) > 20 {
+			job.Results = job.Results[len(job.Results)-20:]
+		}
+
+		if result.Status == "FAILED" {
+			log.Printf("[WARNING] Orborus job %s (%s) failed in environment %s after %dms: %s", result.Type, result.ExecutionId, env.Name, result.Duration, result.Error)
+
+			if job.Attempts < job.MaxAttempts {
+				job.Status = "RETRYING"
+				job.NextRetry = time.Now().Unix() + int64(job.Attempts*30)
+			} else {
+				err = shuffle.CreateOrgNotification(
+					ctx,
+					fmt.Sprintf("Orborus job %s failed in environment %s", result.Type, env.Name),
+					fmt.Sprintf("The job failed %d time(s). Last error: %s", job.Attempts, result.Error),
+					"/admin?tab=environments",
+					env.OrgId,
+					true,
+				)
+
+				if err != nil {
+					log.Printf("[ERROR] Failed creating notification for failed job %s: %s", job.Id, err)
+				}
+			}
+		}
+
+		err = setOrborusJob(ctx, env.OrgId, *job)
+		if err != nil {
+			log.Printf("[ERROR] Failed storing result for job %s: %s", job.Id, err)
+		}
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Lists the latest jobs Orborus has handled in an environment
+func handleGetEnvironmentJobs(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get environment jobs: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[AUDIT] User %s isn't admin during get environment jobs", user.Username)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to perform this action"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	if location[1] != "api" || len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getUserEnvironment(ctx, user, location[4])
+	if err != nil {
+		log.Printf("[WARNING] Failed getting environment %s for jobs: %s", location[4], err)
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	orborusJobIndexLock.Lock()
+	index := getOrborusJobIndex(ctx, user.ActiveOrg.Id)
+	orborusJobIndexLock.Unlock()
+
+	jobIds := []string{}
+	for jobId, entry := range index.Jobs {
+		if entry.Environment == env.Name {
+			jobIds = append(jobIds, jobId)
+		}
+	}
+
+	sort.Slice(jobIds, func(i, j int) bool {
+		return index.Jobs[jobIds[i]].Edited > index.Jobs[jobIds[j]].Edited
+	})
+
+	if len(jobIds) > 100 {
+		jobIds = jobIds[0:100]
+	}
+
+	jobs := []OrborusJob{}
+	for _, jobId := range jobIds {
+		job, err := getOrborusJob(ctx, user.ActiveOrg.Id, jobId)
+		if err != nil {
+			continue
+		}
+
+		jobs = append(jobs, *job)
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool         `json:"success"`
+		Jobs    []OrborusJob `json:"jobs"`
+	}{
+		Success: true,
+		Jobs:    jobs,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling jobs"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Manually retries a failed job, ignoring the retry count
+func handleRetryEnvironmentJob(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in retry environment job: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[AUDIT] User %s isn't admin during retry environment job", user.Username)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to perform this action"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.String(), "/")
+	if location[1] != "api" || len(location) <= 6 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getUserEnvironment(ctx, user, location[4])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	jobId := location[6]
+	job, err := getOrborusJob(ctx, user.ActiveOrg.Id, jobId)
+	if err != nil || job.Environment != env.Name {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Job not found"}`))
+		return
+	}
+
+	if job.Status != "FAILED" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Only failed jobs can be retried. Current status: %s"}`, job.Status)))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s is retrying Orborus job %s (%s) in environment %s", user.Username, job.Id, job.Type, env.Name)
+
+	// Gives the job a new set of attempts
+	job.MaxAttempts = job.Attempts + getMaxJobAttempts()
+	err = queueOrborusJobRetry(ctx, user.ActiveOrg.Id, *job)
+	if err != nil {
+		log.Printf("[ERROR] Failed retrying job %s: %s", job.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed re-queueing the job"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s"}`, job.Id)))
+}
+
+// A single aggregated stats sample from Orborus
+type EnvironmentStatsPoint struct {
+	Timestamp         int64   `json:"timestamp"`
+	OrborusUuid       string  `json:"orborus_uuid"`
+	CPU               int     `json:"cpu"`
+	CPUPercent        float64 `json:"cpu_percent"`
+	Memory            int     `json:"memory"`
+	MaxMemory         int     `json:"max_memory"`
+	MemoryPercent     float64 `json:"memory_percent"`
+	AppContainers     int     `json:"app_containers"`
+	WorkerContainers  int     `json:"worker_containers"`
+	StoppedContainers int     `json:"stopped_containers"`
+	TotalContainers   int     `json:"total_containers"`
+	Queue             int     `json:"queue"`
+}
+
+var environmentStatsCategory = "environment_stats"
+
+// Max amount of points kept per environment. 1440 = 24 hours with the
+// default 60 second interval in Orborus.
+func getEnvironmentStatsRetention() int {
+	retention := 1440
+	if len(os.Getenv("SHUFFLE_ENVIRONMENT_STATS_RETENTION")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ENVIRONMENT_STATS_RETENTION"))
+		if err == nil && tmpInt > 0 {
+			retention = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ENVIRONMENT_STATS_RETENTION must be a number, not '%s'. Using default.", os.Getenv("SHUFFLE_ENVIRONMENT_STATS_RETENTION"))
+		}
+	}
+
+	return retention
+}
+
+func getEnvironmentStats(ctx context.Context, env shuffle.Environment) ([]EnvironmentStatsPoint, error) {
+	points := []EnvironmentStatsPoint{}
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", env.OrgId, environmentStatsCategory, env.Id), environmentStatsCategory)
+	if err != nil {
+		return points, err
+	}
+
+	err = json.Unmarshal([]byte(cacheData.Value), &points)
+	return points, err
+}
+
+// Samples closer together than this are dropped, whatever interval a
+// (misconfigured) Orborus sends them at.
+var environmentStatsMinInterval = int64(30)
+
+// Guards the read-modify-write of the stats, and the last stored point
+// per environment ID.
+var environmentStatsLock sync.Mutex
+var environmentStatsLastPoint = map[string]int64{}
+
+// Appends to the bounded time series of an environment
+func appendEnvironmentStats(ctx context.Context, env shuffle.Environment, stats shuffle.OrborusStats) {
+	if len(env.Id) == 0 || len(env.OrgId) == 0 {
+		return
+	}
+
+	environmentStatsLock.Lock()
+	defer environmentStatsLock.Unlock()
+
+	if stats.Timestamp < environmentStatsLastPoint[env.Id]+environmentStatsMinInterval {
+		return
+	}
+
+	points, err := getEnvironmentStats(ctx, env)
+	if err != nil {
+		points = []EnvironmentStatsPoint{}
+	}
+
+	// Covers samples stored before a restart
+	if len(points) > 0 && stats.Timestamp < points[len(points)-1].Timestamp+environmentStatsMinInterval {
+		environmentStatsLastPoint[env.Id] = points[len(points)-1].Timestamp
+		return
+	}
+
+	environmentStatsLastPoint[env.Id] = stats.Timestamp
+
+	points = append(points, EnvironmentStatsPoint{
+		Timestamp:         stats.Timestamp,
+		OrborusUuid:       stats.Uuid,
+		CPU:               stats.CPU,
+		CPUPercent:        stats.CPUPercent,
+		Memory:            stats.Memory,
+		MaxMemory:         stats.MaxMemory,
+		MemoryPercent:     stats.MemoryPercent,
+		AppContainers:     stats.AppContainers,
+		WorkerContainers:  stats.WorkerContainers,
+		StoppedContainers: stats.StoppedContainers,
+		TotalContainers:   stats.TotalContainers,
+		Queue:             stats.Queue,
+	})
+
+	retention := getEnvironmentStatsRetention()
+	if len(points) > retention {
+		points = points[len(points)-retention:]
+	}
+
+	data, err := json.Marshal(points)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling stats for environment %s: %s", env.Name, err)
+		return
+	}
+
+	err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    env.OrgId,
+		Key:      fmt.Sprintf("%s_%s", environmentStatsCategory, env.Id),
+		Value:    string(data),
+		Category: environmentStatsCategory,
+	})
+
+	if err != nil {
+		log.Printf("[WARNING] Failed storing stats for environment %s: %s", env.Name, err)
+	}
+}
+
+// Returns the stats time series of an environment.
+// Use ?since=<unix timestamp> to only get the latest points.
+func handleGetEnvironmentStats(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get env stats: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[AUDIT] User %s isn't admin during get env stats", user.Username)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to perform this action"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if location[1] != "api" || len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getUserEnvironment(ctx, user, location[4])
+	if err != nil {
+		log.Printf("[WARNING] Failed getting environment %s for stats: %s", location[4], err)
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	since := int64(0)
+	sinceParam, ok := request.URL.Query()["since"]
+	if ok && len(sinceParam) > 0 {
+		since, err = strconv.ParseInt(sinceParam[0], 10, 64)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "since must be a unix timestamp"}`))
+			return
+		}
+	}
+
+	points, err := getEnvironmentStats(ctx, *env)
+	if err != nil {
+		points = []EnvironmentStatsPoint{}
+	}
+
+	filteredPoints := []EnvironmentStatsPoint{}
+	for _, point := range points {
+		if point.Timestamp >= since {
+			filteredPoints = append(filteredPoints, point)
+		}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success     bool                    `json:"success"`
+		Environment string                  `json:"environment"`
+		Stats       []EnvironmentStatsPoint `json:"stats"`
+	}{
+		Success:     true,
+		Environment: env.Name,
+		Stats:       filteredPoints,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling stats"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Image cache status of a single Orborus node
+type EnvironmentNodeCache struct {
+	OrborusUuid string            `json:"orborus_uuid"`
+	Node        string            `json:"node"`
+	Images      map[string]string `json:"images"`
+	Edited      int64             `json:"edited"`
+}
+
+var imageCacheCategory = "environment_image_cache"
+
+// Orborus queues use the lowercased environment name onprem
+func getEnvironmentQueueName(envName string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.ReplaceAll(envName, " ", "-"), "_", "-"))
+}
+
+// Same naming as the worker uses when deploying apps
+func getAppImageName(appName, appVersion string) string {
+	return fmt.Sprintf("frikky/shuffle:%s_%s", strings.ReplaceAll(strings.ToLower(appName), " ", "-"), appVersion)
+}
+
+func getImageWarmupLimit() int {
+	limit := 50
+	if len(os.Getenv("SHUFFLE_IMAGE_WARMUP_LIMIT")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_IMAGE_WARMUP_LIMIT"))
+		if err == nil && tmpInt >= 0 {
+			limit = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_IMAGE_WARMUP_LIMIT must be a number, not '%s'. Using default.", os.Getenv("SHUFFLE_IMAGE_WARMUP_LIMIT"))
+		}
+	}
+
+	return limit
+}
+
+// Finds the app images used by active workflows in an environment.
+// Active means the workflow is in production, or has a running trigger.
+func getEnvironmentWarmupImages(ctx context.Context, env shuffle.Environment) ([]string, error) {
+	images := []string{}
+	user := shuffle.User{
+		Role: "admin",
+		ActiveOrg: shuffle.OrgMini{
+			Id: env.OrgId,
+		},
+	}
+
+	workflows, err := shuffle.GetAllWorkflowsByQuery(ctx, user, 250, "")
+	if err != nil {
+		return images, err
+	}
+
+	limit := getImageWarmupLimit()
+	for _, workflow := range workflows {
+		if workflow.Hidden {
+			continue
+		}
+
+		active := workflow.Status == "production"
+		for _, trigger := range workflow.Triggers {
+			if trigger.Status == "running" {
+				active = true
+				break
+			}
+		}
+
+		if !active {
+			continue
+		}
+
+		for _, action := range workflow.Actions {
+			if len(action.AppName) == 0 || len(action.AppVersion) == 0 || !strings.EqualFold(action.Environment, env.Name) {
+				continue
+			}
+
+			image := getAppImageName(action.AppName, action.AppVersion)
+			if shuffle.ArrayContains(images, image) {
+				continue
+			}
+
+			images = append(images, image)
+			if len(images) >= limit {
+				return images, nil
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// Asks Orborus in the environment to pre-pull the images. Kubernetes
+// nodes pull on their own, and Orborus there has no Docker to pull with.
+func queueImageWarmup(ctx context.Context, env shuffle.Environment, images []string) error {
+	if len(images) == 0 || env.RunType == "k8s" {
+		return nil
+	}
+
+	request := shuffle.ExecutionRequest{
+		Type:              "DOCKER_IMAGE_PREPULL",
+		ExecutionId:       uuid.NewV4().String(),
+		ExecutionArgument: strings.Join(images, ","),
+		Priority:          11,
+	}
+
+	return shuffle.SetWorkflowQueue(ctx, request, getEnvironmentQueueName(env.Name))
+}
+
+// Pre-pulls a newly activated app in every onprem environment of the org
+func warmupAppImage(ctx context.Context, orgId string, app shuffle.WorkflowApp) {
+	envs, err := shuffle.GetEnvironments(ctx, orgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting environments for image warmup of %s: %s", app.Name, err)
+		return
+	}
+
+	image := getAppImageName(app.Name, app.AppVersion)
+	for _, env := range envs {
+		if env.Archived || strings.ToLower(env.Name) == "cloud" || env.Type == "cloud" {
+			continue
+		}
+
+		err = queueImageWarmup(ctx, env, []string{image})
+		if err != nil {
+			log.Printf("[WARNING] Failed queueing image warmup of %s in environment %s: %s", image, env.Name, err)
+		}
+	}
+}
+
+// Used by Orborus on startup to find the images to pre-pull
+func handleGetQueueImages(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getOrborusEnvironment(ctx, request)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding environment for image warmup: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	images := []string{}
+	if env.RunType != "k8s" {
+		images, err = getEnvironmentWarmupImages(ctx, *env)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting warmup images for environment %s: %s", env.Name, err)
+		}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success bool     `json:"success"`
+		Images  []string `json:"images"`
+	}{
+		Success: true,
+		Images:  images,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling images"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Used by Orborus before cleaning up anything belonging to an execution.
+// Executions outside the environment's org (or its suborgs) are NOT_FOUND.
+func handleGetQueueExecutionStatus(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getOrborusEnvironment(ctx, request)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding environment for execution status: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	parsedBody := struct {
+		ExecutionIds []string `json:"execution_ids"`
+	}{}
+
+	err = json.Unmarshal(body, &parsedBody)
+	if err != nil || len(parsedBody.ExecutionIds) > 500 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Specify up to 500 execution_ids"}`))
+		return
+	}
+
+	statuses := map[string]string{}
+	for _, executionId := range parsedBody.ExecutionIds {
+		if _, ok := statuses[executionId]; ok || len(executionId) == 0 {
+			continue
+		}
+
+		statuses[executionId] = "NOT_FOUND"
+		exec, err := shuffle.GetWorkflowExecution(ctx, executionId)
+		if err != nil || len(exec.ExecutionId) == 0 {
+			continue
+		}
+
+		execOrg := exec.ExecutionOrg
+		if len(execOrg) == 0 {
+			execOrg = exec.Workflow.OrgId
+		}
+
+		if execOrg != env.OrgId {
+			foundOrg, err := shuffle.GetOrg(ctx, execOrg)
+			if err != nil || foundOrg.CreatorOrg != env.OrgId {
+				continue
+			}
+		}
+
+		statuses[executionId] = exec.Status
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success  bool              `json:"success"`
+		Statuses map[string]string `json:"statuses"`
+	}{
+		Success:  true,
+		Statuses: statuses,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling statuses"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func getEnvironmentImageCache(ctx context.Context, env shuffle.Environment) (map[string]EnvironmentNodeCache, error) {
+	nodes := map[string]EnvironmentNodeCache{}
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", env.OrgId, imageCacheCategory, env.Id), imageCacheCategory)
+	if err != nil {
+		return nodes, err
+	}
+
+	err = json.Unmarshal([]byte(cacheData.Value), &nodes)
+	return nodes, err
+}
+
+// Used by Orborus to report which images each node has cached
+func handleSetQueueImageCache(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getOrborusEnvironment(ctx, request)
+	if err != nil {
+		log.Printf("[WARNING] Failed finding environment for image cache: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	nodeCache := EnvironmentNodeCache{}
+	err = json.Unmarshal(body, &nodeCache)
+	if err != nil || len(nodeCache.Node) == 0 {
+		log.Printf("[WARNING] Failed unmarshalling image cache for environment %s: %s", env.Name, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling image cache"}`))
+		return
+	}
+
+	nodes, err := getEnvironmentImageCache(ctx, *env)
+	if err != nil {
+		nodes = map[string]EnvironmentNodeCache{}
+	}
+
+	nodeCache.Edited = time.Now().Unix()
+	nodes[nodeCache.Node] = nodeCache
+
+	data, err := json.Marshal(nodes)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling image cache"}`))
+		return
+	}
+
+	err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    env.OrgId,
+		Key:      fmt.Sprintf("%s_%s", imageCacheCategory, env.Id),
+		Value:    string(data),
+		Category: imageCacheCategory,
+	})
+
+	if err != nil {
+		log.Printf("[WARNING] Failed storing image cache for environment %s: %s", env.Name, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed storing image cache"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Returns the image cache status of each node in an environment
+func handleGetEnvironmentImageCache(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get env image cache: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		log.Printf("[AUDIT] User %s isn't admin during get env image cache", user.Username)
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to perform this action"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if location[1] != "api" || len(location) <= 4 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	env, err := getUserEnvironment(ctx, user, location[4])
+	if err != nil {
+		log.Printf("[WARNING] Failed getting environment %s for image cache: %s", location[4], err)
+		resp.WriteHeader(404)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
+	}
+
+	// Rerunning the warmup for the environment
+	if request.Method == "POST" && env.RunType == "k8s" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Image warmup isn't supported in Kubernetes environments"}`))
+		return
+	}
+
+	if request.Method == "POST" {
+		images, err := getEnvironmentWarmupImages(ctx, *env)
+		if err == nil {
+			err = queueImageWarmup(ctx, *env, images)
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Failed queueing image warmup for environment %s: %s", env.Name, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed queueing image warmup"}`))
+			return
+		}
+	}
+
+	nodes, err := getEnvironmentImageCache(ctx, *env)
+	if err != nil {
+		nodes = map[string]EnvironmentNodeCache{}
+	}
+
+	newjson, err := json.Marshal(struct {
+		Success     bool                            `json:"success"`
+		Environment string                          `json:"environment"`
+		Nodes       map[string]EnvironmentNodeCache `json:"nodes"`
+	}{
+		Success:     true,
+		Environment: env.Name,
+		Nodes:       nodes,
+	})
+
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling image cache"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
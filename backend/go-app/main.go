@@ -9,6 +9,8 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
 	"strconv"
 
 	"os"
@@ -17,6 +19,8 @@ import (
 	"fmt"
 	"errors"
 	"net/url"
+	"path"
+	"path/filepath"
 	"os/exec"
 	"net/http"
 	"io/ioutil"
@@ -44,6 +48,7 @@ import (
 	xj "github.com/basgys/goxml2json"
 	newscheduler "github.com/carlescere/scheduler"
 	"golang.org/x/crypto/bcrypt"
+	gyaml "github.com/ghodss/yaml"
 	"gopkg.in/yaml.v3"
 
 	// Web
@@ -2212,7 +2217,7 @@ func handlePipelineCallback(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	if len(pipeline.StartNode) == 0 {
-		log.Printf("[WARNING] No start node for pipeline %s - running with workflow default.")
+		log.Printf("[WARNING] No start node for pipeline %s - running with workflow default.", pipeline.WorkflowId)
 	}
 
 	newRequest := &http.Request{
@@ -2950,6 +2955,7 @@ func handleSwaggerValidation(body []byte) (shuffle.ParsedOpenApi, error) {
 		Swagger        string `datastore:"swagger" json:"swagger" yaml:"swagger"`
 		SwaggerVersion string `datastore:"swaggerVersion" json:"swaggerVersion" yaml:"swaggerVersion"`
 		OpenAPI        string `datastore:"openapi" json:"openapi" yaml:"openapi"`
+		AsyncAPI       string `datastore:"asyncapi" json:"asyncapi" yaml:"asyncapi"`
 	}
 
 	//body = []byte(`swagger: "2.0"`)
@@ -2989,8 +2995,33 @@ func handleSwaggerValidation(body []byte) (shuffle.ParsedOpenApi, error) {
 		version.Swagger = version.SwaggerVersion
 	}
 
-	if strings.HasPrefix(version.Swagger, "3.") || strings.HasPrefix(version.OpenAPI, "3.") {
+	if len(version.AsyncAPI) > 0 {
+		// AsyncAPI is kept as is, as it's generated into its own kind of app
+		err = validateAsyncApiSpec(body)
+		if err != nil {
+			log.Printf("[WARNING] Failed parsing AsyncAPI: %s", err)
+			return shuffle.ParsedOpenApi{}, err
+		}
+
+		swaggerdata, err = gyaml.YAMLToJSON(body)
+		if err != nil {
+			return shuffle.ParsedOpenApi{}, err
+		}
+
+		hasher := md5.New()
+		hasher.Write(swaggerdata)
+		idstring = hex.EncodeToString(hasher.Sum(nil))
+
+	} else if strings.HasPrefix(version.Swagger, "3.") || strings.HasPrefix(version.OpenAPI, "3.") {
 		//log.Println("Handling v3 API")
+		if isOpenApi31(version.OpenAPI) {
+			body, err = convertOpenApi31(body)
+			if err != nil {
+				log.Printf("[WARNING] Failed converting OpenAPI 3.1: %s", err)
+				return shuffle.ParsedOpenApi{}, err
+			}
+		}
+
 		swaggerLoader := openapi3.NewSwaggerLoader()
 		swaggerLoader.IsExternalRefsAllowed = true
 		swaggerv3, err := swaggerLoader.LoadSwaggerFromData(body)
@@ -3068,6 +3099,9 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 		Id      string `json:"id" datastore:"id"`
 		Image   string `json:"image" datastore:"image"`
 		Body    string `json:"body" datastore:"body"`
+
+		// Set when publishing a regenerated app as a new version
+		AppVersion string `json:"app_version" datastore:"app_version"`
 	}
 
 	var test Test
@@ -3112,9 +3146,7 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 	// Test = client side with fetch?
 
 	ctx := context.Background()
-	swaggerLoader := openapi3.NewSwaggerLoader()
-	swaggerLoader.IsExternalRefsAllowed = true
-	swagger, err := swaggerLoader.LoadSwaggerFromData(body)
+	body, swagger, asyncApi, err := loadSwaggerSpec(body)
 	if err != nil {
 		log.Printf("[ERROR] Swagger validation error: %s", err)
 		resp.WriteHeader(500)
@@ -3143,7 +3175,23 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 	}
 
 	//log.Printf("Should generate yaml")
-	swagger, api, pythonfunctions, err := shuffle.GenerateYaml(swagger, newmd5)
+	var api shuffle.WorkflowApp
+	var pythonfunctions []string
+	requirements := shuffle.GetAppRequirements()
+	if asyncApi {
+		extraRequirements := ""
+		api, pythonfunctions, extraRequirements, err = generateAsyncApiApp(body, swagger, newmd5)
+		if err == nil {
+			requirements += extraRequirements
+			err = ioutil.WriteFile(fmt.Sprintf("%s/requirements.txt", basePath), []byte(requirements), 0644)
+		}
+	} else {
+		swagger, api, pythonfunctions, err = shuffle.GenerateYaml(swagger, newmd5)
+		if err == nil {
+			addOpenApiWebhooks(&api, swagger)
+		}
+	}
+
 	if err != nil {
 		log.Printf("[WARNING] Failed building and generating yaml (buildapp): %s", err)
 		resp.WriteHeader(500)
@@ -3184,6 +3232,10 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 		api.LargeImage = test.Image
 	}
 
+	if len(test.AppVersion) > 0 {
+		api.AppVersion = test.AppVersion
+	}
+
 	err = shuffle.DumpApi(basePath, api)
 	if err != nil {
 		log.Printf("[WARNING] Failed dumping yaml: %s", err)
@@ -3244,7 +3296,7 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 	//log.Println(stitched)
 
 	// 3. Zip and stream it directly in the directory
-	_, err = shuffle.StreamZipdata(ctx, identifier, stitched, shuffle.GetAppRequirements(), "")
+	_, err = shuffle.StreamZipdata(ctx, identifier, stitched, requirements, "")
 	if err != nil {
 		log.Printf("[ERROR] Zipfile error: %s", err)
 		resp.WriteHeader(500)
@@ -3356,7 +3408,19 @@ func buildSwaggerApp(resp http.ResponseWriter, body []byte, user shuffle.User, s
 
 	// Doing this last to ensure we can copy the docker image over
 	// even though builds fail
-	err = buildImage(dockerTags, dockerLocation)
+	build := &AppBuild{
+		Id:         uuid.NewV4().String(),
+		AppId:      api.ID,
+		OrgId:      user.ActiveOrg.Id,
+		AppName:    api.Name,
+		AppVersion: api.AppVersion,
+		Tags:       dockerTags,
+		Status:     "building",
+		Created:    time.Now().Unix(),
+	}
+	setAppBuild(ctx, build)
+
+	err = buildImage(dockerTags, dockerLocation, build)
 	if err != nil {
 		log.Printf("[ERROR] Docker build error: %s", err)
 		resp.WriteHeader(500)
@@ -3475,6 +3539,287 @@ func handleAppHotload(ctx context.Context, location string, forceUpdate bool) er
 	return nil
 }
 
+// Fingerprints the files of each app folder in the hotload folder that
+// affect a build: api.yaml, Dockerfile and everything under src/
+func getHotloadFingerprints(location string) map[string]string {
+	fingerprints := map[string]string{}
+	folders, err := ioutil.ReadDir(location)
+	if err != nil {
+		log.Printf("[WARNING] Failed reading hotload folder %s: %s", location, err)
+		return fingerprints
+	}
+
+	for _, folder := range folders {
+		if !folder.IsDir() || folder.Name() == "unsupported" {
+			continue
+		}
+
+		hasher := md5.New()
+		appFolder := filepath.Join(location, folder.Name())
+		filepath.Walk(appFolder, func(fullPath string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return nil
+			}
+
+			relativePath, err := filepath.Rel(appFolder, fullPath)
+			if err != nil {
+				return nil
+			}
+
+			relativePath = filepath.ToSlash(relativePath)
+			filename := path.Base(relativePath)
+			if filename != "api.yaml" && filename != "api.yml" && filename != "Dockerfile" && !strings.Contains("/"+relativePath, "/src/") {
+				return nil
+			}
+
+			hasher.Write([]byte(fmt.Sprintf("%s:%d:%d\n", relativePath, info.Size(), info.ModTime().UnixNano())))
+			return nil
+		})
+
+		fingerprints[folder.Name()] = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	return fingerprints
+}
+
+// Watches the hotload folder and rebuilds apps whose folders changed.
+// Changes are debounced so a save of several files only builds once.
+func watchAppHotloadFolder(ctx context.Context, location string) {
+	interval := 2 * time.Second
+	if len(os.Getenv("SHUFFLE_APP_HOTLOAD_WATCH_INTERVAL")) > 0 {
+		parsedInterval, err := time.ParseDuration(os.Getenv("SHUFFLE_APP_HOTLOAD_WATCH_INTERVAL"))
+		if err == nil && parsedInterval > 0 {
+			interval = parsedInterval
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_APP_HOTLOAD_WATCH_INTERVAL must be a duration like '2s', not '%s'. Using default.", os.Getenv("SHUFFLE_APP_HOTLOAD_WATCH_INTERVAL"))
+		}
+	}
+
+	debounce := 3 * time.Second
+	if len(os.Getenv("SHUFFLE_APP_HOTLOAD_DEBOUNCE")) > 0 {
+		parsedDebounce, err := time.ParseDuration(os.Getenv("SHUFFLE_APP_HOTLOAD_DEBOUNCE"))
+		if err == nil && parsedDebounce >= 0 {
+			debounce = parsedDebounce
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_APP_HOTLOAD_DEBOUNCE must be a duration like '3s', not '%s'. Using default.", os.Getenv("SHUFFLE_APP_HOTLOAD_DEBOUNCE"))
+		}
+	}
+
+	log.Printf("[INFO] Watching %s for app changes every %s", location, interval)
+
+	known := getHotloadFingerprints(location)
+	pending := map[string]time.Time{}
+	for {
+		time.Sleep(interval)
+
+		current := getHotloadFingerprints(location)
+		for appFolder, fingerprint := range current {
+			if known[appFolder] != fingerprint {
+				log.Printf("[DEBUG] Detected changes in hotload app folder %s", appFolder)
+				pending[appFolder] = time.Now()
+			}
+		}
+
+		known = current
+		for appFolder, changed := range pending {
+			if time.Since(changed) < debounce {
+				continue
+			}
+
+			delete(pending, appFolder)
+			if _, ok := current[appFolder]; !ok {
+				continue
+			}
+
+			err := hotloadSingleApp(ctx, location, appFolder)
+			if err != nil {
+				log.Printf("[WARNING] Failed hotloading changed app %s: %s", appFolder, err)
+			}
+		}
+	}
+}
+
+// Rebuilds a single app folder in the hotload folder
+func hotloadSingleApp(ctx context.Context, location, appFolder string) error {
+	log.Printf("[INFO] Hotloading changed app %s from %s", appFolder, location)
+
+	fs, err := shuffle.CreateFs("base", location)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to find directory %s", location))
+	}
+
+	dir, err := fs.ReadDir("")
+	if err != nil {
+		return err
+	}
+
+	_, _, err = IterateAppGithubFolders(ctx, fs, dir, "", appFolder, true)
+	if err != nil {
+		return err
+	}
+
+	cacheKey := fmt.Sprintf("workflowapps-sorted")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-100")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-500")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-1000")
+	shuffle.DeleteCache(ctx, cacheKey)
+
+	return nil
+}
+
+var gmailHistoryCategory = "gmail_history"
+
+// Runs the workflow of a Gmail trigger once for every mail added since the
+// last poll. The Gmail history ID to continue from is stored per trigger,
+// starting at the one of the Gmail subscription.
+func pollGmailTrigger(ctx context.Context, job shuffle.CloudSyncJob) error {
+	trigger, err := shuffle.GetTriggerAuth(ctx, job.Id)
+	if err != nil {
+		return err
+	}
+
+	if trigger.OrgId != job.OrgId {
+		return errors.New("Gmail trigger belongs to another org")
+	}
+
+	gmailClient, err := shuffle.RefreshGmailClient(ctx, *trigger)
+	if err != nil {
+		return err
+	}
+
+	historyId := trigger.SubscriptionId
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", trigger.OrgId, gmailHistoryCategory, trigger.Id), gmailHistoryCategory)
+	if err == nil && len(cacheData.Value) > 0 {
+		historyId = cacheData.Value
+	}
+
+	userId := trigger.AssociatedUser
+	if len(userId) == 0 {
+		userId = "me"
+	}
+
+	history, err := shuffle.GetGmailHistory(ctx, gmailClient, userId, historyId)
+	if err != nil {
+		if strings.Contains(err.Error(), "Couldn't find the history") && !strings.Contains(err.Error(), `"error"`) {
+			// No new mail since the last poll
+			return nil
+		}
+
+		// History IDs expire after about a week. Continues from now.
+		profile, profileErr := shuffle.GetGmailUserProfile(ctx, gmailClient)
+		if profileErr != nil || len(profile.HistoryId) == 0 {
+			return err
+		}
+
+		log.Printf("[WARNING] Gmail history %s for trigger %s is no longer available. Continuing from %s: %s", historyId, trigger.Id, profile.HistoryId, err)
+		history.HistoryID = profile.HistoryId
+	}
+
+	handled := []string{}
+	for _, item := range history.History {
+		for _, addedMsg := range item.MessagesAdded {
+			if shuffle.ArrayContains(handled, addedMsg.Message.ID) {
+				continue
+			}
+
+			handled = append(handled, addedMsg.Message.ID)
+			mail, err := shuffle.GetGmailMessage(ctx, gmailClient, userId, addedMsg.Message.ID)
+			if err != nil {
+				log.Printf("[WARNING] Failed getting gmail message %s for trigger %s: %s", addedMsg.Message.ID, trigger.Id, err)
+				continue
+			}
+
+			mail.Type = "new"
+			mail.FileIds = []string{}
+			for _, part := range mail.Payload.Parts {
+				if len(part.Filename) == 0 || len(part.Body.AttachmentID) == 0 {
+					continue
+				}
+
+				fileId, err := uploadGmailAttachment(ctx, gmailClient, *trigger, userId, mail.ID, part.Filename, part.Body.AttachmentID)
+				if err != nil {
+					log.Printf("[WARNING] Failed uploading attachment %s of gmail message %s: %s", part.Filename, mail.ID, err)
+					continue
+				}
+
+				mail.FileIds = append(mail.FileIds, fileId)
+			}
+
+			mailBytes, err := json.Marshal(mail)
+			if err != nil {
+				log.Printf("[WARNING] Failed marshalling gmail message %s: %s", mail.ID, err)
+				continue
+			}
+
+			err = handleCloudExecutionOnprem(trigger.WorkflowId, trigger.Start, "gmail", string(mailBytes))
+			if err != nil {
+				log.Printf("[WARNING] Failed executing workflow %s from gmail message %s: %s", trigger.WorkflowId, mail.ID, err)
+			}
+		}
+	}
+
+	if len(history.HistoryID) == 0 || history.HistoryID == historyId {
+		return nil
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    trigger.OrgId,
+		Key:      fmt.Sprintf("%s_%s", gmailHistoryCategory, trigger.Id),
+		Value:    history.HistoryID,
+		Category: gmailHistoryCategory,
+	})
+}
+
+// Stores a gmail attachment as a file of the trigger's workflow, like the
+// Pub/Sub routing does
+func uploadGmailAttachment(ctx context.Context, gmailClient *http.Client, trigger shuffle.TriggerAuth, userId, messageId, filename, attachmentId string) (string, error) {
+	attachment, err := shuffle.GetGmailMessageAttachment(ctx, gmailClient, userId, messageId, attachmentId)
+	if err != nil {
+		return "", err
+	}
+
+	parsedData, err := base64.URLEncoding.DecodeString(attachment.Data)
+	if err != nil && len(parsedData) == 0 {
+		return "", err
+	}
+
+	basepath := os.Getenv("SHUFFLE_FILE_LOCATION")
+	if len(basepath) == 0 {
+		basepath = "files"
+	}
+
+	timeNow := time.Now().Unix()
+	fileId := uuid.NewV4().String()
+	newFile := shuffle.File{
+		Id:           fileId,
+		CreatedAt:    timeNow,
+		UpdatedAt:    timeNow,
+		Description:  fmt.Sprintf("File found in email message %s with ID %s", messageId, attachmentId),
+		Status:       "uploading",
+		Filename:     filename,
+		OrgId:        trigger.OrgId,
+		WorkflowId:   trigger.WorkflowId,
+		DownloadPath: fmt.Sprintf("%s/%s/%s/%s", basepath, trigger.OrgId, trigger.WorkflowId, fileId),
+		Subflows:     []string{},
+		StorageArea:  "local",
+	}
+
+	err = shuffle.SetFile(ctx, newFile)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = shuffle.UploadFile(ctx, &newFile, "", parsedData)
+	if err != nil {
+		return "", err
+	}
+
+	return fileId, nil
+}
+
 func handleCloudExecutionOnprem(workflowId, startNode, executionSource, executionArgument string) error {
 	ctx := context.Background()
 	// 1. Get the workflow
@@ -3556,6 +3901,19 @@ func handleCloudJob(job shuffle.CloudSyncJob) error {
 				return err
 			}
 
+			// The relay only knows the trigger the notification is for.
+			// Only Graph and the backend know the subscription ID, so it
+			// has to match the one of the trigger.
+			if len(job.PrimaryItemId) == 0 {
+				if len(maildata.Value) == 0 || len(hook.SubscriptionId) == 0 || subtle.ConstantTimeCompare([]byte(maildata.Value[0].Subscriptionid), []byte(hook.SubscriptionId)) != 1 {
+					log.Printf("[WARNING] Outlook notification for trigger %s doesn't match its subscription", hookId)
+					return errors.New("Outlook notification doesn't match the trigger subscription")
+				}
+
+				job.PrimaryItemId = hook.WorkflowId
+				job.SecondaryItem = hook.Start
+			}
+
 			backendPort := os.Getenv("BACKEND_PORT")
 			if backendPort == "" {
 				backendPort = "5001"
@@ -3593,6 +3951,16 @@ func handleCloudJob(job shuffle.CloudSyncJob) error {
 				log.Printf("[INFO] Successfully executed workflow from cloud outlook hook!")
 			}
 		}
+	} else if job.Type == "gmail" {
+		// Sent by a sync relay, which can't receive the Google Pub/Sub
+		// notifications of the trigger
+		if job.Action == "poll" {
+			err := pollGmailTrigger(ctx, job)
+			if err != nil {
+				log.Printf("[WARNING] Failed polling gmail trigger %s: %s", job.Id, err)
+				return err
+			}
+		}
 	} else if job.Type == "webhook" {
 		if job.Action == "execute" {
 			log.Printf("[INFO] Should handle normal webhook for workflow %s with start node %s and data %s", job.PrimaryItemId, job.SecondaryItem, job.ThirdItem)
@@ -3639,6 +4007,18 @@ func handleCloudJob(job shuffle.CloudSyncJob) error {
 				return errors.New("Bad workflow ID when stopping execution.")
 			}
 
+			// The relay never sees the execution authorization. It answers
+			// with the single use token the backend issued for the input.
+			if syncUrl != "https://shuffler.io" {
+				err = useUserInputToken(ctx, job.OrgId, job.FourthItem, job.PrimaryItemId, job.ThirdItem)
+				if err != nil {
+					log.Printf("[WARNING] Bad user input answer for execution %s: %s", job.ThirdItem, err)
+					return err
+				}
+
+				job.FourthItem = workflowExecution.Authorization
+			}
+
 			workflowExecution.Status = "EXECUTING"
 			err = shuffle.SetWorkflowExecution(ctx, *workflowExecution, true)
 			if err != nil {
@@ -3681,6 +4061,14 @@ func handleCloudJob(job shuffle.CloudSyncJob) error {
 				}
 			*/
 
+			if syncUrl != "https://shuffler.io" {
+				err = useUserInputToken(ctx, job.OrgId, job.FourthItem, job.PrimaryItemId, job.ThirdItem)
+				if err != nil {
+					log.Printf("[WARNING] Bad user input answer for execution %s: %s", job.ThirdItem, err)
+					return err
+				}
+			}
+
 			newResults := []shuffle.ActionResult{}
 			for _, result := range workflowExecution.Results {
 				if result.Action.AppName == "User Input" && result.Result == "Waiting for user feedback based on configuration" {
@@ -4389,9 +4777,23 @@ func runInitEs(ctx context.Context) {
 
 		log.Printf("[DEBUG] Getting apps from url '%s'", url)
 
-		r, err := git.Clone(storer, fs, cloneOptions)
-		if err != nil {
-			log.Printf("[ERROR] Failed loading repo into memory (init): %s", err)
+		// Archives are for offline sites, verified with SHUFFLE_APP_DOWNLOAD_CHECKSUM
+		var r *git.Repository
+		if isArchiveSourceUrl(url) {
+			archiveFs, err := loadArchiveSource(ctx, ArchiveSource{
+				URL:      url,
+				Checksum: os.Getenv("SHUFFLE_APP_DOWNLOAD_CHECKSUM"),
+			})
+			if err != nil {
+				log.Printf("[ERROR] Failed loading app archive (init): %s", err)
+			} else {
+				fs = archiveFs
+			}
+		} else {
+			r, err = git.Clone(storer, fs, cloneOptions)
+			if err != nil {
+				log.Printf("[ERROR] Failed loading repo into memory (init): %s", err)
+			}
 		}
 
 		dir, err := fs.ReadDir("")
@@ -4416,6 +4818,27 @@ func runInitEs(ctx context.Context) {
 		log.Printf("[DEBUG] Skipping download of default apps as %d were found", len(workflowapps))
 	}
 
+	startAppRepositorySync()
+	go runOrborusJobRetries()
+
+	if os.Getenv("SHUFFLE_APP_HOTLOAD_WATCH") == "true" {
+		location := os.Getenv("SHUFFLE_APP_HOTLOAD_FOLDER")
+		if len(location) != 0 {
+			go watchAppHotloadFolder(ctx, location)
+		} else {
+			log.Printf("[WARNING] SHUFFLE_APP_HOTLOAD_WATCH is set, but SHUFFLE_APP_HOTLOAD_FOLDER isn't")
+		}
+	}
+
+	// Imports signed app bundles, e.g. for air-gapped sites
+	bundleLocation := os.Getenv("SHUFFLE_APP_BUNDLE_FOLDER")
+	if len(bundleLocation) != 0 {
+		err = handleAppBundleFolder(ctx, bundleLocation, false)
+		if err != nil {
+			log.Printf("[WARNING] Failed app bundle import: %s", err)
+		}
+	}
+
 	if os.Getenv("SHUFFLE_HEALTHCHECK_DISABLED") != "true" {
 		healthcheckInterval := 60
 		log.Printf("[INFO] Starting healthcheck job every %d minute. Stats available on /api/v1/health/stats, and dashboard on /health. Disable with SHUFFLE_HEALTHCHECK_DISABLED=true", healthcheckInterval)
@@ -4543,7 +4966,7 @@ func handleStopCloudSync(syncUrl string, org shuffle.Org) (*shuffle.Org, error)
 	err = shuffle.SetOrg(ctx, org, org.Id)
 	if err != nil {
 		newerror := fmt.Sprintf("[WARNING] ERROR: Failed updating even though there was success: %s", err)
-		log.Printf(newerror)
+		log.Printf("%s", newerror)
 		return &org, errors.New(newerror)
 	}
 
@@ -4984,6 +5407,10 @@ func makeWorkflowPublic(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
+	// Sanitization is done in the frontend as well, but pasted keys and
+	// internal hosts are only caught here
+	parsedWorkflow = shuffle.SanitizeWorkflow(parsedWorkflow)
+	parsedWorkflow, changes := sanitizeWorkflowForPublish(parsedWorkflow)
 	workflowData, err := json.Marshal(parsedWorkflow)
 	if err != nil {
 		log.Printf("[WARNING] Failed marshalling workflow: %s", err)
@@ -4992,27 +5419,53 @@ func makeWorkflowPublic(resp http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	// Sanitization is done in the frontend as well
-	parsedWorkflow = shuffle.SanitizeWorkflow(parsedWorkflow)
-	parsedWorkflow.ID = uuid.NewV4().String()
-	action := shuffle.CloudSyncJob{
-		Type:          "workflow",
-		Action:        "publish",
-		OrgId:         user.ActiveOrg.Id,
-		PrimaryItemId: workflow.ID,
-		SecondaryItem: string(workflowData),
-		FifthItem:     user.Id,
+	// Shows what would be published without publishing it
+	if strings.HasSuffix(request.URL.Path, "/review") {
+		type reviewResponse struct {
+			Success          bool                    `json:"success"`
+			ApprovalRequired bool                    `json:"approval_required"`
+			Changes          []WorkflowPublishChange `json:"changes"`
+			Workflow         shuffle.Workflow        `json:"workflow"`
+		}
+
+		newjson, err := json.Marshal(reviewResponse{
+			Success:          true,
+			ApprovalRequired: isWorkflowPublishApprovalRequired(),
+			Changes:          changes,
+			Workflow:         parsedWorkflow,
+		})
+		if err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed marshalling review"}`))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write(newjson)
+		return
 	}
 
-	org, err := shuffle.GetOrg(ctx, user.ActiveOrg.Id)
-	if err != nil {
-		log.Printf("[WARNING] Failed setting getting org during cloud job setting: %s", err)
-		resp.WriteHeader(401)
-		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+	if len(changes) > 0 {
+		log.Printf("[AUDIT] Stripped %d credential(s), internal host(s) or auth ID(s) from workflow %s (%s) before publishing", len(changes), workflow.Name, workflow.ID)
+	}
+
+	if isWorkflowPublishApprovalRequired() {
+		publishRequest := newWorkflowPublishRequest(user, *workflow, workflowData, changes)
+		err = setWorkflowPublishRequest(ctx, publishRequest)
+		if err != nil {
+			log.Printf("[WARNING] Failed saving publish request for workflow %s: %s", workflow.ID, err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed saving publish request"}`))
+			return
+		}
+
+		log.Printf("[AUDIT] User %s (%s) requested publishing workflow %s (%s). Waiting for approval from another admin", user.Username, user.Id, workflow.Name, workflow.ID)
+		resp.WriteHeader(200)
+		resp.Write([]byte(fmt.Sprintf(`{"success": true, "status": "pending", "id": "%s", "sanitized": %d}`, publishRequest.Id, len(changes))))
 		return
 	}
 
-	err = executeCloudAction(action, org.SyncConfig.Apikey)
+	err = publishWorkflowToCloud(ctx, user.ActiveOrg.Id, workflow.ID, user.Id, workflowData)
 	if err != nil {
 		log.Printf("[WARNING] Failed cloud PUBLISH: %s", err)
 		resp.WriteHeader(401)
@@ -5022,69 +5475,327 @@ func makeWorkflowPublic(resp http.ResponseWriter, request *http.Request) {
 
 	log.Printf("[INFO] Successfully published workflow %s (%s) TO CLOUD", workflow.Name, workflow.ID)
 	resp.WriteHeader(200)
-	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "sanitized": %d}`, len(changes))))
+}
+
+// Limits for uploaded app zips, to stop zip bombs from filling the disk
+func getAppUploadLimits() (int64, int64) {
+	maxSize := int64(50 * 1024 * 1024)
+	if len(os.Getenv("SHUFFLE_APP_UPLOAD_MAX_SIZE")) > 0 {
+		parsedSize, err := strconv.ParseInt(os.Getenv("SHUFFLE_APP_UPLOAD_MAX_SIZE"), 10, 64)
+		if err == nil && parsedSize > 0 {
+			maxSize = parsedSize
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_APP_UPLOAD_MAX_SIZE must be a number of bytes, not '%s'. Using default.", os.Getenv("SHUFFLE_APP_UPLOAD_MAX_SIZE"))
+		}
+	}
+
+	return maxSize, maxSize * 10
 }
 
+// Extracts an app zip into target. The app folder is the one holding
+// api.yaml, so zips with or without a top level folder both work.
+func extractAppZip(zipdata *zip.Reader, target string, maxUncompressed int64) error {
+	appRoot := ""
+	for _, item := range zipdata.File {
+		name := path.Clean(strings.ReplaceAll(item.Name, "\\", "/"))
+		if path.Base(name) != "api.yaml" && path.Base(name) != "api.yml" {
+			continue
+		}
+
+		dir := path.Dir(name)
+		if len(appRoot) == 0 || len(dir) < len(appRoot) {
+			appRoot = dir
+		}
+	}
+
+	if len(appRoot) == 0 {
+		return errors.New("No api.yaml found in the zip")
+	}
+
+	totalSize := int64(0)
+	fileCount := 0
+	for _, item := range zipdata.File {
+		name := path.Clean(strings.ReplaceAll(item.Name, "\\", "/"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid path %s in zip", item.Name)
+		}
+
+		if item.FileInfo().IsDir() {
+			continue
+		}
+
+		if !item.Mode().IsRegular() {
+			return fmt.Errorf("Only regular files are allowed in app zips. Found %s", item.Name)
+		}
+
+		relativePath := name
+		if appRoot != "." {
+			if !strings.HasPrefix(name, appRoot+"/") {
+				continue
+			}
+
+			relativePath = strings.TrimPrefix(name, appRoot+"/")
+		}
+
+		fileCount += 1
+		if fileCount > 1000 {
+			return errors.New("Too many files in the zip")
+		}
+
+		fullPath := filepath.Join(target, filepath.FromSlash(relativePath))
+		if !strings.HasPrefix(fullPath, filepath.Clean(target)+string(os.PathSeparator)) {
+			return fmt.Errorf("Invalid path %s in zip", item.Name)
+		}
+
+		err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+		if err != nil {
+			return err
+		}
+
+		reader, err := item.Open()
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Create(fullPath)
+		if err != nil {
+			reader.Close()
+			return err
+		}
+
+		// The header sizes can't be trusted, so the copy itself is capped
+		written, err := io.Copy(file, io.LimitReader(reader, maxUncompressed-totalSize+1))
+		reader.Close()
+		file.Close()
+		if err != nil {
+			return err
+		}
+
+		totalSize += written
+		if totalSize > maxUncompressed {
+			return errors.New("The zip is too large when uncompressed")
+		}
+	}
+
+	return nil
+}
+
+// Uploads a zipped app folder (api.yaml, Dockerfile, src/app.py), registers
+// it like the hotloader does and starts building its image
 func handleAppZipUpload(resp http.ResponseWriter, request *http.Request) {
 	cors := shuffle.HandleCors(resp, request)
 	if cors {
 		return
 	}
 
-	resp.WriteHeader(500)
-	resp.Write([]byte(`{"success": false, "reason": "The upload API is not yet implemented in self-hosted Shuffle. Please explore the app hotloading system: https://shuffler.io/docs/app_creation#uploading-an-app"}`))
-	return
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app upload: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to upload apps"}`))
+		return
+	}
+
+	maxSize, maxUncompressed := getAppUploadLimits()
+	request.Body = http.MaxBytesReader(resp, request.Body, maxSize+(1024*1024))
 
 	//https://stackoverflow.com/questions/22964950/http-request-formfile-handle-zip-files
-	request.ParseMultipartForm(32 << 20)
+	err = request.ParseMultipartForm(32 << 20)
+	if err != nil {
+		log.Printf("[WARNING] Failed parsing app upload: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed reading upload. Max size is %d bytes"}`, maxSize)))
+		return
+	}
+
 	f, _, err := request.FormFile("shuffle_file")
 	if err != nil {
 		log.Printf("[ERROR] Couldn't upload file: %s", err)
-		resp.WriteHeader(401)
+		resp.WriteHeader(400)
 		resp.Write([]byte(`{"success": false, "reason": "Failed uploading file. Correct usage is: shuffle_file=@filepath"}`))
 		return
 	}
+	defer f.Close()
+
+	buf := new(bytes.Buffer)
+	fileSize, err := io.Copy(buf, io.LimitReader(f, maxSize+1))
+	if err != nil || fileSize > maxSize {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Failed reading upload. Max size is %d bytes"}`, maxSize)))
+		return
+	}
+
+	zipdata, err := zip.NewReader(bytes.NewReader(buf.Bytes()), fileSize)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "The uploaded file is not a valid zip"}`))
+		return
+	}
 
-	fileSize, err := f.Seek(0, 2) //2 = from end
+	// Extracted below generated/ so Kaniko builds can reach it as well
+	target := filepath.Join("generated", "uploads", uuid.NewV4().String())
+	err = extractAppZip(zipdata, target, maxUncompressed)
 	if err != nil {
-		panic(err)
+		os.RemoveAll(target)
+		log.Printf("[WARNING] Failed extracting uploaded app: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+		return
 	}
-	_, err = f.Seek(0, 0)
+
+	appfileLocation := filepath.Join(target, "api.yaml")
+	appfileData, err := ioutil.ReadFile(appfileLocation)
 	if err != nil {
-		panic(err)
+		appfileLocation = filepath.Join(target, "api.yml")
+		appfileData, err = ioutil.ReadFile(appfileLocation)
+	}
+
+	appPythonData, pythonErr := ioutil.ReadFile(filepath.Join(target, "src", "app.py"))
+	dockerfileData, dockerErr := ioutil.ReadFile(filepath.Join(target, "Dockerfile"))
+	if err != nil || pythonErr != nil || dockerErr != nil {
+		os.RemoveAll(target)
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "The app folder must contain api.yaml, Dockerfile and src/app.py"}`))
+		return
+	}
+
+	contentHash := ""
+	appFs, err := shuffle.CreateFs("base", target)
+	if err == nil {
+		contentHash, err = getAppContentHash(appFs, "")
 	}
 
-	buf := new(bytes.Buffer)
-	fileSize, err = io.Copy(buf, f)
 	if err != nil {
-		panic(err)
+		combined := []byte{}
+		combined = append(combined, appfileData...)
+		combined = append(combined, appPythonData...)
+		combined = append(combined, dockerfileData...)
+		contentHash = md5sum(combined)
 	}
 
-	zipdata, err := zip.NewReader(bytes.NewReader(buf.Bytes()), fileSize)
+	var workflowapp shuffle.WorkflowApp
+	err = validateAppYaml(appfileLocation)
+	if err == nil {
+		err = gyaml.Unmarshal(appfileData, &workflowapp)
+	}
+
+	if err != nil {
+		os.RemoveAll(target)
+		log.Printf("[WARNING] Invalid api.yaml in uploaded app: %s", err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Invalid api.yaml: %s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	workflowapp = appendAppAuthParameters(workflowapp)
+
+	ctx := shuffle.GetContext(request)
+	allapps, err := shuffle.GetAllWorkflowApps(ctx, 0, 0)
 	if err != nil {
-		panic(err)
+		log.Printf("[WARNING] Failed getting apps to verify upload: %s", err)
 	}
 
-	// https://github.com/alexmullins/zip/blob/master/example_test.go
-	for _, item := range zipdata.File {
-		log.Printf("\n\nName: %s\n\n", item.FileHeader.Name)
-		log.Printf("item: %#v", item)
+	// Only replaces the same app uploaded earlier by the user in this org
+	for _, app := range allapps {
+		if app.ReferenceOrg != user.ActiveOrg.Id || app.Owner != user.Id {
+			continue
+		}
+
+		if app.Name == workflowapp.Name && app.AppVersion == workflowapp.AppVersion {
+			log.Printf("[WARNING] Removing duplicate app during upload: %s", app.ID)
+			err = shuffle.DeleteKey(ctx, "workflowapp", app.ID)
+			if err != nil {
+				log.Printf("[ERROR] Failed deleting duplicate %s: %s", app.ID, err)
+			}
+		}
+	}
+
+	workflowapp.ID = uuid.NewV4().String()
+	workflowapp.IsValid = true
+	workflowapp.Sharing = false
+	workflowapp.Downloaded = true
+	workflowapp.Hash = contentHash
+	workflowapp.Public = false
+	workflowapp.Owner = user.Id
+	workflowapp.ReferenceOrg = user.ActiveOrg.Id
+	workflowapp.Contributors = []string{user.Id}
+
+	err = shuffle.SetWorkflowAppDatastore(ctx, workflowapp, workflowapp.ID)
+	if err != nil {
+		os.RemoveAll(target)
+		log.Printf("[WARNING] Failed setting uploaded app: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving the app"}`))
+		return
+	}
+
+	cacheKey := fmt.Sprintf("workflowapps-sorted")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-100")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-500")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-1000")
+	shuffle.DeleteCache(ctx, cacheKey)
+	shuffle.DeleteCache(ctx, fmt.Sprintf("apps_%s", user.Id))
+
+	appName := strings.ToLower(strings.ReplaceAll(workflowapp.Name, " ", "-"))
+	dockerTags := []string{
+		fmt.Sprintf("%s:%s_%s", baseDockerName, appName, workflowapp.ID),
+		fmt.Sprintf("%s:%s_%s", baseDockerName, appName, workflowapp.AppVersion),
+	}
+
+	build := &AppBuild{
+		Id:         uuid.NewV4().String(),
+		AppId:      workflowapp.ID,
+		OrgId:      user.ActiveOrg.Id,
+		AppName:    workflowapp.Name,
+		AppVersion: workflowapp.AppVersion,
+		Tags:       dockerTags,
+		Hash:       contentHash,
+		Status:     "building",
+		Created:    time.Now().Unix(),
+	}
+	setAppBuild(ctx, build)
+
+	log.Printf("[AUDIT] User %s (%s) uploaded app %s:%s (%s). Starting build %s", user.Username, user.Id, workflowapp.Name, workflowapp.AppVersion, workflowapp.ID, build.Id)
+
+	go func() {
+		defer os.RemoveAll(target)
 
-		rr, err := item.Open()
+		ctx := context.Background()
+		err := buildImage(dockerTags, filepath.Join(target, "Dockerfile"), build)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("[ERROR] Failed building uploaded app %s: %s", workflowapp.ID, err)
+			return
 		}
 
-		_, err = io.Copy(os.Stdout, rr)
+		org, err := shuffle.GetOrg(ctx, user.ActiveOrg.Id)
 		if err != nil {
-			log.Fatal(err)
+			log.Printf("[ERROR] Failed getting org during upload build (%s): %s", user.ActiveOrg.Id, err)
+			return
 		}
-		rr.Close()
 
-	}
+		imagenames := []string{
+			fmt.Sprintf("%s_%s", workflowapp.Name, workflowapp.AppVersion),
+			fmt.Sprintf("%s_%s", workflowapp.Name, workflowapp.ID),
+		}
+
+		err = shuffle.DistributeAppToEnvironments(ctx, *org, imagenames)
+		if err != nil {
+			log.Printf("[ERROR] Failed distributing uploaded app to environments: %s", err)
+		}
+	}()
 
 	resp.WriteHeader(200)
-	resp.Write([]byte("OK"))
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "id": "%s", "build_id": "%s"}`, workflowapp.ID, build.Id)))
 }
 
 func initHandlers() {
@@ -5180,6 +5891,11 @@ func initHandlers() {
 	// Used by orborus
 	r.HandleFunc("/api/v1/workflows/queue", handleGetWorkflowqueue).Methods("GET", "POST")
 	r.HandleFunc("/api/v1/workflows/queue/confirm", handleGetWorkflowqueueConfirm).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/pipelines", handleGetQueuePipelines).Methods("GET")
+	r.HandleFunc("/api/v1/workflows/queue/results", handleOrborusJobResults).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/images", handleGetQueueImages).Methods("GET")
+	r.HandleFunc("/api/v1/workflows/queue/images", handleSetQueueImageCache).Methods("POST")
+	r.HandleFunc("/api/v1/workflows/queue/executions", handleGetQueueExecutionStatus).Methods("POST")
 
 	// App specific
 	// From here down isnt checked for org specific
@@ -5193,11 +5909,26 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/apps/{appId}/distribute", activateWorkflowAppDocker).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/frameworkConfiguration", shuffle.GetFrameworkConfiguration).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/frameworkConfiguration", shuffle.SetFrameworkConfiguration).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/egress_policies", handleAppEgressPolicies).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/{appId}", shuffle.UpdateWorkflowAppConfig).Methods("PATCH", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/{appId}", shuffle.DeleteWorkflowApp).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/{appId}/config", shuffle.GetWorkflowAppConfig).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/build", handleGetAppBuild).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/build/logs", handleGetAppBuild).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/{appId}/regenerate", handleRegenerateApp).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/run_hotload", handleAppHotloadRequest).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/{appName}/run_hotload", handleSingleAppHotloadRequest).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/bundle/export", handleExportAppBundle).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/bundle/import", handleImportAppBundle).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories", handleGetAppRepositories).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories", handleSetAppRepository).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories/{repoId}", handleGetAppRepositories).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories/{repoId}", handleSetAppRepository).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories/{repoId}", handleDeleteAppRepository).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/api/v1/apps/repositories/{repoId}/{action}", handleAppRepositoryAction).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/git/credentials", handleGetGitCredentials).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/git/credentials", handleSetGitCredential).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/git/credentials/{credentialId}", handleDeleteGitCredential).Methods("DELETE", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/get_existing", LoadSpecificApps).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/download_remote", LoadSpecificApps).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/apps/validate", validateAppInput).Methods("POST", "OPTIONS")
@@ -5232,6 +5963,11 @@ func initHandlers() {
 	/* Everything below here increases the counters*/
 	r.HandleFunc("/api/v1/workflows", checkLicenseMiddleware(shuffle.GetWorkflows, "")).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows", checkLicenseMiddleware(shuffle.SetNewWorkflow, "workflows")).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/git/config", handleWorkflowGitConfig).Methods("GET", "PUT", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/git/export", handleWorkflowGitSync).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/git/import", handleWorkflowGitSync).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/publish/requests", handleGetWorkflowPublishRequests).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/publish/requests/{requestId}/{action}", handleWorkflowPublishRequestAction).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/search", checkLicenseMiddleware(shuffle.HandleWorkflowRunSearch, "")).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/schedules", checkLicenseMiddleware(shuffle.HandleGetSchedules, "")).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/executions", shuffle.GetWorkflowExecutions).Methods("GET", "OPTIONS")
@@ -5247,7 +5983,7 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/workflows/{key}/stream", shuffle.HandleStreamWorkflowUpdate).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}/duplicate", shuffle.DuplicateWorkflow).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", deleteWorkflow).Methods("DELETE", "OPTIONS")
-	r.HandleFunc("/api/v1/workflows/{key}", shuffle.SaveWorkflow).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}", handleSaveWorkflow).Methods("PUT", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/{key}", shuffle.GetSpecificWorkflow).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/workflows/recommend", shuffle.HandleActionRecommendation).Methods("POST", "OPTIONS")
 
@@ -5312,6 +6048,7 @@ func initHandlers() {
 
 	// EVERYTHING below here is NEW for 0.8.0 (written 25.05.2021)
 	r.HandleFunc("/api/v1/workflows/{key}/publish", makeWorkflowPublic).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/workflows/{key}/publish/review", makeWorkflowPublic).Methods("POST", "OPTIONS")
 	r.HandleFunc("/api/v1/cloud/setup", handleCloudSetup).Methods("POST", "OPTIONS")
 	//r.HandleFunc("/api/v1/orgs", shuffle.HandleGetOrgs).Methods("GET", "OPTIONS")
 	//r.HandleFunc("/api/v1/orgs/", shuffle.HandleGetOrgs).Methods("GET", "OPTIONS")
@@ -5330,8 +6067,11 @@ func initHandlers() {
 	r.HandleFunc("/api/v1/setenvironments", shuffle.HandleSetEnvironments).Methods("PUT", "OPTIONS")
 	r.HandleFunc("/api/v1/environments/{key}/stop", shuffle.HandleStopExecutions).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/environments/{key}/rerun", shuffle.HandleRerunExecutions).Methods("GET", "POST", "OPTIONS")
-	r.HandleFunc("/api/v1/environments/{key}/stats", shuffle.HandleGetenvStats).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/environments/{key}/stats", handleGetEnvironmentStats).Methods("GET", "OPTIONS")
 	r.HandleFunc("/api/v1/environments/{key}/config", shuffle.HandleSetenvConfig).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/environments/{key}/jobs", handleGetEnvironmentJobs).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/v1/environments/{key}/jobs/{jobId}/retry", handleRetryEnvironmentJob).Methods("POST", "OPTIONS")
+	r.HandleFunc("/api/v1/environments/{key}/images", handleGetEnvironmentImageCache).Methods("GET", "POST", "OPTIONS")
 	r.HandleFunc("/api/v1/environments", shuffle.HandleGetEnvironments).Methods("GET", "OPTIONS")
 
 	r.HandleFunc("/api/v1/orgs/{orgId}/validate_app_values", shuffle.HandleKeyValueCheck).Methods("POST", "OPTIONS")
@@ -5408,6 +6148,19 @@ func initHandlers() {
 
 // Had to move away from mux, which means Method is fucked up right now.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "bundle" {
+		os.Exit(runAppBundleCli(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "relay" {
+		os.Exit(runSyncRelay())
+	}
+
+	// E.g. a self-hosted relay started with "relay"
+	if len(os.Getenv("SHUFFLE_CLOUD_SYNC_URL")) > 0 {
+		syncUrl = strings.TrimSuffix(os.Getenv("SHUFFLE_CLOUD_SYNC_URL"), "/")
+		log.Printf("[INFO] Using %s for cloud sync (env: SHUFFLE_CLOUD_SYNC_URL)", syncUrl)
+	}
 
 	initHandlers()
 	hostname, err := os.Hostname()
@@ -1,3 +1,10 @@
+//go:build integration
+// +build integration
+
+// These tests need a database. Start the emulator with
+// "docker-compose up database", and run them with
+// DATASTORE_EMULATOR_HOST=0.0.0.0:8000 go test -tags integration
+
 package main
 
 import (
@@ -58,10 +65,10 @@ func TestAuthenticationRequired(t *testing.T) {
 		{handler: shuffle.HandleGetEnvironments, path: "/api/v1/getenvironments", method: "GET"},
 		{handler: shuffle.HandleSetEnvironments, path: "/api/v1/setenvironments", method: "PUT"},
 
-		// handleWorkflowQueue generates nil pointer exception
-		//{handler: handleWorkflowQueue, path: "/api/v1/streams", method: "POST"},
-		// handleGetStreamResults generates nil pointer exception
-		//{handler: handleGetStreamResults, path: "/api/v1/streams/results", method: "POST"},
+		// handleSetWorkflowExecution generates nil pointer exception
+		//{handler: handleSetWorkflowExecution, path: "/api/v1/streams", method: "POST"},
+		// handleGetWorkflowExecutionResult generates nil pointer exception
+		//{handler: handleGetWorkflowExecutionResult, path: "/api/v1/streams/results", method: "POST"},
 
 		{handler: handleAppHotloadRequest, path: "/api/v1/apps/run_hotload", method: "GET"},
 		{handler: LoadSpecificApps, path: "/api/v1/apps/get_existing", method: "POST"},
@@ -130,7 +137,7 @@ func TestAuthenticationRequired(t *testing.T) {
 	//   docker-compose up database
 	// To let the tests know about the database, run:
 	//   DATASTORE_EMULATOR_HOST=0.0.0.0:8000 go test
-	dbclient, err = datastore.NewClient(ctx, gceProject, option.WithGRPCDialOption(grpc.WithNoProxy()))
+	_, err = datastore.NewClient(ctx, gceProject, option.WithGRPCDialOption(grpc.WithNoProxy()))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -165,7 +172,7 @@ func TestAuthenticationNotRequired(t *testing.T) {
 		{handler: shuffle.HandleLogout, path: "/api/v1/users/logout", method: "POST"},
 		{handler: shuffle.GetDocList, path: "/api/v1/docs", method: "GET"},
 		{handler: shuffle.GetDocs, path: "/api/v1/docs/123", method: "GET"},
-		{handler: healthCheckHandler, path: "/api/v1/_ah/health"},
+		{handler: shuffle.HealthCheckHandler, path: "/api/v1/_ah/health"},
 	}
 
 	for _, e := range handlers {
@@ -198,7 +205,7 @@ func TestAuthenticationNotRequired(t *testing.T) {
 // requirements might change after the refactor.
 func TestCors(t *testing.T) {
 	handlers := []endpoint{
-		{handler: handleLogin, path: "/api/v1/users/login", method: "POST"}, // prob not this one
+		{handler: shuffle.HandleLogin, path: "/api/v1/users/login", method: "POST"}, // prob not this one
 
 		{handler: shuffle.HandleNewOutlookRegister, path: "/functions/outlook/register", method: "GET"},
 		{handler: shuffle.HandleGetOutlookFolders, path: "/functions/outlook/getFolders", method: "GET"},
@@ -216,10 +223,10 @@ func TestCors(t *testing.T) {
 		{handler: shuffle.HandleGetEnvironments, path: "/api/v1/getenvironments", method: "GET"},
 		{handler: shuffle.HandleSetEnvironments, path: "/api/v1/setenvironments", method: "PUT"},
 
-		// handleWorkflowQueue generates nil pointer exception
-		{handler: handleWorkflowQueue, path: "/api/v1/streams", method: "POST"},
-		// handleGetStreamResults generates nil pointer exception
-		{handler: handleGetStreamResults, path: "/api/v1/streams/results", method: "POST"},
+		// handleSetWorkflowExecution generates nil pointer exception
+		{handler: handleSetWorkflowExecution, path: "/api/v1/streams", method: "POST"},
+		// handleGetWorkflowExecutionResult generates nil pointer exception
+		{handler: handleGetWorkflowExecutionResult, path: "/api/v1/streams/results", method: "POST"},
 
 		{handler: handleAppHotloadRequest, path: "/api/v1/apps/run_hotload", method: "GET"},
 		{handler: LoadSpecificApps, path: "/api/v1/apps/get_existing", method: "POST"},
@@ -267,8 +274,8 @@ func TestCors(t *testing.T) {
 
 		{handler: verifySwagger, path: "/api/v1/verify_swagger", method: "POST"},
 		{handler: verifySwagger, path: "/api/v1/verify_openapi", method: "POST"},
-		{handler: echoOpenapiData, path: "/api/v1/get_openapi_uri", method: "POST"},
-		{handler: echoOpenapiData, path: "/api/v1/validate_openapi", method: "POST"},
+		{handler: shuffle.EchoOpenapiData, path: "/api/v1/get_openapi_uri", method: "POST"},
+		{handler: shuffle.EchoOpenapiData, path: "/api/v1/validate_openapi", method: "POST"},
 		{handler: shuffle.ValidateSwagger, path: "/api/v1/validate_openapi", method: "POST"},
 		{handler: getOpenapi, path: "/api/v1/get_openapi", method: "GET"},
 
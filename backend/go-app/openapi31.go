@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/frikky/kin-openapi/openapi3"
+	gyaml "github.com/ghodss/yaml"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// The OpenAPI loader and app generator only understand OpenAPI 3.0.
+// OpenAPI 3.1 uses JSON Schema 2020-12, so its schemas are rewritten to
+// the closest 3.0 form. The webhooks section has no 3.0 equivalent, and is
+// kept as x-webhooks.
+func isOpenApi31(version string) bool {
+	return strings.HasPrefix(version, "3.1")
+}
+
+func convertOpenApi31(body []byte) ([]byte, error) {
+	jsonBody, err := gyaml.YAMLToJSON(body)
+	if err != nil {
+		return body, err
+	}
+
+	spec := map[string]interface{}{}
+	err = json.Unmarshal(jsonBody, &spec)
+	if err != nil {
+		return body, err
+	}
+
+	spec["openapi"] = "3.0.3"
+	delete(spec, "jsonSchemaDialect")
+	if webhooks, ok := spec["webhooks"]; ok {
+		spec["x-webhooks"] = webhooks
+		delete(spec, "webhooks")
+	}
+
+	// Paths are optional in 3.1, e.g. for webhook only APIs
+	if _, ok := spec["paths"]; !ok {
+		spec["paths"] = map[string]interface{}{}
+	}
+
+	if info, ok := spec["info"].(map[string]interface{}); ok {
+		delete(info, "summary")
+		if license, ok := info["license"].(map[string]interface{}); ok {
+			delete(license, "identifier")
+		}
+	}
+
+	for key, value := range spec {
+		spec[key] = convertJsonSchema2020(value)
+	}
+
+	return json.Marshal(spec)
+}
+
+// Keywords are only rewritten when their value has the 3.1 shape, so
+// properties which happen to be named e.g. "type" are left alone
+func convertJsonSchema2020(value interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case []interface{}:
+		for index, item := range typedValue {
+			typedValue[index] = convertJsonSchema2020(item)
+		}
+
+		return typedValue
+	case map[string]interface{}:
+		if types, ok := typedValue["type"].([]interface{}); ok {
+			schemaTypes := []string{}
+			for _, schemaType := range types {
+				if schemaType == "null" {
+					typedValue["nullable"] = true
+				} else if stringType, ok := schemaType.(string); ok {
+					schemaTypes = append(schemaTypes, stringType)
+				}
+			}
+
+			delete(typedValue, "type")
+			if len(schemaTypes) == 1 {
+				typedValue["type"] = schemaTypes[0]
+			} else if len(schemaTypes) > 1 {
+				if _, ok := typedValue["anyOf"]; !ok {
+					anyOf := []interface{}{}
+					for _, schemaType := range schemaTypes {
+						anyOf = append(anyOf, map[string]interface{}{"type": schemaType})
+					}
+
+					typedValue["anyOf"] = anyOf
+				}
+			}
+		}
+
+		for _, limit := range []string{"Minimum", "Maximum"} {
+			exclusiveKey := fmt.Sprintf("exclusive%s", limit)
+			if number, ok := typedValue[exclusiveKey].(float64); ok {
+				typedValue[strings.ToLower(limit)] = number
+				typedValue[exclusiveKey] = true
+			}
+		}
+
+		if constValue, ok := typedValue["const"]; ok {
+			if _, isMap := constValue.(map[string]interface{}); !isMap {
+				if _, hasEnum := typedValue["enum"]; !hasEnum {
+					typedValue["enum"] = []interface{}{constValue}
+				}
+
+				delete(typedValue, "const")
+			}
+		}
+
+		// Examples are a list in JSON Schema, and a map of example objects
+		// elsewhere in OpenAPI
+		if examples, ok := typedValue["examples"].([]interface{}); ok {
+			if _, hasExample := typedValue["example"]; !hasExample && len(examples) > 0 {
+				typedValue["example"] = examples[0]
+			}
+
+			delete(typedValue, "examples")
+		}
+
+		for _, keyword := range []string{"$schema", "$id", "$anchor", "$comment", "$dynamicRef", "$dynamicAnchor"} {
+			delete(typedValue, keyword)
+		}
+
+		for key, item := range typedValue {
+			typedValue[key] = convertJsonSchema2020(item)
+		}
+
+		return typedValue
+	}
+
+	return value
+}
+
+// Lists the webhook events of a converted 3.1 spec in the app
+// documentation, and marks the app as usable with the generic Webhook
+// trigger. Apps can't hold trigger definitions, so no trigger is made per
+// event. The URL of a Webhook trigger has to be registered in the API.
+func addOpenApiWebhooks(api *shuffle.WorkflowApp, swagger *openapi3.Swagger) {
+	rawWebhooks, ok := swagger.ExtensionProps.Extensions["x-webhooks"]
+	if !ok {
+		return
+	}
+
+	webhookData, err := json.Marshal(rawWebhooks)
+	if err != nil {
+		return
+	}
+
+	// json.RawMessage is marshalled as is
+	webhooks := map[string]map[string]interface{}{}
+	err = json.Unmarshal(webhookData, &webhooks)
+	if err != nil || len(webhooks) == 0 {
+		return
+	}
+
+	names := []string{}
+	for name := range webhooks {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	documentation := "\n\n## Webhooks\nThis API can send the events below. They aren't set up automatically. To receive one, add a Webhook trigger to a workflow and register the trigger URL for the event in the API.\n"
+	for _, name := range names {
+		for _, method := range []string{"post", "put", "patch", "get", "delete"} {
+			operation, ok := webhooks[name][method].(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			summary, _ := operation["summary"].(string)
+			if len(summary) == 0 {
+				summary, _ = operation["description"].(string)
+			}
+
+			documentation += fmt.Sprintf("- **%s** (%s): %s\n", name, strings.ToUpper(method), strings.TrimSpace(summary))
+		}
+	}
+
+	if !shuffle.ArrayContains(api.ReferenceInfo.Triggers, "webhook") {
+		api.ReferenceInfo.Triggers = append(api.ReferenceInfo.Triggers, "webhook")
+	}
+
+	api.Documentation += documentation
+}
+
+func getOpenApiVersion(body []byte) string {
+	type versionCheck struct {
+		OpenAPI string `json:"openapi" yaml:"openapi"`
+	}
+
+	var version versionCheck
+	jsonBody, err := gyaml.YAMLToJSON(body)
+	if err != nil {
+		return ""
+	}
+
+	json.Unmarshal(jsonBody, &version)
+	return version.OpenAPI
+}
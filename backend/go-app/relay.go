@@ -0,0 +1,914 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// A self-hosted stand-in for the cloud sync at shuffler.io. It speaks the
+// same CloudSyncJob protocol (setup, job polling and handle_action), and
+// delivers user input mails and SMS through your own SMTP server and SMS
+// gateway. Run it with "<binary> relay", and point the backend at it with
+// SHUFFLE_CLOUD_SYNC_URL.
+//
+// Outlook triggers work by setting SHUFFLE_CLOUDRUN_URL to the public URL
+// of the relay, so Microsoft Graph sends its notifications here. They are
+// only queued for the org which started the trigger, and the backend checks
+// the subscription ID of each notification. Gmail notifications go through
+// Google Pub/Sub, which can't reach the relay. Instead the relay asks the
+// backend of the org to poll the Gmail history of each started trigger
+// every SHUFFLE_RELAY_GMAIL_INTERVAL seconds (default 60).
+//
+// Answer links, trigger routes and queued jobs are kept in
+// SHUFFLE_RELAY_STATE_FILE (default relay_state.json), so they survive a
+// restart.
+//
+// With SHUFFLE_RELAY_DELIVERY=stub nothing is sent. Mails and SMS are kept
+// in an outbox instead, which together with the job endpoint makes the
+// relay testable without any external service.
+type RelayDelivery struct {
+	Type    string   `json:"type"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject,omitempty"`
+	Body    string   `json:"body"`
+	Created int64    `json:"created"`
+}
+
+type relayDeliverer interface {
+	SendMail(to []string, subject, body string) error
+	SendSms(to, message string) error
+}
+
+type relayUserInput struct {
+	SessionKey string               `json:"session_key"`
+	Job        shuffle.CloudSyncJob `json:"job"`
+	Created    int64                `json:"created"`
+}
+
+// The org session a trigger was started from
+type relayHook struct {
+	SessionKey string `json:"session_key"`
+	OrgId      string `json:"org_id"`
+	Type       string `json:"type"`
+	WorkflowId string `json:"workflow_id"`
+	Created    int64  `json:"created"`
+}
+
+type relayState struct {
+	Queues     map[string][]shuffle.CloudSyncJob `json:"queues"`
+	Unrouted   []shuffle.CloudSyncJob            `json:"unrouted"`
+	UserInputs map[string]relayUserInput         `json:"user_inputs"`
+	Hooks      map[string]relayHook              `json:"hooks"`
+}
+
+type SyncRelay struct {
+	sync.Mutex
+
+	ApiKey        string
+	PublicUrl     string
+	Interval      int64
+	GmailInterval int64
+	Deliverer     relayDeliverer
+
+	// Not kept across restarts if empty
+	StateFile string
+
+	queues     map[string][]shuffle.CloudSyncJob
+	unrouted   []shuffle.CloudSyncJob
+	userInputs map[string]relayUserInput
+	hooks      map[string]relayHook
+}
+
+// Sends through SHUFFLE_RELAY_SMTP_* and SHUFFLE_RELAY_SMS_*
+type relaySmtpDeliverer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	SmsUrl   string
+	SmsAuth  string
+}
+
+func (deliverer *relaySmtpDeliverer) SendMail(to []string, subject, body string) error {
+	if len(deliverer.Host) == 0 {
+		return errors.New("No SMTP server configured (SHUFFLE_RELAY_SMTP_HOST)")
+	}
+
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s\r\n", deliverer.From, strings.Join(to, ", "), subject, body)
+
+	var auth smtp.Auth
+	if len(deliverer.Username) > 0 {
+		auth = smtp.PlainAuth("", deliverer.Username, deliverer.Password, deliverer.Host)
+	}
+
+	return smtp.SendMail(fmt.Sprintf("%s:%s", deliverer.Host, deliverer.Port), auth, deliverer.From, to, []byte(message))
+}
+
+// The gateway gets a JSON POST with "to" and "message"
+func (deliverer *relaySmtpDeliverer) SendSms(to, message string) error {
+	if len(deliverer.SmsUrl) == 0 {
+		return errors.New("No SMS gateway configured (SHUFFLE_RELAY_SMS_URL)")
+	}
+
+	data, err := json.Marshal(map[string]string{
+		"to":      to,
+		"message": message,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", deliverer.SmsUrl, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	if len(deliverer.SmsAuth) > 0 {
+		req.Header.Add("Authorization", deliverer.SmsAuth)
+	}
+
+	client := shuffle.GetExternalClient(deliverer.SmsUrl)
+	newresp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer newresp.Body.Close()
+	if newresp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(newresp.Body)
+		return errors.New(fmt.Sprintf("SMS gateway returned status %d: %s", newresp.StatusCode, string(respBody)))
+	}
+
+	return nil
+}
+
+// Keeps deliveries in memory instead of sending them
+type relayStubDeliverer struct {
+	sync.Mutex
+	Outbox []RelayDelivery
+}
+
+func (deliverer *relayStubDeliverer) SendMail(to []string, subject, body string) error {
+	deliverer.Lock()
+	defer deliverer.Unlock()
+
+	deliverer.Outbox = append(deliverer.Outbox, RelayDelivery{Type: "email", To: to, Subject: subject, Body: body, Created: time.Now().Unix()})
+	return nil
+}
+
+func (deliverer *relayStubDeliverer) SendSms(to, message string) error {
+	deliverer.Lock()
+	defer deliverer.Unlock()
+
+	deliverer.Outbox = append(deliverer.Outbox, RelayDelivery{Type: "sms", To: []string{to}, Body: message, Created: time.Now().Unix()})
+	return nil
+}
+
+func newSyncRelay() (*SyncRelay, error) {
+	relay := &SyncRelay{
+		ApiKey:        os.Getenv("SHUFFLE_RELAY_API_KEY"),
+		PublicUrl:     strings.TrimSuffix(os.Getenv("SHUFFLE_RELAY_PUBLIC_URL"), "/"),
+		Interval:      15,
+		GmailInterval: 60,
+		StateFile:     os.Getenv("SHUFFLE_RELAY_STATE_FILE"),
+		queues:        map[string][]shuffle.CloudSyncJob{},
+		userInputs:    map[string]relayUserInput{},
+		hooks:         map[string]relayHook{},
+	}
+
+	if len(relay.ApiKey) == 0 {
+		return relay, errors.New("SHUFFLE_RELAY_API_KEY has to be set")
+	}
+
+	if len(relay.StateFile) == 0 {
+		relay.StateFile = "relay_state.json"
+	}
+
+	err := relay.loadState()
+	if err != nil {
+		return relay, fmt.Errorf("Failed loading relay state from %s: %s", relay.StateFile, err)
+	}
+
+	if len(relay.PublicUrl) == 0 {
+		relay.PublicUrl = fmt.Sprintf("http://localhost:%s", getRelayPort())
+	}
+
+	if len(os.Getenv("SHUFFLE_RELAY_INTERVAL")) > 0 {
+		interval, err := strconv.ParseInt(os.Getenv("SHUFFLE_RELAY_INTERVAL"), 10, 64)
+		if err == nil && interval > 0 {
+			relay.Interval = interval
+		}
+	}
+
+	if len(os.Getenv("SHUFFLE_RELAY_GMAIL_INTERVAL")) > 0 {
+		interval, err := strconv.ParseInt(os.Getenv("SHUFFLE_RELAY_GMAIL_INTERVAL"), 10, 64)
+		if err == nil && interval > 0 {
+			relay.GmailInterval = interval
+		}
+	}
+
+	if strings.ToLower(os.Getenv("SHUFFLE_RELAY_DELIVERY")) == "stub" {
+		relay.Deliverer = &relayStubDeliverer{}
+		return relay, nil
+	}
+
+	smtpPort := os.Getenv("SHUFFLE_RELAY_SMTP_PORT")
+	if len(smtpPort) == 0 {
+		smtpPort = "587"
+	}
+
+	relay.Deliverer = &relaySmtpDeliverer{
+		Host:     os.Getenv("SHUFFLE_RELAY_SMTP_HOST"),
+		Port:     smtpPort,
+		Username: os.Getenv("SHUFFLE_RELAY_SMTP_USERNAME"),
+		Password: os.Getenv("SHUFFLE_RELAY_SMTP_PASSWORD"),
+		From:     os.Getenv("SHUFFLE_RELAY_SMTP_FROM"),
+		SmsUrl:   os.Getenv("SHUFFLE_RELAY_SMS_URL"),
+		SmsAuth:  os.Getenv("SHUFFLE_RELAY_SMS_AUTH"),
+	}
+
+	return relay, nil
+}
+
+func getRelayPort() string {
+	port := os.Getenv("SHUFFLE_RELAY_PORT")
+	if len(port) == 0 {
+		port = "5002"
+	}
+
+	return port
+}
+
+func getRelayToken() string {
+	tokenBytes := make([]byte, 16)
+	rand.Read(tokenBytes)
+	return hex.EncodeToString(tokenBytes)
+}
+
+func (relay *SyncRelay) loadState() error {
+	if len(relay.StateFile) == 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(relay.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state := relayState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	relay.Lock()
+	defer relay.Unlock()
+
+	if state.Queues != nil {
+		relay.queues = state.Queues
+	}
+
+	if state.UserInputs != nil {
+		relay.userInputs = state.UserInputs
+	}
+
+	if state.Hooks != nil {
+		relay.hooks = state.Hooks
+	}
+
+	relay.unrouted = state.Unrouted
+	return nil
+}
+
+// Has to be called with the relay locked. The file is replaced in one
+// rename, so a crash can't leave half of it behind.
+func (relay *SyncRelay) saveState() {
+	if len(relay.StateFile) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(relayState{
+		Queues:     relay.queues,
+		Unrouted:   relay.unrouted,
+		UserInputs: relay.userInputs,
+		Hooks:      relay.hooks,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling relay state: %s", err)
+		return
+	}
+
+	tmpFile := fmt.Sprintf("%s.tmp", relay.StateFile)
+	err = ioutil.WriteFile(tmpFile, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, relay.StateFile)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed saving relay state to %s: %s", relay.StateFile, err)
+	}
+}
+
+// Session keys are signed with the relay API key, so they stay valid
+// across restarts without storing them
+func (relay *SyncRelay) signSession(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(relay.ApiKey))
+	mac.Write([]byte(nonce))
+	return hex.EncodeToString(mac.Sum(nil))[0:32]
+}
+
+func (relay *SyncRelay) newSessionKey() string {
+	nonce := getRelayToken()
+	return fmt.Sprintf("%s.%s", nonce, relay.signSession(nonce))
+}
+
+func (relay *SyncRelay) isValidSession(sessionKey string) bool {
+	keyParts := strings.Split(sessionKey, ".")
+	if len(keyParts) != 2 || len(keyParts[0]) == 0 {
+		return false
+	}
+
+	return hmac.Equal([]byte(keyParts[1]), []byte(relay.signSession(keyParts[0])))
+}
+
+func (relay *SyncRelay) isValidApiKey(apikey string) bool {
+	return len(apikey) > 0 && subtle.ConstantTimeCompare([]byte(apikey), []byte(relay.ApiKey)) == 1
+}
+
+func getRelayBearer(request *http.Request) string {
+	return strings.TrimSpace(strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer "))
+}
+
+// Jobs without a session go to the next org which polls. Only jobs queued
+// through /api/v1/relay/jobs with the relay API key can be unrouted.
+func (relay *SyncRelay) enqueue(sessionKey string, job shuffle.CloudSyncJob) {
+	relay.Lock()
+	defer relay.Unlock()
+
+	job.Created = strconv.FormatInt(time.Now().Unix(), 10)
+	if len(sessionKey) == 0 {
+		relay.unrouted = append(relay.unrouted, job)
+	} else {
+		relay.queues[sessionKey] = append(relay.queues[sessionKey], job)
+	}
+
+	relay.saveState()
+}
+
+func (relay *SyncRelay) dequeue(sessionKey string) []shuffle.CloudSyncJob {
+	relay.Lock()
+	defer relay.Unlock()
+
+	jobs := append(relay.queues[sessionKey], relay.unrouted...)
+	if len(jobs) == 0 {
+		return []shuffle.CloudSyncJob{}
+	}
+
+	delete(relay.queues, sessionKey)
+	relay.unrouted = []shuffle.CloudSyncJob{}
+	relay.saveState()
+	return jobs
+}
+
+func (relay *SyncRelay) getSyncFeatures() shuffle.SyncFeatures {
+	startDate := time.Now().Unix()
+	return shuffle.SyncFeatures{
+		UserInput:    shuffle.SyncData{Active: true, Type: "trigger", Name: "User Input", StartDate: startDate},
+		SendMail:     shuffle.SyncData{Active: true, Type: "action", Name: "Send Email", StartDate: startDate},
+		SendSms:      shuffle.SyncData{Active: true, Type: "action", Name: "Send SMS", StartDate: startDate},
+		EmailTrigger: shuffle.SyncData{Active: true, Type: "action", Name: "Email Trigger", StartDate: startDate},
+	}
+}
+
+func writeRelayResponse(resp http.ResponseWriter, status int, data interface{}) {
+	newjson, err := json.Marshal(data)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling response"}`))
+		return
+	}
+
+	resp.WriteHeader(status)
+	resp.Write(newjson)
+}
+
+func (relay *SyncRelay) handleSetup(resp http.ResponseWriter, request *http.Request) {
+	type requestStruct struct {
+		ApiKey string `json:"api_key"`
+	}
+
+	var requestData requestStruct
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &requestData)
+	}
+
+	if err != nil || !relay.isValidApiKey(requestData.ApiKey) {
+		log.Printf("[WARNING] Relay setup with bad API key from %s", request.RemoteAddr)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad apikey"}`))
+		return
+	}
+
+	log.Printf("[INFO] New org sync session set up through the relay")
+	writeRelayResponse(resp, 200, retStruct{
+		Success:         true,
+		SyncFeatures:    relay.getSyncFeatures(),
+		SessionKey:      relay.newSessionKey(),
+		IntervalSeconds: relay.Interval,
+	})
+}
+
+func (relay *SyncRelay) handleGetAccess(resp http.ResponseWriter, request *http.Request) {
+	if !relay.isValidSession(getRelayBearer(request)) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad apikey"}`))
+		return
+	}
+
+	writeRelayResponse(resp, 200, retStruct{
+		Success:      true,
+		SyncFeatures: relay.getSyncFeatures(),
+	})
+}
+
+func (relay *SyncRelay) handleStop(resp http.ResponseWriter, request *http.Request) {
+	sessionKey := getRelayBearer(request)
+	if !relay.isValidSession(sessionKey) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad apikey"}`))
+		return
+	}
+
+	relay.Lock()
+	delete(relay.queues, sessionKey)
+	for triggerId, hook := range relay.hooks {
+		if hook.SessionKey == sessionKey {
+			delete(relay.hooks, triggerId)
+		}
+	}
+
+	relay.saveState()
+	relay.Unlock()
+
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true, "reason": "Stopped syncing"}`))
+}
+
+// Polled by remoteOrgJobHandler. Backups in the body are ignored, as they
+// would only be stored by the cloud.
+func (relay *SyncRelay) handleSync(resp http.ResponseWriter, request *http.Request) {
+	sessionKey := getRelayBearer(request)
+	if !relay.isValidSession(sessionKey) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad apikey"}`))
+		return
+	}
+
+	type syncResponse struct {
+		Success bool                   `json:"success"`
+		Reason  string                 `json:"reason"`
+		Jobs    []shuffle.CloudSyncJob `json:"jobs"`
+	}
+
+	jobs := relay.dequeue(sessionKey)
+	writeRelayResponse(resp, 200, syncResponse{
+		Success: true,
+		Reason:  fmt.Sprintf("%d job(s)", len(jobs)),
+		Jobs:    jobs,
+	})
+}
+
+// Answer links point back to the relay, which queues the continue or
+// stop job for the org that sent the user input. The job ID is the single
+// use token the backend issued for the input, and is sent back with the
+// answer.
+func (relay *SyncRelay) getUserInputLinks(sessionKey string, job shuffle.CloudSyncJob) (string, string) {
+	token := getRelayToken()
+
+	relay.Lock()
+	relay.userInputs[token] = relayUserInput{
+		SessionKey: sessionKey,
+		Job:        job,
+		Created:    time.Now().Unix(),
+	}
+	relay.saveState()
+	relay.Unlock()
+
+	link := fmt.Sprintf("%s/api/v1/relay/user_input/%s", relay.PublicUrl, token)
+	return fmt.Sprintf("%s?answer=true", link), fmt.Sprintf("%s?answer=false", link)
+}
+
+func (relay *SyncRelay) handleAction(resp http.ResponseWriter, request *http.Request) {
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	job := shuffle.CloudSyncJob{}
+	err = json.Unmarshal(body, &job)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling job"}`))
+		return
+	}
+
+	// Sent by runInitCloudSetup before any org is set up
+	if job.Type == "setup" && job.Action == "init" {
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	sessionKey := getRelayBearer(request)
+	if !relay.isValidSession(sessionKey) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Bad apikey"}`))
+		return
+	}
+
+	log.Printf("[INFO] Relay handling action %s for type %s in org %s", job.Action, job.Type, job.OrgId)
+	if job.Type == "user_input" && (job.Action == "send_email" || job.Action == "send_sms") {
+		recipients := []string{}
+		for _, recipient := range strings.Split(job.FourthItem, ",") {
+			recipient = strings.TrimSpace(recipient)
+			if len(recipient) > 0 && !strings.ContainsAny(recipient, "\r\n") {
+				recipients = append(recipients, recipient)
+			}
+		}
+
+		if len(recipients) == 0 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "No recipients"}`))
+			return
+		}
+
+		continueLink, stopLink := relay.getUserInputLinks(sessionKey, job)
+		if job.Action == "send_email" {
+			message := fmt.Sprintf("A workflow is waiting for your input.\n\n%s\n\nContinue: %s\nStop: %s\n", job.ThirdItem, continueLink, stopLink)
+			err = relay.Deliverer.SendMail(recipients, "Shuffle: Action required", message)
+		} else {
+			message := fmt.Sprintf("Shuffle: %s\nContinue: %s\nStop: %s", job.ThirdItem, continueLink, stopLink)
+			for _, recipient := range recipients {
+				err = relay.Deliverer.SendSms(recipient, message)
+				if err != nil {
+					break
+				}
+			}
+		}
+
+		if err != nil {
+			log.Printf("[WARNING] Relay failed %s for workflow %s: %s", job.Action, job.PrimaryItemId, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+			return
+		}
+
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	// Routes the notifications of an Outlook trigger, or the polls of a
+	// Gmail trigger, to this session
+	if (job.Type == "outlook" || job.Type == "gmail") && (job.Action == "start" || job.Action == "stop") && len(job.PrimaryItemId) > 0 {
+		relay.Lock()
+		hook, found := relay.hooks[job.PrimaryItemId]
+		if found && hook.OrgId != job.OrgId {
+			relay.Unlock()
+			resp.WriteHeader(403)
+			resp.Write([]byte(`{"success": false, "reason": "The trigger belongs to another org"}`))
+			return
+		}
+
+		if job.Action == "start" {
+			relay.hooks[job.PrimaryItemId] = relayHook{
+				SessionKey: sessionKey,
+				OrgId:      job.OrgId,
+				Type:       job.Type,
+				WorkflowId: job.ThirdItem,
+				Created:    time.Now().Unix(),
+			}
+		} else {
+			delete(relay.hooks, job.PrimaryItemId)
+		}
+
+		relay.saveState()
+		relay.Unlock()
+
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+		return
+	}
+
+	resp.WriteHeader(400)
+	resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s %s isn't available through the relay"}`, job.Type, job.Action)))
+}
+
+// Finds an answer link that hasn't expired, and cleans up expired ones
+func (relay *SyncRelay) getUserInput(token string, remove bool) (relayUserInput, bool) {
+	relay.Lock()
+	defer relay.Unlock()
+
+	userInput, ok := relay.userInputs[token]
+	if remove {
+		delete(relay.userInputs, token)
+	}
+
+	for key, value := range relay.userInputs {
+		if value.Created < time.Now().Unix()-7*24*60*60 {
+			delete(relay.userInputs, key)
+		}
+	}
+	relay.saveState()
+
+	if !ok || userInput.Created < time.Now().Unix()-7*24*60*60 {
+		return userInput, false
+	}
+
+	return userInput, true
+}
+
+// Links are single use, and expire after a week. Opening a link only shows
+// a confirmation page, as mail scanners and link previews open them too.
+// The answer is recorded when the page is submitted.
+func (relay *SyncRelay) handleUserInputAnswer(resp http.ResponseWriter, request *http.Request) {
+	location := strings.Split(request.URL.Path, "/")
+	token := location[len(location)-1]
+
+	answer := request.FormValue("answer")
+	if answer != "true" && answer != "false" {
+		resp.WriteHeader(400)
+		resp.Write([]byte("The link is missing the answer."))
+		return
+	}
+
+	action := "stop"
+	if answer == "true" {
+		action = "continue"
+	}
+
+	if request.Method != "POST" {
+		_, ok := relay.getUserInput(token, false)
+		if !ok {
+			resp.WriteHeader(404)
+			resp.Write([]byte("This link has expired or was already used."))
+			return
+		}
+
+		resp.Header().Set("Content-Type", "text/html; charset=utf-8")
+		resp.WriteHeader(200)
+		resp.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<body>
+<p>A workflow is waiting for your input.</p>
+<form method="POST">
+<input type="hidden" name="answer" value="%s">
+<button type="submit">Confirm: %s the workflow</button>
+</form>
+</body>
+</html>`, answer, action)))
+		return
+	}
+
+	userInput, ok := relay.getUserInput(token, true)
+	if !ok {
+		resp.WriteHeader(404)
+		resp.Write([]byte("This link has expired or was already used."))
+		return
+	}
+
+	relay.enqueue(userInput.SessionKey, shuffle.CloudSyncJob{
+		Id:            getRelayToken(),
+		Type:          "user_input",
+		Action:        action,
+		OrgId:         userInput.Job.OrgId,
+		PrimaryItemId: userInput.Job.PrimaryItemId,
+		SecondaryItem: userInput.Job.SecondaryItem,
+		ThirdItem:     userInput.Job.FifthItem,
+		FourthItem:    userInput.Job.Id,
+	})
+
+	log.Printf("[INFO] Relay queued user input %s for workflow %s", action, userInput.Job.PrimaryItemId)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf("Your answer was recorded. The workflow will %s shortly.", action)))
+}
+
+// Receives Microsoft Graph notifications for Outlook triggers, and queues
+// them for the session which started the trigger
+func (relay *SyncRelay) handleHook(resp http.ResponseWriter, request *http.Request) {
+	location := strings.Split(request.URL.Path, "/")
+	hookId := strings.TrimPrefix(location[len(location)-1], "webhook_")
+
+	relay.Lock()
+	hook, found := relay.hooks[hookId]
+	relay.Unlock()
+
+	if !found || hook.Type != "outlook" || !relay.isValidSession(hook.SessionKey) {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Unknown trigger"}`))
+		return
+	}
+
+	validationToken := request.URL.Query().Get("validationToken")
+	if len(validationToken) > 0 {
+		resp.Header().Set("Content-Type", "text/plain")
+		resp.WriteHeader(200)
+		resp.Write([]byte(validationToken))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	maildata := shuffle.MailDataOutlook{}
+	err = json.Unmarshal(body, &maildata)
+	if err != nil || len(maildata.Value) == 0 || maildata.Value[0].Clientstate != "Shuffle subscription" {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Only Outlook notifications are handled by the relay"}`))
+		return
+	}
+
+	relay.enqueue(hook.SessionKey, shuffle.CloudSyncJob{
+		Id:        hookId,
+		Type:      "outlook",
+		Action:    "execute",
+		OrgId:     hook.OrgId,
+		ThirdItem: string(body),
+	})
+
+	resp.WriteHeader(202)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Queues a poll for each started Gmail trigger, unless one is already
+// waiting for the backend
+func (relay *SyncRelay) queueGmailPolls() {
+	relay.Lock()
+	defer relay.Unlock()
+
+	changed := false
+	for triggerId, hook := range relay.hooks {
+		if hook.Type != "gmail" || !relay.isValidSession(hook.SessionKey) {
+			continue
+		}
+
+		queued := false
+		for _, job := range relay.queues[hook.SessionKey] {
+			if job.Type == "gmail" && job.Id == triggerId {
+				queued = true
+				break
+			}
+		}
+
+		if queued {
+			continue
+		}
+
+		relay.queues[hook.SessionKey] = append(relay.queues[hook.SessionKey], shuffle.CloudSyncJob{
+			Id:            triggerId,
+			Type:          "gmail",
+			Action:        "poll",
+			OrgId:         hook.OrgId,
+			PrimaryItemId: hook.WorkflowId,
+			Created:       strconv.FormatInt(time.Now().Unix(), 10),
+		})
+		changed = true
+	}
+
+	if changed {
+		relay.saveState()
+	}
+}
+
+func (relay *SyncRelay) runGmailPolling() {
+	for {
+		time.Sleep(time.Duration(relay.GmailInterval) * time.Second)
+		relay.queueGmailPolls()
+	}
+}
+
+// Lets local tools queue jobs and read the stub outbox, using the relay
+// API key
+func (relay *SyncRelay) handleJobs(resp http.ResponseWriter, request *http.Request) {
+	if !relay.isValidApiKey(getRelayBearer(request)) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	type jobRequest struct {
+		SessionKey string               `json:"session_key"`
+		Job        shuffle.CloudSyncJob `json:"job"`
+	}
+
+	var jobData jobRequest
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil {
+		err = json.Unmarshal(body, &jobData)
+	}
+
+	if err != nil || len(jobData.Job.Type) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Missing job"}`))
+		return
+	}
+
+	if len(jobData.SessionKey) > 0 && !relay.isValidSession(jobData.SessionKey) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Bad session key"}`))
+		return
+	}
+
+	relay.enqueue(jobData.SessionKey, jobData.Job)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+func (relay *SyncRelay) handleOutbox(resp http.ResponseWriter, request *http.Request) {
+	if !relay.isValidApiKey(getRelayBearer(request)) {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	stub, ok := relay.Deliverer.(*relayStubDeliverer)
+	if !ok {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "The outbox is only kept with SHUFFLE_RELAY_DELIVERY=stub"}`))
+		return
+	}
+
+	stub.Lock()
+	outbox := append([]RelayDelivery{}, stub.Outbox...)
+	stub.Unlock()
+
+	writeRelayResponse(resp, 200, outbox)
+}
+
+func (relay *SyncRelay) getRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/api/v1/_ah/health", func(resp http.ResponseWriter, request *http.Request) {
+		resp.WriteHeader(200)
+		resp.Write([]byte(`{"success": true}`))
+	})
+	r.HandleFunc("/api/v1/cloud/sync", relay.handleSync).Methods("POST")
+	r.HandleFunc("/api/v1/cloud/sync/setup", relay.handleSetup).Methods("POST")
+	r.HandleFunc("/api/v1/cloud/sync/get_access", relay.handleGetAccess).Methods("GET")
+	r.HandleFunc("/api/v1/cloud/sync/stop", relay.handleStop).Methods("POST", "DELETE")
+	r.HandleFunc("/api/v1/cloud/sync/handle_action", relay.handleAction).Methods("POST")
+	r.HandleFunc("/api/v1/hooks/{key}", relay.handleHook).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/relay/user_input/{token}", relay.handleUserInputAnswer).Methods("GET", "POST")
+	r.HandleFunc("/api/v1/relay/jobs", relay.handleJobs).Methods("POST")
+	r.HandleFunc("/api/v1/relay/outbox", relay.handleOutbox).Methods("GET")
+	return r
+}
+
+func runSyncRelay() int {
+	relay, err := newSyncRelay()
+	if err != nil {
+		log.Printf("[ERROR] Failed starting relay: %s", err)
+		return 1
+	}
+
+	go relay.runGmailPolling()
+
+	port := getRelayPort()
+	log.Printf("[INFO] Running cloud sync relay on :%s with public URL %s", port, relay.PublicUrl)
+	err = http.ListenAndServe(fmt.Sprintf(":%s", port), relay.getRouter())
+	if err != nil {
+		log.Printf("[ERROR] Relay stopped: %s", err)
+		return 1
+	}
+
+	return 0
+}
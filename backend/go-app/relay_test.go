@@ -0,0 +1,357 @@
+package main
+
+import (
+	"github.com/shuffle/shuffle-shared"
+
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestRelay(t *testing.T, stateFile string) (*SyncRelay, *relayStubDeliverer) {
+	stub := &relayStubDeliverer{}
+	relay := &SyncRelay{
+		ApiKey:     "relay-test-key",
+		PublicUrl:  "http://relay.test",
+		Interval:   15,
+		Deliverer:  stub,
+		StateFile:  stateFile,
+		queues:     map[string][]shuffle.CloudSyncJob{},
+		userInputs: map[string]relayUserInput{},
+		hooks:      map[string]relayHook{},
+	}
+
+	err := relay.loadState()
+	if err != nil {
+		t.Fatalf("Failed loading relay state: %s", err)
+	}
+
+	return relay, stub
+}
+
+func relayRequest(relay *SyncRelay, method, path, bearer string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if rawBody, ok := body.(string); ok {
+		data = []byte(rawBody)
+	} else if body != nil {
+		data, _ = json.Marshal(body)
+	}
+
+	request := httptest.NewRequest(method, path, bytes.NewReader(data))
+	if len(bearer) > 0 {
+		request.Header.Set("Authorization", "Bearer "+bearer)
+	}
+
+	recorder := httptest.NewRecorder()
+	relay.getRouter().ServeHTTP(recorder, request)
+	return recorder
+}
+
+func setupRelaySession(t *testing.T, relay *SyncRelay) string {
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync/setup", "", map[string]string{"api_key": relay.ApiKey})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Setup returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	setup := retStruct{}
+	err := json.Unmarshal(rr.Body.Bytes(), &setup)
+	if err != nil || !setup.Success || len(setup.SessionKey) == 0 {
+		t.Fatalf("Bad setup response: %s", rr.Body.String())
+	}
+
+	return setup.SessionKey
+}
+
+func pollRelay(t *testing.T, relay *SyncRelay, sessionKey string) []shuffle.CloudSyncJob {
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync", sessionKey, "{}")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Sync returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var syncData struct {
+		Jobs []shuffle.CloudSyncJob `json:"jobs"`
+	}
+
+	err := json.Unmarshal(rr.Body.Bytes(), &syncData)
+	if err != nil {
+		t.Fatalf("Bad sync response: %s", rr.Body.String())
+	}
+
+	return syncData.Jobs
+}
+
+func TestRelaySetup(t *testing.T) {
+	relay, _ := newTestRelay(t, "")
+
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync/setup", "", map[string]string{"api_key": "wrong"})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Setup with a bad API key returned %d", rr.Code)
+	}
+
+	sessionKey := setupRelaySession(t, relay)
+	if !relay.isValidSession(sessionKey) {
+		t.Errorf("Session key %s isn't valid", sessionKey)
+	}
+
+	rr = relayRequest(relay, "GET", "/api/v1/cloud/sync/get_access", sessionKey, nil)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Get access returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "GET", "/api/v1/cloud/sync/get_access", sessionKey+"0", nil)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Get access with a bad session returned %d", rr.Code)
+	}
+}
+
+func TestRelaySyncPolling(t *testing.T) {
+	relay, _ := newTestRelay(t, "")
+	sessionKey := setupRelaySession(t, relay)
+	otherSession := setupRelaySession(t, relay)
+
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync", "bad.session", "{}")
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Sync with a bad session returned %d", rr.Code)
+	}
+
+	job := shuffle.CloudSyncJob{Id: "job-1", Type: "webhook", Action: "execute", PrimaryItemId: "workflow-1"}
+	rr = relayRequest(relay, "POST", "/api/v1/relay/jobs", "wrong", map[string]interface{}{"session_key": sessionKey, "job": job})
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Queueing a job with a bad API key returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/relay/jobs", relay.ApiKey, map[string]interface{}{"session_key": sessionKey, "job": job})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Queueing a job returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if jobs := pollRelay(t, relay, otherSession); len(jobs) != 0 {
+		t.Errorf("Another session got %d job(s)", len(jobs))
+	}
+
+	jobs := pollRelay(t, relay, sessionKey)
+	if len(jobs) != 1 || jobs[0].Id != "job-1" {
+		t.Fatalf("Expected job-1, got %#v", jobs)
+	}
+
+	if jobs := pollRelay(t, relay, sessionKey); len(jobs) != 0 {
+		t.Errorf("Job was returned twice")
+	}
+}
+
+func TestRelayHandleAction(t *testing.T) {
+	relay, stub := newTestRelay(t, "")
+	sessionKey := setupRelaySession(t, relay)
+
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", "", shuffle.CloudSyncJob{Type: "setup", Action: "init"})
+	if rr.Code != http.StatusOK {
+		t.Errorf("Init setup returned %d", rr.Code)
+	}
+
+	sms := shuffle.CloudSyncJob{Id: "token-1", Type: "user_input", Action: "send_sms", FourthItem: "+4712345678"}
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", "", sms)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Action without a session returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, sms)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Send SMS returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	noRecipients := shuffle.CloudSyncJob{Type: "user_input", Action: "send_email", FourthItem: "evil@example.com\r\nBcc: x"}
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, noRecipients)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Header injection in recipients returned %d", rr.Code)
+	}
+
+	if len(stub.Outbox) != 1 || stub.Outbox[0].Type != "sms" || stub.Outbox[0].To[0] != "+4712345678" {
+		t.Errorf("Unexpected outbox: %#v", stub.Outbox)
+	}
+}
+
+func TestRelayUserInputLinks(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "relay_state.json")
+	relay, stub := newTestRelay(t, stateFile)
+	sessionKey := setupRelaySession(t, relay)
+
+	job := shuffle.CloudSyncJob{
+		Id:            "backend-token",
+		Type:          "user_input",
+		Action:        "send_email",
+		OrgId:         "org-1",
+		PrimaryItemId: "workflow-1",
+		SecondaryItem: "trigger-1",
+		ThirdItem:     "Approve the change?",
+		FourthItem:    "analyst@example.com",
+		FifthItem:     "execution-1",
+	}
+
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, job)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Send email returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if len(stub.Outbox) != 1 {
+		t.Fatalf("Expected one mail, got %d", len(stub.Outbox))
+	}
+
+	continueLink := ""
+	for _, line := range strings.Split(stub.Outbox[0].Body, "\n") {
+		if strings.HasPrefix(line, "Continue: ") {
+			continueLink = strings.TrimPrefix(line, "Continue: ")
+		}
+	}
+
+	if !strings.HasPrefix(continueLink, relay.PublicUrl) || !strings.Contains(continueLink, "answer=true") {
+		t.Fatalf("Bad continue link in mail: %s", stub.Outbox[0].Body)
+	}
+
+	// The links still work after a restart
+	restarted, _ := newTestRelay(t, stateFile)
+	linkPath := strings.TrimPrefix(continueLink, relay.PublicUrl)
+
+	// Opening the link only asks for confirmation
+	for i := 0; i < 2; i++ {
+		rr = relayRequest(restarted, "GET", linkPath, "", nil)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `method="POST"`) {
+			t.Fatalf("Opening the link returned %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	if jobs := pollRelay(t, restarted, sessionKey); len(jobs) != 0 {
+		t.Fatalf("Opening the link queued an answer: %#v", jobs)
+	}
+
+	rr = relayRequest(restarted, "POST", strings.Split(linkPath, "?")[0], "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Answer without a value returned %d", rr.Code)
+	}
+
+	rr = relayRequest(restarted, "POST", linkPath, "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Answer returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = relayRequest(restarted, "POST", linkPath, "", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Second answer returned %d", rr.Code)
+	}
+
+	jobs := pollRelay(t, restarted, sessionKey)
+	if len(jobs) != 1 {
+		t.Fatalf("Expected one answer job, got %#v", jobs)
+	}
+
+	answer := jobs[0]
+	if answer.Action != "continue" || answer.PrimaryItemId != "workflow-1" || answer.SecondaryItem != "trigger-1" || answer.ThirdItem != "execution-1" || answer.FourthItem != "backend-token" {
+		t.Errorf("Unexpected answer job: %#v", answer)
+	}
+}
+
+func TestRelayHooks(t *testing.T) {
+	relay, _ := newTestRelay(t, "")
+	sessionKey := setupRelaySession(t, relay)
+	otherSession := setupRelaySession(t, relay)
+
+	notification := `{"value": [{"subscriptionId": "sub-1", "clientState": "Shuffle subscription", "changeType": "created"}]}`
+	rr := relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1?validationToken=abc", "", nil)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Validation for an unknown trigger returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1", "", notification)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Notification for an unknown trigger returned %d", rr.Code)
+	}
+
+	start := shuffle.CloudSyncJob{Type: "outlook", Action: "start", OrgId: "org-1", PrimaryItemId: "trigger-1", ThirdItem: "workflow-1"}
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, start)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Outlook start returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	otherStart := start
+	otherStart.OrgId = "org-2"
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", otherSession, otherStart)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Taking over another org's trigger returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1?validationToken=abc", "", nil)
+	if rr.Code != http.StatusOK || rr.Body.String() != "abc" {
+		t.Errorf("Validation returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1", "", `{"value": [{"clientState": "something else"}]}`)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Notification with a bad client state returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1", "", notification)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("Notification returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	if jobs := pollRelay(t, relay, otherSession); len(jobs) != 0 {
+		t.Errorf("Another session got the notification: %#v", jobs)
+	}
+
+	jobs := pollRelay(t, relay, sessionKey)
+	if len(jobs) != 1 || jobs[0].Id != "trigger-1" || jobs[0].Type != "outlook" || jobs[0].OrgId != "org-1" {
+		t.Fatalf("Unexpected notification jobs: %#v", jobs)
+	}
+
+	stop := start
+	stop.Action = "stop"
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, stop)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Outlook stop returned %d", rr.Code)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1", "", notification)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Notification after stop returned %d", rr.Code)
+	}
+}
+
+func TestRelayGmailPolling(t *testing.T) {
+	relay, _ := newTestRelay(t, "")
+	sessionKey := setupRelaySession(t, relay)
+
+	start := shuffle.CloudSyncJob{Type: "gmail", Action: "start", OrgId: "org-1", PrimaryItemId: "trigger-1", ThirdItem: "workflow-1"}
+	rr := relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, start)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Gmail start returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	// Only one poll waits for the backend at a time
+	relay.queueGmailPolls()
+	relay.queueGmailPolls()
+
+	jobs := pollRelay(t, relay, sessionKey)
+	if len(jobs) != 1 || jobs[0].Id != "trigger-1" || jobs[0].Type != "gmail" || jobs[0].Action != "poll" || jobs[0].OrgId != "org-1" {
+		t.Fatalf("Unexpected poll jobs: %#v", jobs)
+	}
+
+	rr = relayRequest(relay, "POST", "/api/v1/hooks/webhook_trigger-1", "", `{"value": [{"clientState": "Shuffle subscription"}]}`)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Notification for a gmail trigger returned %d", rr.Code)
+	}
+
+	stop := start
+	stop.Action = "stop"
+	rr = relayRequest(relay, "POST", "/api/v1/cloud/sync/handle_action", sessionKey, stop)
+	if rr.Code != http.StatusOK {
+		t.Errorf("Gmail stop returned %d", rr.Code)
+	}
+
+	relay.queueGmailPolls()
+	if jobs := pollRelay(t, relay, sessionKey); len(jobs) != 0 {
+		t.Errorf("Stopped trigger was polled: %#v", jobs)
+	}
+}
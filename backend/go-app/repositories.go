@@ -0,0 +1,994 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gyaml "github.com/ghodss/yaml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	http2 "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	uuid "github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Managed app repositories are git repositories apps are loaded from,
+// with the deployed commit recorded so updates can be previewed and
+// rolled back.
+var appRepositoryCategory = "app_repositories"
+var appRepositoryHistoryLimit = 50
+
+// One lock per repository ID, so the scheduled sync doesn't overwrite a
+// repository that is edited, synced or deleted at the same time
+var appRepositoryLocks sync.Map
+
+type AppRepositoryApp struct {
+	Name       string `json:"name"`
+	AppVersion string `json:"app_version"`
+	Folder     string `json:"folder"`
+	Hash       string `json:"hash"`
+}
+
+type AppRepositoryDiff struct {
+	FromCommit string             `json:"from_commit"`
+	ToCommit   string             `json:"to_commit"`
+	Added      []AppRepositoryApp `json:"added"`
+	Changed    []AppRepositoryApp `json:"changed"`
+	Removed    []AppRepositoryApp `json:"removed"`
+}
+
+type AppRepositoryDeployment struct {
+	Commit     string             `json:"commit"`
+	Ref        string             `json:"ref"`
+	Deployed   int64              `json:"deployed"`
+	DeployedBy string             `json:"deployed_by"`
+	Apps       []AppRepositoryApp `json:"apps"`
+}
+
+type AppRepository struct {
+	Id     string `json:"id"`
+	OrgId  string `json:"org_id"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+
+	// A commit or tag. Empty follows the head of the branch.
+	Pin      string `json:"pin"`
+	Username string `json:"username,omitempty"`
+
+	// Password is only set on input. It is stored in EncryptedPassword.
+	Password          string `json:"password,omitempty"`
+	EncryptedPassword string `json:"encrypted_password,omitempty"`
+
+	// A stored git credential, used over the username and password
+	CredentialId string `json:"credential_id"`
+
+	// Minutes between syncs. 0 only syncs on request.
+	SyncInterval int  `json:"sync_interval"`
+	AutoApply    bool `json:"auto_apply"`
+
+	DeployedCommit string                    `json:"deployed_commit"`
+	LatestCommit   string                    `json:"latest_commit"`
+	PendingDiff    *AppRepositoryDiff        `json:"pending_diff,omitempty"`
+	History        []AppRepositoryDeployment `json:"history"`
+	LastSync       int64                     `json:"last_sync"`
+	LastError      string                    `json:"last_error"`
+	Created        int64                     `json:"created"`
+	Edited         int64                     `json:"edited"`
+}
+
+func lockAppRepository(repoId string) *sync.Mutex {
+	lock, _ := appRepositoryLocks.LoadOrStore(repoId, &sync.Mutex{})
+	repoLock := lock.(*sync.Mutex)
+	repoLock.Lock()
+	return repoLock
+}
+
+func getAppRepositoryPassphrase(repo AppRepository) string {
+	return fmt.Sprintf("%s_%d_%s", repo.OrgId, repo.Created, repo.Id)
+}
+
+func getAppRepository(ctx context.Context, orgId, repoId string) (*AppRepository, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, appRepositoryCategory, repoId), appRepositoryCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	repo := AppRepository{}
+	err = json.Unmarshal([]byte(cacheData.Value), &repo)
+	if err != nil {
+		return nil, err
+	}
+
+	return &repo, nil
+}
+
+func getAppRepositories(ctx context.Context, orgId string) ([]AppRepository, error) {
+	repos := []AppRepository{}
+	cacheKeys, _, err := shuffle.GetAllCacheKeys(ctx, orgId, appRepositoryCategory, 100, "")
+	if err != nil {
+		return repos, err
+	}
+
+	for _, cacheKey := range cacheKeys {
+		repo := AppRepository{}
+		err = json.Unmarshal([]byte(cacheKey.Value), &repo)
+		if err != nil || len(repo.Id) == 0 {
+			continue
+		}
+
+		repos = append(repos, repo)
+	}
+
+	return repos, nil
+}
+
+// A new plaintext password is encrypted before the repository is stored
+func setAppRepository(ctx context.Context, repo AppRepository) error {
+	if len(repo.Password) > 0 {
+		encrypted, err := shuffle.HandleKeyEncryption([]byte(repo.Password), getAppRepositoryPassphrase(repo))
+		if err != nil {
+			return err
+		}
+
+		repo.EncryptedPassword = string(encrypted)
+		repo.Password = ""
+	}
+
+	if len(repo.History) > appRepositoryHistoryLimit {
+		repo.History = repo.History[len(repo.History)-appRepositoryHistoryLimit:]
+	}
+
+	repo.Edited = time.Now().Unix()
+	data, err := json.Marshal(repo)
+	if err != nil {
+		return err
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    repo.OrgId,
+		Key:      fmt.Sprintf("%s_%s", appRepositoryCategory, repo.Id),
+		Value:    string(data),
+		Category: appRepositoryCategory,
+	})
+}
+
+func deleteAppRepository(ctx context.Context, repo AppRepository) error {
+	cacheId := fmt.Sprintf("%s_%s_%s_%s", repo.OrgId, appRepositoryCategory, repo.Id, appRepositoryCategory)
+	return shuffle.DeleteKey(ctx, "org_cache", url.QueryEscape(cacheId))
+}
+
+// Clones the repository with its full history, so any commit or tag
+// can be checked out afterwards
+func cloneAppRepository(ctx context.Context, repo AppRepository) (*git.Repository, billy.Filesystem, error) {
+	fs := memfs.New()
+	cloneOptions := &git.CloneOptions{
+		URL:  repo.URL,
+		Tags: git.AllTags,
+	}
+
+	if len(repo.Branch) > 0 {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(repo.Branch)
+	}
+
+	if len(repo.Username) > 0 && len(repo.EncryptedPassword) > 0 {
+		password, err := shuffle.HandleKeyDecryption([]byte(repo.EncryptedPassword), getAppRepositoryPassphrase(repo))
+		if err != nil {
+			return nil, fs, errors.New("Failed decrypting repository credentials")
+		}
+
+		cloneOptions.Auth = &http2.BasicAuth{
+			Username: repo.Username,
+			Password: string(password),
+		}
+	}
+
+	err := applyGitCredential(ctx, repo.OrgId, repo.CredentialId, cloneOptions)
+	if err != nil {
+		return nil, fs, err
+	}
+
+	cloneOptions = checkGitProxy(cloneOptions)
+
+	storer := memory.NewStorage()
+	r, err := git.Clone(storer, fs, cloneOptions)
+	if err != nil {
+		return nil, fs, err
+	}
+
+	return r, fs, nil
+}
+
+// Checks out a commit or tag. An empty ref stays on the branch head.
+func checkoutAppRepository(r *git.Repository, ref string) (string, error) {
+	if len(ref) == 0 {
+		head, err := r.Head()
+		if err != nil {
+			return "", err
+		}
+
+		return head.Hash().String(), nil
+	}
+
+	hash, err := r.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return "", fmt.Errorf("Failed resolving %s: %s", ref, err)
+	}
+
+	worktree, err := r.Worktree()
+	if err != nil {
+		return "", err
+	}
+
+	err = worktree.Checkout(&git.CheckoutOptions{
+		Hash:  *hash,
+		Force: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("Failed checking out %s: %s", ref, err)
+	}
+
+	return hash.String(), nil
+}
+
+// Lists the app versions in a checked out repository
+func listAppRepositoryApps(fs billy.Filesystem, extra string) []AppRepositoryApp {
+	apps := []AppRepositoryApp{}
+	files, err := fs.ReadDir(extra)
+	if err != nil {
+		return apps
+	}
+
+	for _, file := range files {
+		if file.IsDir() {
+			if file.Name() == ".git" || file.Name() == "unsupported" {
+				continue
+			}
+
+			apps = append(apps, listAppRepositoryApps(fs, fmt.Sprintf("%s%s/", extra, file.Name()))...)
+			continue
+		}
+
+		if file.Name() != "api.yaml" && file.Name() != "api.yml" {
+			continue
+		}
+
+		fileReader, err := fs.Open(fmt.Sprintf("%s%s", extra, file.Name()))
+		if err != nil {
+			continue
+		}
+
+		appfileData, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			continue
+		}
+
+		workflowapp := shuffle.WorkflowApp{}
+		err = gyaml.Unmarshal(appfileData, &workflowapp)
+		if err != nil || len(workflowapp.Name) == 0 {
+			continue
+		}
+
+		contentHash, err := getAppContentHash(fs, extra)
+		if err != nil {
+			continue
+		}
+
+		apps = append(apps, AppRepositoryApp{
+			Name:       workflowapp.Name,
+			AppVersion: workflowapp.AppVersion,
+			Folder:     strings.TrimSuffix(extra, "/"),
+			Hash:       contentHash,
+		})
+	}
+
+	return apps
+}
+
+func diffAppRepositoryApps(fromCommit string, from []AppRepositoryApp, toCommit string, to []AppRepositoryApp) AppRepositoryDiff {
+	diff := AppRepositoryDiff{
+		FromCommit: fromCommit,
+		ToCommit:   toCommit,
+		Added:      []AppRepositoryApp{},
+		Changed:    []AppRepositoryApp{},
+		Removed:    []AppRepositoryApp{},
+	}
+
+	existing := map[string]AppRepositoryApp{}
+	for _, app := range from {
+		existing[fmt.Sprintf("%s:%s", app.Name, app.AppVersion)] = app
+	}
+
+	for _, app := range to {
+		key := fmt.Sprintf("%s:%s", app.Name, app.AppVersion)
+		previous, found := existing[key]
+		if !found {
+			diff.Added = append(diff.Added, app)
+		} else if previous.Hash != app.Hash {
+			diff.Changed = append(diff.Changed, app)
+		}
+
+		delete(existing, key)
+	}
+
+	for _, app := range existing {
+		diff.Removed = append(diff.Removed, app)
+	}
+
+	sort.Slice(diff.Removed, func(i, j int) bool {
+		return diff.Removed[i].Name < diff.Removed[j].Name
+	})
+
+	return diff
+}
+
+func getDeployedAppRepositoryApps(repo AppRepository) []AppRepositoryApp {
+	if len(repo.History) == 0 {
+		return []AppRepositoryApp{}
+	}
+
+	return repo.History[len(repo.History)-1].Apps
+}
+
+// Fetches the pinned commit, or the branch head, and stores the diff
+// against the deployed commit as a preview
+func syncAppRepository(ctx context.Context, repo *AppRepository) error {
+	repo.LastSync = time.Now().Unix()
+
+	r, fs, err := cloneAppRepository(ctx, *repo)
+	if err == nil {
+		repo.LatestCommit, err = checkoutAppRepository(r, repo.Pin)
+	}
+
+	if err != nil {
+		repo.LastError = err.Error()
+		return err
+	}
+
+	repo.LastError = ""
+	if repo.LatestCommit == repo.DeployedCommit {
+		repo.PendingDiff = nil
+		return nil
+	}
+
+	diff := diffAppRepositoryApps(repo.DeployedCommit, getDeployedAppRepositoryApps(*repo), repo.LatestCommit, listAppRepositoryApps(fs, ""))
+	repo.PendingDiff = &diff
+	return nil
+}
+
+// Deploys a commit or tag of the repository as private apps of its org.
+// Only apps whose content hash changed are rebuilt. Apps removed from the
+// repository are kept, as workflows may still use them.
+func deployAppRepository(ctx context.Context, repo *AppRepository, ref, username string) error {
+	r, fs, err := cloneAppRepository(ctx, *repo)
+	if err != nil {
+		repo.LastError = err.Error()
+		return err
+	}
+
+	commit, err := checkoutAppRepository(r, ref)
+	if err != nil {
+		repo.LastError = err.Error()
+		return err
+	}
+
+	log.Printf("[INFO] Deploying app repository %s (%s) at commit %s", repo.Name, repo.URL, commit)
+	apps := listAppRepositoryApps(fs, "")
+	err = deployAppRepositoryApps(ctx, fs, *repo, apps)
+	if err != nil {
+		log.Printf("[WARNING] Error deploying app repository %s at %s: %s", repo.Name, commit, err)
+		repo.LastError = err.Error()
+		return err
+	}
+
+	if len(ref) == 0 {
+		ref = repo.Branch
+	}
+
+	repo.History = append(repo.History, AppRepositoryDeployment{
+		Commit:     commit,
+		Ref:        ref,
+		Deployed:   time.Now().Unix(),
+		DeployedBy: username,
+		Apps:       apps,
+	})
+
+	repo.DeployedCommit = commit
+	repo.LastError = ""
+	if repo.LatestCommit == commit {
+		repo.PendingDiff = nil
+	}
+
+	cacheKey := fmt.Sprintf("workflowapps-sorted")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-100")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-500")
+	shuffle.DeleteCache(ctx, cacheKey)
+	cacheKey = fmt.Sprintf("workflowapps-sorted-1000")
+	shuffle.DeleteCache(ctx, cacheKey)
+
+	return nil
+}
+
+// Stores the apps of a checked out repository in the repository org and
+// builds them in the background. Only the org's own copies of an app are
+// replaced, and unchanged apps with a working build are kept.
+func deployAppRepositoryApps(ctx context.Context, fs billy.Filesystem, repo AppRepository, apps []AppRepositoryApp) error {
+	allapps, err := shuffle.GetAllWorkflowApps(ctx, 0, 0)
+	if err != nil {
+		return fmt.Errorf("Failed getting existing apps: %s", err)
+	}
+
+	type appRepositoryBuild struct {
+		folder string
+		app    shuffle.WorkflowApp
+		build  *AppBuild
+	}
+
+	builds := []appRepositoryBuild{}
+	for _, repoApp := range apps {
+		folder := ""
+		if len(repoApp.Folder) > 0 {
+			folder = fmt.Sprintf("%s/", repoApp.Folder)
+		}
+
+		fileReader, err := fs.Open(fmt.Sprintf("%sapi.yaml", folder))
+		if err != nil {
+			fileReader, err = fs.Open(fmt.Sprintf("%sapi.yml", folder))
+			if err != nil {
+				continue
+			}
+		}
+
+		appfileData, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			continue
+		}
+
+		var workflowapp shuffle.WorkflowApp
+		err = gyaml.Unmarshal(appfileData, &workflowapp)
+		if err != nil {
+			log.Printf("[WARNING] Failed parsing app %s in repository %s: %s", folder, repo.Id, err)
+			continue
+		}
+
+		workflowapp = appendAppAuthParameters(workflowapp)
+		err = checkWorkflowApp(workflowapp)
+		if err != nil {
+			log.Printf("[DEBUG] %s for app %s:%s in repository %s", err, workflowapp.Name, workflowapp.AppVersion, repo.Id)
+			continue
+		}
+
+		removeApps := []string{}
+		skip := false
+		for _, app := range allapps {
+			if app.ReferenceOrg != repo.OrgId || app.Name != workflowapp.Name || app.AppVersion != workflowapp.AppVersion {
+				continue
+			}
+
+			if app.Hash == repoApp.Hash && len(app.Hash) > 0 {
+				previousBuild, err := getAppBuild(ctx, repo.OrgId, app.ID)
+				if err != nil || previousBuild.Status != "failed" {
+					skip = true
+					break
+				}
+			}
+
+			removeApps = append(removeApps, app.ID)
+		}
+
+		if skip {
+			continue
+		}
+
+		for _, item := range removeApps {
+			log.Printf("[INFO] Replacing app %s from repository %s in org %s", item, repo.Id, repo.OrgId)
+			err = shuffle.DeleteKey(ctx, "workflowapp", item)
+			if err != nil {
+				log.Printf("[ERROR] Failed deleting replaced app %s: %s", item, err)
+			}
+		}
+
+		workflowapp.ID = uuid.NewV4().String()
+		workflowapp.IsValid = true
+		workflowapp.Verified = false
+		workflowapp.Sharing = false
+		workflowapp.Public = false
+		workflowapp.Downloaded = true
+		workflowapp.Hash = repoApp.Hash
+		workflowapp.ReferenceOrg = repo.OrgId
+
+		err = shuffle.SetWorkflowAppDatastore(ctx, workflowapp, workflowapp.ID)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting app %s from repository %s: %s", workflowapp.Name, repo.Id, err)
+			continue
+		}
+
+		appName := strings.ToLower(strings.ReplaceAll(workflowapp.Name, " ", "-"))
+		build := &AppBuild{
+			Id:         uuid.NewV4().String(),
+			AppId:      workflowapp.ID,
+			OrgId:      repo.OrgId,
+			AppName:    workflowapp.Name,
+			AppVersion: workflowapp.AppVersion,
+			Tags: []string{
+				fmt.Sprintf("%s:%s_%s", baseDockerName, appName, workflowapp.ID),
+				fmt.Sprintf("%s:%s_%s", baseDockerName, appName, workflowapp.AppVersion),
+			},
+			Hash:    repoApp.Hash,
+			Builder: "docker",
+			Status:  "building",
+			Created: time.Now().Unix(),
+		}
+		setAppBuild(ctx, build)
+
+		builds = append(builds, appRepositoryBuild{
+			folder: folder,
+			app:    workflowapp,
+			build:  build,
+		})
+	}
+
+	if len(builds) == 0 {
+		return nil
+	}
+
+	go func() {
+		ctx := context.Background()
+		imagenames := []string{}
+		for _, item := range builds {
+			err := buildImageMemory(fs, item.build.Tags, item.folder, true)
+			finishAppBuild(ctx, item.build, "", err)
+			if err != nil {
+				log.Printf("[ERROR] Failed building app %s from repository %s: %s", item.app.ID, repo.Id, err)
+				continue
+			}
+
+			imagenames = append(imagenames, fmt.Sprintf("%s_%s", item.app.Name, item.app.AppVersion))
+			imagenames = append(imagenames, fmt.Sprintf("%s_%s", item.app.Name, item.app.ID))
+		}
+
+		if len(imagenames) == 0 {
+			return
+		}
+
+		org, err := shuffle.GetOrg(ctx, repo.OrgId)
+		if err != nil {
+			log.Printf("[ERROR] Failed getting org %s for repository build: %s", repo.OrgId, err)
+			return
+		}
+
+		err = shuffle.DistributeAppToEnvironments(ctx, *org, imagenames)
+		if err != nil {
+			log.Printf("[ERROR] Failed distributing repository apps to environments: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// Syncs repositories with a sync interval, and deploys the update if
+// the repository is set to auto apply. The fetch runs without the lock.
+// The result is only deployed and stored if the repository wasn't
+// deleted or edited in the meantime.
+func runAppRepositorySync() {
+	ctx := context.Background()
+	for {
+		time.Sleep(1 * time.Minute)
+
+		orgs, err := shuffle.GetAllOrgs(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting orgs for app repository sync: %s", err)
+			continue
+		}
+
+		for _, org := range orgs {
+			repos, err := getAppRepositories(ctx, org.Id)
+			if err != nil {
+				continue
+			}
+
+			for _, repo := range repos {
+				if repo.SyncInterval <= 0 || time.Now().Unix() < repo.LastSync+int64(repo.SyncInterval*60) {
+					continue
+				}
+
+				syncErr := syncAppRepository(ctx, &repo)
+
+				repoLock := lockAppRepository(repo.Id)
+				currentRepo, err := getAppRepository(ctx, repo.OrgId, repo.Id)
+				if err != nil || currentRepo.Edited != repo.Edited {
+					log.Printf("[DEBUG] App repository %s was deleted or changed during sync. Skipping update.", repo.Id)
+					repoLock.Unlock()
+					continue
+				}
+
+				if syncErr != nil {
+					log.Printf("[WARNING] Failed syncing app repository %s (%s): %s", repo.Name, repo.Id, syncErr)
+				} else if repo.AutoApply && repo.PendingDiff != nil {
+					err = deployAppRepository(ctx, &repo, repo.LatestCommit, "scheduler")
+					if err != nil {
+						log.Printf("[WARNING] Failed deploying app repository %s (%s): %s", repo.Name, repo.Id, err)
+					}
+				}
+
+				err = setAppRepository(ctx, repo)
+				if err != nil {
+					log.Printf("[WARNING] Failed saving app repository %s after sync: %s", repo.Id, err)
+				}
+
+				repoLock.Unlock()
+			}
+		}
+	}
+}
+
+func writeAppRepository(resp http.ResponseWriter, repo AppRepository) {
+	repo.Password = ""
+	repo.EncryptedPassword = ""
+	newjson, err := json.Marshal(repo)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling repository"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+func handleGetAppRepositories(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get app repositories: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage app repositories"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) > 5 && len(location[5]) > 0 {
+		repo, err := getAppRepository(ctx, user.ActiveOrg.Id, location[5])
+		if err != nil {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Repository not found"}`))
+			return
+		}
+
+		writeAppRepository(resp, *repo)
+		return
+	}
+
+	repos, err := getAppRepositories(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting app repositories: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed getting repositories"}`))
+		return
+	}
+
+	for index := range repos {
+		repos[index].Password = ""
+		repos[index].EncryptedPassword = ""
+		repos[index].History = []AppRepositoryDeployment{}
+	}
+
+	newjson, err := json.Marshal(repos)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling repositories"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Creates (POST) or updates (PUT) a repository, then syncs it to
+// preview what deploying it would change
+func handleSetAppRepository(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in set app repository: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage app repositories"}`))
+		return
+	}
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+		return
+	}
+
+	var input AppRepository
+	err = json.Unmarshal(body, &input)
+	if err != nil {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling repository"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	location := strings.Split(request.URL.Path, "/")
+	repo := &AppRepository{
+		Id:      uuid.NewV4().String(),
+		OrgId:   user.ActiveOrg.Id,
+		History: []AppRepositoryDeployment{},
+		Created: time.Now().Unix(),
+	}
+
+	if request.Method == "PUT" {
+		if len(location) < 6 {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+			return
+		}
+
+		repoLock := lockAppRepository(location[5])
+		defer repoLock.Unlock()
+
+		repo, err = getAppRepository(ctx, user.ActiveOrg.Id, location[5])
+		if err != nil {
+			resp.WriteHeader(404)
+			resp.Write([]byte(`{"success": false, "reason": "Repository not found"}`))
+			return
+		}
+
+		// Stored credentials are never sent to a new host
+		if input.URL != repo.URL {
+			repo.EncryptedPassword = ""
+		}
+	}
+
+	if !isGitRepositoryUrl(input.URL) {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "A valid git repository URL is required"}`))
+		return
+	}
+
+	repo.Name = input.Name
+	if len(repo.Name) == 0 {
+		repo.Name = input.URL
+	}
+
+	repo.URL = input.URL
+	repo.Branch = input.Branch
+	repo.Pin = input.Pin
+	repo.Username = input.Username
+
+	// Keeps the stored password unless a new one is set
+	repo.Password = input.Password
+	if len(repo.Username) == 0 {
+		repo.EncryptedPassword = ""
+	}
+	repo.CredentialId = input.CredentialId
+	repo.SyncInterval = input.SyncInterval
+	repo.AutoApply = input.AutoApply
+
+	// The password is encrypted on save, so the sync uses the stored copy
+	err = setAppRepository(ctx, *repo)
+	if err == nil {
+		repo, err = getAppRepository(ctx, user.ActiveOrg.Id, repo.Id)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed saving app repository: %s", err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed saving repository"}`))
+		return
+	}
+
+	err = syncAppRepository(ctx, repo)
+	if err != nil {
+		log.Printf("[WARNING] Failed syncing app repository %s: %s", repo.URL, err)
+	}
+
+	err = setAppRepository(ctx, *repo)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving app repository %s after sync: %s", repo.Id, err)
+	}
+
+	log.Printf("[AUDIT] User %s (%s) saved app repository %s (%s)", user.Username, user.Id, repo.URL, repo.Id)
+	writeAppRepository(resp, *repo)
+}
+
+func handleDeleteAppRepository(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in delete app repository: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage app repositories"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 6 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	repoLock := lockAppRepository(location[5])
+	defer repoLock.Unlock()
+
+	ctx := shuffle.GetContext(request)
+	repo, err := getAppRepository(ctx, user.ActiveOrg.Id, location[5])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Repository not found"}`))
+		return
+	}
+
+	err = deleteAppRepository(ctx, *repo)
+	if err != nil {
+		log.Printf("[WARNING] Failed deleting app repository %s: %s", repo.Id, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed deleting repository"}`))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) deleted app repository %s (%s)", user.Username, user.Id, repo.URL, repo.Id)
+	resp.WriteHeader(200)
+	resp.Write([]byte(`{"success": true}`))
+}
+
+// Handles /sync, /apply and /rollback for a repository. Apply deploys the
+// synced commit, or the commit in the body. Rollback deploys the commit
+// in the body, or the one deployed before the current one.
+func handleAppRepositoryAction(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in app repository action: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage app repositories"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 7 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Path too short"}`))
+		return
+	}
+
+	repoLock := lockAppRepository(location[5])
+	defer repoLock.Unlock()
+
+	ctx := shuffle.GetContext(request)
+	repo, err := getAppRepository(ctx, user.ActiveOrg.Id, location[5])
+	if err != nil {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Repository not found"}`))
+		return
+	}
+
+	type actionRequest struct {
+		Commit string `json:"commit"`
+	}
+
+	var actionData actionRequest
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		json.Unmarshal(body, &actionData)
+	}
+
+	action := location[6]
+	switch action {
+	case "sync":
+		err = syncAppRepository(ctx, repo)
+	case "apply":
+		ref := actionData.Commit
+		if len(ref) == 0 {
+			ref = repo.LatestCommit
+		}
+
+		if len(ref) == 0 {
+			err = errors.New("Nothing to apply. Sync the repository first")
+		} else {
+			err = deployAppRepository(ctx, repo, ref, user.Username)
+		}
+	case "rollback":
+		ref := actionData.Commit
+		if len(ref) == 0 {
+			if len(repo.History) < 2 {
+				err = errors.New("No previous deployment to roll back to")
+				break
+			}
+
+			ref = repo.History[len(repo.History)-2].Commit
+		}
+
+		err = deployAppRepository(ctx, repo, ref, user.Username)
+	default:
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Unknown action %s"}`, action)))
+		return
+	}
+
+	saveErr := setAppRepository(ctx, *repo)
+	if saveErr != nil {
+		log.Printf("[WARNING] Failed saving app repository %s after %s: %s", repo.Id, action, saveErr)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed app repository %s for %s: %s", action, repo.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) ran %s on app repository %s (%s)", user.Username, user.Id, action, repo.URL, repo.Id)
+	writeAppRepository(resp, *repo)
+}
+
+func startAppRepositorySync() {
+	if os.Getenv("SHUFFLE_APP_REPOSITORY_SYNC_DISABLED") == "true" {
+		return
+	}
+
+	go runAppRepositorySync()
+}
@@ -5,19 +5,22 @@ import (
 
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	dockerclient "github.com/docker/docker/client"
@@ -310,150 +313,144 @@ func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 		orgId = env.OrgId
 	}
 
-	// FIXME: Workflow stats disabled for now
-	// as it caused too many problems
-	// goal: track docker stuff once a minute and graph it
-	// For now: Disable this as it caused too many problems
-	if request.Method == "POST" && true == false {
-		//log.Printf("[DEBUG] POST to workflowqueue")
-		if rand.Intn(10) == 0 {
-			// Parse out body
-			body, err := ioutil.ReadAll(request.Body)
-			if err == nil {
+	// Orborus samples and aggregates the stats itself, and only sends
+	// them once per interval (SHUFFLE_STATS_INTERVAL). Swarm stats are
+	// those of the Orborus host, and are stored the same way.
+	if request.Method == "POST" {
+		// Parse out body
+		body, err := ioutil.ReadAll(request.Body)
+		if err == nil {
 
-				// Parse out CPU, memory and disk.
+			// Parse out CPU, memory and disk.
 
-				var envData shuffle.OrborusStats
-				err = json.Unmarshal(body, &envData)
-				if err == nil && !envData.Swarm && !envData.Kubernetes && (envData.CPU > 0 || envData.Memory > 0 || envData.Disk > 0) {
+			var envData shuffle.OrborusStats
+			err = json.Unmarshal(body, &envData)
+			if err == nil && !envData.Kubernetes && (envData.CPU > 0 || envData.Memory > 0 || envData.Disk > 0) {
 
-					// Set the input in memory
-					envData.OrgId = orgId
-					envData.Environment = environment
-					envData.OrborusLabel = orborusLabel
-					envData.Timestamp = time.Now().Unix()
+				// Set the input in memory
+				envData.OrgId = orgId
+				envData.Environment = environment
+				envData.OrborusLabel = orborusLabel
+				envData.Timestamp = time.Now().Unix()
 
-					if envData.CPU > 0 && envData.MaxCPU > 0 {
-						envData.CPUPercent = float64(envData.CPU) / float64(envData.MaxCPU)
-					}
+				if envData.MemoryPercent == 0 && envData.Memory > 0 && envData.MaxMemory > 0 {
+					envData.MemoryPercent = float64(envData.Memory) / float64(envData.MaxMemory)
+				}
 
-					if envData.Memory > 0 && envData.MaxMemory > 0 {
-						envData.MemoryPercent = float64(envData.Memory) / float64(envData.MaxMemory)
-					}
+				// Check if CPU percent constantly has stayed above X% for the last Y requests
+				percentageCheck := 90
+				concurrentChecks := 2
 
-					// Check if CPU percent constantly has stayed above X% for the last Y requests
-					percentageCheck := 90
-					concurrentChecks := 2
+				//if int(envData.CPUPercent) > percentageCheck {
+				// Get cached data
+				percentages := []float64{}
+				cacheKey := fmt.Sprintf("%s_%s_percent", environment , strings.ToLower(orgId))
 
-					//if int(envData.CPUPercent) > percentageCheck {
-					// Get cached data
-					percentages := []float64{}
-					cacheKey := fmt.Sprintf("%s_%s_percent", environment , strings.ToLower(orgId))
+				// Marshal float list into []byte
+				cacheData := []byte{}
+				cache, err := shuffle.GetCache(ctx, cacheKey)
+				if err == nil {
+					// Unmarshal into percentages
+					cacheData := []byte(cache.([]uint8))
+					err = json.Unmarshal(cacheData, &percentages)
+					if err != nil {
+						log.Printf("[INFO] error in cache unmarshal for percentages: %s", err)
+					}
 
-					// Marshal float list into []byte
-					cacheData := []byte{}
-					cache, err := shuffle.GetCache(ctx, cacheKey)
-					if err == nil {
-						// Unmarshal into percentages
-						cacheData := []byte(cache.([]uint8))
-						err = json.Unmarshal(cacheData, &percentages)
-						if err != nil {
-							log.Printf("[INFO] error in cache unmarshal for percentages: %s", err)
-						}
+					if len(percentages) > concurrentChecks {
+						percentages = percentages[:concurrentChecks]
+					}
 
-						if len(percentages) > concurrentChecks {
-							percentages = percentages[:concurrentChecks]
+					percentages = append(percentages, envData.CPUPercent)
+					if len(percentages) > concurrentChecks {
+						//log.Printf("[INFO] Checking percentages: %v", percentages)
+
+						// percentageCheck := 1
+						sendAlert := true
+						for _, p := range percentages {
+							if int(p) < percentageCheck {
+								//log.Printf("[AUDIT] CPU percent is below %d: %d", percentageCheck, int(p))
+								sendAlert = false
+								break
+							}
 						}
 
-						percentages = append(percentages, envData.CPUPercent)
-						if len(percentages) > concurrentChecks {
-							//log.Printf("[INFO] Checking percentages: %v", percentages)
-
-							// percentageCheck := 1
-							sendAlert := true
-							for _, p := range percentages {
-								if int(p) < percentageCheck {
-									//log.Printf("[AUDIT] CPU percent is below %d: %d", percentageCheck, int(p))
-									sendAlert = false
-									break
-								}
+						if sendAlert {
+							log.Printf("[INFO] CPU percent has been above %d percent for the last 5 requests. Sending alert. Env: %s, org: %s", percentageCheck, environment, orgId)
+
+							// Set notification + alert for organization
+							err = shuffle.CreateOrgNotification(
+								ctx,
+								fmt.Sprintf("CPU percent has been above %d percent", percentageCheck),
+								fmt.Sprintf("A environment %s has been using more than %d%% CPU for the last 5 requests.", environment, percentageCheck),
+								fmt.Sprintf("/admin?tab=environments"),
+								orgId,
+								true,
+							)
+
+							if err != nil {
+								log.Printf("[ERROR] error creating notification: %s", err)
 							}
 
-							if sendAlert {
-								log.Printf("[INFO] CPU percent has been above %d percent for the last 5 requests. Sending alert. Env: %s, org: %s", percentageCheck, environment, orgId)
-
-								// Set notification + alert for organization
-								err = shuffle.CreateOrgNotification(
-									ctx,
-									fmt.Sprintf("CPU percent has been above %d percent", percentageCheck),
-									fmt.Sprintf("A environment %s has been using more than %d\\% CPU for the last 5 requests.", environment, percentageCheck),
-									fmt.Sprintf("/admin?tab=environments"),
-									environment,
-									true,
-								)
-
-								if err != nil {
-									log.Printf("[ERROR] error creating notification: %s", err)
-								}
-
-								org, err := shuffle.GetOrg(ctx, environment)
-								if err == nil {
-									foundRecommendation := false
-									for _, recommendation := range org.Priorities {
-										if strings.Contains(recommendation.Name, "CPU") {
-											foundRecommendation = true
-											break
-										}
+							org, err := shuffle.GetOrg(ctx, orgId)
+							if err == nil {
+								foundRecommendation := false
+								for _, recommendation := range org.Priorities {
+									if strings.Contains(recommendation.Name, "CPU") {
+										foundRecommendation = true
+										break
 									}
+								}
 
-									if !foundRecommendation {
-										// Add to start of org.Priorities
-										org, _ = shuffle.AddPriority(*org, shuffle.Priority{
-											Name:        fmt.Sprintf("High CPU in environment %s", orgId),
-											Description: fmt.Sprintf("The environment %s has been using more than %d percent CPU. This indicates you may need to look at scaling.", orgId, percentageCheck),
-											Type:        "scale",
-											Active:      true,
-											URL:         fmt.Sprintf("/admin?tab=environments"),
-											Severity:    1,
-										}, false)
-
-										//Make last item the first item
-										org.Priorities = append([]shuffle.Priority{org.Priorities[len(org.Priorities)-1]}, org.Priorities[:len(org.Priorities)-1]...)
-										err = shuffle.SetOrg(ctx, *org, org.Id)
-										if err != nil {
-											log.Printf("[ERROR] Problem setting org: %s", err)
-										}
+								if !foundRecommendation {
+									// Add to start of org.Priorities
+									org, _ = shuffle.AddPriority(*org, shuffle.Priority{
+										Name:        fmt.Sprintf("High CPU in environment %s", orgId),
+										Description: fmt.Sprintf("The environment %s has been using more than %d percent CPU. This indicates you may need to look at scaling.", orgId, percentageCheck),
+										Type:        "scale",
+										Active:      true,
+										URL:         fmt.Sprintf("/admin?tab=environments"),
+										Severity:    1,
+									}, false)
+
+									//Make last item the first item
+									org.Priorities = append([]shuffle.Priority{org.Priorities[len(org.Priorities)-1]}, org.Priorities[:len(org.Priorities)-1]...)
+									err = shuffle.SetOrg(ctx, *org, org.Id)
+									if err != nil {
+										log.Printf("[ERROR] Problem setting org: %s", err)
 									}
 								}
 							}
-
-							if len(percentages) > 1 {
-								percentages = percentages[1:]
-							}
 						}
 
-						// Marshal float list into []byte
-					} else {
-						//log.Printf("[ERROR] Failed getting cache: %s", err)
-						percentages = append(percentages, envData.CPUPercent)
+						if len(percentages) > 1 {
+							percentages = percentages[1:]
+						}
 					}
 
-					if len(percentages) > 0 {
-						//log.Printf("[DEBUG] Setting cache for %s: %#v", cacheKey, percentages)
-						cacheData, err = json.Marshal(percentages)
-						if err != nil {
-							log.Printf("[INFO] error in cache marshal: %s", err)
-						}
+					// Marshal float list into []byte
+				} else {
+					//log.Printf("[ERROR] Failed getting cache: %s", err)
+					percentages = append(percentages, envData.CPUPercent)
+				}
 
-						// Add the new data
-						go shuffle.SetCache(ctx, cacheKey, cacheData, 5)
+				if len(percentages) > 0 {
+					//log.Printf("[DEBUG] Setting cache for %s: %#v", cacheKey, percentages)
+					cacheData, err = json.Marshal(percentages)
+					if err != nil {
+						log.Printf("[INFO] error in cache marshal: %s", err)
 					}
+
+					// Add the new data
+					go shuffle.SetCache(ctx, cacheKey, cacheData, 5)
 				}
 
 				//log.Printf("CPU percent: %f", envData.CPUPercent)
 				//log.Printf("Memory percent: %f", envData.MemoryPercent*100)
 
-				go shuffle.SetenvStats(ctx, envData)
+				if env != nil {
+					go appendEnvironmentStats(context.Background(), *env, envData)
+				}
 			}
 		}
 	}
@@ -509,6 +506,10 @@ func handleGetWorkflowqueue(resp http.ResponseWriter, request *http.Request) {
 		if len(executionRequests.Data) > 50 {
 			executionRequests.Data = executionRequests.Data[0:49]
 		}
+
+		if env != nil && len(env.OrgId) > 0 {
+			recordOrborusJobs(ctx, env.OrgId, env.Name, environment, executionRequests.Data)
+		}
 	}
 
 	newjson, err := json.Marshal(executionRequests)
@@ -1100,10 +1101,10 @@ func handleExecution(id string, workflow shuffle.Workflow, request *http.Request
 		}
 	}
 
-	err := imageCheckBuilder(execInfo.ImageNames)
+	err := imageCheckBuilder(ctx, execInfo.ImageNames, workflowExecution.Workflow.Actions)
 	if err != nil {
 		log.Printf("[ERROR] Failed building the required images from %#v: %s", execInfo.ImageNames, err)
-		return shuffle.WorkflowExecution{}, "Failed unmarshal during execution", err
+		return shuffle.WorkflowExecution{}, fmt.Sprintf("%s", err), err
 	}
 
 	err = shuffle.SetWorkflowExecution(ctx, workflowExecution, true)
@@ -1141,7 +1142,6 @@ func handleExecution(id string, workflow shuffle.Workflow, request *http.Request
 	}
 
 	// Check if the actions are children of the startnode?
-	imageNames := []string{}
 	cloudExec := false
 	_ = cloudExec
 	for _, action := range workflowExecution.Workflow.Actions {
@@ -1177,22 +1177,11 @@ func handleExecution(id string, workflow shuffle.Workflow, request *http.Request
 			}
 		}
 
-		// Check if the app exists?
-		newName := action.AppName
-		newName = strings.ReplaceAll(newName, " ", "-")
-		imageNames = append(imageNames, fmt.Sprintf("%s:%s_%s", baseDockerName, newName, action.AppVersion))
-
 		if !found {
 			environments = append(environments, action.Environment)
 		}
 	}
 
-	err = imageCheckBuilder(imageNames)
-	if err != nil {
-		log.Printf("[ERROR] Failed building the required images from %#v: %s", imageNames, err)
-		return shuffle.WorkflowExecution{}, "Failed building missing Docker images", err
-	}
-
 	err = shuffle.SetWorkflowExecution(ctx, workflowExecution, true)
 	if err != nil {
 		log.Printf("[WARNING] Error saving workflow execution for updates %s", err)
@@ -2160,16 +2149,18 @@ func validateAppInput(resp http.ResponseWriter, request *http.Request) {
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
 
-func loadGithubWorkflows(url, username, password, userId, branch, orgId string) error {
+// A stored git credential is used over the username and password.
+// Archive sources (tar.gz or zip over HTTPS or S3) are verified with the
+// checksum.
+func loadGithubWorkflows(url, username, password, userId, branch, orgId, credentialId, checksum string) error {
 	fs := memfs.New()
 
 	log.Printf("Starting load of %s with branch %s", url, branch)
-	if strings.Contains(url, "github") || strings.Contains(url, "gitlab") || strings.Contains(url, "bitbucket") {
+	if isGitRepositoryUrl(url) && !isArchiveSourceUrl(url) {
 		cloneOptions := &git.CloneOptions{
 			URL: url,
 		}
 
-		// FIXME: Better auth.
 		if len(username) > 0 && len(password) > 0 {
 			cloneOptions.Auth = &http2.BasicAuth{
 
@@ -2183,6 +2174,11 @@ func loadGithubWorkflows(url, username, password, userId, branch, orgId string)
 			cloneOptions.ReferenceName = plumbing.ReferenceName(branch)
 		}
 
+		err := applyGitCredential(context.Background(), orgId, credentialId, cloneOptions)
+		if err != nil {
+			return err
+		}
+
         cloneOptions = checkGitProxy(cloneOptions)
 
 		storer := memory.NewStorage()
@@ -2201,22 +2197,25 @@ func loadGithubWorkflows(url, username, password, userId, branch, orgId string)
 		log.Printf("Starting workflow folder iteration")
 		iterateWorkflowGithubFolders(fs, dir, "", "", userId, orgId)
 
-	} else if strings.Contains(url, "s3") {
-		//https://docs.aws.amazon.com/sdk-for-go/api/service/s3/
-
-		//sess := session.Must(session.NewSession())
-		//downloader := s3manager.NewDownloader(sess)
-
-		//// Write the contents of S3 Object to the file
-		//storer := memory.NewStorage()
-		//n, err := downloader.Download(storer, &s3.GetObjectInput{
-		//	Bucket: aws.String(myBucket),
-		//	Key:    aws.String(myString),
-		//})
-		//if err != nil {
-		//	return fmt.Errorf("failed to download file, %v", err)
-		//}
-		//fmt.Printf("file downloaded, %d bytes\n", n)
+	} else if isArchiveSourceUrl(url) {
+		fs, err := loadArchiveSource(context.Background(), ArchiveSource{
+			URL:          url,
+			OrgId:        orgId,
+			Checksum:     checksum,
+			CredentialId: credentialId,
+		})
+		if err != nil {
+			log.Printf("[INFO] Failed loading archive %s (workflows): %s", url, err)
+			return err
+		}
+
+		dir, err := fs.ReadDir("/")
+		if err != nil {
+			log.Printf("[WARNING] Failed reading archive folder: %s", err)
+		}
+
+		log.Printf("Starting workflow folder iteration")
+		iterateWorkflowGithubFolders(fs, dir, "", "", userId, orgId)
 	} else {
 		return errors.New(fmt.Sprintf("URL %s is unsupported when downloading workflows", url))
 	}
@@ -2257,10 +2256,12 @@ func loadSpecificWorkflows(resp http.ResponseWriter, request *http.Request) {
 
 	// Field1 & 2 can be a lot of things..
 	type tmpStruct struct {
-		URL    string `json:"url"`
-		Field1 string `json:"field_1"`
-		Field2 string `json:"field_2"`
-		Field3 string `json:"field_3"`
+		URL          string `json:"url"`
+		Field1       string `json:"field_1"`
+		Field2       string `json:"field_2"`
+		Field3       string `json:"field_3"`
+		CredentialId string `json:"credential_id"`
+		Checksum     string `json:"checksum"`
 	}
 	//log.Printf("Body: %s", string(body))
 
@@ -2274,7 +2275,7 @@ func loadSpecificWorkflows(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	// Field3 = branch
-	err = loadGithubWorkflows(tmpBody.URL, tmpBody.Field1, tmpBody.Field2, user.Id, tmpBody.Field3, user.ActiveOrg.Id)
+	err = loadGithubWorkflows(tmpBody.URL, tmpBody.Field1, tmpBody.Field2, user.Id, tmpBody.Field3, user.ActiveOrg.Id, tmpBody.CredentialId, tmpBody.Checksum)
 	if err != nil {
 		log.Printf("Failed to update workflows: %s", err)
 		resp.WriteHeader(401)
@@ -2825,6 +2826,71 @@ func setNewWorkflowApp(resp http.ResponseWriter, request *http.Request) {
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
 
+// Answers to user input sent through a self-hosted relay carry a single
+// use token issued here, instead of the execution authorization
+var userInputTokenCategory = "user_input_tokens"
+var userInputTokenLock sync.Mutex
+
+type userInputToken struct {
+	WorkflowId  string `json:"workflow_id"`
+	ExecutionId string `json:"execution_id"`
+	Created     int64  `json:"created"`
+}
+
+func issueUserInputToken(ctx context.Context, orgId, workflowId, executionId string) (string, error) {
+	token := uuid.NewV4().String()
+	data, err := json.Marshal(userInputToken{
+		WorkflowId:  workflowId,
+		ExecutionId: executionId,
+		Created:     time.Now().Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    orgId,
+		Key:      fmt.Sprintf("%s_%s", userInputTokenCategory, token),
+		Value:    string(data),
+		Category: userInputTokenCategory,
+	})
+
+	return token, err
+}
+
+// Tokens are deleted when used, and expire after a week
+func useUserInputToken(ctx context.Context, orgId, token, workflowId, executionId string) error {
+	if len(token) == 0 {
+		return errors.New("Missing user input token")
+	}
+
+	userInputTokenLock.Lock()
+	defer userInputTokenLock.Unlock()
+
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, userInputTokenCategory, token), userInputTokenCategory)
+	if err != nil {
+		return errors.New("Unknown or already used user input token")
+	}
+
+	tokenData := userInputToken{}
+	err = json.Unmarshal([]byte(cacheData.Value), &tokenData)
+	if err != nil {
+		return err
+	}
+
+	if tokenData.WorkflowId != workflowId || tokenData.ExecutionId != executionId {
+		return errors.New("User input token doesn't match the execution")
+	}
+
+	if tokenData.Created < time.Now().Unix()-7*24*60*60 {
+		return errors.New("User input token has expired")
+	}
+
+	// Only an accepted token is used up
+	cacheId := fmt.Sprintf("%s_%s_%s_%s", orgId, userInputTokenCategory, token, userInputTokenCategory)
+	return shuffle.DeleteKey(ctx, "org_cache", url.QueryEscape(cacheId))
+}
+
 func handleUserInput(trigger shuffle.Trigger, organizationId string, workflowId string, referenceExecution string) error {
 	// E.g. check email
 	sms := ""
@@ -2855,8 +2921,20 @@ func handleUserInput(trigger shuffle.Trigger, organizationId string, workflowId
 	// FIXME: This is not the right time to send them, BUT it's well served for testing. Save -> send email / sms
 	ctx := context.Background()
 	startNode := trigger.ID
+
+	// The email and SMS share the token, so only one of them can be answered
+	inputToken := ""
+	if syncUrl != "https://shuffler.io" && (strings.Contains(triggerType, "email") || strings.Contains(triggerType, "sms")) {
+		var err error
+		inputToken, err = issueUserInputToken(ctx, organizationId, workflowId, referenceExecution)
+		if err != nil {
+			log.Printf("[WARNING] Failed issuing user input token for execution %s: %s", referenceExecution, err)
+			return err
+		}
+	}
 	if strings.Contains(triggerType, "email") {
 		action := shuffle.CloudSyncJob{
+			Id:            inputToken,
 			Type:          "user_input",
 			Action:        "send_email",
 			OrgId:         organizationId,
@@ -2884,6 +2962,7 @@ func handleUserInput(trigger shuffle.Trigger, organizationId string, workflowId
 
 	if strings.Contains(triggerType, "sms") {
 		action := shuffle.CloudSyncJob{
+			Id:            inputToken,
 			Type:          "user_input",
 			Action:        "send_sms",
 			OrgId:         organizationId,
@@ -3232,7 +3311,13 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 				combined = append(combined, appfileData...)
 				combined = append(combined, appPythonData...)
 				combined = append(combined, dockerfileData...)
-				md5 := md5sum(combined)
+				// The content hash covers api.yaml, the Dockerfile and the whole
+				// src tree, so a change in any source file leads to a rebuild
+				contentHash, err := getAppContentHash(fs, extra)
+				if err != nil {
+					log.Printf("[WARNING] Failed hashing app folder %s: %s", extra, err)
+					contentHash = md5sum(combined)
+				}
 
 				var workflowapp shuffle.WorkflowApp
 				err = gyaml.Unmarshal(appfileData, &workflowapp)
@@ -3305,13 +3390,20 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 				//Hash string `json:"hash" datastore:"hash" yaml:"hash"` // api.yaml+dockerfile+src/app.py for apps
 				removeApps := []string{}
 				skip := false
+				unchangedId := ""
 				for _, app := range allapps {
 					if app.Name == workflowapp.Name && app.AppVersion == workflowapp.AppVersion {
 						// FIXME: Check if there's a new APP_SDK as well.
 						// Skip this check if app_sdk is new.
-						if app.Hash == md5 && app.Hash != "" && !forceUpdate {
-							skip = true
-							break
+						if app.Hash == contentHash && app.Hash != "" {
+							unchangedId = app.ID
+
+							// Failed builds are retried even if nothing changed
+							previousBuild, err := getAppBuild(ctx, "", app.ID)
+							if !forceUpdate && (err != nil || previousBuild.Status != "failed") {
+								skip = true
+								break
+							}
 						}
 
 						//log.Printf("Overriding app %s:%s as it exists but has different hash.", app.Name, app.AppVersion)
@@ -3324,52 +3416,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 				}
 
 				// Fixes (appends) authentication parameters if they're required
-				if workflowapp.Authentication.Required {
-					//log.Printf("[INFO] Checking authentication fields and appending for %s!", workflowapp.Name)
-					// FIXME:
-					// Might require reflection into the python code to append the fields as well
-					for index, action := range workflowapp.Actions {
-						if action.AuthNotRequired {
-							log.Printf("Skipping auth setup: %s", action.Name)
-							continue
-						}
-
-						// 1. Check if authentication params exists at all
-						// 2. Check if they're present in the action
-						// 3. Add them IF they DONT exist
-						// 4. Fix python code with reflection (FIXME)
-						appendParams := []shuffle.WorkflowAppActionParameter{}
-						for _, fieldname := range workflowapp.Authentication.Parameters {
-							found := false
-							for index, param := range action.Parameters {
-								if param.Name == fieldname.Name {
-									found = true
-
-									action.Parameters[index].Configuration = true
-									//log.Printf("Set config to true for field %s!", param.Name)
-									break
-								}
-							}
-
-							if !found {
-								appendParams = append(appendParams, shuffle.WorkflowAppActionParameter{
-									Name:          fieldname.Name,
-									Description:   fieldname.Description,
-									Example:       fieldname.Example,
-									Required:      fieldname.Required,
-									Configuration: true,
-									Schema:        fieldname.Schema,
-								})
-							}
-						}
-
-						if len(appendParams) > 0 {
-							//log.Printf("[AUTH] Appending %d params to the START of %s", len(appendParams), action.Name)
-							workflowapp.Actions[index].Parameters = append(appendParams, workflowapp.Actions[index].Parameters...)
-						}
-
-					}
-				}
+				workflowapp = appendAppAuthParameters(workflowapp)
 
 				err = checkWorkflowApp(workflowapp)
 				if err != nil {
@@ -3392,7 +3439,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 				workflowapp.Verified = true
 				workflowapp.Sharing = true
 				workflowapp.Downloaded = true
-				workflowapp.Hash = md5
+				workflowapp.Hash = contentHash
 				workflowapp.Public = true
 
 				err = shuffle.SetWorkflowAppDatastore(ctx, workflowapp, workflowapp.ID)
@@ -3401,6 +3448,30 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 					continue
 				}
 
+				// Unchanged apps keep their image if the last build of it succeeded
+				if !forceUpdate && len(unchangedId) > 0 && hotloadImageIsCurrent(ctx, unchangedId, contentHash, tags[0]) {
+					previousBuild, err := getAppBuild(ctx, "", unchangedId)
+					if err == nil {
+						previousBuild.AppId = workflowapp.ID
+						setAppBuild(ctx, previousBuild)
+					}
+
+					log.Printf("[DEBUG] Skipping rebuild of %s:%s as its content hash is unchanged", workflowapp.Name, workflowapp.AppVersion)
+					continue
+				}
+
+				setAppBuild(ctx, &AppBuild{
+					Id:         uuid.NewV4().String(),
+					AppId:      workflowapp.ID,
+					AppName:    workflowapp.Name,
+					AppVersion: workflowapp.AppVersion,
+					Tags:       tags,
+					Hash:       contentHash,
+					Builder:    "docker",
+					Status:     "building",
+					Created:    time.Now().Unix(),
+				})
+
 				/*
 					err = increaseStatisticsField(ctx, "total_apps_created", workflowapp.ID, 1, "")
 					if err != nil {
@@ -3484,6 +3555,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 		log.Printf("[INFO] Starting build of %d containers (FIRST)", len(buildLaterFirst))
 		for _, item := range buildLaterFirst {
 			err = buildImageMemory(fs, item.Tags, item.Extra, true)
+			finishHotloadBuild(ctx, item.Id, err)
 			if err != nil {
 				orgId := ""
 
@@ -3514,6 +3586,7 @@ func IterateAppGithubFolders(ctx context.Context, fs billy.Filesystem, dir []os.
 			log.Printf("[INFO] Starting build of %d skipped docker images", len(buildLaterList))
 			for _, item := range buildLaterList {
 				err = buildImageMemory(fs, item.Tags, item.Extra, true)
+				finishHotloadBuild(ctx, item.Id, err)
 				if err != nil {
 					log.Printf("[INFO] Failed image build memory: %s", err)
 				} else {
@@ -3563,12 +3636,16 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 	// Field1 & 2 can be a lot of things.
 	// Field1 = Username
 	// Field2 = Password
+	// CredentialId = A stored git credential, used over Field1 & 2
+	// Checksum = sha256 of an archive source
 	type tmpStruct struct {
-		URL         string `json:"url"`
-		Branch      string `json:"branch"`
-		Field1      string `json:"field_1"`
-		Field2      string `json:"field_2"`
-		ForceUpdate bool   `json:"force_update"`
+		URL          string `json:"url"`
+		Branch       string `json:"branch"`
+		Field1       string `json:"field_1"`
+		Field2       string `json:"field_2"`
+		ForceUpdate  bool   `json:"force_update"`
+		CredentialId string `json:"credential_id"`
+		Checksum     string `json:"checksum"`
 	}
 	//log.Printf("Body: %s", string(body))
 
@@ -3583,7 +3660,7 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 
 	fs := memfs.New()
 	ctx := context.Background()
-	if strings.Contains(tmpBody.URL, "github") || strings.Contains(tmpBody.URL, "gitlab") || strings.Contains(tmpBody.URL, "bitbucket") {
+	if isGitRepositoryUrl(tmpBody.URL) && !isArchiveSourceUrl(tmpBody.URL) {
 		cloneOptions := &git.CloneOptions{
 			URL: tmpBody.URL,
 		}
@@ -3592,7 +3669,6 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 			cloneOptions.ReferenceName = plumbing.ReferenceName(tmpBody.Branch)
 		}
 
-		// FIXME: Better auth.
 		if len(tmpBody.Field1) > 0 && len(tmpBody.Field2) > 0 {
 			cloneOptions.Auth = &http2.BasicAuth{
 				Username: tmpBody.Field1,
@@ -3600,6 +3676,13 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 			}
 		}
 
+		err = applyGitCredential(ctx, user.ActiveOrg.Id, tmpBody.CredentialId, cloneOptions)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, err)))
+			return
+		}
+
         cloneOptions = checkGitProxy(cloneOptions)
 
 		storer := memory.NewStorage()
@@ -3637,7 +3720,7 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 				} else {
 					_, err := dockercli.ImagePull(ctx, fmt.Sprintf("%s/%s/shuffle-app_sdk:%s", "ghcr.io", "frikky", appSdk), image.PullOptions{})
 					if err != nil {
-						log.Printf("[WARNING] Failed to download new App SDK %s: %s", err)
+						log.Printf("[WARNING] Failed to download new App SDK %s: %s", appSdk, err)
 					}
 
 				}
@@ -3648,22 +3731,27 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 
 		IterateAppGithubFolders(ctx, fs, dir, "", "", tmpBody.ForceUpdate)
 
-	} else if strings.Contains(tmpBody.URL, "s3") {
-		//https://docs.aws.amazon.com/sdk-for-go/api/service/s3/
-
-		//sess := session.Must(session.NewSession())
-		//downloader := s3manager.NewDownloader(sess)
-
-		//// Write the contents of S3 Object to the file
-		//storer := memory.NewStorage()
-		//n, err := downloader.Download(storer, &s3.GetObjectInput{
-		//	Bucket: aws.String(myBucket),
-		//	Key:    aws.String(myString),
-		//})
-		//if err != nil {
-		//	return fmt.Errorf("failed to download file, %v", err)
-		//}
-		//fmt.Printf("file downloaded, %d bytes\n", n)
+	} else if isArchiveSourceUrl(tmpBody.URL) {
+		fs, err := loadArchiveSource(ctx, ArchiveSource{
+			URL:          tmpBody.URL,
+			OrgId:        user.ActiveOrg.Id,
+			Checksum:     tmpBody.Checksum,
+			CredentialId: tmpBody.CredentialId,
+		})
+		if err != nil {
+			log.Printf("[WARNING] Failed loading archive %s (apps): %s", tmpBody.URL, err)
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+			return
+		}
+
+		dir, err := fs.ReadDir("/")
+		if err != nil {
+			log.Printf("[WARNING] Failed reading archive folder: %s", err)
+		}
+
+		log.Printf("[AUDIT] Loading apps from archive %s for user %s (%s). Force: %t", tmpBody.URL, user.Username, user.Id, tmpBody.ForceUpdate)
+		IterateAppGithubFolders(ctx, fs, dir, "", "", tmpBody.ForceUpdate)
 	} else {
 		resp.WriteHeader(401)
 		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s is unsupported"}`, tmpBody.URL)))
@@ -3681,6 +3769,161 @@ func LoadSpecificApps(resp http.ResponseWriter, request *http.Request) {
 	resp.Write([]byte(fmt.Sprintf(`{"success": true}`)))
 }
 
+// Hashes api.yaml, the Dockerfile and every file under src/ of an app version
+func getAppContentHash(fs billy.Filesystem, extra string) (string, error) {
+	hasher := sha256.New()
+	found := false
+	for _, filename := range []string{"api.yaml", "api.yml", "Dockerfile"} {
+		fileReader, err := fs.Open(fmt.Sprintf("%s%s", extra, filename))
+		if err != nil {
+			continue
+		}
+
+		fileData, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return "", err
+		}
+
+		found = true
+		hasher.Write([]byte(fmt.Sprintf("%s:%d\n", filename, len(fileData))))
+		hasher.Write(fileData)
+	}
+
+	if !found {
+		return "", errors.New("No app files found to hash")
+	}
+
+	err := hashAppSourceFolder(fs, hasher, fmt.Sprintf("%ssrc", extra), "src")
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func hashAppSourceFolder(fs billy.Filesystem, hasher hash.Hash, folder, relativePath string) error {
+	files, err := fs.ReadDir(folder)
+	if err != nil {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	for _, file := range files {
+		filePath := fmt.Sprintf("%s/%s", folder, file.Name())
+		fileRelativePath := fmt.Sprintf("%s/%s", relativePath, file.Name())
+		if file.IsDir() {
+			if file.Name() == "__pycache__" {
+				continue
+			}
+
+			err = hashAppSourceFolder(fs, hasher, filePath, fileRelativePath)
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		fileReader, err := fs.Open(filePath)
+		if err != nil {
+			return err
+		}
+
+		fileData, err := ioutil.ReadAll(fileReader)
+		fileReader.Close()
+		if err != nil {
+			return err
+		}
+
+		hasher.Write([]byte(fmt.Sprintf("%s:%d\n", fileRelativePath, len(fileData))))
+		hasher.Write(fileData)
+	}
+
+	return nil
+}
+
+// An image is current if the last build of the same content hash succeeded
+// and the image still exists
+func hotloadImageIsCurrent(ctx context.Context, appId, contentHash, imageName string) bool {
+	previousBuild, err := getAppBuild(ctx, "", appId)
+	if err != nil || previousBuild.Status != "ready" || previousBuild.Hash != contentHash {
+		return false
+	}
+
+	dockercli, err := dockerclient.NewEnvClient()
+	if err != nil {
+		return appImageExists(ctx, nil, imageName)
+	}
+	defer dockercli.Close()
+
+	return appImageExists(ctx, dockercli, imageName)
+}
+
+func finishHotloadBuild(ctx context.Context, appId string, err error) {
+	build, getErr := getAppBuild(ctx, "", appId)
+	if getErr != nil {
+		return
+	}
+
+	finishAppBuild(ctx, build, "", err)
+}
+
+// Appends the authentication parameters of an app to the actions that need them
+func appendAppAuthParameters(workflowapp shuffle.WorkflowApp) shuffle.WorkflowApp {
+	if workflowapp.Authentication.Required {
+		//log.Printf("[INFO] Checking authentication fields and appending for %s!", workflowapp.Name)
+		// FIXME:
+		// Might require reflection into the python code to append the fields as well
+		for index, action := range workflowapp.Actions {
+			if action.AuthNotRequired {
+				log.Printf("Skipping auth setup: %s", action.Name)
+				continue
+			}
+
+			// 1. Check if authentication params exists at all
+			// 2. Check if they're present in the action
+			// 3. Add them IF they DONT exist
+			// 4. Fix python code with reflection (FIXME)
+			appendParams := []shuffle.WorkflowAppActionParameter{}
+			for _, fieldname := range workflowapp.Authentication.Parameters {
+				found := false
+				for index, param := range action.Parameters {
+					if param.Name == fieldname.Name {
+						found = true
+
+						action.Parameters[index].Configuration = true
+						//log.Printf("Set config to true for field %s!", param.Name)
+						break
+					}
+				}
+
+				if !found {
+					appendParams = append(appendParams, shuffle.WorkflowAppActionParameter{
+						Name:          fieldname.Name,
+						Description:   fieldname.Description,
+						Example:       fieldname.Example,
+						Required:      fieldname.Required,
+						Configuration: true,
+						Schema:        fieldname.Schema,
+					})
+				}
+			}
+
+			if len(appendParams) > 0 {
+				//log.Printf("[AUTH] Appending %d params to the START of %s", len(appendParams), action.Name)
+				workflowapp.Actions[index].Parameters = append(appendParams, workflowapp.Actions[index].Parameters...)
+			}
+
+		}
+	}
+
+	return workflowapp
+}
+
 // Bad check for workflowapps :)
 // FIXME - use tags and struct reflection
 func checkWorkflowApp(workflowApp shuffle.WorkflowApp) error {
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Workflows are sanitized before they are published, as parameters often
+// contain pasted API keys and internal hostnames. With
+// SHUFFLE_WORKFLOW_PUBLISH_APPROVAL=true a second admin has to approve
+// the sanitized workflow before it leaves the org.
+var workflowPublishCategory = "workflow_publish_requests"
+var workflowPublishReviewLock sync.Mutex
+
+type WorkflowPublishChange struct {
+	Location string `json:"location"`
+	Id       string `json:"id"`
+	Label    string `json:"label"`
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	Before   string `json:"before"`
+	After    string `json:"after"`
+}
+
+type WorkflowPublishRequest struct {
+	Id            string                  `json:"id"`
+	OrgId         string                  `json:"org_id"`
+	WorkflowId    string                  `json:"workflow_id"`
+	WorkflowName  string                  `json:"workflow_name"`
+	Workflow      string                  `json:"workflow"`
+	Changes       []WorkflowPublishChange `json:"changes"`
+	Status        string                  `json:"status"`
+	RequestedBy   string                  `json:"requested_by"`
+	RequestedName string                  `json:"requested_name"`
+	ReviewedBy    string                  `json:"reviewed_by"`
+	ReviewedName  string                  `json:"reviewed_name"`
+	Created       int64                   `json:"created"`
+	Edited        int64                   `json:"edited"`
+}
+
+type workflowPublishPattern struct {
+	Type        string
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+var workflowPublishPatterns = []workflowPublishPattern{
+	workflowPublishPattern{"credential", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\b[rs]k_(?:live|test)_[0-9A-Za-z]{16,}`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), "REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`(?i)\b(bearer|basic|token)\s+[A-Za-z0-9._~+/-]{16,}=*`), "${1} REDACTED"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`(?i)\b([a-z][a-z0-9+.-]*://)[^/\s:@"']+:[^/\s@"']+@`), "${1}"},
+	workflowPublishPattern{"credential", regexp.MustCompile(`(?i)((?:api[_-]?key|apikey|secret|passw(?:or)?d|token|access[_-]?key|client[_-]?secret)["']?\s*[:=]\s*["']?)[^\s"'&,;}$]{6,}`), "${1}REDACTED"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`\b(?:10(?:\.\d{1,3}){3}|127(?:\.\d{1,3}){3}|169\.254(?:\.\d{1,3}){2}|192\.168(?:\.\d{1,3}){2}|172\.(?:1[6-9]|2\d|3[01])(?:\.\d{1,3}){2})\b`), "REDACTED_IP"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`\b100\.(?:6[4-9]|[7-9]\d|1[01]\d|12[0-7])(?:\.\d{1,3}){2}\b`), "REDACTED_IP"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`(?i)(^|[^0-9a-z:])(?:f[cd][0-9a-f]{2}|fe[89ab][0-9a-f]):[0-9a-f:]*[0-9a-f]`), "${1}REDACTED_IP"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`(?i)(^|[^0-9a-z:])::1($|[^0-9a-z:])`), "${1}REDACTED_IP${2}"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`(?i)\b(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+(?:local|internal|intranet|corp|lan|localdomain|localhost|home\.arpa)\b`), "REDACTED_HOST"},
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`(?i)\blocalhost\b`), "REDACTED_HOST"},
+
+	// Single label hosts in URLs, e.g. http://shuffle-backend:5001, are service names
+	workflowPublishPattern{"internal_host", regexp.MustCompile(`(?i)(\b[a-z][a-z0-9+.-]*://)[a-z0-9](?:[a-z0-9_-]{0,61}[a-z0-9])?([:/?#\s"']|$)`), "${1}REDACTED_HOST${2}"},
+}
+
+// Extra internal domains, e.g. SHUFFLE_PUBLISH_INTERNAL_DOMAINS=example.com,example.net
+func getWorkflowPublishPatterns() []workflowPublishPattern {
+	patterns := workflowPublishPatterns
+	for _, domain := range strings.Split(os.Getenv("SHUFFLE_PUBLISH_INTERNAL_DOMAINS"), ",") {
+		domain = strings.Trim(strings.TrimSpace(domain), ".")
+		if len(domain) == 0 {
+			continue
+		}
+
+		patterns = append(patterns, workflowPublishPattern{
+			Type:        "internal_host",
+			Pattern:     regexp.MustCompile(fmt.Sprintf(`(?i)\b(?:[a-z0-9-]+\.)*%s\b`, regexp.QuoteMeta(domain))),
+			Replacement: "REDACTED_HOST",
+		})
+	}
+
+	return patterns
+}
+
+func isWorkflowPublishApprovalRequired() bool {
+	return strings.ToLower(os.Getenv("SHUFFLE_WORKFLOW_PUBLISH_APPROVAL")) == "true"
+}
+
+// Masks credentials in the diff, so the review doesn't leak them either
+func maskWorkflowPublishValue(value, changeType string) string {
+	if changeType != "credential" {
+		return value
+	}
+
+	if len(value) <= 4 {
+		return "****"
+	}
+
+	return fmt.Sprintf("%s****", value[0:4])
+}
+
+// Returns the sanitized value and the type of the first match. Values
+// which only reference other data, e.g. $exec.token, are kept as is.
+func sanitizeWorkflowPublishValue(patterns []workflowPublishPattern, value string, secretName bool) (string, string) {
+	if len(value) == 0 {
+		return value, ""
+	}
+
+	if secretName && !strings.HasPrefix(strings.TrimSpace(value), "$") {
+		return "", "credential"
+	}
+
+	foundType := ""
+	for _, pattern := range patterns {
+		if !pattern.Pattern.MatchString(value) {
+			continue
+		}
+
+		value = pattern.Pattern.ReplaceAllString(value, pattern.Replacement)
+		if len(foundType) == 0 {
+			foundType = pattern.Type
+		}
+	}
+
+	return value, foundType
+}
+
+// Strips credentials, internal hosts and authentication IDs from actions,
+// triggers and variables. Returns the sanitized workflow and what changed.
+func sanitizeWorkflowForPublish(workflow shuffle.Workflow) (shuffle.Workflow, []WorkflowPublishChange) {
+	patterns := getWorkflowPublishPatterns()
+	changes := []WorkflowPublishChange{}
+	addChange := func(location, id, label, field, changeType, before, after string) {
+		changes = append(changes, WorkflowPublishChange{
+			Location: location,
+			Id:       id,
+			Label:    label,
+			Field:    field,
+			Type:     changeType,
+			Before:   maskWorkflowPublishValue(before, changeType),
+			After:    after,
+		})
+	}
+
+	actions := []shuffle.Action{}
+	for _, action := range workflow.Actions {
+		if len(action.AuthenticationId) > 0 {
+			addChange("action", action.ID, action.Label, "authentication_id", "auth_id", action.AuthenticationId, "")
+			action.AuthenticationId = ""
+		}
+
+		params := []shuffle.WorkflowAppActionParameter{}
+		for _, param := range action.Parameters {
+			sanitized, changeType := sanitizeWorkflowPublishValue(patterns, param.Value, isWorkflowSecretParameter(param))
+			if len(changeType) > 0 {
+				addChange("action", action.ID, action.Label, param.Name, changeType, param.Value, sanitized)
+				param.Value = sanitized
+			}
+
+			params = append(params, param)
+		}
+
+		action.Parameters = params
+		actions = append(actions, action)
+	}
+
+	triggers := []shuffle.Trigger{}
+	for _, trigger := range workflow.Triggers {
+		params := []shuffle.WorkflowAppActionParameter{}
+		for _, param := range trigger.Parameters {
+			sanitized, changeType := sanitizeWorkflowPublishValue(patterns, param.Value, isWorkflowSecretParameter(param))
+			if len(changeType) > 0 {
+				addChange("trigger", trigger.ID, trigger.Label, param.Name, changeType, param.Value, sanitized)
+				param.Value = sanitized
+			}
+
+			params = append(params, param)
+		}
+
+		trigger.Parameters = params
+		triggers = append(triggers, trigger)
+	}
+
+	variables := []shuffle.Variable{}
+	for _, variable := range workflow.WorkflowVariables {
+		sanitized, changeType := sanitizeWorkflowPublishValue(patterns, variable.Value, workflowSecretPattern.MatchString(variable.Name))
+		if len(changeType) > 0 {
+			addChange("variable", variable.ID, variable.Name, "value", changeType, variable.Value, sanitized)
+			variable.Value = sanitized
+		}
+
+		variables = append(variables, variable)
+	}
+
+	workflow.Actions = actions
+	workflow.Triggers = triggers
+	workflow.WorkflowVariables = variables
+	return workflow, changes
+}
+
+func getWorkflowPublishRequest(ctx context.Context, orgId, requestId string) (*WorkflowPublishRequest, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, workflowPublishCategory, requestId), workflowPublishCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	publishRequest := WorkflowPublishRequest{}
+	err = json.Unmarshal([]byte(cacheData.Value), &publishRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &publishRequest, nil
+}
+
+func getWorkflowPublishRequests(ctx context.Context, orgId string) ([]WorkflowPublishRequest, error) {
+	publishRequests := []WorkflowPublishRequest{}
+	cacheKeys, _, err := shuffle.GetAllCacheKeys(ctx, orgId, workflowPublishCategory, 100, "")
+	if err != nil {
+		return publishRequests, err
+	}
+
+	for _, cacheKey := range cacheKeys {
+		publishRequest := WorkflowPublishRequest{}
+		err = json.Unmarshal([]byte(cacheKey.Value), &publishRequest)
+		if err != nil || len(publishRequest.Id) == 0 {
+			continue
+		}
+
+		publishRequests = append(publishRequests, publishRequest)
+	}
+
+	sort.Slice(publishRequests, func(i, j int) bool {
+		return publishRequests[i].Created > publishRequests[j].Created
+	})
+
+	return publishRequests, nil
+}
+
+func setWorkflowPublishRequest(ctx context.Context, publishRequest WorkflowPublishRequest) error {
+	publishRequest.Edited = time.Now().Unix()
+	data, err := json.Marshal(publishRequest)
+	if err != nil {
+		return err
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    publishRequest.OrgId,
+		Key:      fmt.Sprintf("%s_%s", workflowPublishCategory, publishRequest.Id),
+		Value:    string(data),
+		Category: workflowPublishCategory,
+	})
+}
+
+func newWorkflowPublishRequest(user shuffle.User, workflow shuffle.Workflow, workflowData []byte, changes []WorkflowPublishChange) WorkflowPublishRequest {
+	return WorkflowPublishRequest{
+		Id:            uuid.NewV4().String(),
+		OrgId:         user.ActiveOrg.Id,
+		WorkflowId:    workflow.ID,
+		WorkflowName:  workflow.Name,
+		Workflow:      string(workflowData),
+		Changes:       changes,
+		Status:        "pending",
+		RequestedBy:   user.Id,
+		RequestedName: user.Username,
+		Created:       time.Now().Unix(),
+	}
+}
+
+// Sends the sanitized workflow to the cloud
+func publishWorkflowToCloud(ctx context.Context, orgId, workflowId, userId string, workflowData []byte) error {
+	action := shuffle.CloudSyncJob{
+		Type:          "workflow",
+		Action:        "publish",
+		OrgId:         orgId,
+		PrimaryItemId: workflowId,
+		SecondaryItem: string(workflowData),
+		FifthItem:     userId,
+	}
+
+	org, err := shuffle.GetOrg(ctx, orgId)
+	if err != nil {
+		log.Printf("[WARNING] Failed setting getting org during cloud job setting: %s", err)
+		return err
+	}
+
+	return executeCloudAction(action, org.SyncConfig.Apikey)
+}
+
+func handleGetWorkflowPublishRequests(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in get workflow publish requests: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to review published workflows"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	publishRequests, err := getWorkflowPublishRequests(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting workflow publish requests for org %s: %s", user.ActiveOrg.Id, err)
+	}
+
+	newjson, err := json.Marshal(publishRequests)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling publish requests"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Approves or rejects a pending publish. The admin approving it can't be
+// the one who requested it.
+func handleWorkflowPublishRequestAction(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in workflow publish review: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to review published workflows"}`))
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 8 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Missing publish request id or action"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	requestId := location[6]
+	action := location[7]
+	publishRequest, err := getWorkflowPublishRequest(ctx, user.ActiveOrg.Id, requestId)
+	if err != nil || publishRequest.OrgId != user.ActiveOrg.Id {
+		resp.WriteHeader(404)
+		resp.Write([]byte(`{"success": false, "reason": "Publish request not found"}`))
+		return
+	}
+
+	if publishRequest.RequestedBy == user.Id {
+		resp.WriteHeader(403)
+		resp.Write([]byte(`{"success": false, "reason": "A different admin has to review the publish request"}`))
+		return
+	}
+
+	// The request is claimed before publishing, so two reviews at the same
+	// time can't both publish it
+	workflowPublishReviewLock.Lock()
+	publishRequest, err = getWorkflowPublishRequest(ctx, user.ActiveOrg.Id, requestId)
+	if err == nil && publishRequest.Status == "pending" && action == "approve" {
+		publishRequest.Status = "approving"
+		err = setWorkflowPublishRequest(ctx, *publishRequest)
+		if err != nil {
+			publishRequest.Status = "pending"
+		}
+	}
+	workflowPublishReviewLock.Unlock()
+
+	if err != nil {
+		log.Printf("[WARNING] Failed claiming publish request %s: %s", requestId, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed updating publish request"}`))
+		return
+	}
+
+	if (action == "approve" && publishRequest.Status != "approving") || (action != "approve" && publishRequest.Status != "pending") {
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "Publish request is already %s"}`, publishRequest.Status)))
+		return
+	}
+
+	if action == "approve" {
+		err = publishWorkflowToCloud(ctx, publishRequest.OrgId, publishRequest.WorkflowId, publishRequest.RequestedBy, []byte(publishRequest.Workflow))
+		if err != nil {
+			log.Printf("[WARNING] Failed cloud PUBLISH of approved workflow %s: %s", publishRequest.WorkflowId, err)
+			publishRequest.Status = "pending"
+			saveErr := setWorkflowPublishRequest(ctx, *publishRequest)
+			if saveErr != nil {
+				log.Printf("[WARNING] Failed resetting publish request %s: %s", publishRequest.Id, saveErr)
+			}
+
+			resp.WriteHeader(400)
+			resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+			return
+		}
+
+		publishRequest.Status = "approved"
+	} else if action == "reject" {
+		publishRequest.Status = "rejected"
+	} else {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Unknown action"}`))
+		return
+	}
+
+	publishRequest.ReviewedBy = user.Id
+	publishRequest.ReviewedName = user.Username
+	err = setWorkflowPublishRequest(ctx, *publishRequest)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving publish request %s: %s", publishRequest.Id, err)
+	}
+
+	log.Printf("[AUDIT] User %s (%s) %s publishing workflow %s (%s) requested by %s", user.Username, user.Id, publishRequest.Status, publishRequest.WorkflowName, publishRequest.WorkflowId, publishRequest.RequestedName)
+	resp.WriteHeader(200)
+	resp.Write([]byte(fmt.Sprintf(`{"success": true, "status": "%s"}`, publishRequest.Status)))
+}
@@ -0,0 +1,973 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gyaml "github.com/ghodss/yaml"
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/shuffle/shuffle-shared"
+)
+
+// Workflows-as-code: workflows are exported to a git repository as
+// normalized files without secrets, and imported back from it. The hash
+// of each workflow at the last sync is kept to detect when both sides
+// changed.
+var workflowGitCategory = "workflow_git"
+
+// Parameter and variable names which are treated as secrets
+var workflowSecretPattern = regexp.MustCompile(`(?i)(passw|secret|token|api_?key|apikey|auth|private|credential|cookie|session)`)
+
+// Exports and imports of an org run one at a time, as each of them clones,
+// pushes and saves the sync state of the org
+var workflowGitLocks sync.Map
+
+type WorkflowGitState struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Hash   string `json:"hash"`
+	Commit string `json:"commit"`
+	Synced int64  `json:"synced"`
+}
+
+type WorkflowGitConfig struct {
+	OrgId        string `json:"org_id"`
+	URL          string `json:"url"`
+	Branch       string `json:"branch"`
+	CredentialId string `json:"credential_id"`
+
+	// Folder in the repository. Defaults to "workflows".
+	Folder string `json:"folder"`
+
+	// json or yaml
+	Format      string `json:"format"`
+	SyncOnSave  bool   `json:"sync_on_save"`
+	AuthorName  string `json:"author_name"`
+	AuthorEmail string `json:"author_email"`
+
+	Workflows map[string]WorkflowGitState `json:"workflows"`
+	LastPush  int64                       `json:"last_push"`
+	LastPull  int64                       `json:"last_pull"`
+	LastError string                      `json:"last_error"`
+	Edited    int64                       `json:"edited"`
+}
+
+type WorkflowGitResult struct {
+	Success   bool     `json:"success"`
+	Commit    string   `json:"commit,omitempty"`
+	Updated   []string `json:"updated"`
+	Unchanged []string `json:"unchanged"`
+	Conflicts []string `json:"conflicts"`
+	Errors    []string `json:"errors"`
+}
+
+func getWorkflowGitConfig(ctx context.Context, orgId string) (*WorkflowGitConfig, error) {
+	cacheData, err := shuffle.GetDatastoreKey(ctx, fmt.Sprintf("%s_%s_%s", orgId, workflowGitCategory, orgId), workflowGitCategory)
+	if err != nil {
+		return nil, err
+	}
+
+	config := WorkflowGitConfig{}
+	err = json.Unmarshal([]byte(cacheData.Value), &config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Workflows == nil {
+		config.Workflows = map[string]WorkflowGitState{}
+	}
+
+	return &config, nil
+}
+
+func setWorkflowGitConfig(ctx context.Context, config WorkflowGitConfig) error {
+	config.Edited = time.Now().Unix()
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return shuffle.SetDatastoreKey(ctx, shuffle.CacheKeyData{
+		OrgId:    config.OrgId,
+		Key:      fmt.Sprintf("%s_%s", workflowGitCategory, config.OrgId),
+		Value:    string(data),
+		Category: workflowGitCategory,
+	})
+}
+
+func isWorkflowSecretParameter(param shuffle.WorkflowAppActionParameter) bool {
+	return param.Configuration || workflowSecretPattern.MatchString(param.Name)
+}
+
+func lockWorkflowGit(orgId string) func() {
+	lock, _ := workflowGitLocks.LoadOrStore(orgId, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// Strips credentials found in the value itself, e.g. in headers, URL query
+// strings and bodies, with the credential patterns used when publishing
+func stripWorkflowGitSecrets(value string) string {
+	for _, pattern := range workflowPublishPatterns {
+		if pattern.Type != "credential" || !pattern.Pattern.MatchString(value) {
+			continue
+		}
+
+		value = pattern.Pattern.ReplaceAllString(value, pattern.Replacement)
+	}
+
+	return value
+}
+
+// Restores a value stripped on export, as long as the git value is what
+// the existing value exports to
+func restoreWorkflowGitValue(value, existingValue string) string {
+	if len(value) == 0 || stripWorkflowGitSecrets(existingValue) == value {
+		return existingValue
+	}
+
+	return value
+}
+
+// Workflows with secrets still missing after an import can't run as is
+func isWorkflowGitIncomplete(workflow shuffle.Workflow) bool {
+	for _, action := range workflow.Actions {
+		for _, param := range action.Parameters {
+			if strings.Contains(param.Value, "REDACTED") || (param.Required && len(param.Value) == 0 && isWorkflowSecretParameter(param)) {
+				return true
+			}
+		}
+	}
+
+	for _, trigger := range workflow.Triggers {
+		for _, param := range trigger.Parameters {
+			if strings.Contains(param.Value, "REDACTED") {
+				return true
+			}
+		}
+	}
+
+	for _, variable := range workflow.WorkflowVariables {
+		if strings.Contains(variable.Value, "REDACTED") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Strips secrets, org specific fields and runtime state, and sorts the
+// workflow so the same workflow always gives the same file
+func normalizeWorkflowForGit(workflow shuffle.Workflow) shuffle.Workflow {
+	workflow = shuffle.SanitizeWorkflow(workflow)
+	workflow.Created = 0
+	workflow.Edited = 0
+	workflow.LastRuntime = 0
+	workflow.Errors = []string{}
+	workflow.IsValid = false
+	workflow.UpdatedBy = ""
+	workflow.Validated = false
+	workflow.Validation = shuffle.TypeValidation{}
+	workflow.RevisionId = ""
+	workflow.Image = ""
+	workflow.ChildWorkflowIds = []string{}
+
+	actions := []shuffle.Action{}
+	for _, action := range workflow.Actions {
+		action.AuthenticationId = ""
+		action.Errors = []string{}
+		action.SmallImage = ""
+		action.LargeImage = ""
+		action.InvalidParameters = []shuffle.WorkflowAppActionParameter{}
+
+		params := []shuffle.WorkflowAppActionParameter{}
+		for _, param := range action.Parameters {
+			if isWorkflowSecretParameter(param) {
+				param.Value = ""
+			} else {
+				param.Value = stripWorkflowGitSecrets(param.Value)
+			}
+
+			params = append(params, param)
+		}
+
+		action.Parameters = params
+		actions = append(actions, action)
+	}
+
+	triggers := []shuffle.Trigger{}
+	for _, trigger := range workflow.Triggers {
+		trigger.Errors = []string{}
+		trigger.SmallImage = ""
+		trigger.LargeImage = ""
+
+		params := []shuffle.WorkflowAppActionParameter{}
+		for _, param := range trigger.Parameters {
+			if isWorkflowSecretParameter(param) || param.Name == "auth_headers" {
+				param.Value = ""
+			} else {
+				param.Value = stripWorkflowGitSecrets(param.Value)
+			}
+
+			params = append(params, param)
+		}
+
+		trigger.Parameters = params
+		triggers = append(triggers, trigger)
+	}
+
+	variables := []shuffle.Variable{}
+	for _, variable := range workflow.WorkflowVariables {
+		if workflowSecretPattern.MatchString(variable.Name) {
+			variable.Value = ""
+		} else {
+			variable.Value = stripWorkflowGitSecrets(variable.Value)
+		}
+
+		variables = append(variables, variable)
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].ID < actions[j].ID })
+	sort.Slice(triggers, func(i, j int) bool { return triggers[i].ID < triggers[j].ID })
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	branches := append([]shuffle.Branch{}, workflow.Branches...)
+	sort.Slice(branches, func(i, j int) bool { return branches[i].ID < branches[j].ID })
+
+	workflow.Actions = actions
+	workflow.Triggers = triggers
+	workflow.Branches = branches
+	workflow.WorkflowVariables = variables
+	return workflow
+}
+
+// Puts back the secrets and images stripped by normalizeWorkflowForGit,
+// using the existing workflow
+func restoreWorkflowFromGit(imported, existing shuffle.Workflow) shuffle.Workflow {
+	existingActions := map[string]shuffle.Action{}
+	for _, action := range existing.Actions {
+		existingActions[action.ID] = action
+	}
+
+	for actionIndex, action := range imported.Actions {
+		existingAction, found := existingActions[action.ID]
+		if !found {
+			continue
+		}
+
+		imported.Actions[actionIndex].AuthenticationId = existingAction.AuthenticationId
+		imported.Actions[actionIndex].SmallImage = existingAction.SmallImage
+		imported.Actions[actionIndex].LargeImage = existingAction.LargeImage
+		for paramIndex, param := range action.Parameters {
+			for _, existingParam := range existingAction.Parameters {
+				if existingParam.Name == param.Name {
+					imported.Actions[actionIndex].Parameters[paramIndex].Value = restoreWorkflowGitValue(param.Value, existingParam.Value)
+					break
+				}
+			}
+		}
+	}
+
+	existingTriggers := map[string]shuffle.Trigger{}
+	for _, trigger := range existing.Triggers {
+		existingTriggers[trigger.ID] = trigger
+	}
+
+	for triggerIndex, trigger := range imported.Triggers {
+		existingTrigger, found := existingTriggers[trigger.ID]
+		if !found {
+			continue
+		}
+
+		imported.Triggers[triggerIndex].SmallImage = existingTrigger.SmallImage
+		imported.Triggers[triggerIndex].LargeImage = existingTrigger.LargeImage
+		for paramIndex, param := range trigger.Parameters {
+			for _, existingParam := range existingTrigger.Parameters {
+				if existingParam.Name == param.Name {
+					imported.Triggers[triggerIndex].Parameters[paramIndex].Value = restoreWorkflowGitValue(param.Value, existingParam.Value)
+					break
+				}
+			}
+		}
+	}
+
+	for variableIndex, variable := range imported.WorkflowVariables {
+		for _, existingVariable := range existing.WorkflowVariables {
+			if existingVariable.Name == variable.Name {
+				imported.WorkflowVariables[variableIndex].Value = restoreWorkflowGitValue(variable.Value, existingVariable.Value)
+				break
+			}
+		}
+	}
+
+	imported.Owner = existing.Owner
+	imported.OrgId = existing.OrgId
+	imported.Org = existing.Org
+	imported.ExecutingOrg = existing.ExecutingOrg
+	imported.Created = existing.Created
+	imported.Image = existing.Image
+	imported.PreviouslySaved = existing.PreviouslySaved
+	imported.ChildWorkflowIds = existing.ChildWorkflowIds
+	imported.IsValid = existing.IsValid
+	imported.Errors = existing.Errors
+	return imported
+}
+
+func marshalWorkflowForGit(workflow shuffle.Workflow, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(normalizeWorkflowForGit(workflow), "", "  ")
+	if err != nil {
+		return data, err
+	}
+
+	if format == "yaml" {
+		return gyaml.JSONToYAML(data)
+	}
+
+	return append(data, '\n'), nil
+}
+
+func unmarshalWorkflowFromGit(data []byte, filename string) (shuffle.Workflow, error) {
+	workflow := shuffle.Workflow{}
+	if strings.HasSuffix(filename, ".yaml") || strings.HasSuffix(filename, ".yml") {
+		jsonData, err := gyaml.YAMLToJSON(data)
+		if err != nil {
+			return workflow, err
+		}
+
+		data = jsonData
+	}
+
+	err := json.Unmarshal(data, &workflow)
+	return workflow, err
+}
+
+// The hash is over the normalized workflow, so formatting changes in the
+// repository don't count as changes
+func getWorkflowGitHash(workflow shuffle.Workflow) string {
+	data, err := json.Marshal(normalizeWorkflowForGit(workflow))
+	if err != nil {
+		return ""
+	}
+
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func getWorkflowGitPath(config WorkflowGitConfig, workflow shuffle.Workflow) string {
+	if state, found := config.Workflows[workflow.ID]; found && len(state.Path) > 0 {
+		return state.Path
+	}
+
+	extension := "json"
+	if config.Format == "yaml" {
+		extension = "yaml"
+	}
+
+	return path.Join(config.Folder, fmt.Sprintf("%s.%s", workflow.ID, extension))
+}
+
+func cloneWorkflowGitRepository(ctx context.Context, config WorkflowGitConfig) (*git.Repository, billy.Filesystem, *git.CloneOptions, error) {
+	fs := memfs.New()
+	cloneOptions := &git.CloneOptions{
+		URL: config.URL,
+	}
+
+	if len(config.Branch) > 0 {
+		cloneOptions.ReferenceName = plumbing.NewBranchReferenceName(config.Branch)
+	}
+
+	err := applyGitCredential(ctx, config.OrgId, config.CredentialId, cloneOptions)
+	if err != nil {
+		return nil, fs, cloneOptions, err
+	}
+
+	cloneOptions = checkGitProxy(cloneOptions)
+
+	storer := memory.NewStorage()
+	r, err := git.Clone(storer, fs, cloneOptions)
+	if err != nil {
+		return nil, fs, cloneOptions, err
+	}
+
+	return r, fs, cloneOptions, nil
+}
+
+// Writes the workflows to the repository, then commits and pushes them.
+// A workflow which changed both in git and locally since the last sync
+// is a conflict, and is skipped unless forced.
+func exportWorkflowsToGit(ctx context.Context, config *WorkflowGitConfig, workflows []shuffle.Workflow, username string, force bool) (WorkflowGitResult, error) {
+	result := WorkflowGitResult{
+		Updated:   []string{},
+		Unchanged: []string{},
+		Conflicts: []string{},
+		Errors:    []string{},
+	}
+
+	r, fs, cloneOptions, err := cloneWorkflowGitRepository(ctx, *config)
+	if err != nil {
+		return result, err
+	}
+
+	worktree, err := r.Worktree()
+	if err != nil {
+		return result, err
+	}
+
+	newStates := map[string]WorkflowGitState{}
+	for _, workflow := range workflows {
+		filePath := getWorkflowGitPath(*config, workflow)
+		state, synced := config.Workflows[workflow.ID]
+		localHash := getWorkflowGitHash(workflow)
+
+		existingData, readErr := readWorkflowGitFile(fs, filePath)
+		if readErr == nil {
+			existingWorkflow, err := unmarshalWorkflowFromGit(existingData, filePath)
+			if err == nil {
+				gitHash := getWorkflowGitHash(existingWorkflow)
+				if gitHash == localHash {
+					result.Unchanged = append(result.Unchanged, workflow.ID)
+					state.Name = workflow.Name
+					state.Path = filePath
+					state.Hash = localHash
+					state.Synced = time.Now().Unix()
+					newStates[workflow.ID] = state
+					continue
+				}
+
+				if synced && gitHash != state.Hash && localHash != state.Hash && !force {
+					result.Conflicts = append(result.Conflicts, workflow.ID)
+					continue
+				}
+			}
+		}
+
+		data, err := marshalWorkflowForGit(workflow, config.Format)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", workflow.ID, err))
+			continue
+		}
+
+		err = fs.MkdirAll(path.Dir(filePath), 0755)
+		if err == nil {
+			err = util.WriteFile(fs, filePath, data, 0644)
+		}
+
+		if err == nil {
+			_, err = worktree.Add(filePath)
+		}
+
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", workflow.ID, err))
+			continue
+		}
+
+		result.Updated = append(result.Updated, workflow.ID)
+		newStates[workflow.ID] = WorkflowGitState{
+			Name:   workflow.Name,
+			Path:   filePath,
+			Hash:   localHash,
+			Synced: time.Now().Unix(),
+		}
+	}
+
+	if len(result.Updated) > 0 {
+		authorName := config.AuthorName
+		if len(authorName) == 0 {
+			authorName = "Shuffle"
+		}
+
+		authorEmail := config.AuthorEmail
+		if len(authorEmail) == 0 {
+			authorEmail = "shuffle@localhost"
+		}
+
+		message := fmt.Sprintf("Update %d workflow(s) from Shuffle", len(result.Updated))
+		if len(result.Updated) == 1 {
+			message = fmt.Sprintf("Update workflow %s from Shuffle", newStates[result.Updated[0]].Name)
+		}
+
+		if len(username) > 0 {
+			message = fmt.Sprintf("%s\n\nExported by %s", message, username)
+		}
+
+		commit, err := worktree.Commit(message, &git.CommitOptions{
+			Author: &object.Signature{
+				Name:  authorName,
+				Email: authorEmail,
+				When:  time.Now(),
+			},
+		})
+		if err != nil {
+			return result, err
+		}
+
+		err = r.PushContext(ctx, &git.PushOptions{
+			Auth:         cloneOptions.Auth,
+			CABundle:     cloneOptions.CABundle,
+			ProxyOptions: cloneOptions.ProxyOptions,
+		})
+		if err != nil {
+			return result, fmt.Errorf("Failed pushing to %s: %s", config.URL, err)
+		}
+
+		result.Commit = commit.String()
+		config.LastPush = time.Now().Unix()
+	}
+
+	for workflowId, state := range newStates {
+		if len(result.Commit) > 0 {
+			state.Commit = result.Commit
+		}
+
+		config.Workflows[workflowId] = state
+	}
+
+	result.Success = len(result.Errors) == 0 && len(result.Conflicts) == 0
+	return result, nil
+}
+
+func readWorkflowGitFile(fs billy.Filesystem, filePath string) ([]byte, error) {
+	fileReader, err := fs.Open(filePath)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	defer fileReader.Close()
+	return ioutil.ReadAll(fileReader)
+}
+
+// Checks the workflow revisions for local changes since the last sync
+func workflowChangedSinceSync(ctx context.Context, workflow shuffle.Workflow, state WorkflowGitState) bool {
+	if getWorkflowGitHash(workflow) == state.Hash {
+		return false
+	}
+
+	revisions, err := shuffle.ListWorkflowRevisions(ctx, workflow.ID, 50)
+	if err != nil || len(revisions) == 0 {
+		return workflow.Edited > state.Synced
+	}
+
+	for _, revision := range revisions {
+		if revision.Edited > state.Synced {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Imports the workflows in the repository folder. A workflow which changed
+// both in git and locally since the last sync is a conflict, and is
+// skipped unless forced.
+func importWorkflowsFromGit(ctx context.Context, config *WorkflowGitConfig, user shuffle.User, force bool) (WorkflowGitResult, error) {
+	result := WorkflowGitResult{
+		Updated:   []string{},
+		Unchanged: []string{},
+		Conflicts: []string{},
+		Errors:    []string{},
+	}
+
+	r, fs, _, err := cloneWorkflowGitRepository(ctx, *config)
+	if err != nil {
+		return result, err
+	}
+
+	head, err := r.Head()
+	if err != nil {
+		return result, err
+	}
+
+	files, err := fs.ReadDir(config.Folder)
+	if err != nil {
+		return result, fmt.Errorf("Failed reading folder '%s': %s", config.Folder, err)
+	}
+
+	for _, file := range files {
+		filename := file.Name()
+		if file.IsDir() || !(strings.HasSuffix(filename, ".json") || strings.HasSuffix(filename, ".yaml") || strings.HasSuffix(filename, ".yml")) {
+			continue
+		}
+
+		filePath := path.Join(config.Folder, filename)
+		data, err := readWorkflowGitFile(fs, filePath)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", filePath, err))
+			continue
+		}
+
+		imported, err := unmarshalWorkflowFromGit(data, filePath)
+		if err != nil || len(imported.ID) != 36 {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: not a valid workflow", filePath))
+			continue
+		}
+
+		gitHash := getWorkflowGitHash(imported)
+		state, synced := config.Workflows[imported.ID]
+		newState := WorkflowGitState{
+			Name:   imported.Name,
+			Path:   filePath,
+			Hash:   gitHash,
+			Commit: head.Hash().String(),
+			Synced: time.Now().Unix(),
+		}
+
+		existing, err := shuffle.GetWorkflow(ctx, imported.ID)
+		if err == nil && len(existing.ID) > 0 {
+			if existing.OrgId != user.ActiveOrg.Id {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: workflow %s belongs to another org", filePath, imported.ID))
+				continue
+			}
+
+			if getWorkflowGitHash(*existing) == gitHash || (synced && state.Hash == gitHash) {
+				result.Unchanged = append(result.Unchanged, imported.ID)
+				if !synced || state.Hash != gitHash {
+					config.Workflows[imported.ID] = newState
+				}
+
+				continue
+			}
+
+			if synced && workflowChangedSinceSync(ctx, *existing, state) && !force {
+				result.Conflicts = append(result.Conflicts, imported.ID)
+				continue
+			}
+
+			imported = restoreWorkflowFromGit(imported, *existing)
+		} else {
+			imported.Owner = user.Id
+			imported.OrgId = user.ActiveOrg.Id
+			imported.ExecutingOrg = shuffle.OrgMini{
+				Id: user.ActiveOrg.Id,
+			}
+
+			imported.Org = []shuffle.OrgMini{
+				shuffle.OrgMini{
+					Id: user.ActiveOrg.Id,
+				},
+			}
+
+			imported.Created = time.Now().Unix()
+			imported.IsValid = true
+		}
+
+		if isWorkflowGitIncomplete(imported) {
+			imported.IsValid = false
+			imported.Errors = []string{"Imported from git. Add the missing secrets and save before using."}
+		}
+
+		imported.UpdatedBy = user.Username
+		imported.Edited = time.Now().Unix()
+		err = shuffle.SetWorkflow(ctx, imported, imported.ID)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", filePath, err))
+			continue
+		}
+
+		err = shuffle.SetWorkflowRevision(ctx, imported)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting revision for workflow %s imported from git: %s", imported.ID, err)
+		}
+
+		newState.Synced = time.Now().Unix()
+		config.Workflows[imported.ID] = newState
+		result.Updated = append(result.Updated, imported.ID)
+	}
+
+	config.LastPull = time.Now().Unix()
+	result.Commit = head.Hash().String()
+	result.Success = len(result.Errors) == 0 && len(result.Conflicts) == 0
+	return result, nil
+}
+
+// Exports a single workflow after it's saved, if the org syncs on save
+func exportWorkflowOnSave(ctx context.Context, user shuffle.User, workflowId string) {
+	unlock := lockWorkflowGit(user.ActiveOrg.Id)
+	defer unlock()
+
+	config, err := getWorkflowGitConfig(ctx, user.ActiveOrg.Id)
+	if err != nil || !config.SyncOnSave || len(config.URL) == 0 {
+		return
+	}
+
+	workflow, err := shuffle.GetWorkflow(ctx, workflowId)
+	if err != nil || workflow.OrgId != user.ActiveOrg.Id {
+		return
+	}
+
+	result, err := exportWorkflowsToGit(ctx, config, []shuffle.Workflow{*workflow}, user.Username, false)
+	if err != nil {
+		log.Printf("[WARNING] Failed exporting workflow %s to git on save: %s", workflowId, err)
+		config.LastError = err.Error()
+	} else if len(result.Conflicts) > 0 {
+		log.Printf("[WARNING] Workflow %s changed in git since the last sync. Skipped export on save.", workflowId)
+		config.LastError = fmt.Sprintf("Conflict for workflow %s. Import or force export to resolve it.", workflowId)
+	} else {
+		config.LastError = ""
+	}
+
+	err = setWorkflowGitConfig(ctx, *config)
+	if err != nil {
+		log.Printf("[WARNING] Failed saving workflow git config for org %s: %s", user.ActiveOrg.Id, err)
+	}
+}
+
+type workflowSaveRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *workflowSaveRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Wraps the workflow save, and exports the workflow to git once it's saved
+func handleSaveWorkflow(resp http.ResponseWriter, request *http.Request) {
+	recorder := &workflowSaveRecorder{ResponseWriter: resp, status: 200}
+	shuffle.SaveWorkflow(recorder, request)
+	if request.Method != "PUT" || recorder.status != 200 {
+		return
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	if len(location) < 5 {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(httptest.NewRecorder(), request)
+	if err != nil {
+		return
+	}
+
+	go exportWorkflowOnSave(context.Background(), user, location[4])
+}
+
+func handleWorkflowGitConfig(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in workflow git config: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to manage workflow git sync"}`))
+		return
+	}
+
+	ctx := shuffle.GetContext(request)
+	config, err := getWorkflowGitConfig(ctx, user.ActiveOrg.Id)
+	if err != nil {
+		config = &WorkflowGitConfig{
+			OrgId:     user.ActiveOrg.Id,
+			Folder:    "workflows",
+			Format:    "json",
+			Workflows: map[string]WorkflowGitState{},
+		}
+	}
+
+	if request.Method == "PUT" {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed reading body"}`))
+			return
+		}
+
+		var input WorkflowGitConfig
+		err = json.Unmarshal(body, &input)
+		if err != nil {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "Failed unmarshalling config"}`))
+			return
+		}
+
+		if !isGitRepositoryUrl(input.URL) {
+			resp.WriteHeader(400)
+			resp.Write([]byte(`{"success": false, "reason": "A valid git repository URL is required"}`))
+			return
+		}
+
+		if input.Format != "yaml" {
+			input.Format = "json"
+		}
+
+		input.Folder = strings.Trim(path.Clean("/"+input.Folder), "/")
+		if len(input.Folder) == 0 {
+			input.Folder = "workflows"
+		}
+
+		// Sync state only carries over within the same repository
+		if input.URL != config.URL || input.Branch != config.Branch || input.Folder != config.Folder {
+			config.Workflows = map[string]WorkflowGitState{}
+		}
+
+		config.URL = input.URL
+		config.Branch = input.Branch
+		config.CredentialId = input.CredentialId
+		config.Folder = input.Folder
+		config.Format = input.Format
+		config.SyncOnSave = input.SyncOnSave
+		config.AuthorName = input.AuthorName
+		config.AuthorEmail = input.AuthorEmail
+		config.OrgId = user.ActiveOrg.Id
+
+		err = setWorkflowGitConfig(ctx, *config)
+		if err != nil {
+			log.Printf("[WARNING] Failed saving workflow git config: %s", err)
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed saving config"}`))
+			return
+		}
+
+		log.Printf("[AUDIT] User %s (%s) set workflow git sync to %s for org %s", user.Username, user.Id, config.URL, user.ActiveOrg.Id)
+	}
+
+	newjson, err := json.Marshal(config)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling config"}`))
+		return
+	}
+
+	resp.WriteHeader(200)
+	resp.Write(newjson)
+}
+
+// Handles /export and /import. Export takes an optional list of workflow
+// ids, and defaults to every workflow in the org.
+func handleWorkflowGitSync(resp http.ResponseWriter, request *http.Request) {
+	cors := shuffle.HandleCors(resp, request)
+	if cors {
+		return
+	}
+
+	user, err := shuffle.HandleApiAuthentication(resp, request)
+	if err != nil {
+		log.Printf("[WARNING] Api authentication failed in workflow git sync: %s", err)
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false}`))
+		return
+	}
+
+	if user.Role != "admin" {
+		resp.WriteHeader(401)
+		resp.Write([]byte(`{"success": false, "reason": "Must be admin to sync workflows with git"}`))
+		return
+	}
+
+	unlock := lockWorkflowGit(user.ActiveOrg.Id)
+	defer unlock()
+
+	ctx := shuffle.GetContext(request)
+	config, err := getWorkflowGitConfig(ctx, user.ActiveOrg.Id)
+	if err != nil || len(config.URL) == 0 {
+		resp.WriteHeader(400)
+		resp.Write([]byte(`{"success": false, "reason": "Workflow git sync isn't configured"}`))
+		return
+	}
+
+	type syncRequest struct {
+		Workflows []string `json:"workflows"`
+		Force     bool     `json:"force"`
+	}
+
+	var syncData syncRequest
+	body, err := ioutil.ReadAll(request.Body)
+	if err == nil && len(body) > 0 {
+		json.Unmarshal(body, &syncData)
+	}
+
+	location := strings.Split(request.URL.Path, "/")
+	action := location[len(location)-1]
+
+	var result WorkflowGitResult
+	if action == "export" {
+		workflows, err := shuffle.GetAllWorkflowsByQuery(ctx, user, 1000, "")
+		if err != nil {
+			resp.WriteHeader(500)
+			resp.Write([]byte(`{"success": false, "reason": "Failed getting workflows"}`))
+			return
+		}
+
+		selected := []shuffle.Workflow{}
+		for _, workflow := range workflows {
+			if workflow.OrgId != user.ActiveOrg.Id {
+				continue
+			}
+
+			if len(syncData.Workflows) > 0 && !shuffle.ArrayContains(syncData.Workflows, workflow.ID) {
+				continue
+			}
+
+			selected = append(selected, workflow)
+		}
+
+		result, err = exportWorkflowsToGit(ctx, config, selected, user.Username, syncData.Force)
+	} else if action == "import" {
+		result, err = importWorkflowsFromGit(ctx, config, user, syncData.Force)
+	} else {
+		err = errors.New("Unknown action")
+	}
+
+	if err != nil {
+		config.LastError = err.Error()
+	} else {
+		config.LastError = ""
+	}
+
+	saveErr := setWorkflowGitConfig(ctx, *config)
+	if saveErr != nil {
+		log.Printf("[WARNING] Failed saving workflow git config after %s: %s", action, saveErr)
+	}
+
+	if err != nil {
+		log.Printf("[WARNING] Failed workflow git %s for org %s: %s", action, user.ActiveOrg.Id, err)
+		resp.WriteHeader(400)
+		resp.Write([]byte(fmt.Sprintf(`{"success": false, "reason": "%s"}`, strings.ReplaceAll(err.Error(), `"`, `'`))))
+		return
+	}
+
+	log.Printf("[AUDIT] User %s (%s) ran workflow git %s for org %s. Updated: %d, conflicts: %d", user.Username, user.Id, action, user.ActiveOrg.Id, len(result.Updated), len(result.Conflicts))
+	newjson, err := json.Marshal(result)
+	if err != nil {
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed marshalling result"}`))
+		return
+	}
+
+	// Conflicts are returned as a 409 so they aren't mistaken for a full sync
+	if len(result.Conflicts) > 0 {
+		resp.WriteHeader(409)
+	} else {
+		resp.WriteHeader(200)
+	}
+
+	resp.Write(newjson)
+}
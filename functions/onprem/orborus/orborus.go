@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/shuffle/shuffle-shared"
@@ -42,6 +43,7 @@ import (
 
 	//"github.com/docker/docker/api/types/filters"
 	dockerclient "github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 	uuid "github.com/satori/go.uuid"
 
 	//"github.com/mackerelio/go-osstat/disk"
@@ -49,8 +51,10 @@ import (
 	//"github.com/shirou/gopsutil/cpu"
 
 	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
@@ -107,8 +111,6 @@ var swarmConfig = os.Getenv("SHUFFLE_SWARM_CONFIG")
 var swarmNetworkName = os.Getenv("SHUFFLE_SWARM_NETWORK_NAME")
 var orborusLabel = os.Getenv("SHUFFLE_ORBORUS_LABEL")
 var memcached = os.Getenv("SHUFFLE_MEMCACHED")
-var queuePerMinute = os.Getenv("SHUFFLE_EXECUTION_PER_MINIUTE")
-var queuePerMinuteInt int
 
 // For it to download from Sigma?
 var pipelineApikey = os.Getenv("SHUFFLE_PIPELINE_AUTH")
@@ -116,9 +118,13 @@ var pipelineUrl = os.Getenv("SHUFFLE_PIPELINE_URL")
 
 var executionIds = []string{}
 var pipelines = []shuffle.PipelineInfoMini{}
+
+// Guards pipelines, which the supervisor resets while the poll loop reads it
+var pipelinesLock sync.Mutex
+
 var namespacemade = false // For K8s
 var skipPipelineMount = false
-var tenzirDisabled = false
+var tenzirDisabled atomic.Bool // Written by the Tenzir supervisor, read by the poll loop
 
 var dockercli *dockerclient.Client
 var containerId string
@@ -477,7 +483,7 @@ func deployServiceWorkers(image string) {
 
 		if err == nil {
 			for _, container := range containers {
-				if strings.Contains(strings.ToLower(container.Image), "docker-socket-proxy") {
+				if strings.Contains(strings.ToLower(container.Image), "docker-socket-proxy") || shuffle.ArrayContains(container.Names, fmt.Sprintf("/%s", dockerProxyName)) {
 					networkConfig := &network.EndpointSettings{}
 					err := dockercli.NetworkConnect(ctx, networkName, container.ID, networkConfig)
 					if err != nil {
@@ -546,7 +552,7 @@ func deployServiceWorkers(image string) {
 	serviceSpec := swarm.ServiceSpec{
 		Annotations: swarm.Annotations{
 			Name:   innerContainerName,
-			Labels: map[string]string{},
+			Labels: getShuffleLabels("worker", ""),
 		},
 		Mode: swarm.ServiceMode{
 			Replicated: &swarm.ReplicatedService{
@@ -574,9 +580,7 @@ func deployServiceWorkers(image string) {
 			},
 		},
 		TaskTemplate: swarm.TaskSpec{
-			Resources: &swarm.ResourceRequirements{
-				Reservations: &swarm.Resources{},
-			},
+			Resources: getWorkerResourceLimits().swarm(),
 			LogDriver: &swarm.Driver{
 				Name: "json-file",
 				Options: map[string]string{
@@ -584,11 +588,11 @@ func deployServiceWorkers(image string) {
 				},
 			},
 			ContainerSpec: &swarm.ContainerSpec{
-				Image: image,
+				Image:  image,
+				Labels: getShuffleLabels("worker", ""),
 				Env: []string{
 					fmt.Sprintf("SHUFFLE_SWARM_CONFIG=%s", os.Getenv("SHUFFLE_SWARM_CONFIG")),
 					fmt.Sprintf("SHUFFLE_SWARM_NETWORK_NAME=%s", networkName),
-					fmt.Sprintf("SHUFFLE_APP_REPLICAS=%d", appReplicaCnt),
 					fmt.Sprintf("SHUFFLE_LOGS_DISABLED=%s", os.Getenv("SHUFFLE_LOGS_DISABLED")),
 					fmt.Sprintf("DEBUG_MEMORY=%s", os.Getenv("DEBUG_MEMORY")),
 					fmt.Sprintf("SHUFFLE_APP_SDK_TIMEOUT=%s", os.Getenv("SHUFFLE_APP_SDK_TIMEOUT")),
@@ -646,6 +650,22 @@ func deployServiceWorkers(image string) {
 		serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, fmt.Sprintf("SHUFFLE_SCALE_REPLICAS=%s", os.Getenv("SHUFFLE_SCALE_REPLICAS")))
 	}
 
+	// Fixed app replicas turns off app autoscaling in the workers
+	if len(appReplicas) > 0 {
+		serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, fmt.Sprintf("SHUFFLE_APP_REPLICAS=%d", appReplicaCnt))
+	}
+
+	for _, key := range appScalingEnvs {
+		if len(os.Getenv(key)) > 0 {
+			serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, fmt.Sprintf("%s=%s", key, os.Getenv(key)))
+		}
+	}
+
+	serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, getAppLimitEnv()...)
+	serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, getHardenedEnv()...)
+	serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, getEgressPolicyEnv()...)
+	serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, getLabelEnv()...)
+
 	if len(os.Getenv("SHUFFLE_MEMCACHED")) > 0 {
 		serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, fmt.Sprintf("SHUFFLE_MEMCACHED=%s", os.Getenv("SHUFFLE_MEMCACHED")))
 	}
@@ -911,6 +931,10 @@ func handleBackendImageDownload(ctx context.Context, images string) error {
 
 	}
 
+	if len(successful) == 0 {
+		return fmt.Errorf("failed downloading image(s) %s", strings.Join(handled, ", "))
+	}
+
 	return nil
 }
 
@@ -950,7 +974,25 @@ func fixk8sRoles() {
 				{
 					APIGroups: []string{"", "apps"},
 					Resources: resourceTypes,
-					Verbs:     []string{"create", "list"},
+					Verbs:     []string{"create", "list", "delete"},
+				},
+				{
+					// Workers find each other through the worker service endpoints
+					APIGroups: []string{"", "discovery.k8s.io"},
+					Resources: []string{"endpoints", "endpointslices"},
+					Verbs:     []string{"get", "list"},
+				},
+				{
+					// Zombie cleanup of finished jobs
+					APIGroups: []string{"batch"},
+					Resources: []string{"jobs"},
+					Verbs:     []string{"list", "delete"},
+				},
+				{
+					// Egress policies for apps
+					APIGroups: []string{"networking.k8s.io"},
+					Resources: []string{"networkpolicies"},
+					Verbs:     []string{"get", "create", "update", "delete"},
 				},
 			},
 		}
@@ -1065,6 +1107,17 @@ func deployK8sWorker(image string, identifier string, env []string) error {
 		env = append(env, fmt.Sprintf("SHUFFLE_APP_CONTAINER_SECURITY_CONTEXT=%s", appContainerSecurityContext))
 	}
 
+	for _, key := range appScalingEnvs {
+		if len(os.Getenv(key)) > 0 {
+			env = append(env, fmt.Sprintf("%s=%s", key, os.Getenv(key)))
+		}
+	}
+
+	env = append(env, getAppLimitEnv()...)
+	env = append(env, getHardenedEnv()...)
+	env = append(env, getEgressPolicyEnv()...)
+	env = append(env, getLabelEnv()...)
+
 	clientset, _, err := shuffle.GetKubernetesClient()
 	if err != nil {
 		log.Printf("[ERROR] Error getting kubernetes client:", err)
@@ -1141,6 +1194,10 @@ func deployK8sWorker(image string, identifier string, env []string) error {
 		"container": "shuffle-worker",
 	}
 
+	for key, value := range getShuffleLabels("worker", "") {
+		labels[key] = value
+	}
+
 	matchLabels := map[string]string{
 		"app.kubernetes.io/name":     "shuffle-worker",
 		"app.kubernetes.io/instance": identifier,
@@ -1173,6 +1230,7 @@ func deployK8sWorker(image string, identifier string, env []string) error {
 		Image:           kubernetesImage,
 		Env:             buildEnvVars(envMap),
 		SecurityContext: containerSecurityContext,
+		Resources:       getWorkerResourceLimits().kubernetes(),
 
 		//ImagePullPolicy: "Never",
 		ImagePullPolicy: corev1.PullIfNotPresent,
@@ -1319,6 +1377,17 @@ func deployK8sWorker(image string, identifier string, env []string) error {
 		},
 	}
 
+	// Apps with egress policies reach the internet through the workers
+	if hasEgressPolicies() {
+		service.Spec.Ports[0].Name = "worker"
+		service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{
+			Name:       "egress-proxy",
+			Protocol:   "TCP",
+			Port:       int32(getEgressProxyPort()),
+			TargetPort: intstr.FromInt(getEgressProxyPort()),
+		})
+	}
+
 	_, err = clientset.CoreV1().Services(kubernetesNamespace).Create(context.Background(), service, metav1.CreateOptions{})
 	if err != nil {
 		log.Printf("[ERROR] Failed creating service: %v", err)
@@ -1328,7 +1397,388 @@ func deployK8sWorker(image string, identifier string, env []string) error {
 	return nil
 }
 
+// Hardened mode gives workers a scoped docker socket proxy instead of the raw
+// docker socket, and makes the workers run apps in a locked down sandbox.
+var hardenedMode = strings.ToLower(os.Getenv("SHUFFLE_HARDENED_MODE")) == "true"
+var dockerProxyName = "shuffle-docker-proxy"
+
+// Passed to the workers, which apply them to the apps
+func getHardenedEnv() []string {
+	if !hardenedMode {
+		return []string{}
+	}
+
+	env := []string{"SHUFFLE_HARDENED_MODE=true"}
+	if len(os.Getenv("SHUFFLE_APP_USER")) > 0 {
+		env = append(env, fmt.Sprintf("SHUFFLE_APP_USER=%s", os.Getenv("SHUFFLE_APP_USER")))
+	}
+
+	if len(os.Getenv("SHUFFLE_APP_TMPFS")) > 0 {
+		env = append(env, fmt.Sprintf("SHUFFLE_APP_TMPFS=%s", os.Getenv("SHUFFLE_APP_TMPFS")))
+	}
+
+	if len(os.Getenv("SHUFFLE_APP_WORKDIR")) > 0 {
+		env = append(env, fmt.Sprintf("SHUFFLE_APP_WORKDIR=%s", os.Getenv("SHUFFLE_APP_WORKDIR")))
+	}
+
+	// The workers can't read files from the Orborus host, so the profile itself is passed along
+	seccompProfile := strings.TrimSpace(os.Getenv("SHUFFLE_APP_SECCOMP_PROFILE"))
+	if len(seccompProfile) > 0 && !strings.HasPrefix(seccompProfile, "{") {
+		fileData, err := ioutil.ReadFile(seccompProfile)
+		if err != nil {
+			log.Printf("[ERROR] Failed reading seccomp profile %s: %s", seccompProfile, err)
+			seccompProfile = ""
+		} else {
+			seccompProfile = string(fileData)
+		}
+	}
+
+	if len(seccompProfile) > 0 {
+		env = append(env, fmt.Sprintf("SHUFFLE_APP_SECCOMP_PROFILE=%s", seccompProfile))
+	}
+
+	return env
+}
+
+// Only allows the parts of the docker API the workers use.
+// Exec, volumes, builds, secrets and plugins are denied.
+//
+// This is NOT an isolation boundary. The proxy filters endpoints, not
+// request bodies, and the workers need POST on containers. A compromised
+// worker can still create a privileged container with host binds or the
+// host network. It keeps the raw socket out of the workers, and removes
+// the endpoints they never use.
+func getDockerProxyEnv() []string {
+	env := []string{
+		"CONTAINERS=1",
+		"IMAGES=1",
+		"NETWORKS=1",
+		"DISTRIBUTION=1",
+		"INFO=1",
+		"EVENTS=1",
+		"PING=1",
+		"VERSION=1",
+		"POST=1",
+		"ALLOW_START=1",
+		"ALLOW_STOP=1",
+		"ALLOW_RESTARTS=0",
+		"EXEC=0",
+		"VOLUMES=0",
+		"BUILD=0",
+		"COMMIT=0",
+		"SECRETS=0",
+		"CONFIGS=0",
+		"PLUGINS=0",
+		"SYSTEM=0",
+	}
+
+	if swarmConfig == "run" || swarmConfig == "swarm" {
+		env = append(env, "SWARM=1", "SERVICES=1", "TASKS=1", "NODES=1")
+	}
+
+	return env
+}
+
+// Starts the docker socket proxy on the same network as Orborus,
+// and returns the DOCKER_HOST the workers should use.
+func deployDockerSocketProxy(ctx context.Context) (string, error) {
+	networkName := "bridge"
+	orborusContainer, err := dockercli.ContainerInspect(ctx, containerId)
+	if err == nil && orborusContainer.NetworkSettings != nil {
+		for name := range orborusContainer.NetworkSettings.Networks {
+			if name != "bridge" && name != "host" && name != "none" {
+				networkName = name
+				break
+			}
+		}
+	} else if err != nil {
+		log.Printf("[WARNING] Failed finding Orborus' own network for the docker socket proxy: %s", err)
+	}
+
+	proxyContainer, err := dockercli.ContainerInspect(ctx, dockerProxyName)
+	if err != nil {
+		if !dockerclient.IsErrNotFound(err) {
+			return "", err
+		}
+
+		// Should be pinned by digest, e.g. tecnativa/docker-socket-proxy@sha256:...
+		proxyImage := os.Getenv("SHUFFLE_DOCKER_PROXY_IMAGE")
+		if len(proxyImage) == 0 {
+			proxyImage = "docker.io/tecnativa/docker-socket-proxy:latest"
+		}
+
+		_, _, err = dockercli.ImageInspectWithRaw(ctx, proxyImage)
+		if dockerclient.IsErrNotFound(err) {
+			log.Printf("[DEBUG] Pulling docker socket proxy image %s", proxyImage)
+			out, err := dockercli.ImagePull(ctx, proxyImage, image.PullOptions{})
+			if err != nil {
+				return "", err
+			}
+
+			io.Copy(io.Discard, out)
+			out.Close()
+		} else if err != nil {
+			return "", err
+		}
+
+		// Runs the exact image that was pulled, so a moved tag can't change it later
+		if !strings.Contains(proxyImage, "@sha256:") {
+			imageInfo, _, err := dockercli.ImageInspectWithRaw(ctx, proxyImage)
+			if err != nil {
+				return "", err
+			}
+
+			if len(imageInfo.RepoDigests) > 0 {
+				log.Printf("[WARNING] Docker socket proxy image %s isn't pinned by digest. Using %s. Set SHUFFLE_DOCKER_PROXY_IMAGE to it to pin it.", proxyImage, imageInfo.RepoDigests[0])
+				proxyImage = imageInfo.RepoDigests[0]
+			} else {
+				log.Printf("[WARNING] Docker socket proxy image %s isn't pinned by digest, and has no digest to pin. Set SHUFFLE_DOCKER_PROXY_IMAGE to a digest reference.", proxyImage)
+			}
+		}
+
+		containerConfig := &container.Config{
+			Image:  proxyImage,
+			Env:    getDockerProxyEnv(),
+			Labels: getShuffleLabels("docker-proxy", ""),
+		}
+
+		hostConfig := &container.HostConfig{
+			Binds:       []string{"/var/run/docker.sock:/var/run/docker.sock:ro"},
+			SecurityOpt: []string{"no-new-privileges:true"},
+			RestartPolicy: container.RestartPolicy{
+				Name: container.RestartPolicyUnlessStopped,
+			},
+			LogConfig: container.LogConfig{
+				Type: "json-file",
+				Config: map[string]string{
+					"max-size": "10m",
+				},
+			},
+		}
+
+		networkingConfig := &network.NetworkingConfig{
+			EndpointsConfig: map[string]*network.EndpointSettings{
+				networkName: &network.EndpointSettings{},
+			},
+		}
+
+		resp, err := dockercli.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, dockerProxyName)
+		if err != nil {
+			return "", err
+		}
+
+		err = dockercli.ContainerStart(ctx, resp.ID, container.StartOptions{})
+		if err != nil {
+			return "", err
+		}
+
+		log.Printf("[INFO] Started docker socket proxy %s on network %s", dockerProxyName, networkName)
+	} else if proxyContainer.State != nil && !proxyContainer.State.Running {
+		err = dockercli.ContainerStart(ctx, dockerProxyName, container.StartOptions{})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Name lookups don't work on the default bridge network
+	if networkName != "bridge" {
+		return fmt.Sprintf("tcp://%s:2375", dockerProxyName), nil
+	}
+
+	proxyContainer, err = dockercli.ContainerInspect(ctx, dockerProxyName)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint, ok := proxyContainer.NetworkSettings.Networks[networkName]
+	if !ok || len(endpoint.IPAddress) == 0 {
+		return "", errors.New("Docker socket proxy has no IP on the bridge network")
+	}
+
+	return fmt.Sprintf("tcp://%s:2375", endpoint.IPAddress), nil
+}
+
+// Makes sure DOCKER_HOST points to the proxy. Workers should never get the raw socket in hardened mode.
+func ensureDockerSocketProxy(ctx context.Context) error {
+	if !hardenedMode || isKubernetes == "true" || len(os.Getenv("DOCKER_HOST")) > 0 {
+		return nil
+	}
+
+	proxyHost, err := deployDockerSocketProxy(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Hardened mode: workers will use the docker socket proxy at %s. The proxy limits the API endpoints, but doesn't isolate the host from a compromised worker.", proxyHost)
+	os.Setenv("DOCKER_HOST", proxyHost)
+	return nil
+}
+
+// App resource limits are applied by the worker, so Orborus only passes them along
+var appLimitEnvs = []string{
+	"SHUFFLE_APP_CPU_LIMIT",
+	"SHUFFLE_APP_MEMORY_LIMIT",
+	"SHUFFLE_APP_PIDS_LIMIT",
+	"SHUFFLE_APP_TIMEOUT_LIMIT",
+	"SHUFFLE_APP_RESOURCE_LIMITS",
+}
+
+func getAppLimitEnv() []string {
+	env := []string{}
+	for _, key := range appLimitEnvs {
+		if len(os.Getenv(key)) > 0 {
+			env = append(env, fmt.Sprintf("%s=%s", key, os.Getenv(key)))
+		}
+	}
+
+	return env
+}
+
+// App egress policies are enforced by the workers. All workers share the
+// proxy secret, as apps may reach any of them behind the worker service.
+var egressPolicyEnvs = []string{
+	"SHUFFLE_APP_EGRESS_POLICY",
+	"SHUFFLE_APP_EGRESS_POLICIES",
+	"SHUFFLE_EGRESS_PROXY_PORT",
+	"SHUFFLE_EGRESS_PROXY_DISABLED",
+}
+
+var egressProxySecret = os.Getenv("SHUFFLE_EGRESS_PROXY_SECRET")
+
+// Orgs can set their own policies in the backend, so the workers run the
+// egress proxy unless it is disabled
+func hasEgressPolicies() bool {
+	return strings.ToLower(os.Getenv("SHUFFLE_EGRESS_PROXY_DISABLED")) != "true"
+}
+
+func getEgressPolicyEnv() []string {
+	env := []string{}
+	if !hasEgressPolicies() {
+		return env
+	}
+
+	for _, key := range egressPolicyEnvs {
+		if len(os.Getenv(key)) > 0 {
+			env = append(env, fmt.Sprintf("%s=%s", key, os.Getenv(key)))
+		}
+	}
+
+	if len(egressProxySecret) == 0 {
+		egressProxySecret = uuid.NewV4().String()
+	}
+
+	return append(env, fmt.Sprintf("SHUFFLE_EGRESS_PROXY_SECRET=%s", egressProxySecret))
+}
+
+func getEgressProxyPort() int {
+	port, err := strconv.Atoi(os.Getenv("SHUFFLE_EGRESS_PROXY_PORT"))
+	if err != nil || port <= 0 {
+		return 33335
+	}
+
+	return port
+}
+
+// CPU in cores, memory in bytes
+type resourceLimits struct {
+	CPU    float64
+	Memory int64
+	Pids   int64
+}
+
+// Parses limits in the Docker CLI format, e.g. cpu "0.5", memory "512m" and pids "256"
+func parseResourceLimits(cpu, memory, pids string) resourceLimits {
+	limits := resourceLimits{}
+	if len(cpu) > 0 {
+		parsedCpu, err := strconv.ParseFloat(cpu, 64)
+		if err != nil || parsedCpu < 0 {
+			log.Printf("[WARNING] Invalid CPU limit '%s'. Should be a number of cores, e.g. 0.5", cpu)
+		} else {
+			limits.CPU = parsedCpu
+		}
+	}
+
+	if len(memory) > 0 {
+		parsedMemory, err := units.RAMInBytes(memory)
+		if err != nil || parsedMemory < 0 {
+			log.Printf("[WARNING] Invalid memory limit '%s'. Should be e.g. 512m or 1g", memory)
+		} else {
+			limits.Memory = parsedMemory
+		}
+	}
+
+	if len(pids) > 0 {
+		parsedPids, err := strconv.ParseInt(pids, 10, 64)
+		if err != nil || parsedPids < 0 {
+			log.Printf("[WARNING] Invalid pids limit '%s'", pids)
+		} else {
+			limits.Pids = parsedPids
+		}
+	}
+
+	return limits
+}
+
+func getWorkerResourceLimits() resourceLimits {
+	return parseResourceLimits(os.Getenv("SHUFFLE_WORKER_CPU_LIMIT"), os.Getenv("SHUFFLE_WORKER_MEMORY_LIMIT"), os.Getenv("SHUFFLE_WORKER_PIDS_LIMIT"))
+}
+
+func (l resourceLimits) docker() container.Resources {
+	resources := container.Resources{
+		NanoCPUs: int64(l.CPU * 1e9),
+		Memory:   l.Memory,
+	}
+
+	if l.Pids > 0 {
+		pids := l.Pids
+		resources.PidsLimit = &pids
+	}
+
+	return resources
+}
+
+func (l resourceLimits) swarm() *swarm.ResourceRequirements {
+	return &swarm.ResourceRequirements{
+		Reservations: &swarm.Resources{},
+		Limits: &swarm.Limit{
+			NanoCPUs:    int64(l.CPU * 1e9),
+			MemoryBytes: l.Memory,
+			Pids:        l.Pids,
+		},
+	}
+}
+
+// Pids can't be limited per pod in Kubernetes. That is the kubelet's podPidsLimit.
+func (l resourceLimits) kubernetes() corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{}
+	if l.CPU <= 0 && l.Memory <= 0 {
+		return requirements
+	}
+
+	requirements.Limits = corev1.ResourceList{}
+	if l.CPU > 0 {
+		requirements.Limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(l.CPU*1000), resource.DecimalSI)
+	}
+
+	if l.Memory > 0 {
+		requirements.Limits[corev1.ResourceMemory] = *resource.NewQuantity(l.Memory, resource.BinarySI)
+	}
+
+	return requirements
+}
+
 func deployWorker(image string, identifier string, env []string, executionRequest shuffle.ExecutionRequest) error {
+	if hardenedMode {
+		err := ensureDockerSocketProxy(context.Background())
+		if err != nil {
+			log.Printf("[ERROR] Hardened mode: failed starting docker socket proxy. Not deploying worker with the raw docker socket: %s", err)
+			return err
+		}
+
+		if len(os.Getenv("DOCKER_HOST")) > 0 && !shuffle.ArrayContains(env, fmt.Sprintf("DOCKER_HOST=%s", os.Getenv("DOCKER_HOST"))) {
+			env = append(env, fmt.Sprintf("DOCKER_HOST=%s", os.Getenv("DOCKER_HOST")))
+		}
+	}
 
 	if len(os.Getenv("REGISTRY_URL")) > 0 && os.Getenv("REGISTRY_URL") != "" {
 		env = append(env, fmt.Sprintf("REGISTRY_URL=%s", os.Getenv("REGISTRY_URL")))
@@ -1344,11 +1794,7 @@ func deployWorker(image string, identifier string, env []string, executionReques
 	}
 
 	// Binds is the actual "-v" volume.
-	// Max 20% CPU every second
-
-	//CPUQuota:  25000,
-	//CPUPeriod: 100000,
-	//CPUShares: 256,
+	// Resources are limited with SHUFFLE_WORKER_CPU_LIMIT, SHUFFLE_WORKER_MEMORY_LIMIT and SHUFFLE_WORKER_PIDS_LIMIT
 	hostConfig := &container.HostConfig{
 		LogConfig: container.LogConfig{
 			Type: "json-file",
@@ -1356,7 +1802,7 @@ func deployWorker(image string, identifier string, env []string, executionReques
 				"max-size": "10m",
 			},
 		},
-		Resources: container.Resources{},
+		Resources: getWorkerResourceLimits().docker(),
 	}
 
 	// This is just to test the mounting locally so
@@ -1379,6 +1825,11 @@ func deployWorker(image string, identifier string, env []string, executionReques
 		hostConfig.Mounts = append(hostConfig.Mounts, certVol)
 	}
 
+	if hardenedMode {
+		hostConfig.CapDrop = []string{"ALL"}
+		hostConfig.SecurityOpt = []string{"no-new-privileges:true"}
+	}
+
 	if len(os.Getenv("DOCKER_HOST")) == 0 {
 		if runtime.GOOS == "windows" {
 			hostConfig.Binds = []string{`\\.\pipe\docker_engine:\\.\pipe\docker_engine`}
@@ -1391,8 +1842,9 @@ func deployWorker(image string, identifier string, env []string, executionReques
 	parsedUuid := uuid.NewV4()
 
 	config := &container.Config{
-		Image: image,
-		Env:   env,
+		Image:  image,
+		Env:    env,
+		Labels: getShuffleLabels("worker", executionRequest.ExecutionId),
 	}
 
 	if isKubernetes != "true" {
@@ -1743,441 +2195,539 @@ func parseResourceUsage(body io.Reader) (float64, float64, error) {
 
 }
 
-func getOrborusStats(ctx context.Context) shuffle.OrborusStats {
-	newStats := shuffle.OrborusStats{
-		OrgId:        org,
-		Environment:  environment,
-		OrborusLabel: orborusLabel,
-		Timestamp:    time.Now().Unix(),
-
-		Uuid: orborusUuid,
-	}
-
-	if (swarmConfig == "run" || swarmConfig == "swarm") && strings.Contains(newWorkerImage, "scale") {
-		newStats.Swarm = true
-	}
-
-	newStats.PollTime = sleepTime
-	newStats.MaxQueue = maxConcurrency
-	newStats.Queue = executionCount
+// Image -> cached, pulled or failed on this node
+var imageCacheStatus = map[string]string{}
+var imageCacheLock sync.Mutex
 
-	if isKubernetes == "true" || runningMode == "kubernetes" || runningMode == "k8s" {
-		newStats.Kubernetes = true
-		return newStats
-	}
+// The same for the other swarm nodes, by node hostname
+var nodeImageCacheStatus = map[string]map[string]string{}
 
-	// Disable orborus stats
-	if os.Getenv("SHUFFLE_STATS_DISABLED") == "true" {
-		return newStats
+func getImagePullConcurrency() int {
+	concurrency := 2
+	if len(os.Getenv("SHUFFLE_IMAGE_PULL_CONCURRENCY")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_IMAGE_PULL_CONCURRENCY"))
+		if err == nil && tmpInt > 0 {
+			concurrency = tmpInt
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_IMAGE_PULL_CONCURRENCY must be a number above 0, not '%s'. Using default.", os.Getenv("SHUFFLE_IMAGE_PULL_CONCURRENCY"))
+		}
 	}
 
-	// FIXME: Returning for now due to this causing network congestion
-	// and database fillup. The backend api also has it disabled.
-	return newStats
-
-	// Use the docker API to get the CPU usage of the docker engine machine
-	pers, err := dockercli.Info(ctx)
-	if err != nil {
-		log.Printf("[ERROR] Failed getting docker info: %s. This is normal IF there are many containers running.", err)
-		return newStats
-	} else {
-		newStats.TotalContainers = pers.Containers
-		newStats.StoppedContainers = pers.ContainersStopped
+	return concurrency
+}
 
-		// Calculate the amount of CPU utilization on the host
-		newStats.CPU = int(pers.NCPU)
-		newStats.MaxCPU = int(pers.NCPU)
-		newStats.Memory = int(pers.MemTotal)
-		newStats.MaxMemory = int(pers.MemTotal)
-	}
+func setImageCacheStatus(imageName, status string) {
+	imageCacheLock.Lock()
+	defer imageCacheLock.Unlock()
 
-	// Get list of all running containers
-	containers, err := dockercli.ContainerList(ctx, container.ListOptions{})
+	imageCacheStatus[imageName] = status
+}
 
-	if err != nil {
-		log.Printf("[ERROR] Failed getting container list: %s", err)
-		return newStats
-	}
+// Pulls the images that aren't already on this node, a few at a time.
+// Returns the ones that failed.
+func prepullImages(ctx context.Context, images []string) []string {
+	semaphore := make(chan struct{}, getImagePullConcurrency())
+	failed := []string{}
+	failedLock := sync.Mutex{}
 
-	// Use a WaitGroup to wait for all goroutines to finish
 	var wg sync.WaitGroup
+	for _, imageName := range images {
+		imageName = strings.TrimSpace(imageName)
+		if len(imageName) == 0 {
+			continue
+		}
 
-	// Channel to collect results
-	resultCh := make(chan struct {
-		containerID string
-		cpuUsage    float64
-		memoryUsage float64
-	})
+		if !strings.Contains(imageName, "/") {
+			imageName = fmt.Sprintf("frikky/shuffle:%s", imageName)
+		}
 
-	// Iterate through containers and start a goroutine for each container
-	for _, container := range containers {
-		// Check if container is running
-		if container.State != "running" {
+		_, _, err := dockercli.ImageInspectWithRaw(ctx, imageName)
+		if err == nil {
+			setImageCacheStatus(imageName, "cached")
 			continue
 		}
 
 		wg.Add(1)
-		go func(container types.Container) {
+		semaphore <- struct{}{}
+		go func(imageName string) {
 			defer wg.Done()
+			defer func() { <-semaphore }()
 
-			// Get CPU and memory usage for the container
-			cpuUsage, memoryUsage, err := getContainerResourceUsage(ctx, dockercli, container.ID)
+			err := shuffle.DownloadDockerImageBackend(&http.Client{Timeout: imagedownloadTimeout}, imageName)
 			if err != nil {
-				//log.Printf("[DEBUG] Error getting resource usage for container %s: %v\n", container.ID, err)
+				log.Printf("[WARNING] Failed pre-pulling image %s: %s", imageName, err)
+				setImageCacheStatus(imageName, "failed")
+
+				failedLock.Lock()
+				failed = append(failed, imageName)
+				failedLock.Unlock()
+				return
 			}
 
-			// Send the result to the channel
-			resultCh <- struct {
-				containerID string
-				cpuUsage    float64
-				memoryUsage float64
-			}{container.ID, cpuUsage, memoryUsage}
-		}(container)
+			log.Printf("[DEBUG] Pre-pulled image %s", imageName)
+			setImageCacheStatus(imageName, "pulled")
+		}(imageName)
 	}
 
-	// Close the result channel after all goroutines are done
-	go func() {
-		wg.Wait()
-		close(resultCh)
-	}()
+	wg.Wait()
 
-	// Collect results from the channel
+	failed = append(failed, prepullSwarmNodeImages(ctx, images)...)
+	return failed
+}
 
-	// Iterate through containers and get CPU usage
-	totalCPU := float64(0.0)
-	memUsage := float64(0.0)
-	for result := range resultCh {
-		//log.Printf("[DEBUG] Container %s CPU utilization: %.2f%%, Memory utilization: %.2f%%\n", result.containerID, result.cpuUsage, result.memoryUsage)
+// Orborus only reaches its own node, so in swarm the worker task on
+// each of the other nodes is asked to pull the images instead.
+func prepullSwarmNodeImages(ctx context.Context, images []string) []string {
+	failed := []string{}
+	if swarmConfig != "run" && swarmConfig != "swarm" {
+		return failed
+	}
 
-		// check if it's NaN or Inf
-		if !math.IsNaN(result.cpuUsage) {
-			totalCPU += float64(result.cpuUsage)
+	info, err := dockercli.Info(ctx)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting swarm info for image pre-pull: %s", err)
+		return failed
+	}
+
+	taskFilters := filters.NewArgs()
+	taskFilters.Add("service", "shuffle-workers")
+	taskFilters.Add("desired-state", "running")
+	tasks, err := dockercli.TaskList(ctx, types.TaskListOptions{
+		Filters: taskFilters,
+	})
+	if err != nil {
+		log.Printf("[WARNING] Failed listing worker tasks for image pre-pull: %s", err)
+		return failed
+	}
+
+	client := &http.Client{Timeout: imagedownloadTimeout}
+	handledNodes := []string{info.Swarm.NodeID}
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning || shuffle.ArrayContains(handledNodes, task.NodeID) {
+			continue
 		}
 
-		if !math.IsNaN(result.memoryUsage) {
-			memUsage += float64(result.memoryUsage)
+		handledNodes = append(handledNodes, task.NodeID)
+		nodeName := task.NodeID
+		node, _, err := dockercli.NodeInspectWithRaw(ctx, task.NodeID)
+		if err == nil && len(node.Description.Hostname) > 0 {
+			nodeName = node.Description.Hostname
 		}
-	}
 
-	newStats.CPUPercent = totalCPU / float64(newStats.CPU)
-	newStats.MemoryPercent = memUsage
+		workerUrl := fmt.Sprintf("http://shuffle-workers.%d.%s:33333/api/v1/download", task.Slot, task.ID)
+		for _, imageName := range images {
+			imageName = strings.TrimSpace(imageName)
+			if len(imageName) == 0 {
+				continue
+			}
 
-	//log.Printf("[DEBUG] CPU: %.2f, Memory: %.2f", newStats.CPUPercent, newStats.MemoryPercent)
+			if !strings.Contains(imageName, "/") {
+				imageName = fmt.Sprintf("frikky/shuffle:%s", imageName)
+			}
 
-	/*
-		cpuPercent, err := cpu.Percent(250*time.Millisecond, false)
-		if err == nil && len(cpuPercent) > 0 {
-			newStats.CPUPercent = cpuPercent[0]
-		}
-		//Percent(interval time.Duration, percpu bool) ([]float64, error)
+			status := "failed"
+			data, _ := json.Marshal(map[string]string{
+				"image": imageName,
+			})
 
-		// Get memory usage
-		memory, err := memory.Get()
-		if err != nil {
-			log.Printf("[ERROR] Failed getting memory stats: %s", err)
-		} else {
-			newStats.Memory = int(memory.Used)
-			newStats.MaxMemory = int(memory.Total)
-		}
-	*/
+			resp, err := client.Post(workerUrl, "application/json", bytes.NewBuffer(data))
+			if err != nil {
+				log.Printf("[WARNING] Failed asking node %s to pre-pull %s: %s", nodeName, imageName, err)
+			} else {
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
 
-	// Get disk usage
-	/*
-		disk, err := disk.Get()
-		if err != nil {
-			log.Printf("[ERROR] Failed getting disk stats: %s", err)
-		} else {
-			newStats.Disk = int(disk.Used)
-			newStats.MaxDisk = int(disk.Total)
-		}
-	*/
+				if resp.StatusCode == 200 && strings.Contains(string(body), "already present") {
+					status = "cached"
+				} else if resp.StatusCode == 200 {
+					status = "pulled"
+				} else {
+					log.Printf("[WARNING] Node %s failed pre-pulling %s (%d): %s", nodeName, imageName, resp.StatusCode, string(body))
+				}
+			}
 
-	/*
-			// General
-			Disk   int `json:"disk"`
+			if status == "failed" {
+				failed = append(failed, fmt.Sprintf("%s (%s)", imageName, nodeName))
+			}
 
-			// Docker
-			AppContainers    int `json:"app_containers"`
-			WorkerContainers int `json:"worker_containers"`
-			TotalContainers  int `json:"total_containers"`
-		}
-	*/
-	return newStats
-}
+			imageCacheLock.Lock()
+			if _, ok := nodeImageCacheStatus[nodeName]; !ok {
+				nodeImageCacheStatus[nodeName] = map[string]string{}
+			}
 
-func sendRemoveRequest(client *http.Client, toBeRemoved shuffle.ExecutionRequestWrapper, baseUrl, environment, auth, org string, sleepTime int) error {
-	confirmUrl := fmt.Sprintf("%s/api/v1/workflows/queue/confirm", baseUrl)
-	data, err := json.Marshal(toBeRemoved)
-	if err != nil {
-		log.Printf("[WARNING] Failed removal marshalling: %s", err)
-		time.Sleep(time.Duration(sleepTime) * time.Second)
-		return err
+			nodeImageCacheStatus[nodeName][imageName] = status
+			imageCacheLock.Unlock()
+		}
 	}
 
-	result, err := http.NewRequest(
-		"POST",
-		confirmUrl,
-		bytes.NewBuffer([]byte(data)),
-	)
+	return failed
+}
 
-	if err != nil {
-		log.Printf("[ERROR] Failed building confirm request: %s", err)
-		time.Sleep(time.Duration(sleepTime) * time.Second)
-		return err
+// Sends the cache status of this node, and of the other swarm nodes, to the backend
+func reportImageCache(client *http.Client) error {
+	node, err := os.Hostname()
+	if err != nil || len(node) == 0 {
+		node = orborusUuid
 	}
 
-	result.Header.Add("Content-Type", "application/json")
-	result.Header.Add("Org-Id", environment)
+	imageCacheLock.Lock()
+	nodes := map[string]map[string]string{}
+	for nodeName, images := range nodeImageCacheStatus {
+		nodes[nodeName] = map[string]string{}
+		for imageName, status := range images {
+			nodes[nodeName][imageName] = status
+		}
+	}
 
-	if len(auth) > 0 {
-		result.Header.Add("Authorization", auth)
+	nodes[node] = map[string]string{}
+	for imageName, status := range imageCacheStatus {
+		nodes[node][imageName] = status
 	}
+	imageCacheLock.Unlock()
 
-	if len(org) > 0 {
-		result.Header.Add("Org", org)
+	for nodeName, images := range nodes {
+		err = reportNodeImageCache(client, nodeName, images)
+		if err != nil {
+			return err
+		}
 	}
 
-	if len(orborusLabel) > 0 {
-		result.Header.Add("X-Orborus-Label", orborusLabel)
+	return nil
+}
+
+func reportNodeImageCache(client *http.Client, node string, images map[string]string) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"orborus_uuid": orborusUuid,
+		"node":         node,
+		"images":       images,
+	})
+	if err != nil {
+		return err
 	}
 
-	resultResp, err := client.Do(result)
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("%s/api/v1/workflows/queue/images", baseUrl),
+		bytes.NewBuffer(data),
+	)
+
 	if err != nil {
-		log.Printf("[ERROR] Failed making confirm request: %s", err)
-		time.Sleep(time.Duration(sleepTime) * time.Second)
 		return err
 	}
 
-	defer resultResp.Body.Close()
-	body, err := ioutil.ReadAll(resultResp.Body)
+	addOrborusHeaders(req)
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("[ERROR] Failed reading confirm body: %s", err)
-		time.Sleep(time.Duration(sleepTime) * time.Second)
 		return err
 	}
 
-	_ = body
-	//log.Printf("[DEBUG] Confirm response: %s", string(body))
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("got status code %d from backend: %s", resp.StatusCode, string(body))
+	}
 
 	return nil
 }
 
-func cleanup() {
-	log.Printf("[INFO] Cleaning up during shutdown")
-	ctx := context.Background()
-	cleanupExistingNodes(ctx)
-	zombiecheck(ctx, 600)
-	os.Exit(0)
-}
-
-// Initial loop etc
-func main() {
-	// Get arch. amd64 or arm64
-
-	//sigCh := make(chan os.Signal, 1)
-	//signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-	//defer cleanup()
+// Pre-pulls the images of active workflows in this environment on startup
+func warmupImages(ctx context.Context, client *http.Client) {
+	req, err := http.NewRequest(
+		"GET",
+		fmt.Sprintf("%s/api/v1/workflows/queue/images", baseUrl),
+		nil,
+	)
 
-	// Block until a signal is received
-	if shuffle.IsRunningInCluster() {
-		log.Printf("[INFO] Running inside k8s cluster")
+	if err != nil {
+		log.Printf("[WARNING] Failed creating image warmup request: %s", err)
+		return
 	}
 
-	if isKubernetes == "true" {
-		fixk8sRoles()
+	addOrborusHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting images to warm up: %s", err)
+		return
 	}
 
-	startupDelay := os.Getenv("SHUFFLE_ORBORUS_STARTUP_DELAY")
-	if len(startupDelay) > 0 {
-		log.Printf("[DEBUG] Setting startup delay to %#v", startupDelay)
-
-		tmpInt, err := strconv.Atoi(startupDelay)
-		if err == nil {
-			time.Sleep(time.Duration(tmpInt) * time.Second)
-		} else {
-			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_STARTUP_DELAY must be a number, not '%s'. Using default.", startupDelay)
-		}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != 200 {
+		log.Printf("[WARNING] Failed getting images to warm up (%d): %s", resp.StatusCode, string(body))
+		return
 	}
 
-	log.Println("[INFO] Setting up execution environment")
+	parsedResp := struct {
+		Images []string `json:"images"`
+	}{}
 
-	// //FIXME
-	if baseUrl == "" {
-		baseUrl = "https://shuffler.io"
-		//baseUrl = "http://localhost:5001"
+	err = json.Unmarshal(body, &parsedResp)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling images to warm up: %s", err)
+		return
 	}
 
-	if len(orborusUuid) == 0 {
-		orborusUuid = uuid.NewV4().String()
+	if len(parsedResp.Images) == 0 {
+		return
 	}
 
-	//if orgId == "" {
-	//	log.Printf("[ERROR] Org not defined. Set variable ORG_ID based on your org")
-	//	os.Exit(3)
-	//}
-	if environment == "" {
-		log.Printf("[ERROR] Environment not defined. Set variable ENVIRONMENT_NAME to configure it.")
-		os.Exit(3)
+	log.Printf("[INFO] Warming up %d image(s) used by active workflows", len(parsedResp.Images))
+	failed := prepullImages(ctx, parsedResp.Images)
+	if len(failed) > 0 {
+		log.Printf("[WARNING] Failed warming up %d image(s): %s", len(failed), strings.Join(failed, ", "))
 	}
 
-	if timezone == "" {
-		timezone = "Europe/Amsterdam"
+	err = reportImageCache(client)
+	if err != nil {
+		log.Printf("[WARNING] Failed reporting image cache to backend: %s", err)
 	}
+}
 
-	log.Printf("[INFO] Using environment '%s' with timezone %s", environment, timezone)
+// Host stats are sampled in the background and sent to the backend
+// aggregated once per interval instead of on every poll. Sending them
+// on every poll caused network congestion and database fillup.
+type hostStatsAggregator struct {
+	sync.Mutex
 
-	if len(os.Getenv("SHUFFLE_ORBORUS_PULL_TIME")) > 0 {
-		log.Printf("[INFO] Trying to set Orborus sleep time between polls to %s", os.Getenv("SHUFFLE_ORBORUS_PULL_TIME"))
+	Samples  []shuffle.OrborusStats
+	Latest   shuffle.OrborusStats
+	LastSent time.Time
+}
 
-		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_PULL_TIME"))
-		if err == nil {
-			sleepTime = tmpInt
-		}
-	}
+var hostStats = &hostStatsAggregator{}
+var statsInterval = 60 * time.Second
 
-	// Handle Cleanup - made it cleanup by default
-	if strings.ToLower(os.Getenv("SHUFFLE_CONTAINER_AUTO_CLEANUP")) != "false" && os.Getenv("CLEANUP") == "" {
-		cleanupEnv = "true"
+func getStatsSampleInterval() time.Duration {
+	sampleInterval := statsInterval / 4
+	if sampleInterval < 5*time.Second {
+		sampleInterval = 5 * time.Second
 	}
 
-	if len(cleanupEnv) > 0 {
-		log.Printf("[DEBUG] Verbose mode. NOT cleaning up. Cleanup env: %s", cleanupEnv)
-	}
+	return sampleInterval
+}
 
-	workerTimeout := 600
-	if workerTimeoutEnv != "" {
-		tmpInt, err := strconv.Atoi(workerTimeoutEnv)
-		if err == nil {
-			workerTimeout = tmpInt
+func runHostStatsSampler(ctx context.Context) {
+	if len(os.Getenv("SHUFFLE_STATS_INTERVAL")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_STATS_INTERVAL"))
+		if err == nil && tmpInt > 0 {
+			statsInterval = time.Duration(tmpInt) * time.Second
 		} else {
-			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_EXECUTION_TIMEOUT must be a number, not %s", workerTimeoutEnv)
+			log.Printf("[WARNING] Env SHUFFLE_STATS_INTERVAL must be a number of seconds, not '%s'. Using default.", os.Getenv("SHUFFLE_STATS_INTERVAL"))
 		}
-
-		log.Printf("[INFO] Cleanup process running every %d seconds", workerTimeout)
 	}
 
-	if concurrencyEnv != "" {
-		//var concurrencyEnv = os.Getenv("SHUFFLE_ORBORUS_EXECUTION_CONCURRENCY")
-		tmpInt, err := strconv.Atoi(concurrencyEnv)
+	log.Printf("[DEBUG] Sampling host stats every %s. Sending them every %s.", getStatsSampleInterval(), statsInterval)
+	for {
+		sample, err := sampleHostStats(ctx)
 		if err == nil {
-			maxConcurrency = tmpInt
-			log.Printf("[INFO] Max workflow execution concurrency set to %d", maxConcurrency)
-		} else {
-			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_EXECUTION_CONCURRENCY must be a number, not %s. Defaulted to %d", workerTimeoutEnv, maxConcurrency)
+			hostStats.Lock()
+			hostStats.Samples = append(hostStats.Samples, sample)
+			hostStats.Latest = sample
+			hostStats.Unlock()
 		}
-	}
-
-	if len(os.Getenv("DOCKER_HOST")) > 0 {
-		log.Printf("[DEBUG] Running docker with socket proxy %s instead of default", os.Getenv("DOCKER_HOST"))
 
-	} else {
-		log.Printf(`[DEBUG] Running docker with default socket /var/run/docker.sock or `)
+		time.Sleep(getStatsSampleInterval())
 	}
+}
 
-	ctx := context.Background()
-	// Run by default from now
-	//commenting for now as its stoppoing minikube
-
-	log.Printf("[INFO] Running towards %s (BASE_URL) with environment name %s", baseUrl, environment)
+// Returns the aggregated samples if the interval has passed since
+// they were last sent, and resets them.
+func (h *hostStatsAggregator) flush() (shuffle.OrborusStats, bool) {
+	h.Lock()
+	defer h.Unlock()
 
-	if environment == "" {
-		environment = "onprem"
-		log.Printf("[WARNING] Defaulting to environment name %s. Set environment variable ENVIRONMENT_NAME to change. This should be the same as in the frontend action.", environment)
+	aggregated := shuffle.OrborusStats{}
+	if len(h.Samples) == 0 || time.Since(h.LastSent) < statsInterval {
+		return aggregated, false
 	}
 
-	if pipelineUrl == "" {
-		pipelineUrl = "http://localhost:5160"
+	for _, sample := range h.Samples {
+		aggregated.CPUPercent += sample.CPUPercent
+		aggregated.MemoryPercent += sample.MemoryPercent
+		aggregated.Memory += sample.Memory
 
-		// Find the IP in baseUrl. Base format is http://<ip>:<port>
-		if baseUrl != "" && !strings.Contains(baseUrl, "shuffle") && !strings.Contains(baseUrl, "localhost") && !strings.Contains(baseUrl, "run.app") {
-			urlSplit := strings.Split(baseUrl, "://")
-			if len(urlSplit) > 1 {
-				// Find the IP
-				ipSplit := strings.Split(urlSplit[1], ":")
-				if len(ipSplit) > 0 {
-					pipelineUrl = fmt.Sprintf("http://%s:5160", ipSplit[0])
-				}
-			}
+		// Peaks are more useful than averages for container counts
+		if sample.AppContainers > aggregated.AppContainers {
+			aggregated.AppContainers = sample.AppContainers
 		}
 
-		if len(containerId) > 0 {
-			pipelineUrl = "http://tenzir-node:5160"
+		if sample.WorkerContainers > aggregated.WorkerContainers {
+			aggregated.WorkerContainers = sample.WorkerContainers
 		}
-
-		log.Printf("[WARNING] SHUFFLE_PIPELINE_URL not set, falling back to default URL: %s. If BASE_URL is set, we use the external IP for that", pipelineUrl)
-		os.Setenv("SHUFFLE_PIPELINE_URL", pipelineUrl)
 	}
 
-	// FIXME - during init, BUILD and/or LOAD worker and app_sdk
-	// Build/load app_sdk so it can be loaded as 127.0.0.1:5000/walkoff_app_sdk
-	log.Printf("[INFO] Setting up Docker environment. Downloading worker and App SDK!")
+	sampleCount := len(h.Samples)
+	latest := h.Samples[sampleCount-1]
+	aggregated.CPUPercent = aggregated.CPUPercent / float64(sampleCount)
+	aggregated.MemoryPercent = aggregated.MemoryPercent / float64(sampleCount)
+	aggregated.Memory = aggregated.Memory / sampleCount
+	aggregated.CPU = latest.CPU
+	aggregated.MaxCPU = latest.MaxCPU
+	aggregated.MaxMemory = latest.MaxMemory
+	aggregated.StoppedContainers = latest.StoppedContainers
+	aggregated.TotalContainers = latest.TotalContainers
 
-	initializeImages()
-	workerImage := fmt.Sprintf("ghcr.io/shuffle/shuffle-worker:%s", workerVersion)
-	if len(newWorkerImage) > 0 {
-		workerImage = newWorkerImage
-	}
+	h.Samples = []shuffle.OrborusStats{}
+	h.LastSent = time.Now()
+	return aggregated, true
+}
 
-	if swarmConfig == "run" || swarmConfig == "swarm" || isKubernetes == "true" {
-		if isKubernetes != "true" {
-			checkSwarmService(ctx)
-		}
+func (h *hostStatsAggregator) latestCPUPercent() float64 {
+	h.Lock()
+	defer h.Unlock()
 
-		log.Printf("[DEBUG] Cleaning up containers from previous run")
-		cleanupExistingNodes(ctx)
-		time.Sleep(time.Duration(5) * time.Second)
+	return h.Latest.CPUPercent
+}
 
-		log.Printf("[DEBUG] Deploying worker image %s to swarm", workerImage)
+func getOrborusStats(ctx context.Context) shuffle.OrborusStats {
+	newStats := shuffle.OrborusStats{
+		OrgId:        org,
+		Environment:  environment,
+		OrborusLabel: orborusLabel,
+		Timestamp:    time.Now().Unix(),
 
-		runString := "Run: \"docker service ls\" for more info"
+		Uuid: orborusUuid,
+	}
 
-		if isKubernetes != "true" {
-			deployServiceWorkers(workerImage)
-		} else {
-			deployK8sWorker(workerImage, "shuffle-workers", []string{})
-			runString = "Run: \"kubectl get pods\" for more info"
-		}
+	if (swarmConfig == "run" || swarmConfig == "swarm") && strings.Contains(newWorkerImage, "scale") {
+		newStats.Swarm = true
+	}
 
-		err := setBackendToSwarmNetwork(ctx)
-		if err != nil {
-			log.Printf("[WARNING] Failed setting backend to swarm network: %s", err)
-		}
+	newStats.PollTime = sleepTime
+	newStats.MaxQueue = maxConcurrency
+	newStats.Queue = executionCount
 
-		log.Printf("[DEBUG] Waiting 45 seconds to ensure workers are deployed. %s", runString)
-		time.Sleep(time.Duration(45) * time.Second)
+	if isKubernetes == "true" || runningMode == "kubernetes" || runningMode == "k8s" {
+		newStats.Kubernetes = true
+		return newStats
+	}
 
-		//deployServiceWorkers(workerImage)
+	// Disable orborus stats
+	if os.Getenv("SHUFFLE_STATS_DISABLED") == "true" {
+		return newStats
 	}
 
-	zombiecheck(ctx, workerTimeout)
+	aggregated, ok := hostStats.flush()
+	if !ok {
+		return newStats
+	}
 
-	client := shuffle.GetExternalClient(baseUrl)
-	fullUrl := fmt.Sprintf("%s/api/v1/workflows/queue", baseUrl)
+	newStats.CPU = aggregated.CPU
+	newStats.MaxCPU = aggregated.MaxCPU
+	newStats.CPUPercent = aggregated.CPUPercent
+	newStats.Memory = aggregated.Memory
+	newStats.MaxMemory = aggregated.MaxMemory
+	newStats.MemoryPercent = aggregated.MemoryPercent
+	newStats.AppContainers = aggregated.AppContainers
+	newStats.WorkerContainers = aggregated.WorkerContainers
+	newStats.StoppedContainers = aggregated.StoppedContainers
+	newStats.TotalContainers = aggregated.TotalContainers
 
-	if isKubernetes == "true" {
-		log.Printf("[INFO] Finished configuring kubernetes environment. Connecting to %s", fullUrl)
-	} else {
-		log.Printf("[INFO] Finished configuring docker environment. Connecting to %s", fullUrl)
-	}
+	//log.Printf("[DEBUG] CPU: %.2f, Memory: %.2f", newStats.CPUPercent, newStats.MemoryPercent)
+	return newStats
+}
 
-	forwardData := bytes.NewBuffer([]byte{})
-	forwardMethod := "POST"
+// Takes a single sample of the docker host's resource usage
+func sampleHostStats(ctx context.Context) (shuffle.OrborusStats, error) {
+	newStats := shuffle.OrborusStats{}
 
-	req, err := http.NewRequest(
-		forwardMethod,
-		fullUrl,
-		forwardData,
-	)
+	// Use the docker API to get the CPU usage of the docker engine machine
+	pers, err := dockercli.Info(ctx)
+	if err != nil {
+		log.Printf("[ERROR] Failed getting docker info: %s. This is normal IF there are many containers running.", err)
+		return newStats, err
+	}
+
+	newStats.TotalContainers = pers.Containers
+	newStats.StoppedContainers = pers.ContainersStopped
+	newStats.CPU = int(pers.NCPU)
+	newStats.MaxCPU = int(pers.NCPU)
+	newStats.MaxMemory = int(pers.MemTotal)
 
+	// Get list of all running containers
+	containers, err := dockercli.ContainerList(ctx, container.ListOptions{})
 	if err != nil {
-		log.Printf("[ERROR] Failed making request builder during init: %s", err)
-		return
+		log.Printf("[ERROR] Failed getting container list: %s", err)
+		return newStats, err
 	}
 
-	zombiecounter := 0
+	// Use a WaitGroup to wait for all goroutines to finish
+	var wg sync.WaitGroup
+
+	// Channel to collect results
+	resultCh := make(chan struct {
+		containerID string
+		cpuUsage    float64
+		memoryUsage float64
+	})
+
+	// Iterate through containers and start a goroutine for each container
+	for _, container := range containers {
+		// Check if container is running
+		if container.State != "running" {
+			continue
+		}
+
+		if container.Labels[shuffleComponentLabel] == "worker" {
+			newStats.WorkerContainers += 1
+		} else if container.Labels[shuffleComponentLabel] == "app" {
+			newStats.AppContainers += 1
+		}
+
+		wg.Add(1)
+		go func(container types.Container) {
+			defer wg.Done()
+
+			// Get CPU and memory usage for the container
+			cpuUsage, memoryUsage, err := getContainerResourceUsage(ctx, dockercli, container.ID)
+			if err != nil {
+				//log.Printf("[DEBUG] Error getting resource usage for container %s: %v\n", container.ID, err)
+			}
+
+			// Send the result to the channel
+			resultCh <- struct {
+				containerID string
+				cpuUsage    float64
+				memoryUsage float64
+			}{container.ID, cpuUsage, memoryUsage}
+		}(container)
+	}
+
+	// Close the result channel after all goroutines are done
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	// Iterate through containers and get CPU usage
+	totalCPU := float64(0.0)
+	memUsage := float64(0.0)
+	for result := range resultCh {
+		// check if it's NaN or Inf
+		if !math.IsNaN(result.cpuUsage) && !math.IsInf(result.cpuUsage, 0) {
+			totalCPU += float64(result.cpuUsage)
+		}
+
+		if !math.IsNaN(result.memoryUsage) && !math.IsInf(result.memoryUsage, 0) {
+			memUsage += float64(result.memoryUsage)
+		}
+	}
+
+	if newStats.CPU > 0 {
+		newStats.CPUPercent = totalCPU / float64(newStats.CPU)
+	}
+
+	newStats.MemoryPercent = memUsage
+	newStats.Memory = int(memUsage / 100 * float64(newStats.MaxMemory))
+
+	return newStats, nil
+}
 
+// Adds the headers the backend uses to identify this Orborus
+func addOrborusHeaders(req *http.Request) {
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Org-Id", environment)
+
 	if len(auth) > 0 {
 		req.Header.Add("Authorization", auth)
 	}
@@ -2187,278 +2737,505 @@ func main() {
 	}
 
 	if len(orborusLabel) > 0 {
-		log.Printf("[DEBUG] Sending with Label '%s'", orborusLabel)
 		req.Header.Add("X-Orborus-Label", orborusLabel)
 	}
+}
 
-	if swarmConfig != "run" && swarmConfig != "swarm" {
-		req.Header.Add("X-Orborus-Runmode", "Default")
-	} else {
-		req.Header.Add("X-Orborus-Runmode", "Docker Swarm")
+func sendRemoveRequest(client *http.Client, toBeRemoved shuffle.ExecutionRequestWrapper, baseUrl, environment, auth, org string, sleepTime int) error {
+	confirmUrl := fmt.Sprintf("%s/api/v1/workflows/queue/confirm", baseUrl)
+	data, err := json.Marshal(toBeRemoved)
+	if err != nil {
+		log.Printf("[WARNING] Failed removal marshalling: %s", err)
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+		return err
 	}
 
-	if os.Getenv("SHUFFLE_MAX_CPU") != "" {
-		// parse
-		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_MAX_CPU"))
-		if err == nil {
-			maxCPUPercent = tmpInt
-		}
-	}
+	result, err := http.NewRequest(
+		"POST",
+		confirmUrl,
+		bytes.NewBuffer([]byte(data)),
+	)
 
-	swarmPollingTime := time.Now()
-	swarmRequestsMade := 0
-	swarmControlMode := false
-	if os.Getenv("SHUFFLE_SWARM_CONTROL_MODE") == "true" {
-		swarmControlMode = true
+	if err != nil {
+		log.Printf("[ERROR] Failed building confirm request: %s", err)
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+		return err
 	}
 
-	log.Printf("[INFO] Waiting for executions at %s with Environment %#v", fullUrl, environment)
+	result.Header.Add("Content-Type", "application/json")
+	result.Header.Add("Org-Id", environment)
 
+	if len(auth) > 0 {
+		result.Header.Add("Authorization", auth)
+	}
 
-	hasStarted := false
-	for {
-		if req.Method == "POST" {
-			// Should find data to send (memory etc.)
+	if len(org) > 0 {
+		result.Header.Add("Org", org)
+	}
 
-			// Create timeout of max 4 seconds just in case
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			defer cancel()
+	if len(orborusLabel) > 0 {
+		result.Header.Add("X-Orborus-Label", orborusLabel)
+	}
 
-			// Marshal and set body
-			orborusStats := getOrborusStats(ctx)
+	resultResp, err := client.Do(result)
+	if err != nil {
+		log.Printf("[ERROR] Failed making confirm request: %s", err)
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+		return err
+	}
 
-			pipelinePayload, pipelineerr := sendPipelineHealthStatus()
+	defer resultResp.Body.Close()
+	body, err := ioutil.ReadAll(resultResp.Body)
+	if err != nil {
+		log.Printf("[ERROR] Failed reading confirm body: %s", err)
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+		return err
+	}
 
-			if pipelineerr != nil {
-				// Too verbose to be enabled.
-				//log.Printf("[ERROR] Failed sending pipeline health status: %s", pipelineerr)
-			}
+	_ = body
+	//log.Printf("[DEBUG] Confirm response: %s", string(body))
 
-			orborusStats.DataLake = pipelinePayload
-			jsonData, err := json.Marshal(orborusStats)
-			if err == nil {
-				req.Body = ioutil.NopCloser(bytes.NewBuffer(jsonData))
-			} else {
-				log.Printf("[ERROR] Failed marshalling. Maybe max 4 second timeout? %s", err)
-			}
+	return nil
+}
 
-			if int(orborusStats.CPUPercent) > maxCPUPercent {
-				log.Printf("[DEBUG] CPU usage is at %f%%. This is more than the max limit the machine should be running at (%d). Waiting before continue.", orborusStats.CPUPercent, maxCPUPercent)
-				time.Sleep(time.Duration(sleepTime) * time.Second)
-				continue
-			}
-		}
+func cleanup() {
+	log.Printf("[INFO] Cleaning up during shutdown")
+	ctx := context.Background()
+	cleanupExistingNodes(ctx)
+	zombiecheck(ctx, 600)
+	os.Exit(0)
+}
 
-		newresp, err := client.Do(req)
-		if err != nil {
-			log.Printf("[WARNING] Failed making request to %s: %s", fullUrl, err)
+// Initial loop etc
+func main() {
+	// Get arch. amd64 or arm64
 
-			zombiecounter += 1
-			if zombiecounter*sleepTime > workerTimeout {
-				go zombiecheck(ctx, workerTimeout)
-				zombiecounter = 0
-			}
-			time.Sleep(time.Duration(sleepTime) * time.Second)
-			continue
-		}
+	//sigCh := make(chan os.Signal, 1)
+	//signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	//defer cleanup()
 
-		//defer newresp.Body.Close()
-		if newresp.StatusCode == 405 {
-			log.Printf("[WARNING] Received 405 from %s. This is likely due to a misconfigured base URL. Automatically swapping to GET request (backwards compatibility)", fullUrl)
+	// Block until a signal is received
+	if shuffle.IsRunningInCluster() {
+		log.Printf("[INFO] Running inside k8s cluster")
+	}
 
-			req.Method = "GET"
-			req.Body = nil
+	if isKubernetes == "true" {
+		fixk8sRoles()
+	}
 
-			//time.Sleep(time.Duration(sleepTime) * time.Second)
-			continue
+	startupDelay := os.Getenv("SHUFFLE_ORBORUS_STARTUP_DELAY")
+	if len(startupDelay) > 0 {
+		log.Printf("[DEBUG] Setting startup delay to %#v", startupDelay)
+
+		tmpInt, err := strconv.Atoi(startupDelay)
+		if err == nil {
+			time.Sleep(time.Duration(tmpInt) * time.Second)
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_STARTUP_DELAY must be a number, not '%s'. Using default.", startupDelay)
 		}
+	}
 
-		body, err := ioutil.ReadAll(newresp.Body)
-		if err != nil {
-			log.Printf("[ERROR] Failed reading body from Shuffle: %s", err)
-			zombiecounter += 1
-			if zombiecounter*sleepTime > workerTimeout {
-				go zombiecheck(ctx, workerTimeout)
-				zombiecounter = 0
-			}
-			time.Sleep(time.Duration(sleepTime) * time.Second)
-			continue
+	log.Println("[INFO] Setting up execution environment")
+
+	// //FIXME
+	if baseUrl == "" {
+		baseUrl = "https://shuffler.io"
+		//baseUrl = "http://localhost:5001"
+	}
+
+	if len(orborusUuid) == 0 {
+		orborusUuid = uuid.NewV4().String()
+	}
+
+	//if orgId == "" {
+	//	log.Printf("[ERROR] Org not defined. Set variable ORG_ID based on your org")
+	//	os.Exit(3)
+	//}
+	if environment == "" {
+		log.Printf("[ERROR] Environment not defined. Set variable ENVIRONMENT_NAME to configure it.")
+		os.Exit(3)
+	}
+
+	if timezone == "" {
+		timezone = "Europe/Amsterdam"
+	}
+
+	log.Printf("[INFO] Using environment '%s' with timezone %s", environment, timezone)
+	if len(auth) == 0 || len(org) == 0 {
+		log.Printf("[WARNING] AUTH or ORG is not set. Pipeline recovery, job results and image cache reporting need both: ORG set to your Org ID and AUTH to the environment's auth key")
+	}
+
+	if len(os.Getenv("SHUFFLE_ORBORUS_PULL_TIME")) > 0 {
+		log.Printf("[INFO] Trying to set Orborus sleep time between polls to %s", os.Getenv("SHUFFLE_ORBORUS_PULL_TIME"))
+
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_ORBORUS_PULL_TIME"))
+		if err == nil {
+			sleepTime = tmpInt
 		}
+	}
 
-		// Controls Leader/Follower mode
-		if newresp.StatusCode == 409 {
-			log.Printf("[INFO] Another Orborus is already handling jobs. Polling every 30 seconds in case Leader stops. Resp: %s", string(body))
-			time.Sleep(time.Duration(30) * time.Second)
-			continue
-		} else if newresp.StatusCode != 200 {
-			log.Printf("[ERROR] Backend connection failed for url '%s', or is missing (%d): %s", fullUrl, newresp.StatusCode, string(body))
+	// Handle Cleanup - made it cleanup by default
+	if strings.ToLower(os.Getenv("SHUFFLE_CONTAINER_AUTO_CLEANUP")) != "false" && os.Getenv("CLEANUP") == "" {
+		cleanupEnv = "true"
+	}
+
+	if len(cleanupEnv) > 0 {
+		log.Printf("[DEBUG] Verbose mode. NOT cleaning up. Cleanup env: %s", cleanupEnv)
+	}
+
+	workerTimeout := 600
+	if workerTimeoutEnv != "" {
+		tmpInt, err := strconv.Atoi(workerTimeoutEnv)
+		if err == nil {
+			workerTimeout = tmpInt
 		} else {
-			if !hasStarted {
-				log.Printf("[DEBUG] Starting iteration on environment %#v (default = Shuffle). Got statuscode %d from backend on first request", environment, newresp.StatusCode)
-			}
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_EXECUTION_TIMEOUT must be a number, not %s", workerTimeoutEnv)
+		}
 
-			if os.Getenv("SHUFFLE_SWARM_CONFIG") == "run" && os.Getenv("SHUFFLE_SCALE_REPLICAS") == "" {
-				// go AutoScale(ctx)
-			}
-			hasStarted = true
+		log.Printf("[INFO] Cleanup process running every %d seconds", workerTimeout)
+	}
+
+	if concurrencyEnv != "" {
+		//var concurrencyEnv = os.Getenv("SHUFFLE_ORBORUS_EXECUTION_CONCURRENCY")
+		tmpInt, err := strconv.Atoi(concurrencyEnv)
+		if err == nil {
+			maxConcurrency = tmpInt
+			log.Printf("[INFO] Max workflow execution concurrency set to %d", maxConcurrency)
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_ORBORUS_EXECUTION_CONCURRENCY must be a number, not %s. Defaulted to %d", workerTimeoutEnv, maxConcurrency)
 		}
+	}
 
-		var executionRequests shuffle.ExecutionRequestWrapper
-		err = json.Unmarshal(body, &executionRequests)
+	if hardenedMode {
+		err := ensureDockerSocketProxy(context.Background())
 		if err != nil {
-			log.Printf("[WARNING] Failed executionrequest in queue unmarshaling: %s", err)
-			sleepTime = 10
-			zombiecounter += 1
-			if zombiecounter*sleepTime > workerTimeout {
-				go zombiecheck(ctx, workerTimeout)
-				zombiecounter = 0
-			}
-			time.Sleep(time.Duration(sleepTime) * time.Second)
-			continue
+			log.Printf("[ERROR] Hardened mode: failed starting docker socket proxy. Workers will not be deployed until it works: %s", err)
 		}
+	}
 
-		if hasStarted && len(executionRequests.Data) > 0 {
-			//log.Printf("[INFO] Body: %s", string(body))
-			// Type string `json:"type"`
-		}
+	if len(os.Getenv("DOCKER_HOST")) > 0 {
+		log.Printf("[DEBUG] Running docker with socket proxy %s instead of default", os.Getenv("DOCKER_HOST"))
 
-		// FIXME: Add features here for orborus & worker to
-		// do things on behalf of backend
-		var toBeRemoved shuffle.ExecutionRequestWrapper
-		if len(executionRequests.Data) > 0 {
-			newrequests := []shuffle.ExecutionRequest{}
+	} else {
+		log.Printf(`[DEBUG] Running docker with default socket /var/run/docker.sock or `)
+	}
 
-			// Deduplicating in case same job shows up multiple times
-			// This is specifically to handle data pipelines better
-			deduplicatedJobs := []shuffle.ExecutionRequest{}
-			for _, incRequest := range executionRequests.Data {
-				if !strings.Contains(incRequest.Type, "DOCKER") && !strings.Contains(incRequest.Type, "PIPELINE") && !strings.Contains(incRequest.Type, "SIGMA") && !strings.Contains(incRequest.Type, "TENZIR") {
-					deduplicatedJobs = append(deduplicatedJobs, incRequest)
-					continue
-				}
+	ctx := context.Background()
+	// Run by default from now
+	//commenting for now as its stoppoing minikube
 
-				found := false
-				for _, dedupRequest := range deduplicatedJobs {
-					if incRequest.ExecutionArgument == dedupRequest.ExecutionArgument && incRequest.Type == dedupRequest.Type {
-						found = true
-						break
-					}
-				}
+	log.Printf("[INFO] Running towards %s (BASE_URL) with environment name %s", baseUrl, environment)
 
-				if found {
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
-					continue
-				}
+	if environment == "" {
+		environment = "onprem"
+		log.Printf("[WARNING] Defaulting to environment name %s. Set environment variable ENVIRONMENT_NAME to change. This should be the same as in the frontend action.", environment)
+	}
 
-				deduplicatedJobs = append(deduplicatedJobs, incRequest)
+	if pipelineUrl == "" {
+		pipelineUrl = "http://localhost:5160"
+
+		// Find the IP in baseUrl. Base format is http://<ip>:<port>
+		if baseUrl != "" && !strings.Contains(baseUrl, "shuffle") && !strings.Contains(baseUrl, "localhost") && !strings.Contains(baseUrl, "run.app") {
+			urlSplit := strings.Split(baseUrl, "://")
+			if len(urlSplit) > 1 {
+				// Find the IP
+				ipSplit := strings.Split(urlSplit[1], ":")
+				if len(ipSplit) > 0 {
+					pipelineUrl = fmt.Sprintf("http://%s:5160", ipSplit[0])
+				}
 			}
+		}
 
-			executionRequests.Data = deduplicatedJobs
-			for _, incRequest := range executionRequests.Data {
+		if len(containerId) > 0 {
+			pipelineUrl = "http://tenzir-node:5160"
+		}
 
-				// Looking for specific jobs
-				if incRequest.Type == "PIPELINE_CREATE" || incRequest.Type == "PIPELINE_START" || incRequest.Type == "PIPELINE_STOP" || incRequest.Type == "PIPELINE_DELETE" {
+		log.Printf("[WARNING] SHUFFLE_PIPELINE_URL not set, falling back to default URL: %s. If BASE_URL is set, we use the external IP for that", pipelineUrl)
+		os.Setenv("SHUFFLE_PIPELINE_URL", pipelineUrl)
+	}
 
-					os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
-					tenzirDisabled = false
+	// FIXME - during init, BUILD and/or LOAD worker and app_sdk
+	// Build/load app_sdk so it can be loaded as 127.0.0.1:5000/walkoff_app_sdk
+	log.Printf("[INFO] Setting up Docker environment. Downloading worker and App SDK!")
 
-					// Running NEW or editing pipelines
-					err := handlePipeline(incRequest)
-					if err != nil {
-						log.Printf("[ERROR] Failed handling pipeline ('%s' '%s'): %s. Deleting job anyway.", incRequest.Type, incRequest.ExecutionSource, err)
-					}
+	initializeImages()
+	workerImage := fmt.Sprintf("ghcr.io/shuffle/shuffle-worker:%s", workerVersion)
+	if len(newWorkerImage) > 0 {
+		workerImage = newWorkerImage
+	}
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
-				} else if incRequest.Type == "DOCKER_IMAGE_DOWNLOAD" {
-					log.Printf("[INFO] Re-downloading new image(s) due to backend request: %#v", incRequest.ExecutionArgument)
+	if swarmConfig == "run" || swarmConfig == "swarm" || isKubernetes == "true" {
+		if isKubernetes != "true" {
+			checkSwarmService(ctx)
+		}
 
-					if len(incRequest.ExecutionArgument) > 0 {
-						go handleBackendImageDownload(ctx, incRequest.ExecutionArgument)
-					} else {
-						log.Printf("[ERROR] No image name provided for download. Removing job from queue.")
-					}
+		log.Printf("[DEBUG] Cleaning up containers from previous run")
+		cleanupExistingNodes(ctx)
+		time.Sleep(time.Duration(5) * time.Second)
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+		log.Printf("[DEBUG] Deploying worker image %s to swarm", workerImage)
 
-				} else if incRequest.Type == "CATEGORY_UPDATE" {
-					os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
-					tenzirDisabled = false
+		runString := "Run: \"docker service ls\" for more info"
 
-					err = handleFileCategoryChange()
-					if err != nil {
-						log.Printf("[ERROR] Failed to download the file category: %s", err)
-					}
+		if isKubernetes != "true" {
+			deployServiceWorkers(workerImage)
+		} else {
+			deployK8sWorker(workerImage, "shuffle-workers", []string{})
+			runString = "Run: \"kubectl get pods\" for more info"
+		}
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+		err := setBackendToSwarmNetwork(ctx)
+		if err != nil {
+			log.Printf("[WARNING] Failed setting backend to swarm network: %s", err)
+		}
 
-				} else if incRequest.Type == "DISABLE_SIGMA_FOLDER" {
-					log.Printf("[INFO] Got job to disable sigma rules")
+		log.Printf("[DEBUG] Waiting 45 seconds to ensure workers are deployed. %s", runString)
+		time.Sleep(time.Duration(45) * time.Second)
 
-					err = removeFileCategory()
-					if err != nil {
-						log.Printf("[ERROR] Failed to disable the sigma rules: %s", err)
-					}
+		//deployServiceWorkers(workerImage)
+	}
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+	zombiecheck(ctx, workerTimeout)
+	if swarmConfig == "run" || swarmConfig == "swarm" || isKubernetes == "true" {
+		go runZombieReconciler(ctx, workerTimeout)
+	}
 
-				} else if incRequest.Type == "DISABLE_SIGMA_FILE" {
-					fileName := incRequest.ExecutionArgument
-					log.Printf("[INFO] Got job to disable sigma file %s", fileName)
+	client := shuffle.GetExternalClient(baseUrl)
+	fullUrl := fmt.Sprintf("%s/api/v1/workflows/queue", baseUrl)
 
-					err = disableRule(fileName)
-					if err != nil {
-						log.Printf("[ERROR] Failed to disable the sigma file %s, reason: %s", fileName, err)
-					}
+	if isKubernetes == "true" {
+		log.Printf("[INFO] Finished configuring kubernetes environment. Connecting to %s", fullUrl)
+	} else {
+		log.Printf("[INFO] Finished configuring docker environment. Connecting to %s", fullUrl)
+	}
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+	forwardData := bytes.NewBuffer([]byte{})
+	forwardMethod := "POST"
 
-				} else if incRequest.Type == "ENABLE_SIGMA_FILE" {
-					fileName := incRequest.ExecutionArgument
-					log.Printf("[INFO] Got job to enable sigma file %s", fileName)
+	req, err := http.NewRequest(
+		forwardMethod,
+		fullUrl,
+		forwardData,
+	)
 
-					err = enableRule(fileName)
-					if err != nil {
-						log.Printf("[ERROR] Failed to disable the sigma file %s, reason: %s", fileName, err)
-					}
+	if err != nil {
+		log.Printf("[ERROR] Failed making request builder during init: %s", err)
+		return
+	}
 
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
-				} else if incRequest.Type == "START_TENZIR" {
-					log.Printf("[INFO] Got job to start tenzir")
+	zombiecounter := 0
 
-					// Manual command = overrides to allow starting of Tenzir from the frontend anyway.
-					os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
-					tenzirDisabled = false
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("Org-Id", environment)
+	if len(auth) > 0 {
+		req.Header.Add("Authorization", auth)
+	}
 
-					// Removed either way
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+	if len(org) > 0 {
+		req.Header.Add("Org", org)
+	}
 
-					err := deployTenzirNode()
-					if err != nil {
-						if strings.Contains(fmt.Sprintf("%s", err), "node available") {
-							// Disabling until UI is updated
-							os.Setenv("SHUFFLE_SKIP_PIPELINES", "true")
-							tenzirDisabled = true
-
-							log.Printf("[ERROR] Failed to start tenzir, reason: %s", err)
-							err = shuffle.CreateOrgNotification(
-								ctx,
-								fmt.Sprintf("Failed to start Tenzir: %s", err),
-								fmt.Sprintf("Tenzir failed to start due to: %s", err),
-								fmt.Sprintf("/detections/Sigma"),
-								org,
-								true,
-							)
-
-							if err != nil {
-								log.Printf("[ERROR] Failed to send notification: %s", err)
-								return
-							}
-						}
-					}
+	if len(orborusLabel) > 0 {
+		log.Printf("[DEBUG] Sending with Label '%s'", orborusLabel)
+		req.Header.Add("X-Orborus-Label", orborusLabel)
+	}
 
-				} else {
+	if swarmConfig != "run" && swarmConfig != "swarm" {
+		req.Header.Add("X-Orborus-Runmode", "Default")
+	} else {
+		req.Header.Add("X-Orborus-Runmode", "Docker Swarm")
+	}
+
+	if os.Getenv("SHUFFLE_MAX_CPU") != "" {
+		// parse
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_MAX_CPU"))
+		if err == nil {
+			maxCPUPercent = tmpInt
+		}
+	}
+
+	swarmPollingTime := time.Now()
+	swarmRequestsMade := 0
+	swarmControlMode := false
+	if os.Getenv("SHUFFLE_SWARM_CONTROL_MODE") == "true" {
+		swarmControlMode = true
+	}
+
+	registerJobHandlers()
+	go runTenzirSupervisor(ctx)
+
+	if isKubernetes != "true" && os.Getenv("SHUFFLE_STATS_DISABLED") != "true" {
+		go runHostStatsSampler(ctx)
+	}
+
+	log.Printf("[INFO] Waiting for executions at %s with Environment %#v", fullUrl, environment)
+
+
+	hasStarted := false
+	for {
+		if req.Method == "POST" {
+			// Should find data to send (memory etc.)
+
+			// Create timeout of max 4 seconds just in case
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			// Marshal and set body
+			orborusStats := getOrborusStats(ctx)
+
+			pipelinePayload, pipelineerr := sendPipelineHealthStatus()
+
+			if pipelineerr != nil {
+				// Too verbose to be enabled.
+				//log.Printf("[ERROR] Failed sending pipeline health status: %s", pipelineerr)
+			}
+
+			orborusStats.DataLake = pipelinePayload
+			jsonData, err := json.Marshal(orborusStats)
+			if err == nil {
+				req.Body = ioutil.NopCloser(bytes.NewBuffer(jsonData))
+			} else {
+				log.Printf("[ERROR] Failed marshalling. Maybe max 4 second timeout? %s", err)
+			}
+
+			// Throttles on the latest sample, as stats are only sent once per interval
+			cpuPercent := hostStats.latestCPUPercent()
+			if int(cpuPercent) > maxCPUPercent {
+				log.Printf("[DEBUG] CPU usage is at %f%%. This is more than the max limit the machine should be running at (%d). Waiting before continue.", cpuPercent, maxCPUPercent)
+				time.Sleep(time.Duration(sleepTime) * time.Second)
+				continue
+			}
+		}
+
+		newresp, err := client.Do(req)
+		if err != nil {
+			log.Printf("[WARNING] Failed making request to %s: %s", fullUrl, err)
+
+			zombiecounter += 1
+			if zombiecounter*sleepTime > workerTimeout {
+				go zombiecheck(ctx, workerTimeout)
+				zombiecounter = 0
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Second)
+			continue
+		}
+
+		//defer newresp.Body.Close()
+		if newresp.StatusCode == 405 {
+			log.Printf("[WARNING] Received 405 from %s. This is likely due to a misconfigured base URL. Automatically swapping to GET request (backwards compatibility)", fullUrl)
+
+			req.Method = "GET"
+			req.Body = nil
+
+			//time.Sleep(time.Duration(sleepTime) * time.Second)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(newresp.Body)
+		if err != nil {
+			log.Printf("[ERROR] Failed reading body from Shuffle: %s", err)
+			zombiecounter += 1
+			if zombiecounter*sleepTime > workerTimeout {
+				go zombiecheck(ctx, workerTimeout)
+				zombiecounter = 0
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Second)
+			continue
+		}
+
+		// Controls Leader/Follower mode
+		if newresp.StatusCode == 409 {
+			log.Printf("[INFO] Another Orborus is already handling jobs. Polling every 30 seconds in case Leader stops. Resp: %s", string(body))
+			time.Sleep(time.Duration(30) * time.Second)
+			continue
+		} else if newresp.StatusCode != 200 {
+			log.Printf("[ERROR] Backend connection failed for url '%s', or is missing (%d): %s", fullUrl, newresp.StatusCode, string(body))
+		} else {
+			if !hasStarted {
+				log.Printf("[DEBUG] Starting iteration on environment %#v (default = Shuffle). Got statuscode %d from backend on first request", environment, newresp.StatusCode)
+			}
+
+			if !hasStarted && (swarmConfig == "run" || swarmConfig == "swarm" || isKubernetes == "true") && os.Getenv("SHUFFLE_SCALE_REPLICAS") == "" && strings.ToLower(os.Getenv("SHUFFLE_AUTOSCALE")) == "true" {
+				go AutoScale(ctx)
+			}
+
+			if !hasStarted && isKubernetes != "true" && strings.ToLower(os.Getenv("SHUFFLE_IMAGE_WARMUP_DISABLED")) != "true" {
+				go warmupImages(context.Background(), client)
+			}
+
+			hasStarted = true
+		}
+
+		var executionRequests shuffle.ExecutionRequestWrapper
+		err = json.Unmarshal(body, &executionRequests)
+		if err != nil {
+			log.Printf("[WARNING] Failed executionrequest in queue unmarshaling: %s", err)
+			sleepTime = 10
+			zombiecounter += 1
+			if zombiecounter*sleepTime > workerTimeout {
+				go zombiecheck(ctx, workerTimeout)
+				zombiecounter = 0
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Second)
+			continue
+		}
+
+		atomic.StoreInt64(&lastQueueLength, int64(len(executionRequests.Data)))
+
+		if hasStarted && len(executionRequests.Data) > 0 {
+			//log.Printf("[INFO] Body: %s", string(body))
+			// Type string `json:"type"`
+		}
+
+		// Jobs Orborus does on behalf of the backend are handled by
+		// the registered job handlers. Everything else is an execution.
+		var toBeRemoved shuffle.ExecutionRequestWrapper
+		if len(executionRequests.Data) > 0 {
+			newrequests := []shuffle.ExecutionRequest{}
+
+			// Deduplicating in case same job shows up multiple times
+			// This is specifically to handle data pipelines better
+			deduplicatedJobs := []shuffle.ExecutionRequest{}
+			for _, incRequest := range executionRequests.Data {
+				handler, ok := jobHandlers[incRequest.Type]
+				if !ok || !handler.Deduplicate {
+					deduplicatedJobs = append(deduplicatedJobs, incRequest)
+					continue
+				}
+
+				found := false
+				for _, dedupRequest := range deduplicatedJobs {
+					if incRequest.ExecutionArgument == dedupRequest.ExecutionArgument && incRequest.Type == dedupRequest.Type {
+						found = true
+						break
+					}
+				}
+
+				if found {
+					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+					continue
+				}
+
+				deduplicatedJobs = append(deduplicatedJobs, incRequest)
+			}
+
+			executionRequests.Data = deduplicatedJobs
+			jobResults := []jobResult{}
+			for _, incRequest := range executionRequests.Data {
+				handler, ok := jobHandlers[incRequest.Type]
+				if !ok {
 					newrequests = append(newrequests, incRequest)
+					continue
 				}
+
+				// Removed either way. Failed jobs are retried by the backend.
+				jobResults = append(jobResults, runJobHandler(ctx, client, handler, incRequest))
+				toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+			}
+
+			err = reportJobResults(client, jobResults)
+			if err != nil {
+				log.Printf("[ERROR] Failed reporting %d job result(s) to backend: %s", len(jobResults), err)
 			}
 
 			if len(toBeRemoved.Data) > 0 {
@@ -2622,18 +3399,25 @@ func main() {
 				env = append(env, fmt.Sprintf("SHUFFLE_MAX_SWARM_NODES=%s", os.Getenv("SHUFFLE_MAX_SWARM_NODES")))
 			}
 
+			env = append(env, getAppLimitEnv()...)
+			env = append(env, getHardenedEnv()...)
+			env = append(env, getEgressPolicyEnv()...)
+			env = append(env, getLabelEnv()...)
+
 			err = deployWorker(workerImage, containerName, env, execution)
 			zombiecounter += 1
 			if err == nil {
 				//log.Printf("[DEBUG] ExecutionID %s was deployed and to be removed from queue.", execution.ExecutionId)
 				toBeRemoved.Data = append(toBeRemoved.Data, execution)
 				executionIds = append(executionIds, execution.ExecutionId)
+				markExecutionActive(execution.ExecutionId)
 			} else {
 				log.Printf("[WARNING][%s] Failed to deploy: %s", execution.ExecutionId, err)
 
 				if strings.Contains(err.Error(), "already exists") {
 					toBeRemoved.Data = append(toBeRemoved.Data, execution)
 					executionIds = append(executionIds, execution.ExecutionId)
+					markExecutionActive(execution.ExecutionId)
 				} else if strings.Contains(err.Error(), "No such image") {
 					// Download the image
 
@@ -2663,1212 +3447,2253 @@ func main() {
 		}
 		time.Sleep(time.Duration(sleepTime) * time.Second)
 	}
-}
+}
+
+// Handles a job the backend asks Orborus to do on its behalf.
+// Jobs without a registered handler are treated as executions.
+type jobHandler struct {
+	Type string
+
+	// Drops jobs with the same type and argument in a single poll
+	Deduplicate bool
+
+	// Runs in the background, reporting the result when done
+	Async bool
+
+	Handle func(ctx context.Context, job shuffle.ExecutionRequest) error
+}
+
+var jobHandlers = map[string]jobHandler{}
+
+func registerJobHandler(handler jobHandler) {
+	if _, ok := jobHandlers[handler.Type]; ok {
+		log.Printf("[WARNING] Job handler for type %s is already registered. Overwriting it.", handler.Type)
+	}
+
+	jobHandlers[handler.Type] = handler
+}
+
+func registerJobHandlers() {
+	for _, pipelineType := range []string{"PIPELINE_CREATE", "PIPELINE_START", "PIPELINE_STOP", "PIPELINE_DELETE"} {
+		registerJobHandler(jobHandler{
+			Type:        pipelineType,
+			Deduplicate: true,
+			Handle:      handlePipelineJob,
+		})
+	}
+
+	registerJobHandler(jobHandler{
+		Type:        "DOCKER_IMAGE_DOWNLOAD",
+		Deduplicate: true,
+		Async:       true,
+		Handle:      handleImageDownloadJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:        "DOCKER_IMAGE_PREPULL",
+		Deduplicate: true,
+		Async:       true,
+		Handle:      handleImagePrepullJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:   "CATEGORY_UPDATE",
+		Handle: handleCategoryUpdateJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:        "DISABLE_SIGMA_FOLDER",
+		Deduplicate: true,
+		Handle:      handleDisableSigmaFolderJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:        "DISABLE_SIGMA_FILE",
+		Deduplicate: true,
+		Handle:      handleDisableSigmaFileJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:        "ENABLE_SIGMA_FILE",
+		Deduplicate: true,
+		Handle:      handleEnableSigmaFileJob,
+	})
+
+	registerJobHandler(jobHandler{
+		Type:        "START_TENZIR",
+		Deduplicate: true,
+		Handle:      handleStartTenzirJob,
+	})
+}
+
+// The result of a job, reported back to the backend
+type jobResult struct {
+	ExecutionId       string `json:"execution_id"`
+	Type              string `json:"type"`
+	ExecutionArgument string `json:"execution_argument"`
+	ExecutionSource   string `json:"execution_source"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+	Duration          int64  `json:"duration"`
+	Timestamp         int64  `json:"timestamp"`
+	OrborusUuid       string `json:"orborus_uuid"`
+}
+
+// Runs the handler and returns the result of the job.
+// Async jobs return immediately and report back when they finish.
+func runJobHandler(ctx context.Context, client *http.Client, handler jobHandler, job shuffle.ExecutionRequest) jobResult {
+	if !handler.Async {
+		return runJob(ctx, handler, job)
+	}
+
+	go func() {
+		result := runJob(context.Background(), handler, job)
+		err := reportJobResults(client, []jobResult{result})
+		if err != nil {
+			log.Printf("[ERROR] Failed reporting result of job %s (%s): %s", job.Type, job.ExecutionId, err)
+		}
+	}()
+
+	return newJobResult(job, "EXECUTING", nil, 0)
+}
+
+func newJobResult(job shuffle.ExecutionRequest, status string, err error, duration time.Duration) jobResult {
+	result := jobResult{
+		ExecutionId:       job.ExecutionId,
+		Type:              job.Type,
+		ExecutionArgument: job.ExecutionArgument,
+		ExecutionSource:   job.ExecutionSource,
+		Status:            status,
+		Duration:          duration.Milliseconds(),
+		Timestamp:         time.Now().Unix(),
+		OrborusUuid:       orborusUuid,
+	}
+
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	return result
+}
+
+func runJob(ctx context.Context, handler jobHandler, job shuffle.ExecutionRequest) jobResult {
+	startTime := time.Now()
+	err := handler.Handle(ctx, job)
+	if err != nil {
+		log.Printf("[ERROR] Failed handling job %s (%s): %s", job.Type, job.ExecutionId, err)
+		return newJobResult(job, "FAILED", err, time.Since(startTime))
+	}
+
+	return newJobResult(job, "FINISHED", nil, time.Since(startTime))
+}
+
+// Sends the job results to the backend, which decides whether to retry
+func reportJobResults(client *http.Client, results []jobResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		fmt.Sprintf("%s/api/v1/workflows/queue/results", baseUrl),
+		bytes.NewBuffer(data),
+	)
+
+	if err != nil {
+		return err
+	}
+
+	addOrborusHeaders(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("got status code %d from backend: %s", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
+
+func handlePipelineJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
+	tenzirDisabled.Store(false)
+
+	// Running NEW or editing pipelines
+	err := handlePipeline(job)
+	tenzirSupervisor.wake()
+
+	return err
+}
+
+func handleImageDownloadJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	log.Printf("[INFO] Re-downloading new image(s) due to backend request: %#v", job.ExecutionArgument)
+	if len(job.ExecutionArgument) == 0 {
+		return errors.New("no image name provided for download")
+	}
+
+	return handleBackendImageDownload(ctx, job.ExecutionArgument)
+}
+
+// Pre-pulls images used by active workflows, so their first run isn't a cold start
+func handleImagePrepullJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	if len(job.ExecutionArgument) == 0 {
+		return errors.New("no images provided for pre-pull")
+	}
+
+	failed := prepullImages(ctx, strings.Split(job.ExecutionArgument, ","))
+	err := reportImageCache(&http.Client{Timeout: 30 * time.Second})
+	if err != nil {
+		log.Printf("[WARNING] Failed reporting image cache to backend: %s", err)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed pre-pulling %d image(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func handleCategoryUpdateJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
+	tenzirDisabled.Store(false)
+
+	return handleFileCategoryChange()
+}
+
+func handleDisableSigmaFolderJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	log.Printf("[INFO] Got job to disable sigma rules")
+	return removeFileCategory()
+}
+
+func handleDisableSigmaFileJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	log.Printf("[INFO] Got job to disable sigma file %s", job.ExecutionArgument)
+	return disableRule(job.ExecutionArgument)
+}
+
+func handleEnableSigmaFileJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	log.Printf("[INFO] Got job to enable sigma file %s", job.ExecutionArgument)
+	return enableRule(job.ExecutionArgument)
+}
+
+func handleStartTenzirJob(ctx context.Context, job shuffle.ExecutionRequest) error {
+	log.Printf("[INFO] Got job to start tenzir")
+
+	// Manual command = overrides to allow starting of Tenzir from the frontend anyway.
+	os.Setenv("SHUFFLE_SKIP_PIPELINES", "false")
+	tenzirDisabled.Store(false)
+
+	// Failures after this are retried with backoff by the supervisor
+	err := deployTenzirNode()
+	tenzirSupervisor.wake()
+
+	return err
+}
+
+// Tenzir command samples
+// docker pull ghcr.io/dominiklohmann/tenzir-arm64:latest
+// docker tag ghcr.io/dominiklohmann/tenzir-arm64:latest tenzir/tenzir:latest
+
+// Read from Cache and send it to a webhook
+// docker run tenzir/tenzir:latest 'from http://192.168.86.44:5002/api/v1/orgs/7e9b9007-5df2-4b47-bca5-c4d267ef2943/cache/CIDR%20ranges?type=text&authorization=cec9d01f-09b2-4419-8a0a-76c6046e3fef read lines | to http://192.168.86.44:5002/api/v1/hooks/webhook_665ace5f-f27b-496a-a365-6e07eb61078c write lines'
+func handlePipeline(incRequest shuffle.ExecutionRequest) error {
+
+	log.Printf("[INFO] Pipeline: '%s' with source '%s'", incRequest.Type, incRequest.ExecutionSource)
+
+	err := deployTenzirNode()
+	if err != nil {
+		log.Printf("[ERROR] Failed to deploy the pipeline, reason: %s", err)
+		return err
+	}
+
+	// no need of execution arguments for STOP and DELETE
+	if (incRequest.Type != "PIPELINE_STOP" && incRequest.Type != "PIPELINE_DELETE") && len(incRequest.ExecutionArgument) == 0 {
+		log.Printf("[ERROR] No execution argument found for pipeline create. Skipping")
+
+		return errors.New("no execution argument found for pipeline create. Skipping")
+	}
+
+	identifier := strings.ToLower(strings.ReplaceAll(incRequest.ExecutionSource, " ", "-"))
+	if !strings.HasPrefix(strings.ToLower(incRequest.ExecutionSource), "shuffle") {
+		identifier = fmt.Sprintf("shuffle-%s", strings.ToLower(strings.ReplaceAll(incRequest.ExecutionSource, " ", "-")))
+	}
+
+	command := incRequest.ExecutionArgument
+	if incRequest.Type == "PIPELINE_CREATE" {
+		log.Printf("[INFO] Should delete -> recreate new pipeline with id %#v", identifier)
+		//err := deployPipeline(image, identifier, command)
+		_, err := createPipeline(command, identifier)
+		if err != nil {
+			log.Printf("[ERROR] Failed to create pipeline: %s", err)
+			return err
+		}
+	} else if incRequest.Type == "PIPELINE_DELETE" || incRequest.Type == "PIPELINE_STOP" {
+		{
+			log.Printf("[INFO] Should delete pipeline %#v", identifier)
+			pipelineId, err := searchPipeline(identifier)
+			if err != nil {
+				log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
+				return err
+			}
+
+			err = deletePipeline(pipelineId)
+			if err != nil {
+				log.Printf("[ERROR] Failed Deleting Pipeline %s", err)
+				return err
+			}
+		}
+
+		/*
+			} else if incRequest.Type == "PIPELINE_STOP" {
+				log.Printf("[INFO] Should stop the pipeline %#v", identifier)
+				pipelineId, err := searchPipeline(identifier)
+				if err != nil {
+					log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
+					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
+					return err
+				}
+				_, err = updatePipelineState(command, pipelineId, "stop")
+				if err != nil {
+					log.Printf("[ERROR] Failed to stop Pipeline: %s reason:%s ", pipelineId, err)
+					return err
+				} else {
+					log.Printf("[INFO] Successfully stopped the Pipeline: %s", pipelineId)
+				}
+		*/
+
+	} else if incRequest.Type == "PIPELINE_START" {
+		log.Printf("[INFO] Should start the pipeline %#v", identifier)
+		pipelineId, err := searchPipeline(identifier)
+		if err != nil {
+			if err.Error() == "no existing pipeline found with name" {
+				log.Printf("[INFO] Starting a new pipeline with command '%s' and identifier '%s'", command, identifier)
+				_, CreateErr := createPipeline(command, identifier)
+				return CreateErr
+			}
+
+			log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
+			return err
+		}
+		_, err = updatePipelineState(command, pipelineId, "start")
+		if err != nil {
+			log.Printf("[ERROR] Failed to start Pipeline: %s reason:%s ", pipelineId, err)
+			return err
+		} else {
+			log.Printf("[INFO] Successfully started the Pipeline: %s", pipelineId)
+		}
+
+	} else {
+		log.Printf("[ERROR] Unknown type for pipeline: %s", incRequest.Type)
+		return errors.New("unknown type for pipeline")
+	}
+
+	return nil
+}
+
+func deployTenzirNode() error {
+	if os.Getenv("SHUFFLE_SKIP_PIPELINES") == "false" || os.Getenv("SHUFFLE_PIPELINE_ENABLED") == "true" {
+		// return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
+		//log.Printf("[INFO] Pipelines are enabled by user")
+	} else {
+		return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
+	}
+
+	if isKubernetes == "true" {
+		return errors.New("Kubernetes not implemented for Tenzir node")
+	}
+
+	err := checkTenzirNode()
+	if err == nil {
+		return nil
+	}
+
+	ctx := context.Background()
+	cacheKey := "tenzir-key"
+
+	imageName := "frikky/shuffle:tenzir"
+	containerName := "tenzir-node"
+	containerStartOptions := container.StartOptions{}
+	_, err = shuffle.GetCache(ctx, cacheKey)
+	if err == nil {
+		return nil
+	}
+
+	containerInfo, err := dockercli.ContainerInspect(ctx, containerName)
+	if err != nil {
+		if dockerclient.IsErrNotFound(err) {
+			// Create network if it doesn't exist
+			networkName := "tenzir-network"
+			networkSubnet := "192.168.1.0/24"
+			networkGateway := "192.168.1.1"
+
+			err = createNetworkIfNotExists(ctx, networkName, networkSubnet, networkGateway)
+			if err != nil {
+				log.Printf("[ERROR] Failed to create network: %s", err)
+				return err
+			}
+
+			// Check if image exists
+			_, _, err := dockercli.ImageInspectWithRaw(ctx, imageName)
+			if dockerclient.IsErrNotFound(err) {
+				log.Printf("[DEBUG] Pulling image %s. This may take a while.", imageName)
+				pullOptions := image.PullOptions{}
+				out, err := dockercli.ImagePull(ctx, imageName, pullOptions)
+				if err != nil {
+					log.Printf("[ERROR] Failed to pull the Tenzir image: %s", err)
+					return err
+				}
+				defer out.Close()
+
+				io.Copy(io.Discard, out)
+			} else if err != nil {
+				return err
+			}
+
+			err = createAndStartTenzirNode(ctx, containerName, imageName, containerStartOptions)
+			if err != nil {
+				return err
+			}
+		} else {
+			return err
+		}
+	} else {
+		if !containerInfo.State.Running {
+			log.Printf("[DEBUG] Tenzir Node exists but is not running. Restarting it.")
+			err := dockercli.ContainerStart(ctx, containerName, containerStartOptions)
+			if err != nil {
+				log.Printf("[ERROR] Failed to start Tenzir Node container: %v", err)
+				return err
+			}
+
+			time.Sleep(10 * time.Second)
+			log.Printf("[INFO] Waiting for Tenzir to become available ...")
+			err = checkTenzirNode()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	tenzirStatus := struct {
+		ContainerStatus string `json:"container_status"`
+	}{
+		ContainerStatus: "running",
+	}
+
+	cacheData, err := json.Marshal(tenzirStatus)
+	if err != nil {
+		log.Printf("[WARNING] Failed marshalling execution: %s", err)
+	}
+	err = shuffle.SetCache(ctx, cacheKey, cacheData, 1)
+	if err != nil {
+		log.Printf("[WARNING] Failed updating cache for tenzir: %s", err)
+	}
+
+	return nil
+}
+
+func createAndStartTenzirNode(ctx context.Context, containerName, imageName string, containerStartOptions container.StartOptions) error {
+	healthconfig := &container.HealthConfig{
+		Test:     []string{"tenzir --connection-timeout=30s --connection-retry-delay=1s 'api /ping'"},
+		Interval: 30 * time.Second,
+		Retries:  1,
+	}
+
+	// Ensure restart policy is there
+	config := &container.Config{
+		Hostname:    containerName,
+		Labels:      getShuffleLabels("pipeline", ""),
+		Cmd:         []string{"--commands=web server --mode=dev --bind=0.0.0.0"},
+		Image:       imageName,
+		Healthcheck: healthconfig,
+		ExposedPorts: nat.PortSet{
+			"5160/tcp": struct{}{},
+			"514/udp":  struct{}{},
+			"514/tcp":  struct{}{},
+		},
+		Entrypoint: []string{containerName},
+		Env:        []string{},
+	}
+
+	tenzirApikey := os.Getenv("TENZIR_PLUGINS__PLATFORM__API_KEY")
+	tenzirControlEndpoint := os.Getenv("TENZIR_PLUGINS__PLATFORM__CONTROL_ENDPOINT")
+	tenzirPluginsPlatform := os.Getenv("TENZIR_PLUGINS__PLATFORM__TENANT_ID")
+
+	anyFound := false
+	if len(tenzirApikey) > 0 {
+		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__API_KEY=%s", tenzirApikey))
+		anyFound = true
+	}
+
+	if len(tenzirControlEndpoint) > 0 {
+		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__CONTROL_ENDPOINT=%s", tenzirControlEndpoint))
+		anyFound = true
+	}
+
+	if len(tenzirPluginsPlatform) > 0 {
+		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__TENANT_ID=%s", tenzirPluginsPlatform))
+		anyFound = true
+	}
+
+	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
+	if len(tenzirStorageFolder) > 0 {
+		tenzirStorageFolder = tenzirStorageFolder
+
+		if !strings.HasSuffix(tenzirStorageFolder, "/") {
+			tenzirStorageFolder = tenzirStorageFolder + "/"
+		}
+	} else {
+		tenzirStorageFolder = "/tmp/"
+		log.Printf("[DEBUG] Using base folder %s for Tenzir storage. Change it using environment variable SHUFFLE_STORAGE_FOLDER=/filepath/", tenzirStorageFolder)
+	}
+
+	if !anyFound {
+		//log.Printf("[DEBUG] No Tenzir Plugin environment variables found.")
+	} else {
+		//log.Printf("[DEBUG] Attempting Tenzir connection with app.tenzir.com tenant '%s'", tenzirPluginsPlatform)
+	}
+
+	hostConfig := &container.HostConfig{
+		PortBindings: nat.PortMap{
+			"514/tcp":  []nat.PortBinding{{HostPort: "514"}},
+			"514/udp":  []nat.PortBinding{{HostPort: "514"}},
+			"5160/tcp": []nat.PortBinding{{HostPort: "5160"}},
+		},
+		Mounts: []mount.Mount{
+			{
+				Type:   "bind",
+				Source: tenzirStorageFolder,
+				Target: "/var/lib/tenzir/",
+			},
+			{
+				Type:   "bind",
+				Source: tenzirStorageFolder,
+				Target: "/var/log/tenzir/",
+			},
+			{
+				Type:   "bind",
+				Source: tenzirStorageFolder,
+				Target: "/var/cache/tenzir/",
+			},
+		},
+		VolumeDriver: "local",
+		RestartPolicy: container.RestartPolicy{
+			Name: "always",
+		},
+	}
+
+	if skipPipelineMount {
+		hostConfig.Mounts = []mount.Mount{}
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			"tenzir-network": {
+				IPAMConfig: &network.EndpointIPAMConfig{
+					IPv4Address: "192.168.1.100",
+				},
+			},
+		},
+	}
+
+	// FIXME: Is this necessary? Seems to screw up networking:
+	// conflicting options: hostname and the network mode
+	/*
+		if isKubernetes != "true" && os.Getenv("SHUFFLE_SWARM_CONFIG") != "run" {
+			hostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", containerId))
+		}
+	*/
+
+	resp, err := dockercli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
+	if err != nil {
+		if strings.Contains(err.Error(), "path does not exist") {
+			log.Printf("[ERROR] Not using permanent pipeline storage as storage folder %s does not exist. If you want permanent storage, create the %s folder then restart Orborus (1). Raw: %s", tenzirStorageFolder, tenzirStorageFolder, err)
+			skipPipelineMount = true
+		} else {
+			log.Printf("[ERROR] Failed to create Tenzir Node container: %v", err)
+		}
+
+		return err
+	}
+
+	if os.Getenv("SHUFFLE_SWARM_CONFIG") == "run" {
+		networkName := "shuffle_swarm_executions"
+		err = dockercli.NetworkConnect(ctx, networkName, resp.ID, nil)
+		if err != nil {
+			log.Printf("[ERROR] Error connecting tenzir container to network: %s", err)
+		}
+	}
+
+	err = dockercli.ContainerStart(ctx, containerName, containerStartOptions)
+	if err != nil {
+		if strings.Contains(err.Error(), "path does not exist") {
+			log.Printf("[ERROR] Not using permanent pipeline storage as storage folder %s does not exist. If you want permanent storage, create the %s folder then restart Orborus (2). Raw: %s", tenzirStorageFolder, tenzirStorageFolder, err)
+			skipPipelineMount = true
+		} else {
+			log.Printf("[ERROR] Failed to START Tenzir Node container: %v", err)
+		}
+
+		return err
+	}
+
+	log.Printf("[INFO] Tenzir Node container started successfully. Waiting for it to become available..")
+	time.Sleep(20 * time.Second)
+	err = checkTenzirNode()
+	if err != nil {
+		log.Printf("[ERROR] Tenzir connection not available: %s. IF the URL seems wrong, set SHUFFLE_PIPELINE_URL=http://<ip>:5160", err)
+		return err
+	}
+
+	log.Printf("[INFO] Successfully deployed Tenzir Node! Setting up default syslog listener on UDP 514")
+
+	command := "from udp://0.0.0.0:514 read syslog | import"
+	_, err = createPipeline(command, "default-syslog-514")
+	if err != nil {
+		log.Printf("[ERROR] Failed to create default syslog pipeline: %s", err)
+		return nil
+	}
+
+	return nil
+}
+
+func createNetworkIfNotExists(ctx context.Context, networkName, subnet, gateway string) error {
+	listOptions := network.ListOptions{}
+	networks, err := dockercli.NetworkList(ctx, listOptions)
+	if err != nil {
+		return err
+	}
+
+	for _, network := range networks {
+		if network.Name == networkName {
+			// Network exists
+			return nil
+		}
+	}
+
+	ipamConfig := &network.IPAM{
+		Config: []network.IPAMConfig{
+			{
+				Subnet:  subnet,
+				Gateway: gateway,
+			},
+		},
+	}
+
+	networkCreate := network.CreateOptions{
+		//CheckDuplicate: true,
+		Driver: "bridge",
+		IPAM:   ipamConfig,
+	}
+
+	_, err = dockercli.NetworkCreate(ctx, networkName, networkCreate)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func checkTenzirNode() error {
+	if os.Getenv("SHUFFLE_SKIP_PIPELINES") == "true" {
+		return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
+	}
+
+	url := fmt.Sprintf("%s/api/v0/ping", pipelineUrl)
+	forwardMethod := "POST"
+
+	client := http.Client{
+		Timeout: 1 * time.Second,
+	}
+	req, err := http.NewRequest(forwardMethod, url, nil)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	return fmt.Errorf("Tenzir node is not available due to: %s", err)
+}
+
+func createPipeline(command, identifier string) (string, error) {
+
+	//toBeDeleted := false
+	/*
+		// Pre-checked. No point here
+		pipelineId, err := searchPipeline(identifier)
+		if err != nil {
+			return "", err
+		}
+	*/
+
+	url := fmt.Sprintf("%s/api/v0/pipeline/create", pipelineUrl)
+	forwardMethod := "POST"
+
+	/*
+		if err != nil {
+			if strings.Contains(fmt.Sprintf("%s", err), "no existing pipeline found") {
+				log.Printf("[INFO] No existing pipeline found with id: %s. Creating a new one!", identifier)
+			} else {
+				log.Printf("[ERROR] Failed to search for existing pipeline but continuing anyway : %s", err)
+			}
+		} else {
+			log.Printf("[INFO] an existing pipeline found with ID: %s. it will be deleted", pipelineId)
+			toBeDeleted = true
+		}
+	*/
+
+	// if strings.Contains(command, "shuffler.io") {
+
+	// } else {
+	// 	var scheme string
+	// 	if strings.Contains(command, "http://") {
+	// 		scheme = "http://"
+	// 	} else if strings.Contains(command, "https://") {
+	// 		scheme = "https://"
+	// 	}
+
+	// 	startIndex := strings.Index(command, scheme)
+	// 	if startIndex != -1 {
+	// 		endIndex := startIndex + len(scheme)
+	// 		endIndex += strings.Index(command[endIndex:], "/")
+
+	// 		command = command[:startIndex] + baseUrl + command[endIndex:]
+	// 	}
+	// }
+
+	//command = "from file /var/lib/tenzir/sysmon_logs.ndjson read json | sigma /var/lib/tenzir/rule.yaml"
+	//command = "from file /var/lib/tenzir/sysmon_logs.ndjson read json | import"
+
+	requestBody := map[string]interface{}{
+		"definition": command,
+		"name":       identifier,
+		"hidden":     false,
+		"autostart": map[string]bool{
+			"created":   true,
+			"completed": false,
+			"failed":    false,
+		},
+		"autodelete": map[string]bool{
+			"completed": false,
+			"failed":    false,
+			"stopped":   false,
+		},
+		"retry_delay": "500.0ms",
+	}
+
+	requestBodyJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		log.Printf("[ERROR] failed marshalling body: %s", err)
+		return "", err
+	}
+
+	forwardData := bytes.NewBuffer(requestBodyJSON)
+
+	req, err := http.NewRequest(
+		forwardMethod,
+		url,
+		forwardData,
+	)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("[ERROR] Failed reading response body: %s", err)
+		return "", err
+	}
+
+	if strings.Contains(string(body), "error") {
+		log.Printf("[ERROR] Pipeline creation response (%d): %s", resp.StatusCode, string(body))
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("[DEBUG] status code is %d instead of 200", resp.StatusCode)
+		return "", fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
+	}
+
+	type PipelineResponse struct {
+		ID       string `json:"id"`
+		Message  string `json:"message"`
+		Severity string `json:"severity"`
+	}
+
+	var response PipelineResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		log.Printf("[ERROR] Failed unmarshalling response: %s", err)
+		return "", err
+	}
+
+	if response.ID == "" {
+		log.Printf("[ERROR] ID not found or empty in response. Severity: %#v, Message: %#v", response.Severity, response.Message)
+		return "", errors.New("Pipeline ID not found or empty in the response. See error logs.")
+	}
+
+	id := response.ID
+	return id, nil
+}
+
+func updatePipelineState(command, pipelineId, action string) (string, error) {
+
+	url := fmt.Sprintf("%s/api/v0/pipeline/update", pipelineUrl)
+	forwardMethod := "POST"
+
+	requestBody := map[string]interface{}{
+		"id":         pipelineId,
+		"definition": command,
+		"action":     action,
+		"autostart": map[string]bool{
+			"created":   true,
+			"completed": true,
+			"failed":    true,
+		},
+		"autodelete": map[string]bool{
+			"completed": false,
+			"failed":    false,
+			"stopped":   false,
+		},
+	}
+
+	requestBodyJSON, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", err
+	}
+	forwardData := bytes.NewBuffer(requestBodyJSON)
+
+	req, err := http.NewRequest(
+		forwardMethod,
+		url,
+		forwardData,
+	)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	var responseData struct {
+		Pipeline struct {
+			State string `json:"state"`
+		} `json:"pipeline"`
+	}
+	if err := json.Unmarshal(body, &responseData); err != nil {
+		return "", err
+	}
 
-// Tenzir command samples
-// docker pull ghcr.io/dominiklohmann/tenzir-arm64:latest
-// docker tag ghcr.io/dominiklohmann/tenzir-arm64:latest tenzir/tenzir:latest
+	return responseData.Pipeline.State, nil
+}
 
-// Read from Cache and send it to a webhook
-// docker run tenzir/tenzir:latest 'from http://192.168.86.44:5002/api/v1/orgs/7e9b9007-5df2-4b47-bca5-c4d267ef2943/cache/CIDR%20ranges?type=text&authorization=cec9d01f-09b2-4419-8a0a-76c6046e3fef read lines | to http://192.168.86.44:5002/api/v1/hooks/webhook_665ace5f-f27b-496a-a365-6e07eb61078c write lines'
-func handlePipeline(incRequest shuffle.ExecutionRequest) error {
+func deletePipeline(pipelineId string) error {
+	requestBody := map[string]string{
+		"id": pipelineId,
+	}
 
-	log.Printf("[INFO] Pipeline: '%s' with source '%s'", incRequest.Type, incRequest.ExecutionSource)
+	url := fmt.Sprintf("%s/api/v0/pipeline/delete", pipelineUrl)
+	forwardMethod := "POST"
 
-	err := deployTenzirNode()
+	requestBodyJSON, err := json.Marshal(requestBody)
 	if err != nil {
-		log.Printf("[ERROR] Failed to deploy the pipeline, reason: %s", err)
+		log.Println("[ERROR] failed marshalling request body:", err)
 		return err
 	}
 
-	// no need of execution arguments for STOP and DELETE
-	if (incRequest.Type != "PIPELINE_STOP" && incRequest.Type != "PIPELINE_DELETE") && len(incRequest.ExecutionArgument) == 0 {
-		log.Printf("[ERROR] No execution argument found for pipeline create. Skipping")
+	forwardData := bytes.NewBuffer(requestBodyJSON)
 
-		return errors.New("no execution argument found for pipeline create. Skipping")
+	req, err := http.NewRequest(
+		forwardMethod,
+		url,
+		forwardData,
+	)
+	if err != nil {
+		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
+		return err
 	}
+	req.Header.Set("Content-Type", "application/json")
 
-	identifier := strings.ToLower(strings.ReplaceAll(incRequest.ExecutionSource, " ", "-"))
-	if !strings.HasPrefix(strings.ToLower(incRequest.ExecutionSource), "shuffle") {
-		identifier = fmt.Sprintf("shuffle-%s", strings.ToLower(strings.ReplaceAll(incRequest.ExecutionSource, " ", "-")))
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
+		return err
 	}
+	defer resp.Body.Close()
 
-	command := incRequest.ExecutionArgument
-	if incRequest.Type == "PIPELINE_CREATE" {
-		log.Printf("[INFO] Should delete -> recreate new pipeline with id %#v", identifier)
-		//err := deployPipeline(image, identifier, command)
-		_, err := createPipeline(command, identifier)
-		if err != nil {
-			log.Printf("[ERROR] Failed to create pipeline: %s", err)
-			return err
-		}
-	} else if incRequest.Type == "PIPELINE_DELETE" || incRequest.Type == "PIPELINE_STOP" {
-		{
-			log.Printf("[INFO] Should delete pipeline %#v", identifier)
-			pipelineId, err := searchPipeline(identifier)
-			if err != nil {
-				log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
-				return err
-			}
-
-			err = deletePipeline(pipelineId)
-			if err != nil {
-				log.Printf("[ERROR] Failed Deleting Pipeline %s", err)
-				return err
-			}
-		}
-
-		/*
-			} else if incRequest.Type == "PIPELINE_STOP" {
-				log.Printf("[INFO] Should stop the pipeline %#v", identifier)
-				pipelineId, err := searchPipeline(identifier)
-				if err != nil {
-					log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
-					toBeRemoved.Data = append(toBeRemoved.Data, incRequest)
-					return err
-				}
-				_, err = updatePipelineState(command, pipelineId, "stop")
-				if err != nil {
-					log.Printf("[ERROR] Failed to stop Pipeline: %s reason:%s ", pipelineId, err)
-					return err
-				} else {
-					log.Printf("[INFO] Successfully stopped the Pipeline: %s", pipelineId)
-				}
-		*/
-
-	} else if incRequest.Type == "PIPELINE_START" {
-		log.Printf("[INFO] Should start the pipeline %#v", identifier)
-		pipelineId, err := searchPipeline(identifier)
-		if err != nil {
-			if err.Error() == "no existing pipeline found with name" {
-				log.Printf("[INFO] Starting a new pipeline with command '%s' and identifier '%s'", command, identifier)
-				_, CreateErr := createPipeline(command, identifier)
-				return CreateErr
-			}
-
-			log.Printf("[ERROR] Failed searching for Pipeline with name %s reason:%s ", identifier, err)
-			return err
-		}
-		_, err = updatePipelineState(command, pipelineId, "start")
-		if err != nil {
-			log.Printf("[ERROR] Failed to start Pipeline: %s reason:%s ", pipelineId, err)
-			return err
-		} else {
-			log.Printf("[INFO] Successfully started the Pipeline: %s", pipelineId)
-		}
-
-	} else {
-		log.Printf("[ERROR] Unknown type for pipeline: %s", incRequest.Type)
-		return errors.New("unknown type for pipeline")
+	if resp.StatusCode != 200 {
+		log.Printf("[DEBUG] The deletion of pipeline with ID: %s is unsucessful as status code is NOT 200 !!!", pipelineId)
+		return fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
 	}
 
+	log.Printf("[INFO] Pipeline with ID: %s deleted successfully", pipelineId)
+
+	setCachedPipelines([]shuffle.PipelineInfoMini{})
 	return nil
 }
 
-func deployTenzirNode() error {
-	if os.Getenv("SHUFFLE_SKIP_PIPELINES") == "false" || os.Getenv("SHUFFLE_PIPELINE_ENABLED") == "true" {
-		// return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
-		//log.Printf("[INFO] Pipelines are enabled by user")
-	} else {
-		return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
-	}
+// Lists the pipelines from the API exactly as they are. Definition is set up in Shuffle structs
+func listPipelines() ([]shuffle.PipelineInfo, error) {
+	responseData := shuffle.PipelineInfoWrapper{}
 
-	if isKubernetes == "true" {
-		return errors.New("Kubernetes not implemented for Tenzir node")
+	if tenzirDisabled.Load() {
+		return responseData.Pipelines, errors.New("Tenzir is disabled")
 	}
 
-	err := checkTenzirNode()
-	if err == nil {
-		return nil
+	var reqBody []byte
+	url := fmt.Sprintf("%s/api/v0/pipeline/list", pipelineUrl)
+	client := http.Client{
+		Timeout: 2 * time.Second,
 	}
 
-	ctx := context.Background()
-	cacheKey := "tenzir-key"
+	req, err := http.NewRequest(
+		"POST",
+		url,
+		bytes.NewBuffer(reqBody),
+	)
 
-	imageName := "frikky/shuffle:tenzir"
-	containerName := "tenzir-node"
-	containerStartOptions := container.StartOptions{}
-	_, err = shuffle.GetCache(ctx, cacheKey)
-	if err == nil {
-		return nil
+	if err != nil {
+		return responseData.Pipelines, err
 	}
 
-	containerInfo, err := dockercli.ContainerInspect(ctx, containerName)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
 	if err != nil {
-		if dockerclient.IsErrNotFound(err) {
-			// Create network if it doesn't exist
-			networkName := "tenzir-network"
-			networkSubnet := "192.168.1.0/24"
-			networkGateway := "192.168.1.1"
+		return responseData.Pipelines, err
+	}
 
-			err = createNetworkIfNotExists(ctx, networkName, networkSubnet, networkGateway)
-			if err != nil {
-				log.Printf("[ERROR] Failed to create network: %s", err)
-				return err
-			}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseData.Pipelines, fmt.Errorf("Got the status code %d instead of 200 from Pipeline node", resp.StatusCode)
+	}
 
-			// Check if image exists
-			_, _, err := dockercli.ImageInspectWithRaw(ctx, imageName)
-			if dockerclient.IsErrNotFound(err) {
-				log.Printf("[DEBUG] Pulling image %s. This may take a while.", imageName)
-				pullOptions := image.PullOptions{}
-				out, err := dockercli.ImagePull(ctx, imageName, pullOptions)
-				if err != nil {
-					log.Printf("[ERROR] Failed to pull the Tenzir image: %s", err)
-					return err
-				}
-				defer out.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return responseData.Pipelines, err
+	}
 
-				io.Copy(io.Discard, out)
-			} else if err != nil {
-				return err
-			}
+	if err := json.Unmarshal(body, &responseData); err != nil {
+		return responseData.Pipelines, err
+	}
 
-			err = createAndStartTenzirNode(ctx, containerName, imageName, containerStartOptions)
-			if err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
-	} else {
-		if !containerInfo.State.Running {
-			log.Printf("[DEBUG] Tenzir Node exists but is not running. Restarting it.")
-			err := dockercli.ContainerStart(ctx, containerName, containerStartOptions)
-			if err != nil {
-				log.Printf("[ERROR] Failed to start Tenzir Node container: %v", err)
-				return err
-			}
+	return responseData.Pipelines, nil
+}
 
-			time.Sleep(10 * time.Second)
-			log.Printf("[INFO] Waiting for Tenzir to become available ...")
-			err = checkTenzirNode()
-			if err != nil {
-				return err
-			}
-		}
+func searchPipeline(identifier string) (string, error) {
+	allPipelines, err := listPipelines()
+	if err != nil {
+		return "", err
 	}
 
-	tenzirStatus := struct {
-		ContainerStatus string `json:"container_status"`
-	}{
-		ContainerStatus: "running",
+	for _, pipeline := range allPipelines {
+		if pipeline.Name == identifier {
+			return pipeline.ID, nil
+		}
 	}
 
-	cacheData, err := json.Marshal(tenzirStatus)
-	if err != nil {
-		log.Printf("[WARNING] Failed marshalling execution: %s", err)
-	}
-	err = shuffle.SetCache(ctx, cacheKey, cacheData, 1)
+	return "", errors.New("no existing pipeline found with name")
+}
+
+func handleFileCategoryChange() error {
+	apiEndpoint := baseUrl + "/api/v1/files/namespaces/sigma"
+	req, err := http.NewRequest("GET", apiEndpoint, nil)
 	if err != nil {
-		log.Printf("[WARNING] Failed updating cache for tenzir: %s", err)
+		return err
 	}
 
-	return nil
-}
+	if len(pipelineApikey) == 0 {
+		return errors.New("Shuffle API-key not set for Pipelines: SHUFFLE_PIPELINE_AUTH=<apikey>")
+	}
 
-func createAndStartTenzirNode(ctx context.Context, containerName, imageName string, containerStartOptions container.StartOptions) error {
-	healthconfig := &container.HealthConfig{
-		Test:     []string{"tenzir --connection-timeout=30s --connection-retry-delay=1s 'api /ping'"},
-		Interval: 30 * time.Second,
-		Retries:  1,
+	req.Header.Add("Authorization", "Bearer "+pipelineApikey)
+	if len(org) > 0 {
+		req.Header.Add("Org-Id", org)
 	}
 
-	// Ensure restart policy is there
-	config := &container.Config{
-		Hostname:    containerName,
-		Cmd:         []string{"--commands=web server --mode=dev --bind=0.0.0.0"},
-		Image:       imageName,
-		Healthcheck: healthconfig,
-		ExposedPorts: nat.PortSet{
-			"5160/tcp": struct{}{},
-			"514/udp":  struct{}{},
-			"514/tcp":  struct{}{},
-		},
-		Entrypoint: []string{containerName},
-		Env:        []string{},
+	client := shuffle.GetExternalClient(apiEndpoint)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
 	}
 
-	tenzirApikey := os.Getenv("TENZIR_PLUGINS__PLATFORM__API_KEY")
-	tenzirControlEndpoint := os.Getenv("TENZIR_PLUGINS__PLATFORM__CONTROL_ENDPOINT")
-	tenzirPluginsPlatform := os.Getenv("TENZIR_PLUGINS__PLATFORM__TENANT_ID")
-
-	anyFound := false
-	if len(tenzirApikey) > 0 {
-		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__API_KEY=%s", tenzirApikey))
-		anyFound = true
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Received non-200 response '%d' from backend URL %s. ", resp.StatusCode, apiEndpoint)
 	}
 
-	if len(tenzirControlEndpoint) > 0 {
-		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__CONTROL_ENDPOINT=%s", tenzirControlEndpoint))
-		anyFound = true
+	out, err := os.Create("files.zip")
+	if err != nil {
+		return err
 	}
 
-	if len(tenzirPluginsPlatform) > 0 {
-		config.Env = append(config.Env, fmt.Sprintf("TENZIR_PLUGINS__PLATFORM__TENANT_ID=%s", tenzirPluginsPlatform))
-		anyFound = true
+	defer out.Close()
+	defer os.Remove("files.zip")
+	_, err = io.Copy(out, resp.Body)
+	if err != nil {
+		log.Printf("[ERROR] Failed to io.Copy ZIP file content: %s", err)
+		return err
 	}
 
-	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
-	if len(tenzirStorageFolder) > 0 {
-		tenzirStorageFolder = tenzirStorageFolder
+	//log.Println("[DEBUG] ZIP file downloaded successfully.")
 
-		if !strings.HasSuffix(tenzirStorageFolder, "/") {
-			tenzirStorageFolder = tenzirStorageFolder + "/"
-		}
-	} else {
+	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
+	if len(tenzirStorageFolder) == 0 {
 		tenzirStorageFolder = "/tmp/"
-		log.Printf("[DEBUG] Using base folder %s for Tenzir storage. Change it using environment variable SHUFFLE_STORAGE_FOLDER=/filepath/", tenzirStorageFolder)
 	}
 
-	if !anyFound {
-		//log.Printf("[DEBUG] No Tenzir Plugin environment variables found.")
-	} else {
-		//log.Printf("[DEBUG] Attempting Tenzir connection with app.tenzir.com tenant '%s'", tenzirPluginsPlatform)
+	tenzirStorageFolder = strings.TrimRight(tenzirStorageFolder, "/")
+	sigmaPath := fmt.Sprintf("%s/sigma_rules", tenzirStorageFolder)
+	err = extractZIP("files.zip", sigmaPath)
+	if err != nil {
+		log.Printf("[ERROR] Failed to extract ZIP file: %s", err)
+		return err
 	}
 
-	hostConfig := &container.HostConfig{
-		PortBindings: nat.PortMap{
-			"514/tcp":  []nat.PortBinding{{HostPort: "514"}},
-			"514/udp":  []nat.PortBinding{{HostPort: "514"}},
-			"5160/tcp": []nat.PortBinding{{HostPort: "5160"}},
-		},
-		Mounts: []mount.Mount{
-			{
-				Type:   "bind",
-				Source: tenzirStorageFolder,
-				Target: "/var/lib/tenzir/",
-			},
-			{
-				Type:   "bind",
-				Source: tenzirStorageFolder,
-				Target: "/var/log/tenzir/",
-			},
-			{
-				Type:   "bind",
-				Source: tenzirStorageFolder,
-				Target: "/var/cache/tenzir/",
-			},
-		},
-		VolumeDriver: "local",
-		RestartPolicy: container.RestartPolicy{
-			Name: "always",
-		},
-	}
+	log.Printf("[DEBUG] Detection files copied to '%s' successfully.", sigmaPath)
 
-	if skipPipelineMount {
-		hostConfig.Mounts = []mount.Mount{}
-	}
+	return nil
+}
 
-	networkingConfig := &network.NetworkingConfig{
-		EndpointsConfig: map[string]*network.EndpointSettings{
-			"tenzir-network": {
-				IPAMConfig: &network.EndpointIPAMConfig{
-					IPv4Address: "192.168.1.100",
-				},
-			},
-		},
+func extractZIP(zipFile, destDir string) error {
+	r, err := zip.OpenReader(zipFile)
+	if err != nil {
+		return err
 	}
 
-	// FIXME: Is this necessary? Seems to screw up networking:
-	// conflicting options: hostname and the network mode
-	/*
-		if isKubernetes != "true" && os.Getenv("SHUFFLE_SWARM_CONFIG") != "run" {
-			hostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", containerId))
-		}
-	*/
+	// FInd size of the zip
+	var totalSize uint64
+	for _, f := range r.File {
+		totalSize += f.UncompressedSize64
+	}
 
-	resp, err := dockercli.ContainerCreate(ctx, config, hostConfig, networkingConfig, nil, containerName)
-	if err != nil {
-		if strings.Contains(err.Error(), "path does not exist") {
-			log.Printf("[ERROR] Not using permanent pipeline storage as storage folder %s does not exist. If you want permanent storage, create the %s folder then restart Orborus (1). Raw: %s", tenzirStorageFolder, tenzirStorageFolder, err)
-			skipPipelineMount = true
-		} else {
-			log.Printf("[ERROR] Failed to create Tenzir Node container: %v", err)
-		}
+	log.Printf("[DEBUG] Total size of the ZIP file: %d bytes", totalSize)
 
+	defer r.Close()
+	if err := os.MkdirAll(destDir, 0755); err != nil {
 		return err
 	}
 
-	if os.Getenv("SHUFFLE_SWARM_CONFIG") == "run" {
-		networkName := "shuffle_swarm_executions"
-		err = dockercli.NetworkConnect(ctx, networkName, resp.ID, nil)
+	for _, f := range r.File {
+		// Fix path traversal
+		if strings.Contains(f.Name, "..") {
+			return fmt.Errorf("illegal file name: %s", f.Name)
+		}
+
+		err := extractFile(f, destDir)
 		if err != nil {
-			log.Printf("[ERROR] Error connecting tenzir container to network: %s", err)
+			return err
 		}
 	}
 
-	err = dockercli.ContainerStart(ctx, containerName, containerStartOptions)
-	if err != nil {
-		if strings.Contains(err.Error(), "path does not exist") {
-			log.Printf("[ERROR] Not using permanent pipeline storage as storage folder %s does not exist. If you want permanent storage, create the %s folder then restart Orborus (2). Raw: %s", tenzirStorageFolder, tenzirStorageFolder, err)
-			skipPipelineMount = true
-		} else {
-			log.Printf("[ERROR] Failed to START Tenzir Node container: %v", err)
-		}
+	return nil
+}
 
+func extractFile(f *zip.File, destDir string) error {
+	rc, err := f.Open()
+	if err != nil {
 		return err
 	}
+	defer rc.Close()
 
-	log.Printf("[INFO] Tenzir Node container started successfully. Waiting for it to become available..")
-	time.Sleep(20 * time.Second)
-	err = checkTenzirNode()
+	path := filepath.Join(destDir, f.Name)
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 	if err != nil {
-		log.Printf("[ERROR] Tenzir connection not available: %s. IF the URL seems wrong, set SHUFFLE_PIPELINE_URL=http://<ip>:5160", err)
 		return err
 	}
+	defer out.Close()
 
-	log.Printf("[INFO] Successfully deployed Tenzir Node! Setting up default syslog listener on UDP 514")
+	_, err = io.Copy(out, rc)
+	return err
+}
 
-	command := "from udp://0.0.0.0:514 read syslog | import"
-	_, err = createPipeline(command, "default-syslog-514")
+func copyToTenzir(srcPath, destPath string) error {
+	containerName := "tenzir-node"
+
+	checkCmd := exec.Command("docker", "exec", containerName, "test", "-d", destPath)
+	if err := checkCmd.Run(); err == nil {
+		rmCmd := exec.Command("docker", "exec", "-u", "root", containerName, "rm", "-rf", destPath)
+		if err := rmCmd.Run(); err != nil {
+			return fmt.Errorf("error removing existing directory in container: %v", err)
+		}
+	}
+
+	cpCmd := exec.Command("docker", "cp", srcPath, fmt.Sprintf("%s:%s", containerName, destPath))
+	var out bytes.Buffer
+	cpCmd.Stdout = &out
+	cpCmd.Stderr = &out
+
+	err := cpCmd.Run()
 	if err != nil {
-		log.Printf("[ERROR] Failed to create default syslog pipeline: %s", err)
-		return nil
+		return fmt.Errorf("error copying files: %v, output: %s", err, out.String())
 	}
 
 	return nil
 }
 
-func createNetworkIfNotExists(ctx context.Context, networkName, subnet, gateway string) error {
-	listOptions := network.ListOptions{}
-	networks, err := dockercli.NetworkList(ctx, listOptions)
+func removeFileCategory() error {
+	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
+	if len(tenzirStorageFolder) == 0 {
+		tenzirStorageFolder = "/tmp/"
+	}
+
+	tenzirStorageFolder = strings.TrimRight(tenzirStorageFolder, "/")
+
+	//sigmaPath := "/var/lib/tenzir/sigma_rules/*"
+	sigmaPath := fmt.Sprintf("%s/sigma_rules", tenzirStorageFolder)
+
+	err := os.RemoveAll(sigmaPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("Error removing category files in %s: %v", sigmaPath, err)
 	}
 
-	for _, network := range networks {
-		if network.Name == networkName {
-			// Network exists
+	log.Printf("[INFO] Removed all local category data in %s", sigmaPath)
+
+	return nil
+}
+
+func removeFile(fileName string) error {
+	containerName := "tenzir-node"
+	srcPath := fmt.Sprintf("/var/lib/tenzir/sigma_rules/%s", fileName)
+
+	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
+	if err := checkSrcCmd.Run(); err != nil {
+		// If the file does not exist, simply return nil
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			log.Printf("[ERROR] No such file: %s, nothing to delete\n", srcPath)
 			return nil
 		}
+		return fmt.Errorf("error checking source file: %v", err)
 	}
 
-	ipamConfig := &network.IPAM{
-		Config: []network.IPAMConfig{
-			{
-				Subnet:  subnet,
-				Gateway: gateway,
-			},
-		},
-	}
-
-	networkCreate := network.CreateOptions{
-		//CheckDuplicate: true,
-		Driver: "bridge",
-		IPAM:   ipamConfig,
-	}
+	return removePath(containerName, srcPath)
+}
 
-	_, err = dockercli.NetworkCreate(ctx, networkName, networkCreate)
+func removePath(containerName, path string) error {
+	rmCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("rm -rf %s", path))
+	output, err := rmCmd.CombinedOutput()
 	if err != nil {
-		return err
+		return fmt.Errorf("error removing path: %v, output: %s", err, output)
 	}
+	return nil
+}
+
+// Tenzir supervisor. Instead of permanently disabling pipelines when the
+// node fails, deployment is retried with exponential backoff. Pipelines
+// are re-created from the backend after the node comes back.
+type tenzirSupervisorState struct {
+	sync.Mutex
+
+	// unknown, running, failing or disabled
+	State       string
+	Failures    int
+	LastError   error
+	NextAttempt time.Time
+
+	wakeup chan bool
+}
 
-	return nil
+var tenzirSupervisor = &tenzirSupervisorState{
+	State:  "unknown",
+	wakeup: make(chan bool, 1),
 }
 
-func checkTenzirNode() error {
-	if os.Getenv("SHUFFLE_SKIP_PIPELINES") == "true" {
-		return errors.New("Pipelines are disabled by user with SHUFFLE_SKIP_PIPELINES")
-	}
+var tenzirMinBackoff = 15 * time.Second
+var tenzirMaxBackoff = 10 * time.Minute
+var tenzirCheckInterval = 30 * time.Second
 
-	url := fmt.Sprintf("%s/api/v0/ping", pipelineUrl)
-	forwardMethod := "POST"
+// Forces a new deployment attempt, skipping the current backoff
+func (s *tenzirSupervisorState) wake() {
+	s.Lock()
+	s.NextAttempt = time.Time{}
+	s.Unlock()
 
-	client := http.Client{
-		Timeout: 1 * time.Second,
-	}
-	req, err := http.NewRequest(forwardMethod, url, nil)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
-		return err
+	select {
+	case s.wakeup <- true:
+	default:
 	}
+}
 
-	resp, err := client.Do(req)
-	if err == nil && resp.StatusCode == http.StatusOK {
-		return nil
+func (s *tenzirSupervisorState) status() (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.State, s.LastError
+}
+
+func getTenzirBackoff(failures int) time.Duration {
+	backoff := tenzirMinBackoff
+	for i := 1; i < failures; i++ {
+		backoff = backoff * 2
+		if backoff >= tenzirMaxBackoff {
+			return tenzirMaxBackoff
+		}
 	}
 
-	return fmt.Errorf("Tenzir node is not available due to: %s", err)
+	return backoff
 }
 
-func createPipeline(command, identifier string) (string, error) {
+// Errors caused by configuration rather than the node itself.
+// These disable pipelines without counting as failures.
+func isTenzirConfigError(err error) bool {
+	return strings.Contains(err.Error(), "SHUFFLE_SKIP_PIPELINES") || strings.Contains(err.Error(), "Kubernetes not implemented for Tenzir node")
+}
 
-	//toBeDeleted := false
-	/*
-		// Pre-checked. No point here
-		pipelineId, err := searchPipeline(identifier)
-		if err != nil {
-			return "", err
+func runTenzirSupervisor(ctx context.Context) {
+	if len(os.Getenv("SHUFFLE_TENZIR_MAX_BACKOFF")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_TENZIR_MAX_BACKOFF"))
+		if err == nil && tmpInt > 0 {
+			tenzirMaxBackoff = time.Duration(tmpInt) * time.Second
+		} else {
+			log.Printf("[WARNING] Env SHUFFLE_TENZIR_MAX_BACKOFF must be a number of seconds, not '%s'. Using default.", os.Getenv("SHUFFLE_TENZIR_MAX_BACKOFF"))
 		}
-	*/
+	}
 
-	url := fmt.Sprintf("%s/api/v0/pipeline/create", pipelineUrl)
-	forwardMethod := "POST"
+	for {
+		superviseTenzirNode(ctx)
 
-	/*
-		if err != nil {
-			if strings.Contains(fmt.Sprintf("%s", err), "no existing pipeline found") {
-				log.Printf("[INFO] No existing pipeline found with id: %s. Creating a new one!", identifier)
-			} else {
-				log.Printf("[ERROR] Failed to search for existing pipeline but continuing anyway : %s", err)
-			}
-		} else {
-			log.Printf("[INFO] an existing pipeline found with ID: %s. it will be deleted", pipelineId)
-			toBeDeleted = true
+		select {
+		case <-tenzirSupervisor.wakeup:
+		case <-time.After(tenzirCheckInterval):
 		}
-	*/
+	}
+}
 
-	// if strings.Contains(command, "shuffler.io") {
+func superviseTenzirNode(ctx context.Context) {
+	tenzirSupervisor.Lock()
+	if time.Now().Before(tenzirSupervisor.NextAttempt) {
+		tenzirSupervisor.Unlock()
+		return
+	}
 
-	// } else {
-	// 	var scheme string
-	// 	if strings.Contains(command, "http://") {
-	// 		scheme = "http://"
-	// 	} else if strings.Contains(command, "https://") {
-	// 		scheme = "https://"
-	// 	}
+	previousState := tenzirSupervisor.State
+	tenzirSupervisor.Unlock()
 
-	// 	startIndex := strings.Index(command, scheme)
-	// 	if startIndex != -1 {
-	// 		endIndex := startIndex + len(scheme)
-	// 		endIndex += strings.Index(command[endIndex:], "/")
+	err := deployTenzirNode()
 
-	// 		command = command[:startIndex] + baseUrl + command[endIndex:]
-	// 	}
-	// }
+	tenzirSupervisor.Lock()
+	newState := "running"
+	if err == nil {
+		tenzirSupervisor.Failures = 0
+		tenzirSupervisor.LastError = nil
+		tenzirSupervisor.NextAttempt = time.Time{}
+	} else if isTenzirConfigError(err) {
+		newState = "disabled"
+		tenzirSupervisor.Failures = 0
+		tenzirSupervisor.LastError = err
+		tenzirSupervisor.NextAttempt = time.Time{}
+	} else {
+		newState = "failing"
+		tenzirSupervisor.Failures += 1
+		tenzirSupervisor.LastError = err
+		tenzirSupervisor.NextAttempt = time.Now().Add(getTenzirBackoff(tenzirSupervisor.Failures))
+	}
 
-	//command = "from file /var/lib/tenzir/sysmon_logs.ndjson read json | sigma /var/lib/tenzir/rule.yaml"
-	//command = "from file /var/lib/tenzir/sysmon_logs.ndjson read json | import"
+	failures := tenzirSupervisor.Failures
+	nextAttempt := tenzirSupervisor.NextAttempt
+	tenzirSupervisor.State = newState
+	tenzirSupervisor.Unlock()
 
-	requestBody := map[string]interface{}{
-		"definition": command,
-		"name":       identifier,
-		"hidden":     false,
-		"autostart": map[string]bool{
-			"created":   true,
-			"completed": false,
-			"failed":    false,
-		},
-		"autodelete": map[string]bool{
-			"completed": false,
-			"failed":    false,
-			"stopped":   false,
-		},
-		"retry_delay": "500.0ms",
+	tenzirDisabled.Store(newState != "running")
+	if newState == "failing" {
+		log.Printf("[WARNING] Tenzir node deployment failed (attempt %d): %s. Retrying in %s", failures, err, time.Until(nextAttempt).Round(time.Second))
 	}
 
-	requestBodyJSON, err := json.Marshal(requestBody)
-	if err != nil {
-		log.Printf("[ERROR] failed marshalling body: %s", err)
-		return "", err
+	// Only notify on state transitions, not on every failure
+	if newState == previousState {
+		return
 	}
 
-	forwardData := bytes.NewBuffer(requestBodyJSON)
+	log.Printf("[INFO] Tenzir node state changed from '%s' to '%s'", previousState, newState)
+	if newState == "failing" {
+		notifyErr := shuffle.CreateOrgNotification(
+			ctx,
+			fmt.Sprintf("Tenzir node is unavailable in environment %s", environment),
+			fmt.Sprintf("Tenzir failed to start due to: %s. Orborus will keep retrying automatically.", err),
+			"/detections/Sigma",
+			org,
+			true,
+		)
+
+		if notifyErr != nil {
+			log.Printf("[ERROR] Failed to send Tenzir failure notification: %s", notifyErr)
+		}
+	} else if newState == "running" && previousState == "failing" {
+		recreatePipelines()
+
+		notifyErr := shuffle.CreateOrgNotification(
+			ctx,
+			fmt.Sprintf("Tenzir node recovered in environment %s", environment),
+			fmt.Sprintf("Tenzir is available again after %d failed attempt(s). Pipelines have been re-created.", failures),
+			"/detections/Sigma",
+			org,
+			true,
+		)
+
+		if notifyErr != nil {
+			log.Printf("[ERROR] Failed to send Tenzir recovery notification: %s", notifyErr)
+		}
+	}
+}
 
+// Gets the pipelines stored in the backend for this environment
+func getStoredPipelines() ([]shuffle.Pipeline, error) {
+	storedPipelineUrl := fmt.Sprintf("%s/api/v1/workflows/queue/pipelines", baseUrl)
 	req, err := http.NewRequest(
-		forwardMethod,
-		url,
-		forwardData,
+		"GET",
+		storedPipelineUrl,
+		nil,
 	)
+
 	if err != nil {
-		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
-		return "", err
+		return []shuffle.Pipeline{}, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	addOrborusHeaders(req)
+
+	client := shuffle.GetExternalClient(baseUrl)
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
-		return "", err
+		return []shuffle.Pipeline{}, err
 	}
 
+	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("[ERROR] Failed reading response body: %s", err)
-		return "", err
-	}
-
-	if strings.Contains(string(body), "error") {
-		log.Printf("[ERROR] Pipeline creation response (%d): %s", resp.StatusCode, string(body))
+		return []shuffle.Pipeline{}, err
 	}
 
-	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		log.Printf("[DEBUG] status code is %d instead of 200", resp.StatusCode)
-		return "", fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
+		return []shuffle.Pipeline{}, fmt.Errorf("got status code %d from backend: %s", resp.StatusCode, string(body))
 	}
 
-	type PipelineResponse struct {
-		ID       string `json:"id"`
-		Message  string `json:"message"`
-		Severity string `json:"severity"`
+	pipelineWrapper := struct {
+		Success   bool               `json:"success"`
+		Pipelines []shuffle.Pipeline `json:"pipelines"`
+	}{}
+
+	err = json.Unmarshal(body, &pipelineWrapper)
+	if err != nil {
+		return []shuffle.Pipeline{}, err
 	}
 
-	var response PipelineResponse
-	if err := json.Unmarshal(body, &response); err != nil {
-		log.Printf("[ERROR] Failed unmarshalling response: %s", err)
-		return "", err
+	return pipelineWrapper.Pipelines, nil
+}
+
+// Re-creates the backend's pipelines on a node that came back
+func recreatePipelines() {
+	storedPipelines, err := getStoredPipelines()
+	if err != nil {
+		log.Printf("[ERROR] Failed getting stored pipelines from backend: %s", err)
+		return
 	}
 
-	if response.ID == "" {
-		log.Printf("[ERROR] ID not found or empty in response. Severity: %#v, Message: %#v", response.Severity, response.Message)
-		return "", errors.New("Pipeline ID not found or empty in the response. See error logs.")
+	log.Printf("[INFO] Re-creating %d pipeline(s) after Tenzir recovery", len(storedPipelines))
+	for _, pipeline := range storedPipelines {
+		err = handlePipeline(shuffle.ExecutionRequest{
+			Type:              "PIPELINE_START",
+			ExecutionSource:   pipeline.Name,
+			ExecutionArgument: pipeline.Command,
+		})
+
+		if err != nil {
+			log.Printf("[ERROR] Failed re-creating pipeline '%s': %s", pipeline.Name, err)
+		}
 	}
 
-	id := response.ID
-	return id, nil
+	setCachedPipelines([]shuffle.PipelineInfoMini{})
 }
 
-func updatePipelineState(command, pipelineId, action string) (string, error) {
+func getCachedPipelines() []shuffle.PipelineInfoMini {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
 
-	url := fmt.Sprintf("%s/api/v0/pipeline/update", pipelineUrl)
-	forwardMethod := "POST"
+	return append([]shuffle.PipelineInfoMini{}, pipelines...)
+}
 
-	requestBody := map[string]interface{}{
-		"id":         pipelineId,
-		"definition": command,
-		"action":     action,
-		"autostart": map[string]bool{
-			"created":   true,
-			"completed": true,
-			"failed":    true,
-		},
-		"autodelete": map[string]bool{
-			"completed": false,
-			"failed":    false,
-			"stopped":   false,
-		},
+func setCachedPipelines(newPipelines []shuffle.PipelineInfoMini) {
+	pipelinesLock.Lock()
+	defer pipelinesLock.Unlock()
+
+	pipelines = newPipelines
+}
+
+func sendPipelineHealthStatus() (shuffle.LakeConfig, error) {
+	pipelinePayload := shuffle.LakeConfig{
+		Enabled:   false,
+		Pipelines: []shuffle.PipelineInfoMini{},
 	}
 
-	requestBodyJSON, err := json.Marshal(requestBody)
-	if err != nil {
-		return "", err
+	// Deployment and retries are handled by the supervisor
+	state, err := tenzirSupervisor.status()
+	if state != "running" {
+		return pipelinePayload, err
 	}
-	forwardData := bytes.NewBuffer(requestBodyJSON)
 
-	req, err := http.NewRequest(
-		forwardMethod,
-		url,
-		forwardData,
-	)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
-		return "", err
+	// To not spam down the list API too much
+	randint := rand.Intn(5)
+	cachedPipelines := getCachedPipelines()
+	if len(cachedPipelines) == 0 || randint == 0 {
+		pipelineDef, err := listPipelines()
+
+		if err == nil {
+			for _, pipeline := range pipelineDef {
+				pipelinePayload.Pipelines = append(pipelinePayload.Pipelines, shuffle.PipelineInfoMini{
+					ID:         pipeline.ID,
+					Name:       pipeline.Name,
+					Definition: pipeline.Definition,
+					TotalRuns:  pipeline.TotalRuns,
+					CreatedAt:  pipeline.CreatedAt,
+				})
+			}
+
+			setCachedPipelines(pipelinePayload.Pipelines)
+		}
+	} else {
+		pipelinePayload.Pipelines = cachedPipelines
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
-		return "", err
+	pipelinePayload.Enabled = true
+
+	// No direct sending.
+	return pipelinePayload, nil
+}
+
+func disableRule(fileName string) error {
+	containerName := "tenzir-node"
+	srcPath := fmt.Sprintf("/var/lib/tenzir/sigma_rules/%s", fileName)
+	destDir := "/var/lib/tenzir/disabled_rules"
+	destPath := fmt.Sprintf("%s/%s", destDir, fileName)
+
+	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
+	if err := checkSrcCmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			fmt.Printf("File does not exist: %s\n", srcPath)
+			return nil // Nothing to disable
+		}
+		return fmt.Errorf("error checking source file: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
+	checkDestDirCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mkdir -p %s", destDir))
+	if err := checkDestDirCmd.Run(); err != nil {
+		return fmt.Errorf("error ensuring destination directory exists: %v", err)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
+	moveCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mv %s %s", srcPath, destPath))
+	if err := moveCmd.Run(); err != nil {
+		return fmt.Errorf("error moving file: %v", err)
+	}
+
+	fmt.Printf("File %s moved to %s successfully.\n", fileName, destDir)
+	return nil
+}
+
+func enableRule(fileName string) error {
+	containerName := "tenzir-node"
+	srcPath := fmt.Sprintf("/var/lib/tenzir/disabled_rules/%s", fileName)
+	destDir := "/var/lib/tenzir/sigma_rules"
+	destPath := fmt.Sprintf("%s/%s", destDir, fileName)
+
+	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
+	if err := checkSrcCmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			fmt.Printf("File does not exist: %s\n", srcPath)
+			return nil // Nothing to enable
+		}
+		return fmt.Errorf("error checking source file: %v", err)
 	}
 
-	var responseData struct {
-		Pipeline struct {
-			State string `json:"state"`
-		} `json:"pipeline"`
+	checkDestDirCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mkdir -p %s", destDir))
+	if err := checkDestDirCmd.Run(); err != nil {
+		return fmt.Errorf("error ensuring destination directory exists: %v", err)
 	}
-	if err := json.Unmarshal(body, &responseData); err != nil {
-		return "", err
+	moveCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mv %s %s", srcPath, destPath))
+	if err := moveCmd.Run(); err != nil {
+		return fmt.Errorf("error moving file: %v", err)
 	}
 
-	return responseData.Pipeline.State, nil
+	fmt.Printf("[DEBUG] File %s moved to %s successfully.\n", fileName, destDir)
+	return nil
 }
 
-func deletePipeline(pipelineId string) error {
-	requestBody := map[string]string{
-		"id": pipelineId,
-	}
+// Is this ok to do with Docker? idk :)
+func getRunningWorkers(ctx context.Context, workerTimeout int) int {
+	//log.Printf("[DEBUG] Getting running workers with API version %s", dockerApiVersion)
+	counter := 0
+	if isKubernetes == "true" {
+		log.Printf("[INFO] Getting running workers in kubernetes")
 
-	url := fmt.Sprintf("%s/api/v0/pipeline/delete", pipelineUrl)
-	forwardMethod := "POST"
+		thresholdTime := time.Now().Add(time.Duration(-workerTimeout) * time.Second)
 
-	requestBodyJSON, err := json.Marshal(requestBody)
-	if err != nil {
-		log.Println("[ERROR] failed marshalling request body:", err)
-		return err
-	}
+		clientset, _, err := shuffle.GetKubernetesClient()
+		if err != nil {
+			log.Printf("[ERROR] Failed getting kubernetes client: %s", err)
+			return 0
+		}
 
-	forwardData := bytes.NewBuffer(requestBodyJSON)
+		for _, selector := range []string{getShuffleLabelSelector("worker"), getLegacyLabelSelector("worker")} {
+			pods, podErr := clientset.CoreV1().Pods(kubernetesNamespace).List(ctx, metav1.ListOptions{
+				LabelSelector: selector,
+			})
+			if podErr != nil {
+				log.Printf("[ERROR] Failed getting running workers: %s", podErr)
+				return 0
+			}
 
-	req, err := http.NewRequest(
-		forwardMethod,
-		url,
-		forwardData,
-	)
-	if err != nil {
-		log.Printf("[ERROR] Failed to create HTTP request: %s", err)
-		return err
-	}
-	req.Header.Set("Content-Type", "application/json")
+			for _, pod := range pods.Items {
+				if pod.Status.Phase == "Running" && pod.CreationTimestamp.Time.After(thresholdTime) {
+					counter++
+				}
+			}
+		}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("[ERROR] Failed to send HTTP request: %s", err)
-		return err
-	}
-	defer resp.Body.Close()
+		if counter > 0 {
+			log.Printf("[INFO] Found %d running workers in Orborus", counter)
+		}
+	} else {
 
-	if resp.StatusCode != 200 {
-		log.Printf("[DEBUG] The deletion of pipeline with ID: %s is unsucessful as status code is NOT 200 !!!", pipelineId)
-		return fmt.Errorf("got the status code %d instead of 200", resp.StatusCode)
-	}
+		containers, err := dockercli.ContainerList(ctx, container.ListOptions{
+			All: true,
+		})
 
-	log.Printf("[INFO] Pipeline with ID: %s deleted successfully", pipelineId)
+		// Automatically updates the version
+		if err != nil {
+			log.Printf("[ERROR] Error getting containers from Docker: %s", err)
 
-	pipelines = []shuffle.PipelineInfoMini{}
-	return nil
-}
+			newVersionSplit := strings.Split(fmt.Sprintf("%s", err), "version is")
+			if len(newVersionSplit) > 1 {
+				//dockerApiVersion = strings.TrimSpace(newVersionSplit[1])
+				log.Printf("[DEBUG] WANT to change the API version to default to %s?", strings.TrimSpace(newVersionSplit[1]))
+			}
 
-// Lists the pipelines from the API exactly as they are. Definition is set up in Shuffle structs
-func listPipelines() ([]shuffle.PipelineInfo, error) {
-	responseData := shuffle.PipelineInfoWrapper{}
+			return maxConcurrency
+		}
 
-	if tenzirDisabled {
-		return responseData.Pipelines, errors.New("Tenzir is disabled")
-	}
+		currenttime := time.Now().Unix()
+		for _, container := range containers {
+			if getContainerComponent(container) != "worker" {
+				continue
+			}
 
-	var reqBody []byte
-	url := fmt.Sprintf("%s/api/v0/pipeline/list", pipelineUrl)
-	client := http.Client{
-		Timeout: 2 * time.Second,
+			//log.Printf("Time: %d - %d", currenttime-container.Created, int64(workerTimeout))
+			if container.State == "running" && currenttime-container.Created < int64(workerTimeout) {
+				counter += 1
+			}
+		}
 	}
+	return counter
+}
 
-	req, err := http.NewRequest(
-		"POST",
-		url,
-		bytes.NewBuffer(reqBody),
-	)
+// FIXME - add this to remove exited workers
+// Should it check what happened to the execution? idk
+func zombiecheck(ctx context.Context, workerTimeout int) error {
+	isK8s := isKubernetes == "true"
 
-	if err != nil {
-		return responseData.Pipelines, err
-	}
+	executionIds = []string{}
+	zombieStats.start()
+	defer zombieStats.report()
 
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
-	if err != nil {
-		return responseData.Pipelines, err
+	if isK8s {
+		return zombiecheckKubernetes(ctx, workerTimeout)
 	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return responseData.Pipelines, fmt.Errorf("Got the status code %d instead of 200 from Pipeline node", resp.StatusCode)
+	if swarmConfig == "run" || swarmConfig == "swarm" {
+		return zombiecheckSwarm(ctx, workerTimeout)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	log.Println("[INFO] Looking for old containers to remove")
+	containers, err := dockercli.ContainerList(ctx, container.ListOptions{
+		All: true,
+	})
+
 	if err != nil {
-		return responseData.Pipelines, err
+		log.Printf("[ERROR] Failed creating Containerlist: %s", err)
+		return err
 	}
 
-	if err := json.Unmarshal(body, &responseData); err != nil {
-		return responseData.Pipelines, err
+	containerNames := map[string]string{}
+	stopContainers := []string{}
+	removeContainers := []string{}
+	stoppedExecutions := []string{}
+	log.Printf("[INFO] Environment: %s, Workertimeout: %d", environment, int64(workerTimeout))
+	runningExecutions := []string{}
+	for _, container := range containers {
+		if container.State == "running" {
+			runningExecutions = append(runningExecutions, container.Labels[shuffleExecutionLabel])
+		}
 	}
 
-	return responseData.Pipelines, nil
-}
+	// Long-running executions keep their containers until the backend says they're done
+	statuses := getExecutionStatuses(runningExecutions, workerTimeout)
+	currenttime := time.Now().Unix()
+	for _, container := range containers {
+		// Supporting containers like the docker proxy and pipelines are long-running
+		component := getContainerComponent(container)
+		if component != "worker" && component != "app" {
+			continue
+		}
 
-func searchPipeline(identifier string) (string, error) {
-	allPipelines, err := listPipelines()
-	if err != nil {
-		return "", err
-	}
+		name := container.ID
+		if len(container.Names) > 0 {
+			name = container.Names[0]
+		}
 
-	for _, pipeline := range allPipelines {
-		if pipeline.Name == identifier {
-			return pipeline.ID, nil
+		// Need to check time here too because a container can be removed the same instant as its created
+		if container.State != "running" && currenttime-container.Created > int64(workerTimeout) {
+			removeContainers = append(removeContainers, container.ID)
+			containerNames[container.ID] = name
 		}
-	}
 
-	return "", errors.New("no existing pipeline found with name")
-}
+		// stopcontainer & removecontainer
+		//log.Printf("Time: %d - %d", currenttime-container.Created, int64(workerTimeout))
+		if container.State == "running" && currenttime-container.Created > int64(workerTimeout) {
+			if len(container.Labels[shuffleExecutionLabel]) > 0 && !isExecutionDone(statuses, container.Labels[shuffleExecutionLabel]) {
+				continue
+			}
 
-func handleFileCategoryChange() error {
-	apiEndpoint := baseUrl + "/api/v1/files/namespaces/sigma"
-	req, err := http.NewRequest("GET", apiEndpoint, nil)
-	if err != nil {
-		return err
-	}
+			stopContainers = append(stopContainers, container.ID)
+			containerNames[container.ID] = name
 
-	if len(pipelineApikey) == 0 {
-		return errors.New("Shuffle API-key not set for Pipelines: SHUFFLE_PIPELINE_AUTH=<apikey>")
+			if component == "worker" && len(container.Labels[shuffleExecutionLabel]) > 0 {
+				stoppedExecutions = append(stoppedExecutions, container.Labels[shuffleExecutionLabel])
+			}
+		}
 	}
 
-	req.Header.Add("Authorization", "Bearer "+pipelineApikey)
-	if len(org) > 0 {
-		req.Header.Add("Org-Id", org)
-	}
+	// Apps of a stopped worker have nowhere to send results
+	for _, container := range containers {
+		if getContainerComponent(container) != "app" || container.State != "running" {
+			continue
+		}
 
-	client := shuffle.GetExternalClient(apiEndpoint)
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+		if !shuffle.ArrayContains(stoppedExecutions, container.Labels[shuffleExecutionLabel]) || shuffle.ArrayContains(stopContainers, container.ID) {
+			continue
+		}
+
+		stopContainers = append(stopContainers, container.ID)
+		containerNames[container.ID] = container.ID
+		if len(container.Names) > 0 {
+			containerNames[container.ID] = container.Names[0]
+		}
 	}
 
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Received non-200 response '%d' from backend URL %s. ", resp.StatusCode, apiEndpoint)
+	log.Printf("[INFO] Should STOP and remove %d containers.", len(stopContainers))
+	var options container.StopOptions
+	for _, containername := range stopContainers {
+		log.Printf("[INFO] Stopping and removing container %s", containerNames[containername])
+		dockercli.ContainerStop(ctx, containername, options)
+		removeContainers = append(removeContainers, containername)
 	}
 
-	out, err := os.Create("files.zip")
-	if err != nil {
-		return err
+	removeOptions := container.RemoveOptions{
+		RemoveVolumes: true,
+		Force:         true,
 	}
 
-	defer out.Close()
-	defer os.Remove("files.zip")
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		log.Printf("[ERROR] Failed to io.Copy ZIP file content: %s", err)
-		return err
+	log.Printf("[INFO] Should REMOVE %d containers.", len(removeContainers))
+	for _, containername := range removeContainers {
+		err = dockercli.ContainerRemove(ctx, containername, removeOptions)
+		if err == nil {
+			zombieStats.removed("containers")
+		}
 	}
 
-	//log.Println("[DEBUG] ZIP file downloaded successfully.")
+	return nil
+}
 
-	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
-	if len(tenzirStorageFolder) == 0 {
-		tenzirStorageFolder = "/tmp/"
-	}
+// Labels set on everything Shuffle deploys, so it can be found again.
+// This is the only definition: workers get them through SHUFFLE_LABEL_KEYS.
+var shuffleComponentLabel = "app.shuffler.io/component"
+var shuffleExecutionLabel = "app.shuffler.io/execution-id"
+var shuffleOrgLabel = "app.shuffler.io/org-id"
+var shuffleEnvironmentLabel = "app.shuffler.io/environment"
+var shuffleAppNameLabel = "app.shuffler.io/name"
+var shuffleAppVersionLabel = "app.shuffler.io/version"
+var shuffleOrborusLabel = "app.shuffler.io/orborus-id"
+
+var shuffleLabelKeys = map[string]string{
+	"component":   shuffleComponentLabel,
+	"execution":   shuffleExecutionLabel,
+	"org":         shuffleOrgLabel,
+	"environment": shuffleEnvironmentLabel,
+	"app_name":    shuffleAppNameLabel,
+	"app_version": shuffleAppVersionLabel,
+	"orborus":     shuffleOrborusLabel,
+}
 
-	tenzirStorageFolder = strings.TrimRight(tenzirStorageFolder, "/")
-	sigmaPath := fmt.Sprintf("%s/sigma_rules", tenzirStorageFolder)
-	err = extractZIP("files.zip", sigmaPath)
-	if err != nil {
-		log.Printf("[ERROR] Failed to extract ZIP file: %s", err)
-		return err
+// Label values are limited to 63 alphanumeric characters, '-', '_' and '.' in Kubernetes
+func getLabelValue(value string) string {
+	parsedValue := []rune{}
+	for _, char := range value {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '-' || char == '_' || char == '.' {
+			parsedValue = append(parsedValue, char)
+		} else {
+			parsedValue = append(parsedValue, '-')
+		}
 	}
 
-	log.Printf("[DEBUG] Detection files copied to '%s' successfully.", sigmaPath)
+	if len(parsedValue) > 63 {
+		parsedValue = parsedValue[:63]
+	}
 
-	return nil
+	return strings.Trim(string(parsedValue), "-_.")
 }
 
-func extractZIP(zipFile, destDir string) error {
-	r, err := zip.OpenReader(zipFile)
-	if err != nil {
-		return err
+func getShuffleLabels(component, executionId string) map[string]string {
+	labels := map[string]string{
+		shuffleComponentLabel:   component,
+		shuffleEnvironmentLabel: getLabelValue(environment),
+		shuffleOrborusLabel:     getLabelValue(orborusUuid),
 	}
 
-	// FInd size of the zip
-	var totalSize uint64
-	for _, f := range r.File {
-		totalSize += f.UncompressedSize64
+	if len(executionId) > 0 {
+		labels[shuffleExecutionLabel] = getLabelValue(executionId)
 	}
 
-	log.Printf("[DEBUG] Total size of the ZIP file: %d bytes", totalSize)
-
-	defer r.Close()
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return err
+	if len(org) > 0 {
+		labels[shuffleOrgLabel] = getLabelValue(org)
 	}
 
-	for _, f := range r.File {
-		// Fix path traversal
-		if strings.Contains(f.Name, "..") {
-			return fmt.Errorf("illegal file name: %s", f.Name)
-		}
+	return labels
+}
 
-		err := extractFile(f, destDir)
-		if err != nil {
-			return err
-		}
+// Everything this environment deployed, optionally of a single component.
+// The Orborus UUID isn't used, as it changes between restarts unless set.
+func getShuffleLabelFilters(component string) filters.Args {
+	filterArgs := filters.NewArgs()
+	filterArgs.Add("label", fmt.Sprintf("%s=%s", shuffleEnvironmentLabel, getLabelValue(environment)))
+	if len(component) > 0 {
+		filterArgs.Add("label", fmt.Sprintf("%s=%s", shuffleComponentLabel, component))
+	} else {
+		filterArgs.Add("label", shuffleComponentLabel)
 	}
 
-	return nil
+	return filterArgs
 }
 
-func extractFile(f *zip.File, destDir string) error {
-	rc, err := f.Open()
-	if err != nil {
-		return err
+func getShuffleLabelSelector(component string) string {
+	selector := fmt.Sprintf("%s=%s", shuffleEnvironmentLabel, getLabelValue(environment))
+	if len(component) > 0 {
+		return fmt.Sprintf("%s,%s=%s", selector, shuffleComponentLabel, component)
 	}
-	defer rc.Close()
 
-	path := filepath.Join(destDir, f.Name)
+	return fmt.Sprintf("%s,%s", selector, shuffleComponentLabel)
+}
 
-	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-	if err != nil {
-		return err
+// FIXME: The legacy lookups below find what was deployed before the labels
+// existed, so it still gets cleaned up after upgrading. Remove next release.
+var legacyKubernetesSelector = "app.kubernetes.io/name in (shuffle-worker, shuffle-app),app.kubernetes.io/managed-by in (shuffle-orborus, shuffle-worker)"
+
+func getLegacyLabelSelector(component string) string {
+	switch component {
+	case "app":
+		return fmt.Sprintf("app.kubernetes.io/name=shuffle-app,app.kubernetes.io/managed-by=shuffle-worker,!%s", shuffleEnvironmentLabel)
+	case "worker":
+		return fmt.Sprintf("app.kubernetes.io/name=shuffle-worker,app.kubernetes.io/managed-by=shuffle-orborus,!%s", shuffleEnvironmentLabel)
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, rc)
-	return err
+	return fmt.Sprintf("%s,!%s", legacyKubernetesSelector, shuffleEnvironmentLabel)
 }
 
-func copyToTenzir(srcPath, destPath string) error {
-	containerName := "tenzir-node"
+// The component of a container in this environment, or an empty string.
+// Unlabelled containers are matched by image, command and name like before.
+func getContainerComponent(container types.Container) string {
+	if len(container.Labels[shuffleComponentLabel]) > 0 {
+		if container.Labels[shuffleEnvironmentLabel] != getLabelValue(environment) {
+			return ""
+		}
 
-	checkCmd := exec.Command("docker", "exec", containerName, "test", "-d", destPath)
-	if err := checkCmd.Run(); err == nil {
-		rmCmd := exec.Command("docker", "exec", "-u", "root", containerName, "rm", "-rf", destPath)
-		if err := rmCmd.Run(); err != nil {
-			return fmt.Errorf("error removing existing directory in container: %v", err)
+		return container.Labels[shuffleComponentLabel]
+	}
+
+	if len(container.Labels[shuffleEnvironmentLabel]) > 0 {
+		return ""
+	}
+
+	if strings.Contains(container.Image, "shuffle-worker") || container.Command == "./worker" {
+		for _, name := range container.Names {
+			if strings.HasPrefix(name, "/worker") {
+				return "worker"
+			}
 		}
+
+		return ""
 	}
 
-	cpCmd := exec.Command("docker", "cp", srcPath, fmt.Sprintf("%s:%s", containerName, destPath))
-	var out bytes.Buffer
-	cpCmd.Stdout = &out
-	cpCmd.Stderr = &out
+	shuffleFound := strings.Contains(container.Image, baseimagename) || strings.Contains(container.Command, "python app.py") || strings.Contains(container.Command, "walkoff")
+	for _, item := range container.Labels {
+		if item == "shuffle" {
+			shuffleFound = true
+			break
+		}
+	}
 
-	err := cpCmd.Run()
-	if err != nil {
-		return fmt.Errorf("error copying files: %v, output: %s", err, out.String())
+	if !shuffleFound {
+		return ""
 	}
 
-	return nil
+	for _, name := range container.Names {
+		if strings.HasPrefix(name, "/shuffle") && !strings.HasPrefix(name, "/shuffle-subflow") {
+			return ""
+		}
+	}
+
+	return "app"
 }
 
-func removeFileCategory() error {
-	tenzirStorageFolder := os.Getenv("SHUFFLE_STORAGE_FOLDER")
-	if len(tenzirStorageFolder) == 0 {
-		tenzirStorageFolder = "/tmp/"
+// Passed to the workers, so the apps they deploy get the same labels
+func getLabelEnv() []string {
+	env := []string{
+		fmt.Sprintf("SHUFFLE_ORBORUS_UUID=%s", orborusUuid),
 	}
 
-	tenzirStorageFolder = strings.TrimRight(tenzirStorageFolder, "/")
-
-	//sigmaPath := "/var/lib/tenzir/sigma_rules/*"
-	sigmaPath := fmt.Sprintf("%s/sigma_rules", tenzirStorageFolder)
+	labelKeys, err := json.Marshal(shuffleLabelKeys)
+	if err == nil {
+		env = append(env, fmt.Sprintf("SHUFFLE_LABEL_KEYS=%s", string(labelKeys)))
+	}
 
-	err := os.RemoveAll(sigmaPath)
-	if err != nil {
-		return fmt.Errorf("Error removing category files in %s: %v", sigmaPath, err)
+	if len(org) > 0 {
+		env = append(env, fmt.Sprintf("ORG=%s", org))
 	}
 
-	log.Printf("[INFO] Removed all local category data in %s", sigmaPath)
+	return env
+}
 
-	return nil
+// Executions dispatched to workers, and when. Recently dispatched executions
+// are skipped without asking the backend.
+var activeExecutions = map[string]time.Time{}
+var activeExecutionsLock sync.Mutex
+
+func markExecutionActive(executionId string) {
+	activeExecutionsLock.Lock()
+	defer activeExecutionsLock.Unlock()
+
+	activeExecutions[executionId] = time.Now()
 }
 
-func removeFile(fileName string) error {
-	containerName := "tenzir-node"
-	srcPath := fmt.Sprintf("/var/lib/tenzir/sigma_rules/%s", fileName)
+func isExecutionActive(executionId string, workerTimeout int) bool {
+	activeExecutionsLock.Lock()
+	defer activeExecutionsLock.Unlock()
 
-	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
-	if err := checkSrcCmd.Run(); err != nil {
-		// If the file does not exist, simply return nil
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			log.Printf("[ERROR] No such file: %s, nothing to delete\n", srcPath)
-			return nil
+	for key, value := range activeExecutions {
+		if time.Since(value) > time.Duration(workerTimeout)*time.Second {
+			delete(activeExecutions, key)
 		}
-		return fmt.Errorf("error checking source file: %v", err)
 	}
 
-	return removePath(containerName, srcPath)
+	_, ok := activeExecutions[executionId]
+	return ok
 }
 
-func removePath(containerName, path string) error {
-	rmCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("rm -rf %s", path))
-	output, err := rmCmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("error removing path: %v, output: %s", err, output)
-	}
-	return nil
-}
+// Asks the backend for the status of executions that weren't dispatched
+// recently. Returns nil if the backend can't be reached, in which case
+// nothing belonging to an execution is removed.
+func getExecutionStatuses(executionIds []string, workerTimeout int) map[string]string {
+	checkIds := []string{}
+	for _, executionId := range executionIds {
+		if len(executionId) == 0 || isExecutionActive(executionId, workerTimeout) || shuffle.ArrayContains(checkIds, executionId) {
+			continue
+		}
 
-func sendPipelineHealthStatus() (shuffle.LakeConfig, error) {
-	pipelinePayload := shuffle.LakeConfig{
-		Enabled:   false,
-		Pipelines: []shuffle.PipelineInfoMini{},
+		checkIds = append(checkIds, executionId)
 	}
 
-	if tenzirDisabled {
-		return pipelinePayload, nil
-	}
+	statuses := map[string]string{}
+	for len(checkIds) > 0 {
+		batch := checkIds
+		if len(batch) > 500 {
+			batch = checkIds[:500]
+		}
 
-	// To not spam down the list API too much
-	randint := rand.Intn(5)
-	if len(pipelines) == 0 || randint == 0 {
-		pipelineDef, err := listPipelines()
+		checkIds = checkIds[len(batch):]
+		data, err := json.Marshal(map[string][]string{
+			"execution_ids": batch,
+		})
+		if err != nil {
+			return nil
+		}
 
-		if err == nil {
-			for _, pipeline := range pipelineDef {
-				pipelinePayload.Pipelines = append(pipelinePayload.Pipelines, shuffle.PipelineInfoMini{
-					ID:         pipeline.ID,
-					Name:       pipeline.Name,
-					Definition: pipeline.Definition,
-					TotalRuns:  pipeline.TotalRuns,
-					CreatedAt:  pipeline.CreatedAt,
-				})
-			}
+		req, err := http.NewRequest(
+			"POST",
+			fmt.Sprintf("%s/api/v1/workflows/queue/executions", baseUrl),
+			bytes.NewBuffer(data),
+		)
+		if err != nil {
+			return nil
+		}
 
-			pipelines = pipelinePayload.Pipelines
+		addOrborusHeaders(req)
+		client := shuffle.GetExternalClient(baseUrl)
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("[WARNING] Failed getting execution statuses for zombie check: %s", err)
+			return nil
 		}
-	} else {
-		pipelinePayload.Pipelines = pipelines
-	}
 
-	err := deployTenzirNode()
-	if err != nil {
-		if (!strings.Contains(err.Error(), "SHUFFLE_SKIP_PIPELINES") && !strings.Contains(err.Error(), "Kubernetes not implemented for Tenzir node")) && !strings.Contains(err.Error(), "Tenzir Node is already running") && !strings.Contains(err.Error(), "docker daemon") {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != 200 {
+			log.Printf("[WARNING] Failed getting execution statuses for zombie check (%d): %s", resp.StatusCode, string(body))
+			return nil
+		}
 
-			log.Printf("[ERROR] Tenzir node connection problem: %s", err)
+		parsedResp := struct {
+			Statuses map[string]string `json:"statuses"`
+		}{}
 
-		} else {
-			tenzirDisabled = true
-			log.Printf("[WARNING] Disabling pipelines: %s. You will need to restart the Orborus to fix this.", err)
+		err = json.Unmarshal(body, &parsedResp)
+		if err != nil {
+			return nil
 		}
 
-		return pipelinePayload, err
+		for key, value := range parsedResp.Statuses {
+			statuses[key] = value
+		}
 	}
 
-	pipelinePayload.Enabled = true
+	return statuses
+}
 
-	// No direct sending.
-	return pipelinePayload, nil
+// Only executions the backend says are done, or doesn't know about
+func isExecutionDone(statuses map[string]string, executionId string) bool {
+	switch statuses[executionId] {
+	case "FINISHED", "ABORTED", "FAILURE", "NOT_FOUND":
+		return true
+	}
+
+	return false
 }
 
-func disableRule(fileName string) error {
-	containerName := "tenzir-node"
-	srcPath := fmt.Sprintf("/var/lib/tenzir/sigma_rules/%s", fileName)
-	destDir := "/var/lib/tenzir/disabled_rules"
-	destPath := fmt.Sprintf("%s/%s", destDir, fileName)
+// How much the zombie cleanup removed, per resource type. Only logged.
+type zombieCleanupCounts struct {
+	sync.Mutex
 
-	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
-	if err := checkSrcCmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			fmt.Printf("File does not exist: %s\n", srcPath)
-			return nil // Nothing to disable
-		}
-		return fmt.Errorf("error checking source file: %v", err)
-	}
+	Runs        int64
+	LastRun     time.Time
+	Removed     map[string]int64
+	LastRemoved map[string]int64
+}
 
-	checkDestDirCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mkdir -p %s", destDir))
-	if err := checkDestDirCmd.Run(); err != nil {
-		return fmt.Errorf("error ensuring destination directory exists: %v", err)
-	}
+var zombieStats = &zombieCleanupCounts{
+	Removed: map[string]int64{},
+}
 
-	moveCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mv %s %s", srcPath, destPath))
-	if err := moveCmd.Run(); err != nil {
-		return fmt.Errorf("error moving file: %v", err)
-	}
+func (z *zombieCleanupCounts) start() {
+	z.Lock()
+	defer z.Unlock()
 
-	fmt.Printf("File %s moved to %s successfully.\n", fileName, destDir)
-	return nil
+	z.Runs += 1
+	z.LastRun = time.Now()
+	z.LastRemoved = map[string]int64{}
 }
 
-func enableRule(fileName string) error {
-	containerName := "tenzir-node"
-	srcPath := fmt.Sprintf("/var/lib/tenzir/disabled_rules/%s", fileName)
-	destDir := "/var/lib/tenzir/sigma_rules"
-	destPath := fmt.Sprintf("%s/%s", destDir, fileName)
+func (z *zombieCleanupCounts) removed(kind string) {
+	z.Lock()
+	defer z.Unlock()
 
-	checkSrcCmd := exec.Command("docker", "exec", containerName, "sh", "-c", fmt.Sprintf("test -f %s", srcPath))
-	if err := checkSrcCmd.Run(); err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
-			fmt.Printf("File does not exist: %s\n", srcPath)
-			return nil // Nothing to enable
-		}
-		return fmt.Errorf("error checking source file: %v", err)
-	}
+	z.Removed[kind] += 1
+	z.LastRemoved[kind] += 1
+}
 
-	checkDestDirCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mkdir -p %s", destDir))
-	if err := checkDestDirCmd.Run(); err != nil {
-		return fmt.Errorf("error ensuring destination directory exists: %v", err)
-	}
-	moveCmd := exec.Command("docker", "exec", "-u", "root", containerName, "sh", "-c", fmt.Sprintf("mv %s %s", srcPath, destPath))
-	if err := moveCmd.Run(); err != nil {
-		return fmt.Errorf("error moving file: %v", err)
+func (z *zombieCleanupCounts) report() {
+	z.Lock()
+	defer z.Unlock()
+
+	if len(z.LastRemoved) == 0 {
+		return
 	}
 
-	fmt.Printf("[DEBUG] File %s moved to %s successfully.\n", fileName, destDir)
-	return nil
+	log.Printf("[INFO] Zombie cleanup run %d removed %#v. Total removed: %#v", z.Runs, z.LastRemoved, z.Removed)
 }
 
-// Is this ok to do with Docker? idk :)
-func getRunningWorkers(ctx context.Context, workerTimeout int) int {
-	//log.Printf("[DEBUG] Getting running workers with API version %s", dockerApiVersion)
-	counter := 0
-	if isKubernetes == "true" {
-		log.Printf("[INFO] Getting running workers in kubernetes")
-
-		thresholdTime := time.Now().Add(time.Duration(-workerTimeout) * time.Second)
+// Swarm apps are long-running services shared between executions, so they are
+// only removed when they never got a task running, or when they belong to an execution that's done.
+func zombiecheckSwarm(ctx context.Context, workerTimeout int) error {
+	// Services deployed before the environment label was added only have the component label
+	serviceFilters := filters.NewArgs()
+	serviceFilters.Add("label", shuffleComponentLabel)
+	allServices, err := dockercli.ServiceList(ctx, types.ServiceListOptions{
+		Filters: serviceFilters,
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed listing services for zombie check: %s", err)
+		return err
+	}
 
-		clientset, _, err := shuffle.GetKubernetesClient()
-		if err != nil {
-			log.Printf("[ERROR] Failed getting kubernetes client: %s", err)
-			return 0
+	services := []swarm.Service{}
+	for _, service := range allServices {
+		serviceEnvironment, ok := service.Spec.Labels[shuffleEnvironmentLabel]
+		if ok && serviceEnvironment != getLabelValue(environment) {
+			continue
 		}
 
-		pods, podErr := clientset.CoreV1().Pods(kubernetesNamespace).List(ctx, metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/name=shuffle-worker",
-		})
-		if podErr != nil {
-			log.Printf("[ERROR] Failed getting running workers: %s", podErr)
-			return 0
-		}
+		services = append(services, service)
+	}
 
-		for _, pod := range pods.Items {
-			if pod.Status.Phase == "Running" && pod.CreationTimestamp.Time.After(thresholdTime) {
-				counter++
-			}
+	labelledExecutions := []string{}
+	for _, service := range services {
+		labelledExecutions = append(labelledExecutions, service.Spec.Labels[shuffleExecutionLabel])
+	}
+
+	statuses := getExecutionStatuses(labelledExecutions, workerTimeout)
+	for _, service := range services {
+		if time.Since(service.CreatedAt) < time.Duration(workerTimeout)*time.Second {
+			continue
 		}
 
-		if counter > 0 {
-			log.Printf("[INFO] Found %d running workers in Orborus", counter)
+		// Workers are managed by Orborus' scaling, and the rest is long-running
+		if service.Spec.Labels[shuffleComponentLabel] != "app" {
+			continue
 		}
-	} else {
 
-		containers, err := dockercli.ContainerList(ctx, container.ListOptions{
-			All: true,
-		})
+		isZombie := false
+		executionId := service.Spec.Labels[shuffleExecutionLabel]
+		if len(executionId) > 0 && isExecutionDone(statuses, executionId) {
+			isZombie = true
+		}
 
-		// Automatically updates the version
-		if err != nil {
-			log.Printf("[ERROR] Error getting containers from Docker: %s", err)
+		if !isZombie {
+			taskFilters := filters.NewArgs()
+			taskFilters.Add("service", service.ID)
+			tasks, err := dockercli.TaskList(ctx, types.TaskListOptions{
+				Filters: taskFilters,
+			})
+			if err != nil {
+				log.Printf("[WARNING] Failed listing tasks for service %s: %s", service.Spec.Name, err)
+				continue
+			}
 
-			newVersionSplit := strings.Split(fmt.Sprintf("%s", err), "version is")
-			if len(newVersionSplit) > 1 {
-				//dockerApiVersion = strings.TrimSpace(newVersionSplit[1])
-				log.Printf("[DEBUG] WANT to change the API version to default to %s?", strings.TrimSpace(newVersionSplit[1]))
+			running := 0
+			failed := 0
+			for _, task := range tasks {
+				switch task.Status.State {
+				case swarm.TaskStateRunning:
+					running += 1
+				case swarm.TaskStateFailed, swarm.TaskStateRejected, swarm.TaskStateOrphaned:
+					failed += 1
+				}
 			}
 
-			return maxConcurrency
+			isZombie = running == 0 && failed > 0
 		}
 
-		currenttime := time.Now().Unix()
+		if !isZombie {
+			continue
+		}
 
-		for _, container := range containers {
-			// Skip random containers. Only handle things related to Shuffle.
-			if !strings.Contains(container.Image, baseimagename) {
-				shuffleFound := false
-				for _, item := range container.Labels {
-					if item == "shuffle" {
-						shuffleFound = true
-						break
-					}
-				}
+		log.Printf("[INFO] Removing zombie service %s", service.Spec.Name)
+		err = dockercli.ServiceRemove(ctx, service.ID)
+		if err != nil {
+			log.Printf("[WARNING] Failed removing zombie service %s: %s", service.Spec.Name, err)
+			continue
+		}
 
-				// Check image name
-				if !shuffleFound {
-					continue
-				}
-				//} else {
-				//	log.Printf("NAME: %s", container.Image)
-			}
+		zombieStats.removed("services")
+	}
+
+	return nil
+}
 
-			for _, name := range container.Names {
-				// FIXME - add name_version_uid_uid regex check as well
-				if !strings.HasPrefix(name, "/worker") {
-					continue
-				}
+// The main loop only runs the zombie check when it's idle or failing, which
+// never happens with swarm and kubernetes, so they run it on a timer instead
+func runZombieReconciler(ctx context.Context, workerTimeout int) {
+	interval := time.Duration(workerTimeout) * time.Second
+	if interval < time.Minute {
+		interval = time.Minute
+	}
 
-				//log.Printf("Time: %d - %d", currenttime-container.Created, int64(workerTimeout))
-				if container.State == "running" && currenttime-container.Created < int64(workerTimeout) {
-					counter += 1
-					break
-				}
-			}
-		}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		zombiecheck(ctx, workerTimeout)
 	}
-	return counter
 }
 
-// FIXME - add this to remove exited workers
-// Should it check what happened to the execution? idk
-func zombiecheck(ctx context.Context, workerTimeout int) error {
-	isK8s := isKubernetes == "true"
+func isKubernetesPodStuck(pod corev1.Pod) bool {
+	if pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded {
+		return true
+	}
 
-	executionIds = []string{}
-	if swarmConfig == "run" || swarmConfig == "swarm" || isK8s {
-		//log.Printf("[DEBUG] Skipping Zombie check due to new execution model (swarm)")
-		return nil
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Waiting == nil {
+			continue
+		}
+
+		switch status.State.Waiting.Reason {
+		case "CrashLoopBackOff", "ImagePullBackOff", "ErrImagePull", "CreateContainerConfigError", "InvalidImageName":
+			return true
+		}
 	}
 
-	log.Println("[INFO] Looking for old containers to remove")
-	containers, err := dockercli.ContainerList(ctx, container.ListOptions{
-		All: true,
-	})
+	return false
+}
 
+// Kubernetes apps are deployments shared between executions. Stuck app deployments
+// are removed and redeployed by the worker on next use. Pods and jobs are
+// removed when they're done, stuck, or belong to an execution that's done.
+func zombiecheckKubernetes(ctx context.Context, workerTimeout int) error {
+	clientset, _, err := shuffle.GetKubernetesClient()
 	if err != nil {
-		log.Printf("[ERROR] Failed creating Containerlist: %s", err)
+		log.Printf("[ERROR] Failed getting kubernetes client for zombie check: %s", err)
 		return err
 	}
 
-	containerNames := map[string]string{}
-	stopContainers := []string{}
-	removeContainers := []string{}
-	log.Printf("[INFO] Baseimage: %s, Workertimeout: %d", baseimagename, int64(workerTimeout))
-	//baseString := `/bin/sh -c 'python app.py --log-level DEBUG'`
-	baseString := `python app.py`
-	for _, container := range containers {
-		// Skip random containers. Only handle things related to Shuffle.
-		if !strings.Contains(container.Image, baseimagename) && !strings.Contains(container.Command, baseString) && !strings.Contains(container.Command, "walkoff") && container.Command != "./worker" {
-			shuffleFound := false
-			for _, item := range container.Labels {
-				if item == "shuffle" {
-					shuffleFound = true
-					break
-				}
+	namespace := kubernetesNamespace
+	if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	thresholdTime := time.Now().Add(time.Duration(-workerTimeout) * time.Second)
+	deletePolicy := metav1.DeletePropagationBackground
+	deleteOptions := metav1.DeleteOptions{
+		PropagationPolicy: &deletePolicy,
+	}
+
+	for _, selector := range []string{getShuffleLabelSelector("app"), getLegacyLabelSelector("app")} {
+		deployments, err := clientset.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed listing app deployments for zombie check: %s", err)
+			continue
+		}
+
+		for _, deployment := range deployments.Items {
+			if deployment.CreationTimestamp.Time.After(thresholdTime) || deployment.Status.AvailableReplicas > 0 {
+				continue
 			}
 
-			// Check image name
-			if !shuffleFound {
-				//log.Printf("[DEBUG] Zombie container skip: %#v, %s", container.Labels, container.Image)
+			log.Printf("[INFO] Removing zombie app deployment %s without available replicas", deployment.Name)
+			err = clientset.AppsV1().Deployments(namespace).Delete(ctx, deployment.Name, deleteOptions)
+			if err != nil {
+				log.Printf("[WARNING] Failed removing deployment %s: %s", deployment.Name, err)
 				continue
 			}
-			//} else {
-			//	log.Printf("NAME: %s", container.Image)
-		} else {
-			//log.Printf("Img: %s", container.Image)
-			//log.Printf("Names: %s", container.Names)
+
+			zombieStats.removed("deployments")
+
+			// Same name as the deployment
+			err = clientset.CoreV1().Services(namespace).Delete(ctx, deployment.Name, metav1.DeleteOptions{})
+			if err == nil {
+				zombieStats.removed("services")
+			}
+
+			clientset.NetworkingV1().NetworkPolicies(namespace).Delete(ctx, deployment.Name, metav1.DeleteOptions{})
 		}
+	}
 
-		for _, name := range container.Names {
-			// FIXME - add name_version_uid_uid regex check as well
-			if strings.HasPrefix(name, "/shuffle") && !strings.HasPrefix(name, "/shuffle-subflow") {
+	for _, selector := range []string{getShuffleLabelSelector(""), getLegacyLabelSelector("")} {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed listing pods for zombie check: %s", err)
+			continue
+		}
+
+		labelledExecutions := []string{}
+		for _, pod := range pods.Items {
+			labelledExecutions = append(labelledExecutions, pod.Labels[shuffleExecutionLabel])
+		}
+
+		statuses := getExecutionStatuses(labelledExecutions, workerTimeout)
+		for _, pod := range pods.Items {
+			if pod.CreationTimestamp.Time.After(thresholdTime) || pod.DeletionTimestamp != nil {
 				continue
 			}
 
-			currenttime := time.Now().Unix()
-			//log.Printf("[INFO] (%s) NAME: %s. TIME: %d", container.State, name, currenttime-container.Created)
-
-			// Need to check time here too because a container can be removed the same instant as its created
-			if container.State != "running" && currenttime-container.Created > int64(workerTimeout) {
-				removeContainers = append(removeContainers, container.ID)
-				containerNames[container.ID] = name
+			executionId := pod.Labels[shuffleExecutionLabel]
+			if !isKubernetesPodStuck(pod) && !isExecutionDone(statuses, executionId) {
+				continue
 			}
 
-			// stopcontainer & removecontainer
-			//log.Printf("Time: %d - %d", currenttime-container.Created, int64(workerTimeout))
-			if container.State == "running" && currenttime-container.Created > int64(workerTimeout) {
-				stopContainers = append(stopContainers, container.ID)
-				containerNames[container.ID] = name
+			log.Printf("[INFO] Removing zombie pod %s with phase %s", pod.Name, pod.Status.Phase)
+			err = clientset.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{})
+			if err != nil {
+				log.Printf("[WARNING] Failed removing pod %s: %s", pod.Name, err)
+				continue
 			}
+
+			zombieStats.removed("pods")
 		}
 	}
 
-	// FIXME - add killing of apps with same execution ID too
-	log.Printf("[INFO] Should STOP and remove %d containers.", len(stopContainers))
-	var options container.StopOptions
-	for _, containername := range stopContainers {
-		log.Printf("[INFO] Stopping and removing container %s", containerNames[containername])
-		dockercli.ContainerStop(ctx, containername, options)
-		removeContainers = append(removeContainers, containername)
-	}
+	for _, selector := range []string{getShuffleLabelSelector(""), getLegacyLabelSelector("")} {
+		jobs, err := clientset.BatchV1().Jobs(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: selector,
+		})
+		if err != nil {
+			log.Printf("[ERROR] Failed listing jobs for zombie check: %s", err)
+			continue
+		}
 
-	removeOptions := container.RemoveOptions{
-		RemoveVolumes: true,
-		Force:         true,
-	}
+		labelledExecutions := []string{}
+		for _, job := range jobs.Items {
+			labelledExecutions = append(labelledExecutions, job.Labels[shuffleExecutionLabel])
+		}
 
-	log.Printf("[INFO] Should REMOVE %d containers.", len(removeContainers))
-	for _, containername := range removeContainers {
-		dockercli.ContainerRemove(ctx, containername, removeOptions)
+		statuses := getExecutionStatuses(labelledExecutions, workerTimeout)
+		for _, job := range jobs.Items {
+			if job.CreationTimestamp.Time.After(thresholdTime) {
+				continue
+			}
+
+			executionId := job.Labels[shuffleExecutionLabel]
+			finished := job.Status.Active == 0 && (job.Status.Succeeded > 0 || job.Status.Failed > 0)
+			if !finished && !isExecutionDone(statuses, executionId) {
+				continue
+			}
+
+			log.Printf("[INFO] Removing zombie job %s", job.Name)
+			err = clientset.BatchV1().Jobs(namespace).Delete(ctx, job.Name, deleteOptions)
+			if err != nil {
+				log.Printf("[WARNING] Failed removing job %s: %s", job.Name, err)
+				continue
+			}
+
+			zombieStats.removed("jobs")
+		}
 	}
 
 	return nil
@@ -4020,53 +5845,175 @@ func sendWorkerRequest(workflowExecution shuffle.ExecutionRequest, image string,
 	return nil
 }
 
+// Autoscaling settings for the worker service (Swarm) or deployment (Kubernetes)
+type ScalingConfig struct {
+	MinReplicas      int
+	MaxReplicas      int
+	MaxScaleUpStep   int
+	MaxScaleDownStep int
+	Cooldown         time.Duration
+
+	// How many executions per minute a single worker should handle
+	QueuePerReplica int
+}
+
+// App autoscaling is done by the workers themselves
+var appScalingEnvs = []string{
+	"SHUFFLE_APP_SCALE_MIN_REPLICAS",
+	"SHUFFLE_APP_SCALE_MAX_REPLICAS",
+	"SHUFFLE_APP_SCALE_UP_STEP",
+	"SHUFFLE_APP_SCALE_DOWN_STEP",
+	"SHUFFLE_APP_SCALE_COOLDOWN",
+	"SHUFFLE_APP_EXECUTIONS_PER_MINUTE",
+	"SHUFFLE_AUTOSCALE",
+}
+
+// Last amount of jobs seen in the queue. Used as part of the queue pressure
+var lastQueueLength int64
+
+func getScalingEnvInt(key string, defaultValue int) int {
+	if len(os.Getenv(key)) == 0 {
+		return defaultValue
+	}
+
+	tmpInt, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || tmpInt < 0 {
+		log.Printf("[WARNING] Env %s must be a positive number, not '%s'. Defaulting to %d", key, os.Getenv(key), defaultValue)
+		return defaultValue
+	}
+
+	return tmpInt
+}
+
+// Without SHUFFLE_SCALE_MIN_REPLICAS, the workers never go below the
+// replicas they were deployed with, e.g. one per node in a swarm.
+func getScalingConfig(initialReplicas int) ScalingConfig {
+	maxReplicas := 6
+	if initialReplicas > maxReplicas {
+		maxReplicas = initialReplicas
+	}
+
+	config := ScalingConfig{
+		MinReplicas:      getScalingEnvInt("SHUFFLE_SCALE_MIN_REPLICAS", initialReplicas),
+		MaxReplicas:      getScalingEnvInt("SHUFFLE_SCALE_MAX_REPLICAS", maxReplicas),
+		MaxScaleUpStep:   getScalingEnvInt("SHUFFLE_SCALE_UP_STEP", 2),
+		MaxScaleDownStep: getScalingEnvInt("SHUFFLE_SCALE_DOWN_STEP", 1),
+		Cooldown:         time.Duration(getScalingEnvInt("SHUFFLE_SCALE_COOLDOWN", 60)) * time.Second,
+		QueuePerReplica:  getScalingEnvInt("SHUFFLE_QUEUE_PER_MINUTE", 20),
+	}
+
+	if config.MinReplicas < 1 {
+		config.MinReplicas = 1
+	}
+
+	if config.MaxReplicas < config.MinReplicas {
+		log.Printf("[WARNING] SHUFFLE_SCALE_MAX_REPLICAS (%d) is lower than SHUFFLE_SCALE_MIN_REPLICAS (%d). Using %d as max.", config.MaxReplicas, config.MinReplicas, config.MinReplicas)
+		config.MaxReplicas = config.MinReplicas
+	}
+
+	if config.MaxScaleUpStep < 1 {
+		config.MaxScaleUpStep = 1
+	}
+
+	if config.MaxScaleDownStep < 1 {
+		config.MaxScaleDownStep = 1
+	}
+
+	if config.QueuePerReplica < 1 {
+		config.QueuePerReplica = 1
+	}
+
+	return config
+}
+
+// Queue pressure = executions sent to workers the last minute + what is still waiting in the queue
+func getQueuePressure() int {
+	return window.CountEvents(time.Now()) + int(atomic.LoadInt64(&lastQueueLength))
+}
+
+// Scales the workers up or down based on the queue pressure. Opt-in with
+// SHUFFLE_AUTOSCALE=true. Replicas move at most one step per cooldown,
+// and always stay within min/max.
 func AutoScale(ctx context.Context) {
 	if os.Getenv("SHUFFLE_SCALE_REPLICAS") != "" {
 		return
 	}
 
-	ticker := time.NewTicker(1 * time.Second)
-	coolDownPeriod := 10 * time.Second
-	queuePerMinuteInt = 20
-	if os.Getenv("SHUFFLE_QUEUE_PER_MINUTE") != "" {
-		var err error
-		queuePerMinuteInt, err = strconv.Atoi(os.Getenv("SHUFFLE_QUEUE_PER_MINUTE"))
+	config := getScalingConfig(currentWokerCount(ctx, dockercli))
+	log.Printf("[INFO] Autoscaling workers between %d and %d replicas (up step: %d, down step: %d, cooldown: %s, executions per replica/min: %d)", config.MinReplicas, config.MaxReplicas, config.MaxScaleUpStep, config.MaxScaleDownStep, config.Cooldown, config.QueuePerReplica)
+
+	if isKubernetes == "true" && strings.ToLower(os.Getenv("SHUFFLE_KUBERNETES_HPA")) == "true" {
+		err := ensureWorkerHPA(ctx, config)
 		if err != nil {
-			log.Printf("[WARNING] Cannot convert %s to int. Using default value for it: %d", queuePerMinute, queuePerMinuteInt)
+			log.Printf("[ERROR] Failed setting up HorizontalPodAutoscaler for workers: %s", err)
 		}
+
+		return
 	}
 
-	lastScaleTime := time.Now()
-	currentWorkers := currentWokerCount(ctx, dockercli)
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	lastScaleTime := time.Time{}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if time.Since(lastScaleTime) < (coolDownPeriod) {
+			if time.Since(lastScaleTime) < config.Cooldown {
 				continue
 			}
-			currentRequestCount := window.CountEvents(time.Now())
-			requiredReplicas := 0
-			if currentRequestCount >= queuePerMinuteInt*currentWorkers {
-				// FIXME: Hardcoded Max Replicas should be 6
-				requiredReplicas = int(math.Min(float64(6), float64(currentRequestCount/queuePerMinuteInt)+1))
+
+			currentWorkers := currentWokerCount(ctx, dockercli)
+			if currentWorkers <= 0 {
+				continue
 			}
 
-			if requiredReplicas > 0 {
-				err := scaleService(ctx, dockercli, uint64(requiredReplicas))
-				if err != nil {
-					log.Printf("[ERROR] Failed to scale service: %s", err)
-				} else {
-					lastScaleTime = time.Now()
-					currentWorkers = currentWokerCount(ctx, dockercli)
-				}
+			requiredReplicas := numberOfReplicas(currentWorkers, getQueuePressure(), config)
+			if requiredReplicas == currentWorkers {
+				continue
+			}
+
+			err := scaleService(ctx, dockercli, uint64(requiredReplicas))
+			if err != nil {
+				log.Printf("[ERROR] Failed to scale workers from %d to %d: %s", currentWorkers, requiredReplicas, err)
+				continue
 			}
+
+			lastScaleTime = time.Now()
 		}
 	}
 }
 
+// Calculates the replicas needed for the current pressure,
+// limited by the step sizes and min/max replicas.
+func numberOfReplicas(currentReplicas, queuePressure int, config ScalingConfig) int {
+	numReplicas := int(math.Ceil(float64(queuePressure) / float64(config.QueuePerReplica)))
+
+	if numReplicas > currentReplicas+config.MaxScaleUpStep {
+		numReplicas = currentReplicas + config.MaxScaleUpStep
+	}
+
+	if numReplicas < currentReplicas-config.MaxScaleDownStep {
+		numReplicas = currentReplicas - config.MaxScaleDownStep
+	}
+
+	if numReplicas < config.MinReplicas {
+		numReplicas = config.MinReplicas
+	}
+
+	if numReplicas > config.MaxReplicas {
+		numReplicas = config.MaxReplicas
+	}
+
+	return numReplicas
+}
+
 func scaleService(ctx context.Context, client *dockerclient.Client, replicas uint64) error {
+	if isKubernetes == "true" {
+		return scaleK8sWorkers(ctx, int32(replicas))
+	}
+
 	service, _, err := client.ServiceInspectWithRaw(ctx, "shuffle-workers", types.ServiceInspectOptions{})
 	if err != nil {
 		return err
@@ -4076,22 +6023,153 @@ func scaleService(ctx context.Context, client *dockerclient.Client, replicas uin
 		return errors.New("Service cannot be replicated")
 	}
 
-	if *service.Spec.Mode.Replicated.Replicas >= replicas {
+	currentReplicas := *service.Spec.Mode.Replicated.Replicas
+	if currentReplicas == replicas {
 		return nil
 	}
 
 	service.Spec.Mode.Replicated.Replicas = &replicas
 
-	_, err = dockercli.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	_, err = client.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Scaled shuffle-workers from %d to %d replicas", currentReplicas, replicas)
+	return nil
+}
+
+func scaleK8sWorkers(ctx context.Context, replicas int32) error {
+	clientset, _, err := shuffle.GetKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	scale, err := clientset.AppsV1().Deployments(kubernetesNamespace).GetScale(ctx, "shuffle-workers", metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	currentReplicas := scale.Spec.Replicas
+	if currentReplicas == replicas {
+		return nil
+	}
+
+	scale.Spec.Replicas = replicas
+	_, err = clientset.AppsV1().Deployments(kubernetesNamespace).UpdateScale(ctx, "shuffle-workers", scale, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] Scaled shuffle-workers deployment from %d to %d replicas", currentReplicas, replicas)
+	return nil
+}
+
+// Lets Kubernetes do the scaling itself. The HPA scales on CPU, with the
+// same min/max/step/cooldown limits as the queue based autoscaler.
+func ensureWorkerHPA(ctx context.Context, config ScalingConfig) error {
+	clientset, _, err := shuffle.GetKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	targetCpu := int32(getScalingEnvInt("SHUFFLE_SCALE_TARGET_CPU", 70))
+	minReplicas := int32(config.MinReplicas)
+	cooldownSeconds := int32(config.Cooldown.Seconds())
+	selectPolicy := autoscalingv2.MaxChangePolicySelect
+
+	hpa := &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "shuffle-workers",
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       "shuffle-worker",
+				"app.kubernetes.io/part-of":    "shuffle",
+				"app.kubernetes.io/managed-by": "shuffle-orborus",
+				shuffleComponentLabel:          "worker",
+			},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       "shuffle-workers",
+			},
+			MinReplicas: &minReplicas,
+			MaxReplicas: int32(config.MaxReplicas),
+			Metrics: []autoscalingv2.MetricSpec{
+				autoscalingv2.MetricSpec{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: corev1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: &targetCpu,
+						},
+					},
+				},
+			},
+			Behavior: &autoscalingv2.HorizontalPodAutoscalerBehavior{
+				ScaleUp: &autoscalingv2.HPAScalingRules{
+					SelectPolicy: &selectPolicy,
+					Policies: []autoscalingv2.HPAScalingPolicy{
+						autoscalingv2.HPAScalingPolicy{
+							Type:          autoscalingv2.PodsScalingPolicy,
+							Value:         int32(config.MaxScaleUpStep),
+							PeriodSeconds: cooldownSeconds,
+						},
+					},
+				},
+				ScaleDown: &autoscalingv2.HPAScalingRules{
+					StabilizationWindowSeconds: &cooldownSeconds,
+					SelectPolicy:               &selectPolicy,
+					Policies: []autoscalingv2.HPAScalingPolicy{
+						autoscalingv2.HPAScalingPolicy{
+							Type:          autoscalingv2.PodsScalingPolicy,
+							Value:         int32(config.MaxScaleDownStep),
+							PeriodSeconds: cooldownSeconds,
+						},
+					},
+				},
+			},
+		},
+	}
+
+	existingHpa, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(kubernetesNamespace).Get(ctx, hpa.Name, metav1.GetOptions{})
+	if err == nil {
+		existingHpa.Spec = hpa.Spec
+		_, err = clientset.AutoscalingV2().HorizontalPodAutoscalers(kubernetesNamespace).Update(ctx, existingHpa, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[INFO] Updated HorizontalPodAutoscaler for shuffle-workers (%d-%d replicas, %d%% CPU)", config.MinReplicas, config.MaxReplicas, targetCpu)
+		return nil
+	}
+
+	_, err = clientset.AutoscalingV2().HorizontalPodAutoscalers(kubernetesNamespace).Create(ctx, hpa, metav1.CreateOptions{})
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[INFO] Scaled shuffle-worker to %d replicas", replicas)
+	log.Printf("[INFO] Created HorizontalPodAutoscaler for shuffle-workers (%d-%d replicas, %d%% CPU)", config.MinReplicas, config.MaxReplicas, targetCpu)
 	return nil
 }
 
 func currentWokerCount(ctx context.Context, client *dockerclient.Client) int {
+	if isKubernetes == "true" {
+		clientset, _, err := shuffle.GetKubernetesClient()
+		if err != nil {
+			return 0
+		}
+
+		scale, err := clientset.AppsV1().Deployments(kubernetesNamespace).GetScale(ctx, "shuffle-workers", metav1.GetOptions{})
+		if err != nil {
+			return 0
+		}
+
+		return int(scale.Spec.Replicas)
+	}
+
 	service, _, err := client.ServiceInspectWithRaw(ctx, "shuffle-workers", types.ServiceInspectOptions{})
 	if err != nil {
 		return 0
@@ -4104,15 +6182,6 @@ func currentWokerCount(ctx context.Context, client *dockerclient.Client) int {
 	return int(*service.Spec.Mode.Replicated.Replicas)
 }
 
-func queueScaleFactor(numQueue int, queuePerMin int) float64 {
-	if numQueue > queuePerMin {
-		queuePressure := float64(numQueue) / float64(queuePerMin)
-		return 1.0 + math.Min(queuePressure-1.0, 1.0)
-	}
-
-	return 1.0
-}
-
 func checkMemcached(ctx context.Context, dockercli *dockerclient.Client) (bool, error) {
 	containerName := "shuffle-cache"
 	continer, err := dockercli.ContainerInspect(context.Background(), containerName)
@@ -4154,8 +6223,9 @@ func deployMemcached(dockercli *dockerclient.Client) error {
 
 	memcachedImage := "docker.io/library/memcached:latest"
 	containerConfig := &container.Config{
-		Image: memcachedImage,
-		Cmd:   []string{"-m", defaultMem},
+		Image:  memcachedImage,
+		Cmd:    []string{"-m", defaultMem},
+		Labels: getShuffleLabels("cache", ""),
 	}
 
 	hostConfig := &container.HostConfig{
@@ -4227,46 +6297,6 @@ func nodesResourceUsage(ctx context.Context, client *dockerclient.Client) error
 }
 */
 
-/*
-func numberOfReplicas(ctx context.Context, queueLength int, config shuffle.ScalingConfig) (int, int) {
-	queueScaleFactor := queueScaleFactor(queueLength, config)
-	numReplicas := int(float64(queueLength) * queueScaleFactor)
-	serviceName := "shuffle-workers"
-	nodes, err := dockercli.NodeList(ctx, types.NodeListOptions{})
-	if err != nil {
-		log.Printf("[ERROR] Cannot find any nodes in the swarm network")
-	}
-
-	filterArgs := filters.NewArgs()
-	filterArgs.Add("service", serviceName)
-	filterArgs.Add("desired-state", "running")
-
-	tasks, err := dockercli.TaskList(context.Background(), types.TaskListOptions{
-		Filters: filterArgs,
-	})
-	if err != nil {
-		log.Fatalf("[WARNING] Failed to list tasks for service %s: %s", serviceName, err)
-	}
-
-	runningReplicas := len(tasks)
-	if numReplicas > runningReplicas*len(nodes) {
-		maxIncrease := config.MaxScaleUpStep
-		if numReplicas > (runningReplicas*len(nodes) + maxIncrease) {
-			numReplicas = runningReplicas + maxIncrease
-		}
-	}
-
-	if numReplicas < config.MinReplicas {
-		numReplicas = config.MinReplicas
-	}
-	if numReplicas > config.MaxReplicas {
-		numReplicas = config.MaxReplicas
-	}
-
-	return numReplicas, runningReplicas
-}
-*/
-
 // TODO: Currently we use number of request made for the worker to run a execution as it is much
 // easier to track in a window time frame. But this could be useful.
 func collectMetrics(ctx context.Context, dockerClient *dockerclient.Client) (int, error) {
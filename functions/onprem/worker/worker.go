@@ -5,12 +5,17 @@ import (
 
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/http/pprof"
@@ -18,15 +23,18 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/api/types/network"
 	dockerclient "github.com/docker/docker/client"
+	units "github.com/docker/go-units"
 
 	// This is for automatic removal of certain code :)
 	/*** STARTREMOVE ***/
@@ -42,6 +50,9 @@ import (
 	//k8s deps
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
@@ -104,7 +115,16 @@ type ImageRequest struct {
 }
 
 var finishedExecutions []string
-var imagesDistributed []string
+// Image -> the workers that confirmed having it, and when all of them last did
+var imagesDistributed = map[string][]string{}
+var imagesDistributedAt = map[string]time.Time{}
+var imagesDistributedLock sync.Mutex
+
+// Kubernetes worker pods, so the API isn't listed for every image
+var workerUrlCache = map[string]string{}
+var workerUrlCacheUpdated time.Time
+var workerUrlCacheLock sync.Mutex
+var workerUrlCacheTTL = time.Second * 60
 var imagedownloadTimeout = time.Second * 300
 
 var window = shuffle.NewTimeWindow(10 * time.Second)
@@ -407,6 +427,11 @@ func deployk8sApp(image string, identifier string, env []string) error {
 	deployport, err := strconv.Atoi(os.Getenv("SHUFFLE_APP_EXPOSED_PORT"))
 	if err != nil {
 		deployport = 80
+
+		// Non-root users can't listen on ports below 1024
+		if hardenedMode {
+			deployport = 8080
+		}
 	}
 
 	envMap := make(map[string]string)
@@ -504,9 +529,11 @@ func deployk8sApp(image string, identifier string, env []string) error {
 		"app.kubernetes.io/managed-by": "shuffle-worker",
 		// Keep legacy labels for backward compatibility
 		"app": name,
-		// TODO: Add Shuffle specific labels
-		// "app.shuffler.io/name":    "APP_NAME",
-		// "app.shuffler.io/version": "APP_VERSION",
+	}
+
+	appName, appVersion := getImageAppName(image)
+	for key, value := range getAppLabels(appName, appVersion, "", "") {
+		labels[key] = value
 	}
 
 	matchLabels := map[string]string{
@@ -536,6 +563,27 @@ func deployk8sApp(image string, identifier string, env []string) error {
 		}
 	}
 
+	volumes := []corev1.Volume{}
+	volumeMounts := []corev1.VolumeMount{}
+	if hardenedMode {
+		if podSecurityContext == nil {
+			podSecurityContext = getDefaultAppPodSecurityContext()
+		}
+
+		if containerSecurityContext == nil {
+			containerSecurityContext = getDefaultAppContainerSecurityContext()
+		}
+
+		if containerSecurityContext.ReadOnlyRootFilesystem != nil && *containerSecurityContext.ReadOnlyRootFilesystem {
+			volumes, volumeMounts = getHardenedK8sVolumes()
+		}
+
+		for _, envStr := range getHardenedAppEnv() {
+			parts := strings.SplitN(envStr, "=", 2)
+			envMap[parts[0]] = parts[1]
+		}
+	}
+
 	// pod := &corev1.Pod{
 	// 	ObjectMeta: metav1.ObjectMeta{
 	// 		Name: podName,
@@ -639,8 +687,11 @@ func deployk8sApp(image string, identifier string, env []string) error {
 								},
 							},
 							SecurityContext: containerSecurityContext,
+							Resources:       getImageResourceLimits(image).kubernetes(),
+							VolumeMounts:    volumeMounts,
 						},
 					},
+					Volumes:            volumes,
 					DNSPolicy:          corev1.DNSClusterFirst,
 					ServiceAccountName: appServiceAccountName,
 					SecurityContext:    podSecurityContext,
@@ -649,6 +700,14 @@ func deployk8sApp(image string, identifier string, env []string) error {
 		},
 	}
 
+	// The policy has to exist before the pods do. The deployment is shared
+	// by all orgs, so only the environment policy goes in it.
+	err = deployAppNetworkPolicy(context.Background(), clientset, name, matchLabels, labels, getAppEgressPolicy(appName))
+	if err != nil {
+		log.Printf("[ERROR] Failed deploying network policy for app %s: %v", appName, err)
+		return err
+	}
+
 	_, err = clientset.AppsV1().Deployments(kubernetesNamespace).Create(context.Background(), deployment, metav1.CreateOptions{})
 	if err != nil {
 		log.Printf("[ERROR] Failed creating deployment: %v", err)
@@ -673,16 +732,1296 @@ func deployk8sApp(image string, identifier string, env []string) error {
 		},
 	}
 
-	_, err = clientset.CoreV1().Services(kubernetesNamespace).Create(context.TODO(), service, metav1.CreateOptions{})
+	_, err = clientset.CoreV1().Services(kubernetesNamespace).Create(context.TODO(), service, metav1.CreateOptions{})
+	if err != nil {
+		log.Printf("[ERROR] Failed creating service: %v", err)
+		return err
+	}
+
+	return nil
+}
+
+//** ENDREMOVE ***/
+
+// Hardened mode runs apps without capabilities, with a read-only root
+// filesystem and as a non-root user. Set by Orborus with SHUFFLE_HARDENED_MODE.
+var hardenedMode = strings.ToLower(os.Getenv("SHUFFLE_HARDENED_MODE")) == "true"
+
+func getHardenedAppUser() string {
+	if len(os.Getenv("SHUFFLE_APP_USER")) > 0 {
+		return os.Getenv("SHUFFLE_APP_USER")
+	}
+
+	return "65534:65534"
+}
+
+func isValidHardenedPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.Contains(path, "..") && path != "/"
+}
+
+// The writable work directory of the apps. The image's own working
+// directory holds the app code, and the app is started relative to it, so
+// it stays read-only. Apps get this one in SHUFFLE_APP_WORKDIR and HOME.
+func getHardenedAppWorkdir() string {
+	workdir := strings.TrimSpace(os.Getenv("SHUFFLE_APP_WORKDIR"))
+	if !isValidHardenedPath(workdir) {
+		return "/workdir"
+	}
+
+	return workdir
+}
+
+// Writable paths inside the otherwise read-only app containers. /tmp and
+// the app workdir are always included.
+func getHardenedTmpfsPaths() []string {
+	paths := []string{"/tmp", getHardenedAppWorkdir()}
+	for _, path := range strings.Split(os.Getenv("SHUFFLE_APP_TMPFS"), ",") {
+		path = strings.TrimSpace(path)
+		if isValidHardenedPath(path) && !shuffle.ArrayContains(paths, path) {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// SHUFFLE_APP_SECCOMP_PROFILE is either the profile itself, or a path to it
+func getAppSeccompProfile() ([]byte, error) {
+	profile := strings.TrimSpace(os.Getenv("SHUFFLE_APP_SECCOMP_PROFILE"))
+	if len(profile) == 0 {
+		return []byte{}, nil
+	}
+
+	if !strings.HasPrefix(profile, "{") {
+		fileData, err := ioutil.ReadFile(profile)
+		if err != nil {
+			return []byte{}, err
+		}
+
+		profile = string(fileData)
+	}
+
+	if !json.Valid([]byte(profile)) {
+		return []byte{}, errors.New("Seccomp profile is not valid JSON")
+	}
+
+	return []byte(profile), nil
+}
+
+func getHardenedAppEnv() []string {
+	return []string{
+		fmt.Sprintf("HOME=%s", getHardenedAppWorkdir()),
+		fmt.Sprintf("SHUFFLE_APP_WORKDIR=%s", getHardenedAppWorkdir()),
+		"TMPDIR=/tmp",
+		"PYTHONDONTWRITEBYTECODE=1",
+	}
+}
+
+func applyHardenedDockerConfig(config *container.Config, hostConfig *container.HostConfig) error {
+	config.User = getHardenedAppUser()
+	config.Env = append(config.Env, getHardenedAppEnv()...)
+
+	hostConfig.CapDrop = []string{"ALL"}
+	hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges:true")
+	hostConfig.ReadonlyRootfs = true
+
+	hostConfig.Tmpfs = map[string]string{}
+	for _, path := range getHardenedTmpfsPaths() {
+		hostConfig.Tmpfs[path] = "rw,nosuid,nodev,size=256m"
+	}
+
+	profile, err := getAppSeccompProfile()
+	if err != nil {
+		return err
+	}
+
+	if len(profile) > 0 {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, fmt.Sprintf("seccomp=%s", string(profile)))
+	}
+
+	return nil
+}
+
+func applyHardenedSwarmConfig(spec *swarm.ContainerSpec) error {
+	spec.User = getHardenedAppUser()
+	spec.Env = append(spec.Env, getHardenedAppEnv()...)
+	spec.ReadOnly = true
+	spec.CapabilityDrop = []string{"ALL"}
+	spec.Privileges = &swarm.Privileges{
+		NoNewPrivileges: true,
+	}
+
+	for _, path := range getHardenedTmpfsPaths() {
+		spec.Mounts = append(spec.Mounts, mount.Mount{
+			Type:   mount.TypeTmpfs,
+			Target: path,
+		})
+	}
+
+	profile, err := getAppSeccompProfile()
+	if err != nil {
+		return err
+	}
+
+	if len(profile) > 0 {
+		spec.Privileges.Seccomp = &swarm.SeccompOpts{
+			Mode:    swarm.SeccompModeCustom,
+			Profile: profile,
+		}
+	}
+
+	return nil
+}
+
+// Used when SHUFFLE_APP_POD_SECURITY_CONTEXT isn't set in hardened mode
+func getDefaultAppPodSecurityContext() *corev1.PodSecurityContext {
+	runAsNonRoot := true
+	userId := int64(65534)
+	return &corev1.PodSecurityContext{
+		RunAsNonRoot: &runAsNonRoot,
+		RunAsUser:    &userId,
+		RunAsGroup:   &userId,
+		FSGroup:      &userId,
+		SeccompProfile: &corev1.SeccompProfile{
+			Type: corev1.SeccompProfileTypeRuntimeDefault,
+		},
+	}
+}
+
+// Used when SHUFFLE_APP_CONTAINER_SECURITY_CONTEXT isn't set in hardened mode
+func getDefaultAppContainerSecurityContext() *corev1.SecurityContext {
+	runAsNonRoot := true
+	allowPrivilegeEscalation := false
+	readOnlyRootFilesystem := true
+	return &corev1.SecurityContext{
+		RunAsNonRoot:             &runAsNonRoot,
+		AllowPrivilegeEscalation: &allowPrivilegeEscalation,
+		ReadOnlyRootFilesystem:   &readOnlyRootFilesystem,
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{"ALL"},
+		},
+	}
+}
+
+// emptyDir volumes are the tmpfs equivalent for a read-only root filesystem
+func getHardenedK8sVolumes() ([]corev1.Volume, []corev1.VolumeMount) {
+	volumes := []corev1.Volume{}
+	volumeMounts := []corev1.VolumeMount{}
+	for cnt, path := range getHardenedTmpfsPaths() {
+		name := fmt.Sprintf("shuffle-tmp-%d", cnt)
+		volumes = append(volumes, corev1.Volume{
+			Name: name,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{
+					Medium: corev1.StorageMediumMemory,
+				},
+			},
+		})
+
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      name,
+			MountPath: path,
+		})
+	}
+
+	return volumes, volumeMounts
+}
+
+// Egress policies decide which destinations an app may connect to.
+// Modes: "allow_all" (default), "internet_only" (no private ranges) and "allowlist".
+// Allow takes hostnames ("api.example.com", "*.example.com") and CIDRs ("203.0.113.0/24").
+// BlockShuffle also blocks the backend, for apps which don't use files, cache or datastore.
+//
+// Enforcement depends on how the apps run:
+//   - Docker, one container per action: the app is on an internal network
+//     where the worker's egress proxy is the only way out.
+//   - Swarm and run mode services: the app only gets HTTP(S)_PROXY. It stays
+//     on the shared network, so a client ignoring the proxy isn't stopped.
+//   - Kubernetes: a NetworkPolicy with the environment policy, plus the
+//     proxy for the org policy. Hostnames in the NetworkPolicy are resolved
+//     when the app is deployed, so a host changing IP is blocked until the
+//     app is redeployed.
+type appEgressPolicy struct {
+	Mode         string   `json:"mode"`
+	Allow        []string `json:"allow"`
+	BlockShuffle bool     `json:"block_shuffle"`
+}
+
+// The policies an org admin set in the backend
+type orgEgressPolicies struct {
+	Default *appEgressPolicy           `json:"default,omitempty"`
+	Apps    map[string]appEgressPolicy `json:"apps"`
+}
+
+type cachedOrgEgressPolicies struct {
+	Policies orgEgressPolicies
+	Fetched  time.Time
+}
+
+var orgEgressPolicyLock sync.Mutex
+var orgEgressPolicyCache = map[string]cachedOrgEgressPolicies{}
+
+var egressProxyPort = 0
+var egressProxySecret = os.Getenv("SHUFFLE_EGRESS_PROXY_SECRET")
+
+// Ranges that "internet_only" doesn't allow. IsPrivate() etc. covers the rest.
+var nonInternetNetworks = []string{
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+}
+
+// Org policies can show up at any time, so the proxy runs unless disabled
+func hasEgressPolicies() bool {
+	return strings.ToLower(os.Getenv("SHUFFLE_EGRESS_PROXY_DISABLED")) != "true"
+}
+
+// SHUFFLE_APP_EGRESS_POLICY is the default for the environment, either a mode or a policy.
+// SHUFFLE_APP_EGRESS_POLICIES overrides it per app: {"http": {"mode": "allowlist", "allow": ["api.example.com"]}}
+func getAppEgressPolicy(appName string) appEgressPolicy {
+	policy := appEgressPolicy{
+		Mode: "allow_all",
+	}
+
+	defaultPolicy := strings.TrimSpace(os.Getenv("SHUFFLE_APP_EGRESS_POLICY"))
+	if strings.HasPrefix(defaultPolicy, "{") {
+		err := json.Unmarshal([]byte(defaultPolicy), &policy)
+		if err != nil {
+			log.Printf("[WARNING] Failed parsing SHUFFLE_APP_EGRESS_POLICY: %s", err)
+		}
+	} else if len(defaultPolicy) > 0 {
+		policy.Mode = strings.ToLower(defaultPolicy)
+	}
+
+	if len(os.Getenv("SHUFFLE_APP_EGRESS_POLICIES")) > 0 {
+		appPolicies := map[string]appEgressPolicy{}
+		err := json.Unmarshal([]byte(os.Getenv("SHUFFLE_APP_EGRESS_POLICIES")), &appPolicies)
+		if err != nil {
+			log.Printf("[WARNING] Failed parsing SHUFFLE_APP_EGRESS_POLICIES: %s", err)
+		} else {
+			for key, value := range appPolicies {
+				if normalizeAppLimitName(key) == normalizeAppLimitName(appName) {
+					policy = value
+					break
+				}
+			}
+		}
+	}
+
+	return policy.normalize(appName)
+}
+
+func (p appEgressPolicy) normalize(appName string) appEgressPolicy {
+	p.Mode = strings.ToLower(p.Mode)
+	if p.Mode != "allow_all" && p.Mode != "internet_only" && p.Mode != "allowlist" {
+		// Unknown modes are handled as the strictest one
+		log.Printf("[WARNING] Unknown egress mode '%s' for app %s. Using allowlist.", p.Mode, appName)
+		p.Mode = "allowlist"
+	}
+
+	return p
+}
+
+func (p appEgressPolicy) restricted() bool {
+	return p.Mode != "allow_all"
+}
+
+// Fetches the org's policies from the backend, at most every 5 minutes.
+// The proxy only uses what is cached, as it has no execution to fetch with.
+func refreshOrgEgressPolicies(workflowExecution shuffle.WorkflowExecution) {
+	orgId := workflowExecution.ExecutionOrg
+	if len(orgId) == 0 {
+		return
+	}
+
+	orgEgressPolicyLock.Lock()
+	cached, ok := orgEgressPolicyCache[orgId]
+	orgEgressPolicyLock.Unlock()
+	if ok && time.Since(cached.Fetched) < 5*time.Minute {
+		return
+	}
+
+	// Failures keep the last known policies, and are retried next round
+	cached.Fetched = time.Now()
+	defer func() {
+		orgEgressPolicyLock.Lock()
+		orgEgressPolicyCache[orgId] = cached
+		orgEgressPolicyLock.Unlock()
+	}()
+
+	policyUrl := fmt.Sprintf("%s/api/v1/apps/egress_policies?execution_id=%s&authorization=%s", baseUrl, url.QueryEscape(workflowExecution.ExecutionId), url.QueryEscape(workflowExecution.Authorization))
+	client := shuffle.GetExternalClient(baseUrl)
+	client.Timeout = 10 * time.Second
+
+	newresp, err := client.Get(policyUrl)
+	if err != nil {
+		log.Printf("[WARNING] Failed getting egress policies for org %s: %s", orgId, err)
+		return
+	}
+
+	defer newresp.Body.Close()
+	body, err := ioutil.ReadAll(newresp.Body)
+	if err != nil || newresp.StatusCode != 200 {
+		log.Printf("[WARNING] Failed getting egress policies for org %s (%d): %s", orgId, newresp.StatusCode, string(body))
+		return
+	}
+
+	policies := orgEgressPolicies{}
+	err = json.Unmarshal(body, &policies)
+	if err != nil {
+		log.Printf("[WARNING] Failed unmarshalling egress policies for org %s: %s", orgId, err)
+		return
+	}
+
+	cached.Policies = policies
+}
+
+// The org's policy for the app, or its default. Allows all without either.
+func getOrgAppEgressPolicy(appName, orgId string) appEgressPolicy {
+	orgEgressPolicyLock.Lock()
+	cached := orgEgressPolicyCache[orgId]
+	orgEgressPolicyLock.Unlock()
+
+	for key, value := range cached.Policies.Apps {
+		if normalizeAppLimitName(key) == normalizeAppLimitName(appName) {
+			return value.normalize(appName)
+		}
+	}
+
+	if cached.Policies.Default != nil {
+		return cached.Policies.Default.normalize(appName)
+	}
+
+	return appEgressPolicy{Mode: "allow_all"}
+}
+
+// The environment policy from Orborus and the org's own policy. A
+// destination has to be allowed by both, so an org can't loosen what the
+// environment allows.
+type appEgressPolicies []appEgressPolicy
+
+func getAppEgressPolicies(appName, orgId string) appEgressPolicies {
+	return appEgressPolicies{
+		getAppEgressPolicy(appName),
+		getOrgAppEgressPolicy(appName, orgId),
+	}
+}
+
+func (policies appEgressPolicies) restricted() bool {
+	for _, policy := range policies {
+		if policy.restricted() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isInternetIP(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+
+	for _, cidr := range nonInternetNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p appEgressPolicy) allowsHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.Allow {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == host {
+			return true
+		}
+
+		if strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p appEgressPolicy) allowsIP(ip net.IP) bool {
+	switch p.Mode {
+	case "allow_all":
+		return true
+	case "internet_only":
+		return isInternetIP(ip)
+	}
+
+	for _, allowed := range p.Allow {
+		allowed = strings.TrimSpace(allowed)
+		if !strings.Contains(allowed, "/") {
+			if allowedIP := net.ParseIP(allowed); allowedIP != nil && allowedIP.Equal(ip) {
+				return true
+			}
+
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(allowed)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches the host and port of one of the URLs, so other services on the
+// same host aren't reachable through it.
+func isUrlAddress(urls []string, host, port string) bool {
+	for _, shuffleUrl := range urls {
+		parsedUrl, err := url.Parse(shuffleUrl)
+		if err != nil || len(parsedUrl.Hostname()) == 0 || !strings.EqualFold(parsedUrl.Hostname(), host) {
+			continue
+		}
+
+		shufflePort := parsedUrl.Port()
+		if len(shufflePort) == 0 {
+			shufflePort = "80"
+			if parsedUrl.Scheme == "https" {
+				shufflePort = "443"
+			}
+		}
+
+		if shufflePort == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The worker is always reachable, as the apps send their results to it.
+// The backend, which the apps use for files, cache and datastore, is
+// reachable unless the policy blocks it.
+func (p appEgressPolicy) allowsAddress(host, port string, ip net.IP, literal bool) bool {
+	if !p.restricted() || isUrlAddress([]string{appCallbackUrl}, host, port) {
+		return true
+	}
+
+	if !p.BlockShuffle && isUrlAddress([]string{baseUrl, os.Getenv("SHUFFLE_CLOUDRUN_URL")}, host, port) {
+		return true
+	}
+
+	// Allowlisted hostnames may still not resolve to internal addresses
+	if p.Mode == "allowlist" && p.allowsHost(host) && (literal || isInternetIP(ip)) {
+		return true
+	}
+
+	return p.allowsIP(ip)
+}
+
+// Resolves the destination and returns the address to dial. Dialing the
+// checked IP instead of the hostname stops DNS rebinding around the policy.
+func (policies appEgressPolicies) resolve(ctx context.Context, host, port string) (string, error) {
+	if !policies.restricted() {
+		return net.JoinHostPort(host, port), nil
+	}
+
+	literal := false
+	addresses := []net.IP{}
+	if ip := net.ParseIP(host); ip != nil {
+		literal = true
+		addresses = append(addresses, ip)
+	} else {
+		resolved, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return "", err
+		}
+
+		for _, address := range resolved {
+			addresses = append(addresses, address.IP)
+		}
+	}
+
+	for _, ip := range addresses {
+		allowed := true
+		for _, policy := range policies {
+			if !policy.allowsAddress(host, port, ip, literal) {
+				allowed = false
+				break
+			}
+		}
+
+		if allowed {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+
+	return "", fmt.Errorf("Egress to %s is not allowed for this app", host)
+}
+
+// Each app gets its own proxy credentials per org, so one app can't use
+// another app's or org's policy. The username is "<app>~<org id>".
+func getEgressProxyUser(appName, orgId string) string {
+	return fmt.Sprintf("%s~%s", normalizeAppLimitName(appName), orgId)
+}
+
+func getEgressProxyToken(proxyUser string) string {
+	mac := hmac.New(sha256.New, []byte(egressProxySecret))
+	mac.Write([]byte(proxyUser))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func getEgressProxyUrl(appName, orgId, host string) string {
+	proxyUser := getEgressProxyUser(appName, orgId)
+	return fmt.Sprintf("http://%s:%s@%s:%d", url.QueryEscape(proxyUser), getEgressProxyToken(proxyUser), host, egressProxyPort)
+}
+
+// Runs the egress proxy the apps with restricted policies use.
+// Kubernetes uses a fixed port for the shuffle-workers service. Otherwise
+// workers may share a network namespace, so any free port is used.
+func startEgressProxy() {
+	if len(egressProxySecret) == 0 {
+		egressProxySecret = uuid.NewV4().String()
+	}
+
+	port := 0
+	if isKubernetes == "true" {
+		port = 33335
+	}
+
+	if len(os.Getenv("SHUFFLE_EGRESS_PROXY_PORT")) > 0 {
+		tmpInt, err := strconv.Atoi(os.Getenv("SHUFFLE_EGRESS_PROXY_PORT"))
+		if err != nil {
+			log.Printf("[WARNING] SHUFFLE_EGRESS_PROXY_PORT must be a number, not '%s'", os.Getenv("SHUFFLE_EGRESS_PROXY_PORT"))
+		} else {
+			port = tmpInt
+		}
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		log.Printf("[ERROR] Failed starting egress proxy on port %d: %s", port, err)
+		return
+	}
+
+	egressProxyPort = listener.Addr().(*net.TCPAddr).Port
+	log.Printf("[INFO] Egress proxy for apps listening on port %d", egressProxyPort)
+	if swarmConfig := strings.ToLower(os.Getenv("SHUFFLE_SWARM_CONFIG")); (swarmConfig == "run" || swarmConfig == "swarm") && getAppEgressPolicy("").restricted() {
+		log.Printf("[WARNING] Egress policies for app services in %s mode are only enforced through HTTP(S)_PROXY. Apps which connect directly aren't blocked.", swarmConfig)
+	}
+
+	srv := http.Server{
+		Handler:           http.HandlerFunc(handleEgressProxy),
+		ReadHeaderTimeout: 60 * time.Second,
+	}
+
+	go func() {
+		err := srv.Serve(listener)
+		if err != nil {
+			log.Printf("[ERROR] Egress proxy stopped: %s", err)
+		}
+	}()
+}
+
+// Returns the app and org from the proxy credentials
+func getEgressProxyApp(request *http.Request) (string, string, bool) {
+	authHeader := request.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(authHeader, "Basic ") {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(authHeader, "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return "", "", false
+	}
+
+	proxyUser, err := url.QueryUnescape(credentials[0])
+	if err != nil {
+		return "", "", false
+	}
+
+	if !hmac.Equal([]byte(credentials[1]), []byte(getEgressProxyToken(proxyUser))) {
+		return "", "", false
+	}
+
+	userParts := strings.SplitN(proxyUser, "~", 2)
+	if len(userParts) != 2 {
+		return "", "", false
+	}
+
+	return userParts[0], userParts[1], true
+}
+
+func handleEgressProxy(resp http.ResponseWriter, request *http.Request) {
+	appName, orgId, ok := getEgressProxyApp(request)
+	if !ok {
+		resp.Header().Set("Proxy-Authenticate", `Basic realm="shuffle"`)
+		resp.WriteHeader(407)
+		return
+	}
+
+	policy := getAppEgressPolicies(appName, orgId)
+
+	host := request.URL.Hostname()
+	port := request.URL.Port()
+	if request.Method == "CONNECT" {
+		host, port, _ = net.SplitHostPort(request.Host)
+	}
+
+	if len(port) == 0 {
+		port = "80"
+		if request.URL.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	address, err := policy.resolve(request.Context(), host, port)
+	if err != nil {
+		log.Printf("[AUDIT] Blocked egress from app %s (org %s) to %s:%s: %s", appName, orgId, host, port, err)
+		resp.WriteHeader(403)
+		resp.Write([]byte(fmt.Sprintf("Shuffle egress policy: %s", err)))
+		return
+	}
+
+	if request.Method == "CONNECT" {
+		destination, err := net.DialTimeout("tcp", address, 30*time.Second)
+		if err != nil {
+			resp.WriteHeader(502)
+			return
+		}
+
+		hijacker, ok := resp.(http.Hijacker)
+		if !ok {
+			destination.Close()
+			resp.WriteHeader(500)
+			return
+		}
+
+		source, _, err := hijacker.Hijack()
+		if err != nil {
+			destination.Close()
+			return
+		}
+
+		source.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(destination, source)
+			destination.Close()
+		}()
+
+		io.Copy(source, destination)
+		source.Close()
+		return
+	}
+
+	request.Header.Del("Proxy-Authorization")
+	request.Header.Del("Proxy-Connection")
+	request.RequestURI = ""
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			dialer := &net.Dialer{Timeout: 30 * time.Second}
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+
+	proxyResp, err := transport.RoundTrip(request)
+	if err != nil {
+		resp.WriteHeader(502)
+		return
+	}
+
+	defer proxyResp.Body.Close()
+	for key, values := range proxyResp.Header {
+		for _, value := range values {
+			resp.Header().Add(key, value)
+		}
+	}
+
+	resp.WriteHeader(proxyResp.StatusCode)
+	io.Copy(resp, proxyResp.Body)
+}
+
+// Puts the app on an internal network named after the app, where the only
+// way out is the egress proxy. Orborus' container owns the worker's network
+// namespace, so that is what gets connected to the network.
+func applyDockerEgressPolicy(ctx context.Context, cli *dockerclient.Client, config *container.Config, hostConfig *container.HostConfig, appName string, workflowExecution shuffle.WorkflowExecution) error {
+	networkName := fmt.Sprintf("shuffle-egress-%s", normalizeAppLimitName(appName))
+	_, err := cli.NetworkInspect(ctx, networkName, network.InspectOptions{})
+	if err != nil {
+		if !dockerclient.IsErrNotFound(err) {
+			return err
+		}
+
+		_, err = cli.NetworkCreate(ctx, networkName, network.CreateOptions{
+			Driver:   "bridge",
+			Internal: true,
+			Labels:   getEgressNetworkLabels(),
+		})
+		if err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+	}
+
+	owner := fmt.Sprintf("worker-%s", workflowExecution.ExecutionId)
+	workerContainer, err := cli.ContainerInspect(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	if workerContainer.HostConfig != nil && workerContainer.HostConfig.NetworkMode.IsContainer() {
+		owner = workerContainer.HostConfig.NetworkMode.ConnectedContainer()
+	}
+
+	err = cli.NetworkConnect(ctx, networkName, owner, nil)
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+
+	ownerContainer, err := cli.ContainerInspect(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	endpoint, ok := ownerContainer.NetworkSettings.Networks[networkName]
+	if !ok || len(endpoint.IPAddress) == 0 {
+		return fmt.Errorf("No IP found for %s in network %s", owner, networkName)
+	}
+
+	// The app no longer shares the worker's network namespace, so
+	// results are sent to the worker on its address in the egress network
+	proxyUrl := getEgressProxyUrl(appName, workflowExecution.ExecutionOrg, endpoint.IPAddress)
+	newEnv := []string{}
+	for _, envStr := range config.Env {
+		key := strings.ToUpper(strings.SplitN(envStr, "=", 2)[0])
+		if key == "HTTP_PROXY" || key == "HTTPS_PROXY" || key == "NO_PROXY" {
+			continue
+		}
+
+		if key == "BASE_URL" {
+			envStr = fmt.Sprintf("BASE_URL=http://%s:%s", endpoint.IPAddress, os.Getenv("WORKER_PORT"))
+		}
+
+		newEnv = append(newEnv, envStr)
+	}
+
+	config.Env = append(newEnv,
+		fmt.Sprintf("HTTP_PROXY=%s", proxyUrl),
+		fmt.Sprintf("HTTPS_PROXY=%s", proxyUrl),
+		fmt.Sprintf("http_proxy=%s", proxyUrl),
+		fmt.Sprintf("https_proxy=%s", proxyUrl),
+		fmt.Sprintf("NO_PROXY=%s", endpoint.IPAddress),
+		fmt.Sprintf("no_proxy=%s", endpoint.IPAddress),
+	)
+
+	hostConfig.NetworkMode = container.NetworkMode(networkName)
+	return nil
+}
+
+// NetworkPolicies can't use hostnames, so allowlisted hostnames are
+// resolved when the app is deployed. The egress proxy handles them by name.
+func getEgressPolicyPeers(policy appEgressPolicy) []networkingv1.NetworkPolicyPeer {
+	peers := []networkingv1.NetworkPolicyPeer{}
+	if policy.Mode == "internet_only" {
+		except := []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "127.0.0.0/8"}
+		except = append(except, nonInternetNetworks...)
+		return append(peers, networkingv1.NetworkPolicyPeer{
+			IPBlock: &networkingv1.IPBlock{
+				CIDR:   "0.0.0.0/0",
+				Except: except,
+			},
+		})
+	}
+
+	for _, allowed := range policy.Allow {
+		allowed = strings.TrimSpace(allowed)
+		cidrs := []string{}
+		if _, _, err := net.ParseCIDR(allowed); err == nil {
+			cidrs = append(cidrs, allowed)
+		} else if ip := net.ParseIP(allowed); ip != nil {
+			cidrs = append(cidrs, fmt.Sprintf("%s/32", ip.String()))
+		} else if !strings.HasPrefix(allowed, "*.") {
+			addresses, err := net.LookupIP(allowed)
+			if err != nil {
+				log.Printf("[WARNING] Failed resolving %s for the app network policy: %s", allowed, err)
+				continue
+			}
+
+			for _, address := range addresses {
+				if address.To4() != nil {
+					cidrs = append(cidrs, fmt.Sprintf("%s/32", address.String()))
+				} else {
+					cidrs = append(cidrs, fmt.Sprintf("%s/128", address.String()))
+				}
+			}
+		}
+
+		for _, cidr := range cidrs {
+			peers = append(peers, networkingv1.NetworkPolicyPeer{
+				IPBlock: &networkingv1.IPBlock{
+					CIDR: cidr,
+				},
+			})
+		}
+	}
+
+	return peers
+}
+
+// Apps can always reach DNS and the workers. Anything else comes from the policy.
+func deployAppNetworkPolicy(ctx context.Context, clientset *kubernetes.Clientset, name string, matchLabels map[string]string, labels map[string]string, policy appEgressPolicy) error {
+	if !policy.restricted() {
+		err := clientset.NetworkingV1().NetworkPolicies(kubernetesNamespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if err != nil && !strings.Contains(strings.ToLower(err.Error()), "not found") {
+			return err
+		}
+
+		return nil
+	}
+
+	udp := corev1.ProtocolUDP
+	tcp := corev1.ProtocolTCP
+	dnsPort := intstr.FromInt(53)
+
+	egressRules := []networkingv1.NetworkPolicyEgressRule{
+		networkingv1.NetworkPolicyEgressRule{
+			Ports: []networkingv1.NetworkPolicyPort{
+				networkingv1.NetworkPolicyPort{Protocol: &udp, Port: &dnsPort},
+				networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &dnsPort},
+			},
+		},
+		networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{
+				networkingv1.NetworkPolicyPeer{
+					PodSelector: &metav1.LabelSelector{
+						MatchLabels: map[string]string{
+							"app.kubernetes.io/name": "shuffle-worker",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	peers := getEgressPolicyPeers(policy)
+	if len(peers) > 0 {
+		egressRules = append(egressRules, networkingv1.NetworkPolicyEgressRule{
+			To: peers,
+		})
+	}
+
+	networkPolicy := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{
+				MatchLabels: matchLabels,
+			},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egressRules,
+		},
+	}
+
+	existingPolicy, err := clientset.NetworkingV1().NetworkPolicies(kubernetesNamespace).Get(ctx, name, metav1.GetOptions{})
+	if err == nil {
+		existingPolicy.Spec = networkPolicy.Spec
+		_, err = clientset.NetworkingV1().NetworkPolicies(kubernetesNamespace).Update(ctx, existingPolicy, metav1.UpdateOptions{})
+		return err
+	}
+
+	_, err = clientset.NetworkingV1().NetworkPolicies(kubernetesNamespace).Create(ctx, networkPolicy, metav1.CreateOptions{})
+	return err
+}
+
+// Action results for apps killed by their resource limits use this in the result body.
+// The action status itself is FAILURE, so the workflow stops the same way as for any failed action.
+var appLimitExceededStatus = "LIMIT_EXCEEDED"
+
+// CPU in cores, memory in bytes and timeout in seconds
+type appResourceLimits struct {
+	CPU     float64
+	Memory  int64
+	Pids    int64
+	Timeout int
+}
+
+// Format of SHUFFLE_APP_RESOURCE_LIMITS, keyed by "appname" or "appname:version":
+// {"shuffle-tools:1.2.0": {"cpu": "0.5", "memory": "512m", "pids": "256", "timeout": "300"}}
+type appResourceLimitsConfig struct {
+	CPU     string `json:"cpu"`
+	Memory  string `json:"memory"`
+	Pids    string `json:"pids"`
+	Timeout string `json:"timeout"`
+}
+
+func normalizeAppLimitName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Replace(name, " ", "-", -1)
+	return strings.Replace(name, "_", "-", -1)
+}
+
+// Parses limits in the Docker CLI format. Empty or invalid values keep the current value.
+func (l *appResourceLimits) apply(config appResourceLimitsConfig) {
+	if len(config.CPU) > 0 {
+		parsedCpu, err := strconv.ParseFloat(config.CPU, 64)
+		if err != nil || parsedCpu < 0 {
+			log.Printf("[WARNING] Invalid app CPU limit '%s'. Should be a number of cores, e.g. 0.5", config.CPU)
+		} else {
+			l.CPU = parsedCpu
+		}
+	}
+
+	if len(config.Memory) > 0 {
+		parsedMemory, err := units.RAMInBytes(config.Memory)
+		if err != nil || parsedMemory < 0 {
+			log.Printf("[WARNING] Invalid app memory limit '%s'. Should be e.g. 512m or 1g", config.Memory)
+		} else {
+			l.Memory = parsedMemory
+		}
+	}
+
+	if len(config.Pids) > 0 {
+		parsedPids, err := strconv.ParseInt(config.Pids, 10, 64)
+		if err != nil || parsedPids < 0 {
+			log.Printf("[WARNING] Invalid app pids limit '%s'", config.Pids)
+		} else {
+			l.Pids = parsedPids
+		}
+	}
+
+	if len(config.Timeout) > 0 {
+		parsedTimeout, err := strconv.Atoi(config.Timeout)
+		if err != nil || parsedTimeout < 0 {
+			log.Printf("[WARNING] Invalid app timeout limit '%s'. Should be in seconds", config.Timeout)
+		} else {
+			l.Timeout = parsedTimeout
+		}
+	}
+}
+
+// Environment wide limits come from SHUFFLE_APP_*_LIMIT, set on Orborus for the environment.
+// SHUFFLE_APP_RESOURCE_LIMITS overrides them per app, then per app version.
+func getAppResourceLimits(appName, appVersion string) appResourceLimits {
+	limits := appResourceLimits{}
+	limits.apply(appResourceLimitsConfig{
+		CPU:     os.Getenv("SHUFFLE_APP_CPU_LIMIT"),
+		Memory:  os.Getenv("SHUFFLE_APP_MEMORY_LIMIT"),
+		Pids:    os.Getenv("SHUFFLE_APP_PIDS_LIMIT"),
+		Timeout: os.Getenv("SHUFFLE_APP_TIMEOUT_LIMIT"),
+	})
+
+	if len(os.Getenv("SHUFFLE_APP_RESOURCE_LIMITS")) == 0 {
+		return limits
+	}
+
+	appLimits := map[string]appResourceLimitsConfig{}
+	err := json.Unmarshal([]byte(os.Getenv("SHUFFLE_APP_RESOURCE_LIMITS")), &appLimits)
+	if err != nil {
+		log.Printf("[WARNING] Failed parsing SHUFFLE_APP_RESOURCE_LIMITS: %s", err)
+		return limits
+	}
+
+	normalizedLimits := map[string]appResourceLimitsConfig{}
+	for key, value := range appLimits {
+		keySplit := strings.SplitN(key, ":", 2)
+		normalizedKey := normalizeAppLimitName(keySplit[0])
+		if len(keySplit) > 1 {
+			normalizedKey = fmt.Sprintf("%s:%s", normalizedKey, strings.Replace(strings.TrimSpace(keySplit[1]), "-", ".", -1))
+		}
+
+		normalizedLimits[normalizedKey] = value
+	}
+
+	appName = normalizeAppLimitName(appName)
+	if config, ok := normalizedLimits[appName]; ok {
+		limits.apply(config)
+	}
+
+	if config, ok := normalizedLimits[fmt.Sprintf("%s:%s", appName, strings.Replace(appVersion, "-", ".", -1))]; ok {
+		limits.apply(config)
+	}
+
+	return limits
+}
+
+// Labels set on everything Shuffle deploys, so Orborus can find and clean it up.
+// They're defined in Orborus, and passed to the worker as SHUFFLE_LABEL_KEYS.
+// Without them (e.g. an older Orborus) nothing is labelled, and apps are
+// found by their Kubernetes name label and service name like before.
+var shuffleLabelKeys = getShuffleLabelKeys()
+var shuffleComponentLabel = shuffleLabelKeys["component"]
+var shuffleExecutionLabel = shuffleLabelKeys["execution"]
+var shuffleOrgLabel = shuffleLabelKeys["org"]
+var shuffleEnvironmentLabel = shuffleLabelKeys["environment"]
+var shuffleAppNameLabel = shuffleLabelKeys["app_name"]
+var shuffleAppVersionLabel = shuffleLabelKeys["app_version"]
+var shuffleOrborusLabel = shuffleLabelKeys["orborus"]
+
+func getShuffleLabelKeys() map[string]string {
+	labelKeys := map[string]string{}
+	if len(os.Getenv("SHUFFLE_LABEL_KEYS")) == 0 {
+		return labelKeys
+	}
+
+	err := json.Unmarshal([]byte(os.Getenv("SHUFFLE_LABEL_KEYS")), &labelKeys)
+	if err != nil {
+		log.Printf("[WARNING] Failed parsing SHUFFLE_LABEL_KEYS: %s", err)
+		return map[string]string{}
+	}
+
+	for _, key := range []string{"component", "execution", "org", "environment", "app_name", "app_version", "orborus"} {
+		if len(labelKeys[key]) == 0 {
+			log.Printf("[WARNING] SHUFFLE_LABEL_KEYS is missing the '%s' label. Not labelling apps.", key)
+			return map[string]string{}
+		}
+	}
+
+	return labelKeys
+}
+
+func hasShuffleLabels() bool {
+	return len(shuffleComponentLabel) > 0
+}
+
+// Label values are limited to 63 alphanumeric characters, '-', '_' and '.' in Kubernetes
+func getLabelValue(value string) string {
+	parsedValue := []rune{}
+	for _, char := range value {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '-' || char == '_' || char == '.' {
+			parsedValue = append(parsedValue, char)
+		} else {
+			parsedValue = append(parsedValue, '-')
+		}
+	}
+
+	if len(parsedValue) > 63 {
+		parsedValue = parsedValue[:63]
+	}
+
+	return strings.Trim(string(parsedValue), "-_.")
+}
+
+// Apps in swarm and kubernetes are shared between executions, so they
+// only get execution and org labels when deployed for a single execution
+func getAppLabels(appName, appVersion, executionId, orgId string) map[string]string {
+	if !hasShuffleLabels() {
+		return map[string]string{}
+	}
+
+	labels := map[string]string{
+		shuffleComponentLabel:   "app",
+		shuffleEnvironmentLabel: getLabelValue(os.Getenv("ENVIRONMENT_NAME")),
+		shuffleOrborusLabel:     getLabelValue(os.Getenv("SHUFFLE_ORBORUS_UUID")),
+		shuffleAppNameLabel:     getLabelValue(appName),
+		shuffleAppVersionLabel:  getLabelValue(appVersion),
+	}
+
+	if len(executionId) > 0 {
+		labels[shuffleExecutionLabel] = getLabelValue(executionId)
+	}
+
+	if len(orgId) == 0 {
+		orgId = os.Getenv("ORG")
+	}
+
+	if len(orgId) > 0 {
+		labels[shuffleOrgLabel] = getLabelValue(orgId)
+	}
+
+	return labels
+}
+
+func getEgressNetworkLabels() map[string]string {
+	if !hasShuffleLabels() {
+		return map[string]string{}
+	}
+
+	return map[string]string{
+		shuffleComponentLabel:   "egress",
+		shuffleEnvironmentLabel: getLabelValue(os.Getenv("ENVIRONMENT_NAME")),
+	}
+}
+
+// Without labels this matches every service, and the workers are skipped by name
+func getAppLabelFilters() filters.Args {
+	filterArgs := filters.NewArgs()
+	if hasShuffleLabels() {
+		filterArgs.Add("label", fmt.Sprintf("%s=app", shuffleComponentLabel))
+	}
+
+	return filterArgs
+}
+
+func getAppLabelSelector() string {
+	if hasShuffleLabels() {
+		return fmt.Sprintf("%s=app", shuffleComponentLabel)
+	}
+
+	return "app.kubernetes.io/name=shuffle-app"
+}
+
+// Images are tagged as <name>_<version>, e.g. frikky/shuffle:shuffle-tools_1.2.0
+func getImageAppName(image string) (string, string) {
+	tag := image
+	if strings.Contains(tag, ":") {
+		tag = tag[strings.LastIndex(tag, ":")+1:]
+	}
+
+	appName := tag
+	appVersion := ""
+	if strings.Contains(tag, "_") {
+		appName = tag[:strings.LastIndex(tag, "_")]
+		appVersion = tag[strings.LastIndex(tag, "_")+1:]
+	}
+
+	return appName, appVersion
+}
+
+func getImageResourceLimits(image string) appResourceLimits {
+	return getAppResourceLimits(getImageAppName(image))
+}
+
+func (l appResourceLimits) docker() container.Resources {
+	resources := container.Resources{
+		NanoCPUs: int64(l.CPU * 1e9),
+		Memory:   l.Memory,
+	}
+
+	if l.Pids > 0 {
+		pids := l.Pids
+		resources.PidsLimit = &pids
+	}
+
+	return resources
+}
+
+func (l appResourceLimits) swarm() *swarm.ResourceRequirements {
+	return &swarm.ResourceRequirements{
+		Reservations: &swarm.Resources{},
+		Limits: &swarm.Limit{
+			NanoCPUs:    int64(l.CPU * 1e9),
+			MemoryBytes: l.Memory,
+			Pids:        l.Pids,
+		},
+	}
+}
+
+// Pids can't be limited per pod in Kubernetes. That is the kubelet's podPidsLimit.
+func (l appResourceLimits) kubernetes() corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{}
+	if l.CPU <= 0 && l.Memory <= 0 {
+		return requirements
+	}
+
+	requirements.Limits = corev1.ResourceList{}
+	if l.CPU > 0 {
+		requirements.Limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(l.CPU*1000), resource.DecimalSI)
+	}
+
+	if l.Memory > 0 {
+		requirements.Limits[corev1.ResourceMemory] = *resource.NewQuantity(l.Memory, resource.BinarySI)
+	}
+
+	return requirements
+}
+
+func sendLimitExceededResult(workflowExecution shuffle.WorkflowExecution, action shuffle.Action, limit, reason string) {
+	log.Printf("[WARNING][%s] Action %s (%s) hit its %s limit: %s", workflowExecution.ExecutionId, action.ID, action.AppName, limit, reason)
+
+	result, err := json.Marshal(map[string]interface{}{
+		"success": false,
+		"status":  appLimitExceededStatus,
+		"limit":   limit,
+		"reason":  reason,
+	})
 	if err != nil {
-		log.Printf("[ERROR] Failed creating service: %v", err)
-		return err
+		log.Printf("[ERROR] Failed marshalling limit result: %s", err)
+		return
 	}
 
-	return nil
+	sendSelfRequest(shuffle.ActionResult{
+		Action:        action,
+		ExecutionId:   workflowExecution.ExecutionId,
+		Authorization: workflowExecution.Authorization,
+		Result:        string(result),
+		StartedAt:     int64(time.Now().Unix()),
+		CompletedAt:   int64(time.Now().Unix()),
+		Status:        "FAILURE",
+	})
 }
 
-//** ENDREMOVE ***/
+// Kills the app container if it runs past its timeout, and reports
+// OOM kills from the memory limit. Docker only.
+func watchAppLimits(cli *dockerclient.Client, containerId string, since time.Time, workflowExecution shuffle.WorkflowExecution, action shuffle.Action, limits appResourceLimits) {
+	if limits.Memory <= 0 && limits.Timeout <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventFilter := filters.NewArgs()
+	eventFilter.Add("type", string(events.ContainerEventType))
+	eventFilter.Add("container", containerId)
+	eventFilter.Add("event", string(events.ActionOOM))
+	eventFilter.Add("event", string(events.ActionDie))
+
+	// Since makes sure events that happened before we started listening are included
+	messages, errs := cli.Events(ctx, events.ListOptions{
+		Since:   strconv.FormatInt(since.Unix(), 10),
+		Filters: eventFilter,
+	})
+
+	var timeout <-chan time.Time
+	if limits.Timeout > 0 {
+		timer := time.NewTimer(time.Duration(limits.Timeout) * time.Second)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	oomKilled := false
+	for {
+		select {
+		case message := <-messages:
+			if message.Action == events.ActionOOM {
+				oomKilled = true
+				continue
+			}
+
+			if oomKilled {
+				sendLimitExceededResult(workflowExecution, action, "memory", fmt.Sprintf("App was killed after reaching its memory limit of %s", units.BytesSize(float64(limits.Memory))))
+			}
+
+			return
+		case err := <-errs:
+			if err != nil && ctx.Err() == nil {
+				log.Printf("[WARNING][%s] Stopped watching limits for container %s: %s", workflowExecution.ExecutionId, containerId, err)
+			}
+
+			return
+		case <-timeout:
+			err := cli.ContainerKill(context.Background(), containerId, "SIGKILL")
+			if err != nil {
+				if !dockerclient.IsErrNotFound(err) && !strings.Contains(err.Error(), "is not running") {
+					log.Printf("[ERROR][%s] Failed killing container %s after timeout: %s", workflowExecution.ExecutionId, containerId, err)
+				}
+
+				return
+			}
+
+			sendLimitExceededResult(workflowExecution, action, "timeout", fmt.Sprintf("App was stopped after running for longer than its time limit of %d seconds", limits.Timeout))
+			return
+		}
+	}
+}
 
 // Deploys the internal worker whenever something happens
 func deployApp(cli *dockerclient.Client, image string, identifier string, env []string, workflowExecution shuffle.WorkflowExecution, action shuffle.Action) error {
@@ -905,10 +2244,7 @@ func deployApp(cli *dockerclient.Client, image string, identifier string, env []
 	}
 	/*** ENDREMOVE ***/
 
-	// Max 10% CPU every second
-	//CPUShares: 128,
-	//CPUQuota:  10000,
-	//CPUPeriod: 100000,
+	limits := getAppResourceLimits(action.AppName, action.AppVersion)
 	hostConfig := &container.HostConfig{
 		LogConfig: container.LogConfig{
 			Type: "json-file",
@@ -916,7 +2252,7 @@ func deployApp(cli *dockerclient.Client, image string, identifier string, env []
 				"max-size": "10m",
 			},
 		},
-		Resources: container.Resources{},
+		Resources: limits.docker(),
 	}
 
 	if os.Getenv("SHUFFLE_SWARM_CONFIG") != "run" && os.Getenv("SHUFFLE_SWARM_CONFIG") != "swarm" {
@@ -991,8 +2327,26 @@ func deployApp(cli *dockerclient.Client, image string, identifier string, env []
 	}
 
 	config := &container.Config{
-		Image: image,
-		Env:   env,
+		Image:  image,
+		Env:    env,
+		Labels: getAppLabels(action.AppName, action.AppVersion, workflowExecution.ExecutionId, workflowExecution.ExecutionOrg),
+	}
+
+	if hardenedMode {
+		err := applyHardenedDockerConfig(config, hostConfig)
+		if err != nil {
+			log.Printf("[ERROR][%s] Failed applying hardened config to app %s: %s", workflowExecution.ExecutionId, action.AppName, err)
+			return err
+		}
+	}
+
+	refreshOrgEgressPolicies(workflowExecution)
+	if getAppEgressPolicies(action.AppName, workflowExecution.ExecutionOrg).restricted() {
+		err := applyDockerEgressPolicy(ctx, cli, config, hostConfig, action.AppName, workflowExecution)
+		if err != nil {
+			log.Printf("[ERROR][%s] Failed applying egress policy to app %s: %s", workflowExecution.ExecutionId, action.AppName, err)
+			return err
+		}
 	}
 
 	//log.Printf("[DEBUG] Deploying image with env: %#v", env)
@@ -1018,11 +2372,11 @@ func deployApp(cli *dockerclient.Client, image string, identifier string, env []
 		waitTime := time.Duration(action.ExecutionDelay) * time.Second
 
 		time.AfterFunc(waitTime, func() {
-			DeployContainer(ctx, cli, config, hostConfig, identifier, workflowExecution, newExecId)
+			DeployContainer(ctx, cli, config, hostConfig, identifier, workflowExecution, newExecId, action, limits)
 		})
 	} else {
 		log.Printf("[DEBUG][%s] Running app %s in docker NORMALLY as there is no delay set with identifier %s", workflowExecution.ExecutionId, action.Name, identifier)
-		returnvalue := DeployContainer(ctx, cli, config, hostConfig, identifier, workflowExecution, newExecId)
+		returnvalue := DeployContainer(ctx, cli, config, hostConfig, identifier, workflowExecution, newExecId, action, limits)
 		//log.Printf("[DEBUG][%s] Normal deploy ret: %s", workflowExecution.ExecutionId, returnvalue)
 		return returnvalue
 	}
@@ -1032,8 +2386,13 @@ func deployApp(cli *dockerclient.Client, image string, identifier string, env []
 
 func cleanupKubernetesExecution(clientset *kubernetes.Clientset, workflowExecution shuffle.WorkflowExecution, namespace string) error {
 	// workerName := fmt.Sprintf("worker-%s", workflowExecution.ExecutionId)
-	// FIXME: The executionId label is currently not set
-	labelSelector := fmt.Sprintf("app.kubernetes.io/name=shuffle-app,executionId=%s", workflowExecution.ExecutionId)
+	// Apps are shared between executions, so this only finds execution specific pods.
+	// Anything left behind is removed by the zombie check in Orborus.
+	if !hasShuffleLabels() {
+		return nil
+	}
+
+	labelSelector := fmt.Sprintf("%s=app,%s=%s", shuffleComponentLabel, shuffleExecutionLabel, getLabelValue(workflowExecution.ExecutionId))
 
 	podList, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
 		LabelSelector: labelSelector,
@@ -1045,7 +2404,8 @@ func cleanupKubernetesExecution(clientset *kubernetes.Clientset, workflowExecuti
 	for _, pod := range podList.Items {
 		err := clientset.CoreV1().Pods(namespace).Delete(context.TODO(), pod.Name, metav1.DeleteOptions{})
 		if err != nil {
-			return fmt.Errorf("failed to delete app %s: %v", pod.Name, err)
+			log.Printf("[WARNING] Failed to delete app %s: %v", pod.Name, err)
+			continue
 		}
 		log.Printf("App %s in namespace %s deleted.", pod.Name, namespace)
 	}
@@ -1058,7 +2418,7 @@ func cleanupKubernetesExecution(clientset *kubernetes.Clientset, workflowExecuti
 	return nil
 }
 
-func DeployContainer(ctx context.Context, cli *dockerclient.Client, config *container.Config, hostConfig *container.HostConfig, identifier string, workflowExecution shuffle.WorkflowExecution, actionExecId string) error {
+func DeployContainer(ctx context.Context, cli *dockerclient.Client, config *container.Config, hostConfig *container.HostConfig, identifier string, workflowExecution shuffle.WorkflowExecution, actionExecId string, action shuffle.Action, limits appResourceLimits) error {
 	cont, err := cli.ContainerCreate(
 		ctx,
 		config,
@@ -1111,6 +2471,7 @@ func DeployContainer(ctx context.Context, cli *dockerclient.Client, config *cont
 		}
 	}
 
+	startTime := time.Now()
 	err = cli.ContainerStart(ctx, cont.ID, container.StartOptions{})
 	if err != nil {
 		if strings.Contains(fmt.Sprintf("%s", err), "cannot join network") || strings.Contains(fmt.Sprintf("%s", err), "No such container") {
@@ -1121,14 +2482,17 @@ func DeployContainer(ctx context.Context, cli *dockerclient.Client, config *cont
 			parsedUuid := uuid.NewV4()
 			identifier = fmt.Sprintf("%s-%s-nonetwork", identifier, parsedUuid)
 
-			hostConfig.NetworkMode = container.NetworkMode("")
+			// Apps with an egress policy never fall back to an unrestricted network
+			if !strings.HasPrefix(string(hostConfig.NetworkMode), "shuffle-egress-") {
+				hostConfig.NetworkMode = container.NetworkMode("")
+			}
+
 			hostConfig.LogConfig = container.LogConfig{
 				Type: "json-file",
 				Config: map[string]string{
 					"max-size": "10m",
 				},
 			}
-			hostConfig.Resources = container.Resources{}
 
 			cont, err = cli.ContainerCreate(
 				context.Background(),
@@ -1168,6 +2532,7 @@ func DeployContainer(ctx context.Context, cli *dockerclient.Client, config *cont
 	}
 
 	log.Printf("[DEBUG][%s] Container %s was created for %s", workflowExecution.ExecutionId, cont.ID, identifier)
+	go watchAppLimits(cli, cont.ID, startTime, workflowExecution, action, limits)
 
 	// Waiting to see if it exits.. Stupid, but stable(r)
 	if workflowExecution.ExecutionSource != "default" {
@@ -1238,48 +2603,31 @@ func removeIndex(s []string, i int) []string {
 	return s[:len(s)-1]
 }
 
-func getWorkerURLs() ([]string, error) {
-	workerUrls := []string{}
+// Returns worker URLs keyed by the pod or task they belong to
+func getWorkerURLs() (map[string]string, error) {
+	workerUrls := map[string]string{}
 
 	if isKubernetes == "true" {
-		workerUrls = append(workerUrls, "http://shuffle-workers:33333")
-		// workerUrls = append(workerUrls, "http://192.168.29.16:33333")
-
-		// get service "shuffle-workers" "Endpoints"
-		// serviceName := "shuffle-workers"
-		// clientset, _, err := shuffle.GetKubernetesClient()
-		// if err != nil {
-		// 	log.Println("[ERROR] Failed to get Kubernetes client:", err)
-		// 	return workerUrls, err
-		// }
-
-		// services, err := clientset.CoreV1().Services("default").List(context.Background(), metav1.ListOptions{})
-		// if err != nil {
-		// 	log.Println("[ERROR] Failed to list services:", err)
-		// 	return workerUrls, err
-		// }
-
-		// for _, service := range services.Items {
-		// 	if service.Name == serviceName {
-		// 		endpoints, err := clientset.CoreV1().Endpoints("default").Get(context.Background(), serviceName, metav1.GetOptions{})
-		// 		if err != nil {
-		// 			log.Println("[ERROR] Failed to get endpoints for service:", err)
-		// 			return workerUrls, err
-		// 		}
-
-		// 		for _, subset := range endpoints.Subsets {
-		// 			for _, address := range subset.Addresses {
-		// 				for _, port := range subset.Ports {
-		// 					url := fmt.Sprintf("http://%s:%d", address.IP, port.Port)
-		// 					workerUrls = append(workerUrls, url)
-		// 				}
-		// 			}
-		// 		}
-		// 	}
-		// }
+		workerUrlCacheLock.Lock()
+		if time.Since(workerUrlCacheUpdated) < workerUrlCacheTTL && len(workerUrlCache) > 0 {
+			workerUrls := workerUrlCache
+			workerUrlCacheLock.Unlock()
+			return workerUrls, nil
+		}
+		workerUrlCacheLock.Unlock()
 
-		log.Printf("[DEBUG] Worker URLs for k8s: %#v", workerUrls)
+		workerUrls, err := getKubernetesWorkerURLs()
+		if err != nil || len(workerUrls) == 0 {
+			log.Printf("[WARNING] Failed discovering worker pods. Using the worker service instead: %s", err)
+			return map[string]string{"shuffle-workers": "http://shuffle-workers:33333"}, err
+		}
+
+		workerUrlCacheLock.Lock()
+		workerUrlCache = workerUrls
+		workerUrlCacheUpdated = time.Now()
+		workerUrlCacheLock.Unlock()
 
+		log.Printf("[DEBUG] Worker URLs for k8s: %#v", workerUrls)
 		return workerUrls, nil
 	}
 
@@ -1308,7 +2656,87 @@ func getWorkerURLs() ([]string, error) {
 	// Print task information
 	for _, task := range tasks {
 		url := fmt.Sprintf("http://%s.%d.%s:33333", serviceName, task.Slot, task.ID)
-		workerUrls = append(workerUrls, url)
+		workerUrls[task.ID] = url
+	}
+
+	return workerUrls, nil
+}
+
+// Finds every ready worker pod behind the shuffle-workers service, as the
+// service itself only reaches one random pod. Uses EndpointSlices, and
+// falls back to Endpoints for clusters without them.
+func getKubernetesWorkerURLs() (map[string]string, error) {
+	workerUrls := map[string]string{}
+	serviceName := "shuffle-workers"
+
+	namespace := kubernetesNamespace
+	if len(namespace) == 0 {
+		namespace = "default"
+	}
+
+	clientset, _, err := shuffle.GetKubernetesClient()
+	if err != nil {
+		return workerUrls, err
+	}
+
+	ctx := context.Background()
+	endpointSlices, err := clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", discoveryv1.LabelServiceName, serviceName),
+	})
+	if err == nil {
+		for _, slice := range endpointSlices.Items {
+			port := int32(33333)
+			for _, slicePort := range slice.Ports {
+				if slicePort.Port != nil && (*slicePort.Port == 33333 || (slicePort.Name != nil && *slicePort.Name == "worker")) {
+					port = *slicePort.Port
+					break
+				}
+			}
+
+			for _, endpoint := range slice.Endpoints {
+				if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+					continue
+				}
+
+				if len(endpoint.Addresses) == 0 {
+					continue
+				}
+
+				identifier := endpoint.Addresses[0]
+				if endpoint.TargetRef != nil && len(endpoint.TargetRef.Name) > 0 {
+					identifier = endpoint.TargetRef.Name
+				}
+
+				workerUrls[identifier] = fmt.Sprintf("http://%s", net.JoinHostPort(endpoint.Addresses[0], strconv.Itoa(int(port))))
+			}
+		}
+
+		return workerUrls, nil
+	}
+
+	log.Printf("[WARNING] Failed listing EndpointSlices for %s in namespace %s: %s. Trying Endpoints.", serviceName, namespace, err)
+	endpoints, err := clientset.CoreV1().Endpoints(namespace).Get(ctx, serviceName, metav1.GetOptions{})
+	if err != nil {
+		return workerUrls, err
+	}
+
+	for _, subset := range endpoints.Subsets {
+		port := int32(33333)
+		for _, subsetPort := range subset.Ports {
+			if subsetPort.Port == 33333 || subsetPort.Name == "worker" {
+				port = subsetPort.Port
+				break
+			}
+		}
+
+		for _, address := range subset.Addresses {
+			identifier := address.IP
+			if address.TargetRef != nil && len(address.TargetRef.Name) > 0 {
+				identifier = address.TargetRef.Name
+			}
+
+			workerUrls[identifier] = fmt.Sprintf("http://%s", net.JoinHostPort(address.IP, strconv.Itoa(int(port))))
+		}
 	}
 
 	return workerUrls, nil
@@ -1326,7 +2754,11 @@ func askOtherWorkersToDownloadImage(image string) {
 		return
 	}
 
-	if shuffle.ArrayContains(imagesDistributed, image) {
+	// Every worker had it the last time, and new ones are only looked for after the TTL
+	imagesDistributedLock.Lock()
+	distributedAt, ok := imagesDistributedAt[image]
+	imagesDistributedLock.Unlock()
+	if ok && time.Since(distributedAt) < workerUrlCacheTTL {
 		return
 	}
 
@@ -1340,9 +2772,17 @@ func askOtherWorkersToDownloadImage(image string) {
 		return
 	}
 
+	// New workers show up when scaling, so only the ones without the image are asked
+	imagesDistributedLock.Lock()
+	confirmed := imagesDistributed[image]
+	imagesDistributedLock.Unlock()
+
 	httpClient := &http.Client{}
-	distributed := false
-	for _, url := range urls {
+	for identifier, url := range urls {
+		if shuffle.ArrayContains(confirmed, identifier) {
+			continue
+		}
+
 		//log.Printf("[DEBUG] Trying to speak to: %s", url)
 		imagesRequest := ImageRequest{
 			Image: image,
@@ -1369,20 +2809,39 @@ func askOtherWorkersToDownloadImage(image string) {
 			continue
 		}
 
-		defer resp.Body.Close()
 		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
 		if err != nil {
 			log.Printf("[ERROR] Error in reading response body : %s", err)
 			continue
 		}
 
-		log.Printf("[INFO] Response body when tried sending images for nodes to download: %s", respBody)
-		distributed = true
+		log.Printf("[INFO] Response body when tried sending images for %s to download: %s", identifier, respBody)
+		if resp.StatusCode != 200 {
+			continue
+		}
+
+		imagesDistributedLock.Lock()
+		if !shuffle.ArrayContains(imagesDistributed[image], identifier) {
+			imagesDistributed[image] = append(imagesDistributed[image], identifier)
+		}
+		imagesDistributedLock.Unlock()
+	}
+
+	// Forget workers that are gone
+	imagesDistributedLock.Lock()
+	existing := []string{}
+	for _, identifier := range imagesDistributed[image] {
+		if _, ok := urls[identifier]; ok {
+			existing = append(existing, identifier)
+		}
 	}
 
-	if distributed {
-		imagesDistributed = append(imagesDistributed, image)
+	imagesDistributed[image] = existing
+	if len(existing) == len(urls) {
+		imagesDistributedAt[image] = time.Now()
 	}
+	imagesDistributedLock.Unlock()
 }
 
 func handleExecutionResult(workflowExecution shuffle.WorkflowExecution) {
@@ -3171,11 +4630,12 @@ func deploySwarmService(dockercli *dockerclient.Client, name, image string, depl
 	replicatedJobs := uint64(replicas * nodeCount)
 	log.Printf("[DEBUG] Deploying app with name %s with image %s", name, image)
 
+	appName, appVersion := getImageAppName(image)
 	containerName := fmt.Sprintf(strings.Replace(name, ".", "-", -1))
 	serviceSpec := swarm.ServiceSpec{
 		Annotations: swarm.Annotations{
 			Name:   containerName,
-			Labels: map[string]string{},
+			Labels: getAppLabels(appName, appVersion, "", ""),
 		},
 		Mode: swarm.ServiceMode{
 			Replicated: &swarm.ReplicatedService{
@@ -3200,9 +4660,7 @@ func deploySwarmService(dockercli *dockerclient.Client, name, image string, depl
 			},
 		},
 		TaskTemplate: swarm.TaskSpec{
-			Resources: &swarm.ResourceRequirements{
-				Reservations: &swarm.Resources{},
-			},
+			Resources: getImageResourceLimits(image).swarm(),
 			LogDriver: &swarm.Driver{
 				Name: "json-file",
 				Options: map[string]string{
@@ -3210,7 +4668,8 @@ func deploySwarmService(dockercli *dockerclient.Client, name, image string, depl
 				},
 			},
 			ContainerSpec: &swarm.ContainerSpec{
-				Image: image,
+				Image:  image,
+				Labels: getAppLabels(appName, appVersion, "", ""),
 				Env: []string{
 					fmt.Sprintf("SHUFFLE_APP_EXPOSED_PORT=%d", deployport),
 					fmt.Sprintf("SHUFFLE_SWARM_CONFIG=%s", os.Getenv("SHUFFLE_SWARM_CONFIG")),
@@ -3278,6 +4737,14 @@ func deploySwarmService(dockercli *dockerclient.Client, name, image string, depl
 
 	serviceSpec.TaskTemplate.ContainerSpec.Env = append(serviceSpec.TaskTemplate.ContainerSpec.Env, fmt.Sprintf("TZ=%s", timezone))
 
+	if hardenedMode {
+		err = applyHardenedSwarmConfig(serviceSpec.TaskTemplate.ContainerSpec)
+		if err != nil {
+			log.Printf("[ERROR] Failed applying hardened config to service %s: %s", name, err)
+			return err
+		}
+	}
+
 	serviceOptions := types.ServiceCreateOptions{}
 	service, err := dockercli.ServiceCreate(
 		context.Background(),
@@ -3529,6 +4996,17 @@ func sendAppRequest(ctx context.Context, incomingUrl, appName string, port int,
 		parsedRequest.FullExecution = *exec
 	}
 
+	// Apps with an egress policy go through the worker's egress proxy. The
+	// app services are shared, so this is per request, and only holds for
+	// clients which use the proxy (see appEgressPolicy).
+	refreshOrgEgressPolicies(*workflowExecution)
+	if egressProxyPort > 0 && getAppEgressPolicies(action.AppName, workflowExecution.ExecutionOrg).restricted() {
+		proxyUrl := getEgressProxyUrl(action.AppName, workflowExecution.ExecutionOrg, getLocalIP())
+		parsedRequest.HTTPProxy = proxyUrl
+		parsedRequest.HTTPSProxy = proxyUrl
+		parsedRequest.ShufflePassProxyToApp = "true"
+	}
+
 	data, err := json.Marshal(parsedRequest)
 	if err != nil {
 		log.Printf("[ERROR] Failed marshalling worker request: %s", err)
@@ -3577,11 +5055,24 @@ func sendAppRequest(ctx context.Context, incomingUrl, appName string, port int,
 		}
 	}
 
+	// The app services are shared, so a request past its time limit can't
+	// be stopped. The app may still send its result, which is used as
+	// normal. LIMIT_EXCEEDED is only reported by watchAppLimits, after the
+	// container is actually killed.
+	limits := getAppResourceLimits(action.AppName, action.AppVersion)
+	if limits.Timeout > 0 {
+		client.Timeout = time.Duration(limits.Timeout) * time.Second
+	}
+
 	newresp, err := client.Do(req)
 	if err != nil {
 		// Another timeout issue here somewhere
 		// context deadline
 		if strings.Contains(fmt.Sprintf("%s", err), "context deadline exceeded") || strings.Contains(fmt.Sprintf("%s", err), "Client.Timeout exceeded") {
+			if limits.Timeout > 0 {
+				log.Printf("[WARNING][%s] Action %s (%s) is still running after its time limit of %d seconds. Waiting for the app to send its result.", workflowExecution.ExecutionId, action.ID, action.AppName, limits.Timeout)
+			}
+
 			return nil
 		}
 
@@ -4063,6 +5554,10 @@ func main() {
 	}
 
 	topClient = client
+	if hasEgressPolicies() {
+		startEgressProxy()
+	}
+
 	swarmConfig := os.Getenv("SHUFFLE_SWARM_CONFIG")
 	log.Printf("[INFO] Running with timezone %s and swarm config %#v", timezone, swarmConfig)
 
@@ -4415,7 +5910,13 @@ func handleDownloadImage(resp http.ResponseWriter, request *http.Request) {
 	}
 
 	log.Printf("[INFO] Downloading image %s", imageBody.Image)
-	shuffle.DownloadDockerImageBackend(&http.Client{Timeout: imagedownloadTimeout}, imageBody.Image)
+	err = shuffle.DownloadDockerImageBackend(&http.Client{Timeout: imagedownloadTimeout}, imageBody.Image)
+	if err != nil {
+		log.Printf("[ERROR] Failed downloading image %s: %s", imageBody.Image, err)
+		resp.WriteHeader(500)
+		resp.Write([]byte(`{"success": false, "reason": "Failed downloading image"}`))
+		return
+	}
 
 	// return success
 	resp.WriteHeader(200)
@@ -4467,8 +5968,8 @@ func runWebserver(listener net.Listener) {
 		log.Printf("[DEBUG] SHUFFLE_APP_EXECUTIONS_PER_MINUTE set to value %s. Trying to overwrite default (%d)", os.Getenv("SHUFFLE_APP_EXECUTIONS_PER_MINUTE"), maxExecutionsPerMinute)
 	}
 
-	if strings.ToLower(os.Getenv("SHUFFLE_SWARM_CONFIG")) == "run" || strings.ToLower(os.Getenv("SHUFFLE_APP_REPLICAS")) == "" {
-		// go AutoScaleApps(ctx, dockercli, maxExecutionsPerMinute)
+	if (strings.ToLower(os.Getenv("SHUFFLE_SWARM_CONFIG")) == "run" || isKubernetes == "true") && os.Getenv("SHUFFLE_APP_REPLICAS") == "" && strings.ToLower(os.Getenv("SHUFFLE_AUTOSCALE")) == "true" {
+		go AutoScaleApps(context.Background(), nil, maxExecutionsPerMinute)
 	}
 	if strings.ToLower(os.Getenv("SHUFFLE_DEBUG_MEMORY")) == "true" {
 		r.HandleFunc("/debug/pprof/", pprof.Index)
@@ -4504,33 +6005,162 @@ func runWebserver(listener net.Listener) {
 	}
 }
 
+// Autoscaling settings for the app services (Swarm) or deployments (Kubernetes)
+type ScalingConfig struct {
+	MinReplicas      int
+	MaxReplicas      int
+	MaxScaleUpStep   int
+	MaxScaleDownStep int
+	Cooldown         time.Duration
+
+	// How many executions per minute a single app replica should handle
+	QueuePerReplica int
+}
+
+func getScalingEnvInt(key string, defaultValue int) int {
+	if len(os.Getenv(key)) == 0 {
+		return defaultValue
+	}
+
+	tmpInt, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || tmpInt < 0 {
+		log.Printf("[WARNING] Env %s must be a positive number, not '%s'. Defaulting to %d", key, os.Getenv(key), defaultValue)
+		return defaultValue
+	}
+
+	return tmpInt
+}
+
+func getAppScalingConfig(maxExecutionsPerMinute int) ScalingConfig {
+	config := ScalingConfig{
+		MinReplicas:      getScalingEnvInt("SHUFFLE_APP_SCALE_MIN_REPLICAS", 1),
+		MaxReplicas:      getScalingEnvInt("SHUFFLE_APP_SCALE_MAX_REPLICAS", int(maxReplicas)),
+		MaxScaleUpStep:   getScalingEnvInt("SHUFFLE_APP_SCALE_UP_STEP", 2),
+		MaxScaleDownStep: getScalingEnvInt("SHUFFLE_APP_SCALE_DOWN_STEP", 1),
+		Cooldown:         time.Duration(getScalingEnvInt("SHUFFLE_APP_SCALE_COOLDOWN", 60)) * time.Second,
+		QueuePerReplica:  maxExecutionsPerMinute,
+	}
+
+	if config.MinReplicas < 1 {
+		config.MinReplicas = 1
+	}
+
+	if config.MaxReplicas < config.MinReplicas {
+		config.MaxReplicas = config.MinReplicas
+	}
+
+	if config.MaxScaleUpStep < 1 {
+		config.MaxScaleUpStep = 1
+	}
+
+	if config.MaxScaleDownStep < 1 {
+		config.MaxScaleDownStep = 1
+	}
+
+	if config.QueuePerReplica < 1 {
+		config.QueuePerReplica = 1
+	}
+
+	return config
+}
+
+// Calculates the replicas needed for the current pressure,
+// limited by the step sizes and min/max replicas.
+func numberOfReplicas(currentReplicas, queuePressure int, config ScalingConfig) int {
+	numReplicas := int(math.Ceil(float64(queuePressure) / float64(config.QueuePerReplica)))
+
+	if numReplicas > currentReplicas+config.MaxScaleUpStep {
+		numReplicas = currentReplicas + config.MaxScaleUpStep
+	}
+
+	if numReplicas < currentReplicas-config.MaxScaleDownStep {
+		numReplicas = currentReplicas - config.MaxScaleDownStep
+	}
+
+	if numReplicas < config.MinReplicas {
+		numReplicas = config.MinReplicas
+	}
+
+	if numReplicas > config.MaxReplicas {
+		numReplicas = config.MaxReplicas
+	}
+
+	return numReplicas
+}
+
+// Scales the apps up or down based on how many executions the workers get.
+// Replicas move at most one step per cooldown, and always stay within min/max.
 func AutoScaleApps(ctx context.Context, client *dockerclient.Client, maxExecutionsPerMinute int) {
-	ticker := time.NewTicker(1 * time.Second)
+	config := getAppScalingConfig(maxExecutionsPerMinute)
+	if isKubernetes == "true" && len(kubernetesNamespace) == 0 {
+		kubernetesNamespace = "default"
+	}
 
+	log.Printf("[INFO] Autoscaling apps between %d and %d replicas (up step: %d, down step: %d, cooldown: %s, executions per replica/min: %d)", config.MinReplicas, config.MaxReplicas, config.MaxScaleUpStep, config.MaxScaleDownStep, config.Cooldown, config.QueuePerReplica)
+
+	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
+
+	lastScaleTime := time.Time{}
 	for {
 		select {
 		case <-ctx.Done():
 			return
 
 		case <-ticker.C:
-			count := window.CountEvents(time.Now())
-			j := numberOfApps(ctx, client)
+			if time.Since(lastScaleTime) < config.Cooldown {
+				continue
+			}
+
+			currentApps := numberOfApps(ctx, client)
+			if currentApps <= 0 {
+				continue
+			}
+
+			// The window is 10 seconds for this worker. Requests are spread
+			// evenly between workers, so this estimates the total per minute.
 			workers := numberOfWorkers(ctx, client)
-			execPerMin := maxExecutionsPerMinute / workers
-			if count >= execPerMin {
-				log.Printf("[DEBUG] Too many executions per minute (%d). Scaling down to %d", count, execPerMin)
-				scaleApps(ctx, client, uint64(j+1))
+			if workers < 1 {
+				workers = 1
 			}
+
+			executionsPerMinute := window.CountEvents(time.Now()) * 6 * workers
+			requiredApps := numberOfReplicas(currentApps, executionsPerMinute, config)
+			if requiredApps == currentApps {
+				continue
+			}
+
+			log.Printf("[DEBUG] %d executions per minute. Scaling apps from %d to %d replicas", executionsPerMinute, currentApps, requiredApps)
+			err := scaleApps(ctx, client, uint64(requiredApps))
+			if err != nil {
+				log.Printf("[ERROR] Failed scaling apps to %d replicas: %s", requiredApps, err)
+				continue
+			}
+
+			lastScaleTime = time.Now()
 		}
 	}
 }
 
 func scaleApps(ctx context.Context, client *dockerclient.Client, replicas uint64) error {
-	client, err := dockerclient.NewEnvClient()
-	services, err := client.ServiceList(ctx, types.ServiceListOptions{})
+	if isKubernetes == "true" {
+		return scaleK8sApps(ctx, int32(replicas))
+	}
+
+	var err error
+	if client == nil {
+		client, err = dockerclient.NewEnvClient()
+		if err != nil {
+			return err
+		}
+	}
+
+	services, err := client.ServiceList(ctx, types.ServiceListOptions{
+		Filters: getAppLabelFilters(),
+	})
 	if err != nil {
 		log.Printf("[ERROR] Failed to find services in the swarm: %s", err)
+		return err
 	}
 
 	networkId, err := getNetworkId(ctx, client)
@@ -4538,11 +6168,6 @@ func scaleApps(ctx context.Context, client *dockerclient.Client, replicas uint64
 		log.Printf("[ERROR] Failed to get network Id in the swarm service: %s", err)
 	}
 
-	workers := numberOfWorkers(ctx, client)
-	if replicas > uint64(workers) {
-		return nil
-	}
-
 	for _, service := range services {
 		if service.Spec.Name == "shuffle-workers" {
 			continue
@@ -4560,10 +6185,11 @@ func scaleApps(ctx context.Context, client *dockerclient.Client, replicas uint64
 		}
 
 		if service.Spec.Mode.Replicated == nil {
-			return errors.New("Service is not replicated")
+			log.Printf("[WARNING] Service %s is not replicated. Skipping scaling.", service.Spec.Name)
+			continue
 		}
 
-		if *service.Spec.Mode.Replicated.Replicas >= replicas {
+		if *service.Spec.Mode.Replicated.Replicas == replicas {
 			continue
 		}
 
@@ -4572,10 +6198,43 @@ func scaleApps(ctx context.Context, client *dockerclient.Client, replicas uint64
 		if err != nil {
 			return err
 		}
+	}
+
+	log.Printf("[DEBUG] Scaled all app services to %d replicas", replicas)
+	return nil
+}
+
+func scaleK8sApps(ctx context.Context, replicas int32) error {
+	clientset, _, err := shuffle.GetKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	deployments, err := clientset.AppsV1().Deployments(kubernetesNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: getAppLabelSelector(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, deployment := range deployments.Items {
+		if deployment.Spec.Replicas != nil && *deployment.Spec.Replicas == replicas {
+			continue
+		}
+
+		scale, err := clientset.AppsV1().Deployments(kubernetesNamespace).GetScale(ctx, deployment.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
 
+		scale.Spec.Replicas = replicas
+		_, err = clientset.AppsV1().Deployments(kubernetesNamespace).UpdateScale(ctx, deployment.Name, scale, metav1.UpdateOptions{})
+		if err != nil {
+			return err
+		}
 	}
 
-	log.Printf("[DEBUG] Scaled all services to %d replicas", replicas)
+	log.Printf("[DEBUG] Scaled all app deployments to %d replicas", replicas)
 	return nil
 }
 
@@ -4597,6 +6256,22 @@ func getNetworkId(ctx context.Context, dockercli *dockerclient.Client) (string,
 }
 
 func numberOfApps(ctx context.Context, dockercli *dockerclient.Client) int {
+	if isKubernetes == "true" {
+		clientset, _, err := shuffle.GetKubernetesClient()
+		if err != nil {
+			return 0
+		}
+
+		deployments, err := clientset.AppsV1().Deployments(kubernetesNamespace).List(ctx, metav1.ListOptions{
+			LabelSelector: getAppLabelSelector(),
+		})
+		if err != nil || len(deployments.Items) == 0 || deployments.Items[0].Spec.Replicas == nil {
+			return 0
+		}
+
+		return int(*deployments.Items[0].Spec.Replicas)
+	}
+
 	// swarmNetworkName
 
 	var err error
@@ -4630,7 +6305,9 @@ func numberOfApps(ctx context.Context, dockercli *dockerclient.Client) int {
 		return 0
 	}
 
-	services, err := dockercli.ServiceList(ctx, types.ServiceListOptions{})
+	services, err := dockercli.ServiceList(ctx, types.ServiceListOptions{
+		Filters: getAppLabelFilters(),
+	})
 	if err != nil {
 		log.Printf("[WARNING] Can't found any services. %s", err)
 		return 0
@@ -4692,6 +6369,20 @@ func IsServiceRunning(ctx context.Context, cli *dockerclient.Client) bool {
 }
 
 func numberOfWorkers(ctx context.Context, cli *dockerclient.Client) int {
+	if isKubernetes == "true" {
+		clientset, _, err := shuffle.GetKubernetesClient()
+		if err != nil {
+			return 0
+		}
+
+		scale, err := clientset.AppsV1().Deployments(kubernetesNamespace).GetScale(ctx, "shuffle-workers", metav1.GetOptions{})
+		if err != nil {
+			return 0
+		}
+
+		return int(scale.Spec.Replicas)
+	}
+
 	cli, err := dockerclient.NewEnvClient()
 	service, _, err := cli.ServiceInspectWithRaw(ctx, "shuffle-workers", types.ServiceInspectOptions{})
 	if err != nil {